@@ -5,7 +5,13 @@
 // statistics, administering and managing cluster.
 package adminport
 
+import "context"
 import "errors"
+import "fmt"
+import "net/http"
+import "strconv"
+import "sync"
+import "time"
 import c "github.com/couchbase/indexing/secondary/common"
 
 // errors codes
@@ -37,6 +43,25 @@ var ErrorDecodeResponse = errors.New("adminport.decodeResponse")
 // ErrorInternal
 var ErrorInternal = errors.New("adminport.internal")
 
+// ErrorStreamClosed
+var ErrorStreamClosed = errors.New("adminport.streamClosed")
+
+// ErrorReadOnlyRequest
+var ErrorReadOnlyRequest = errors.New("adminport.readOnlyRequest")
+
+// ErrorStreamIncomplete
+var ErrorStreamIncomplete = errors.New("adminport.streamIncomplete")
+
+// ErrorMessageVersion
+var ErrorMessageVersion = errors.New("adminport.messageVersion")
+
+// ErrorRequestCompleted
+var ErrorRequestCompleted = errors.New("adminport.requestCompleted")
+
+// StreamingContentType is used by clients to request progress updates,
+// as JSON-lines, for long-running operations.
+const StreamingContentType = "application/x-ndjson"
+
 // MessageMarshaller APIs message format.
 type MessageMarshaller interface {
 	// Name of the message
@@ -52,6 +77,102 @@ type MessageMarshaller interface {
 	Decode(data []byte) (err error)
 }
 
+// EncodeFunc shall marshal `msg` to byte array.
+type EncodeFunc func(msg MessageMarshaller) (data []byte, err error)
+
+// DecodeFunc shall unmarshal byte array into `msg`.
+type DecodeFunc func(data []byte, msg MessageMarshaller) (err error)
+
+type codec struct {
+	enc EncodeFunc
+	dec DecodeFunc
+}
+
+var codecs = make(map[string]codec) // content-type -> codec
+var codecsMu sync.RWMutex
+
+// RegisterCodec shall encode and decode messages of `contentType`, as
+// returned by their ContentType(), using `enc` and `dec` instead of the
+// message's Encode() and Decode(). A nil `enc` or `dec` falls back to
+// the message's method. Codecs are used by both server and client, and
+// shall be registered before they are started. Messages of a content
+// type without codec, like the default JSON and protobuf messages, use
+// their own methods.
+func RegisterCodec(contentType string, enc EncodeFunc, dec DecodeFunc) {
+	codecsMu.Lock()
+	defer codecsMu.Unlock()
+	codecs[contentType] = codec{enc: enc, dec: dec}
+}
+
+func lookupCodec(msg MessageMarshaller) codec {
+	codecsMu.RLock()
+	defer codecsMu.RUnlock()
+	return codecs[msg.ContentType()]
+}
+
+// encodeMessage `msg` with the codec for its content type.
+func encodeMessage(msg MessageMarshaller) ([]byte, error) {
+	if enc := lookupCodec(msg).enc; enc != nil {
+		return enc(msg)
+	}
+	return msg.Encode()
+}
+
+// decodeMessage `data` into `msg` with the codec for its content type.
+func decodeMessage(data []byte, msg MessageMarshaller) error {
+	if dec := lookupCodec(msg).dec; dec != nil {
+		return dec(data, msg)
+	}
+	return msg.Decode(data)
+}
+
+// MessageVersionHeader carries the version of request and response
+// messages, missing header is version ZERO.
+const MessageVersionHeader = "X-Message-Version"
+
+// VersionedMessage is implemented by messages whose schema can evolve.
+// Request and response messages are not decoded, and fail with
+// ErrorMessageVersion, if client and server differ on the version.
+// Messages not implementing this interface are version ZERO. Final
+// response of a streaming request is not checked.
+type VersionedMessage interface {
+	MessageMarshaller
+
+	// Version of the message schema.
+	Version() int
+}
+
+// messageVersion of `msg`, ZERO if it is not versioned.
+func messageVersion(msg MessageMarshaller) int {
+	if vmsg, ok := msg.(VersionedMessage); ok {
+		return vmsg.Version()
+	}
+	return 0
+}
+
+// checkMessageVersion of `msg` with the version in `header`.
+func checkMessageVersion(header http.Header, msg MessageMarshaller) error {
+	version, expected := 0, messageVersion(msg)
+	if value := header.Get(MessageVersionHeader); value != "" {
+		var err error
+		if version, err = strconv.Atoi(value); err != nil {
+			return fmt.Errorf("%v, invalid version %q", ErrorMessageVersion, value)
+		}
+	}
+	if version != expected {
+		fmsg := "%v, %s version %v, expected %v"
+		return fmt.Errorf(fmsg, ErrorMessageVersion, msg.Name(), version, expected)
+	}
+	return nil
+}
+
+// setMessageVersion of `msg` in `header`, if it is versioned.
+func setMessageVersion(header http.Header, msg MessageMarshaller) {
+	if version := messageVersion(msg); version != 0 {
+		header.Set(MessageVersionHeader, strconv.Itoa(version))
+	}
+}
+
 // Request API for server application to handle incoming request.
 type Request interface {
 	// Get message from request packet.
@@ -64,6 +185,17 @@ type Request interface {
 	SendError(error) error
 }
 
+// StreamingRequest API for server application to send progress updates
+// for a long-running request. Requests are dispatched as StreamingRequest
+// when client uses RequestStreaming(), Send() or SendError() shall
+// complete the request.
+type StreamingRequest interface {
+	Request
+
+	// SendProgress shall send `update`, encoded as JSON, to the client.
+	SendProgress(update interface{}) error
+}
+
 // Server API for adminport
 type Server interface {
 	// Register a request message that shall be supported by adminport-server
@@ -76,10 +208,31 @@ type Server interface {
 	// Unregister a previously registered request message
 	Unregister(msg MessageMarshaller) error
 
+	// HandleFunc shall route requests for message `name`, registered via
+	// Register(), to `handler` instead of the request channel. If handler
+	// returns an error without responding, the error is sent back to the
+	// client. Requests for messages without a handler are sent on the
+	// request channel, if there is no request channel they are rejected
+	// as not found.
+	HandleFunc(name string, handler func(Request) error) error
+
+	// WithCORS shall add CORS headers to responses for requests from
+	// `allowedOrigins`, "*" allows any origin. Preflight requests are
+	// handled by the server. Must be called before starting the server.
+	WithCORS(allowedOrigins, allowedMethods []string) Server
+
 	// Start server routine and wait for incoming request, Register() and
 	// Unregister() APIs cannot be called after starting the server.
 	Start() error
 
+	// Subscribe shall return a channel receiving a copy of every request
+	// for message `msgType`, subscribers cannot respond to the request.
+	// Requests are dropped if subscriber is slow to receive them.
+	Subscribe(msgType string) <-chan Request
+
+	// Unsubscribe a channel returned by Subscribe(), and close it.
+	Unsubscribe(ch <-chan Request)
+
 	// GetStatistics returns server statistics.
 	GetStatistics() c.Statistics
 
@@ -93,4 +246,29 @@ type Client interface {
 	// decode response into `response` argument. `response` argument must be a
 	// pointer to an object implementing `MessageMarshaller` interface.
 	Request(request, response MessageMarshaller) (err error)
+
+	// RequestStreaming is same as Request, but for long-running requests,
+	// `onUpdate` is called with every progress update, encoded as JSON,
+	// sent by the server until the final response is received.
+	RequestStreaming(request, response MessageMarshaller, onUpdate func([]byte)) (err error)
+
+	// RequestStat shall request statistics from the server's adminport
+	// under `urlPrefix` and decode them into `stats`.
+	RequestStat(urlPrefix string, stats *c.Statistics) (err error)
+
+	// RequestStatWithContext is same as RequestStat, except that the
+	// request is cancelled when ctx is done.
+	RequestStatWithContext(ctx context.Context, urlPrefix string, stats *c.Statistics) (err error)
+
+	// WithTimeout shall bound Request() and RequestStat() calls to
+	// `timeout`, a ZERO timeout waits for ever. Streaming requests are
+	// not bounded.
+	WithTimeout(timeout time.Duration) Client
+}
+
+// Closer is optionally implemented by a Client that holds connections
+// with the server.
+type Closer interface {
+	// Close shall release the connections held by the client.
+	Close()
 }
@@ -12,50 +12,250 @@
 package adminport
 
 import "bytes"
+import "context"
+import "crypto/tls"
+import "encoding/json"
+import "errors"
+import "fmt"
+import "io"
 import "io/ioutil"
 import "net/http"
+import "net/url"
 import "strings"
+import "time"
+
+import "github.com/couchbase/indexing/secondary/common"
 
 // httpClient is a concrete type implementing Client interface.
 type httpClient struct {
 	serverAddr string
 	urlPrefix  string
 	httpc      *http.Client
+	timeout    time.Duration
+}
+
+// KeepAlive tunes the reuse of connections with adminport server,
+// across requests made by the same client.
+type KeepAlive struct {
+	// idle connections to keep open, ZERO for
+	// http.DefaultMaxIdleConnsPerHost.
+	MaxIdleConnsPerHost int
+	// close connections that are idle for this long, ZERO for
+	// http.DefaultTransport's timeout.
+	IdleConnTimeout time.Duration
+	// open a new connection for every request.
+	Disable bool
 }
 
 // NewHTTPClient returns a new instance of Client over HTTP.
 func NewHTTPClient(listenAddr, urlPrefix string) Client {
+	return NewHTTPClientWithProxy(listenAddr, urlPrefix, nil)
+}
+
+// NewHTTPClientWithProxy returns a new instance of Client over HTTP,
+// requests are sent via proxyURL. If proxyURL is nil, proxy is picked
+// from the environment.
+func NewHTTPClientWithProxy(listenAddr, urlPrefix string, proxyURL *url.URL) Client {
+	return newHTTPClient(listenAddr, urlPrefix, proxyURL, KeepAlive{})
+}
+
+// NewHTTPClientWithKeepAlive returns a new instance of Client over
+// HTTP, connections with server are reused as tuned by keepAlive.
+func NewHTTPClientWithKeepAlive(
+	listenAddr, urlPrefix string, keepAlive KeepAlive) Client {
+
+	return newHTTPClient(listenAddr, urlPrefix, nil, keepAlive)
+}
+
+func newHTTPClient(
+	listenAddr, urlPrefix string, proxyURL *url.URL,
+	keepAlive KeepAlive) *httpClient {
+
 	if !strings.HasPrefix(listenAddr, "http://") {
 		listenAddr = "http://" + listenAddr
 	}
+	if proxyURL == nil && keepAlive == (KeepAlive{}) {
+		// clients without options share the pool of idle connections,
+		// so that short lived clients do not leave theirs behind.
+		return &httpClient{
+			serverAddr: listenAddr,
+			urlPrefix:  urlPrefix,
+			httpc:      http.DefaultClient,
+		}
+	}
+	proxy := http.ProxyFromEnvironment
+	if proxyURL != nil {
+		proxy = http.ProxyURL(proxyURL)
+	}
+	tr := newTransport()
+	tr.Proxy = proxy
+	tr.MaxIdleConnsPerHost = keepAlive.MaxIdleConnsPerHost
+	if keepAlive.IdleConnTimeout > 0 {
+		tr.IdleConnTimeout = keepAlive.IdleConnTimeout
+	}
+	tr.DisableKeepAlives = keepAlive.Disable
 	return &httpClient{
 		serverAddr: listenAddr,
 		urlPrefix:  urlPrefix,
-		httpc:      http.DefaultClient,
+		httpc:      &http.Client{Transport: tr},
+	}
+}
+
+// newTransport returns a transport for a single client, with the dial,
+// TLS handshake and idle connection timeouts of http.DefaultTransport.
+func newTransport() *http.Transport {
+	if tr, ok := http.DefaultTransport.(*http.Transport); ok {
+		return tr.Clone()
+	}
+	return &http.Transport{Proxy: http.ProxyFromEnvironment}
+}
+
+// NewHTTPSClient returns a new instance of Client over TLS. The client
+// negotiates HTTP/2 with the server, concurrent requests are multiplexed
+// on the same connection.
+func NewHTTPSClient(listenAddr, urlPrefix string, config *tls.Config) Client {
+	if !strings.HasPrefix(listenAddr, "https://") {
+		listenAddr = "https://" + listenAddr
+	}
+	tr := newTransport()
+	tr.TLSClientConfig = config
+	tr.ForceAttemptHTTP2 = true // custom TLS config disables HTTP/2 otherwise
+	return &httpClient{
+		serverAddr: listenAddr,
+		urlPrefix:  urlPrefix,
+		httpc:      &http.Client{Transport: tr},
 	}
 }
 
 // Request is part of `Client` interface
 func (c *httpClient) Request(msg, resp MessageMarshaller) (err error) {
+	ctx, cancel := c.withTimeout(context.Background())
+	defer cancel()
+	return c.request(ctx, c.urlPrefix, msg, resp)
+}
+
+// RequestStat is part of `Client` interface
+func (c *httpClient) RequestStat(urlPrefix string, stats *common.Statistics) (err error) {
+	return c.RequestStatWithContext(context.Background(), urlPrefix, stats)
+}
+
+// RequestStatWithContext is part of `Client` interface
+func (c *httpClient) RequestStatWithContext(
+	ctx context.Context, urlPrefix string, stats *common.Statistics) (err error) {
+
+	if *stats == nil {
+		*stats = make(common.Statistics)
+	}
+	if !strings.HasSuffix(urlPrefix, "/") {
+		urlPrefix += "/"
+	}
+	ctx, cancel := c.withTimeout(ctx)
+	defer cancel()
+	return c.request(ctx, urlPrefix, *stats, *stats)
+}
+
+// WithTimeout is part of `Client` interface
+func (c *httpClient) WithTimeout(timeout time.Duration) Client {
+	c.timeout = timeout
+	return c
+}
+
+func (c *httpClient) request(
+	ctx context.Context, urlPrefix string, msg, resp MessageMarshaller) error {
+
 	return doResponse(func() (*http.Response, error) {
 		// marshall message
-		body, err := msg.Encode()
+		body, err := encodeMessage(msg)
 		if err != nil {
 			return nil, err
 		}
 		// create request
 		bodybuf := bytes.NewBuffer(body)
-		url := c.serverAddr + c.urlPrefix + msg.Name()
-		req, err := http.NewRequest("POST", url, bodybuf)
+		url := c.serverAddr + urlPrefix + msg.Name()
+		req, err := http.NewRequestWithContext(ctx, "POST", url, bodybuf)
 		if err != nil {
 			return nil, err
 		}
 		req.Header.Add("Content-Type", msg.ContentType())
+		setMessageVersion(req.Header, msg)
 		// POST request and return back the response
 		return c.httpc.Do(req)
 	}, resp)
 }
 
+// withTimeout bounds ctx to client's timeout, if any.
+func (c *httpClient) withTimeout(
+	ctx context.Context) (context.Context, context.CancelFunc) {
+
+	if c.timeout > 0 {
+		return context.WithTimeout(ctx, c.timeout)
+	}
+	return context.WithCancel(ctx)
+}
+
+// RequestStreaming is part of `Client` interface
+func (c *httpClient) RequestStreaming(
+	msg, resp MessageMarshaller, onUpdate func([]byte)) (err error) {
+
+	// marshall message
+	body, err := encodeMessage(msg)
+	if err != nil {
+		return err
+	}
+	// create request
+	url := c.serverAddr + c.urlPrefix + msg.Name()
+	req, err := http.NewRequest("POST", url, bytes.NewBuffer(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Add("Content-Type", msg.ContentType())
+	req.Header.Add("Accept", StreamingContentType)
+	setMessageVersion(req.Header, msg)
+
+	htresp, err := c.httpc.Do(req)
+	if err != nil {
+		return err
+	}
+	defer htresp.Body.Close()
+	// drain what is left, so that the connection can be reused.
+	defer io.Copy(ioutil.Discard, htresp.Body)
+
+	if htresp.StatusCode != http.StatusOK {
+		data, _ := ioutil.ReadAll(htresp.Body)
+		return fmt.Errorf("%v, %s", ErrorRequest, bytes.TrimSpace(data))
+	}
+
+	// read progress updates, one per line, until the final response.
+	dec := json.NewDecoder(htresp.Body)
+	for {
+		var line streamLine
+		if err := dec.Decode(&line); err == io.EOF {
+			return ErrorStreamIncomplete
+		} else if err != nil {
+			return err
+		}
+		if !line.Done {
+			onUpdate(line.Progress)
+			continue
+		}
+		if line.Error != "" {
+			return errors.New(line.Error)
+		}
+		return decodeMessage(line.Response, resp) // unmarshal and return
+	}
+}
+
+// Close is part of `Closer` interface, idle connections shared with
+// other clients are left open.
+func (c *httpClient) Close() {
+	if c.httpc == http.DefaultClient {
+		return
+	}
+	if tr, ok := c.httpc.Transport.(*http.Transport); ok {
+		tr.CloseIdleConnections()
+	}
+}
+
 func doResponse(postRequest func() (*http.Response, error), resp MessageMarshaller) error {
 	htresp, err := postRequest() // get response back from server
 	if err != nil {
@@ -67,5 +267,11 @@ func doResponse(postRequest func() (*http.Response, error), resp MessageMarshall
 	if err != nil {
 		return err
 	}
-	return resp.Decode(body) // unmarshal and return
+	if htresp.StatusCode != http.StatusOK {
+		return fmt.Errorf("%v, %s", ErrorRequest, bytes.TrimSpace(body))
+	}
+	if err := checkMessageVersion(htresp.Header, resp); err != nil {
+		return err
+	}
+	return decodeMessage(body, resp) // unmarshal and return
 }
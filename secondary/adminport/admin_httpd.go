@@ -28,11 +28,13 @@ package adminport
 
 import "fmt"
 import "expvar"
+import "crypto/tls"
 import "encoding/json"
 import "io"
 import "net"
 import "net/http"
 import "reflect"
+import "strings"
 import "sync"
 import "time"
 
@@ -49,6 +51,10 @@ type httpServer struct {
 	messages map[string]MessageMarshaller
 	conns    []net.Conn
 	reqch    chan<- Request // request channel back to application
+	// msgname -> handler routed to, instead of reqch
+	handlers map[string]func(Request) error
+	// msgname -> subscribers receiving a copy of the request
+	subscribers map[string][]chan Request
 
 	// config params
 	name      string // human readable name for this server
@@ -57,14 +63,24 @@ type httpServer struct {
 	rtimeout  time.Duration
 	wtimeout  time.Duration
 	maxHdrlen int
+	certFile  string // serve HTTP/2 over TLS if supplied
+	keyFile   string
+	// CORS
+	corsOrigins []string
+	corsMethods string
+	corsHeaders string
 
 	// local
 	logPrefix     string
 	statsInBytes  uint64
 	statsOutBytes uint64
 	statsMessages map[string][3]uint64 // msgname -> [3]uint64{in,out,err}
+	statsDropped  uint64               // requests dropped by subscribers
 }
 
+// channel size for subscribers.
+const subscriberChanSize = 100
+
 // NewHTTPServer creates an instance of admin-server.
 // Start() will actually start the server.
 func NewHTTPServer(config c.Config, reqch chan<- Request) Server {
@@ -72,6 +88,8 @@ func NewHTTPServer(config c.Config, reqch chan<- Request) Server {
 		messages:      make(map[string]MessageMarshaller),
 		conns:         make([]net.Conn, 0),
 		reqch:         reqch,
+		handlers:      make(map[string]func(Request) error),
+		subscribers:   make(map[string][]chan Request),
 		statsInBytes:  0.0,
 		statsOutBytes: 0.0,
 		statsMessages: make(map[string][3]uint64),
@@ -82,6 +100,8 @@ func NewHTTPServer(config c.Config, reqch chan<- Request) Server {
 		rtimeout:  time.Duration(config["readTimeout"].Int()),
 		wtimeout:  time.Duration(config["writeTimeout"].Int()),
 		maxHdrlen: config["maxHeaderBytes"].Int(),
+		certFile:  config["certFile"].String(),
+		keyFile:   config["keyFile"].String(),
 	}
 	s.logPrefix = fmt.Sprintf("%s[%s]", s.name, s.laddr)
 
@@ -139,6 +159,22 @@ func (s *httpServer) RegisterHTTPHandler(
 	return
 }
 
+// HandleFunc is part of Server interface.
+func (s *httpServer) HandleFunc(
+	name string, handler func(Request) error) (err error) {
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.lis != nil {
+		logging.Errorf("%v can't register, server already started\n", s.logPrefix)
+		return ErrorRegisteringRequest
+	}
+	s.handlers[name] = handler
+	logging.Infof("%s registered handler for %s\n", s.logPrefix, name)
+	return
+}
+
 // Unregister is part of Server interface.
 func (s *httpServer) Unregister(msg MessageMarshaller) (err error) {
 	s.mu.Lock()
@@ -158,6 +194,51 @@ func (s *httpServer) Unregister(msg MessageMarshaller) (err error) {
 	return
 }
 
+// WithCORS is part of Server interface.
+func (s *httpServer) WithCORS(allowedOrigins, allowedMethods []string) Server {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.lis != nil {
+		logging.Errorf("%v can't enable CORS, server already started\n", s.logPrefix)
+		return s
+	}
+	s.corsOrigins = allowedOrigins
+	s.corsMethods = strings.Join(allowedMethods, ", ")
+	s.corsHeaders = "Content-Type, Authorization"
+	s.srv.Handler = http.HandlerFunc(s.corsHandler)
+	logging.Infof("%s enabled CORS for %v\n", s.logPrefix, allowedOrigins)
+	return s
+}
+
+// Subscribe is part of Server interface.
+func (s *httpServer) Subscribe(msgType string) <-chan Request {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	ch := make(chan Request, subscriberChanSize)
+	s.subscribers[msgType] = append(s.subscribers[msgType], ch)
+	logging.Infof("%s subscribed to %s\n", s.logPrefix, msgType)
+	return ch
+}
+
+// Unsubscribe is part of Server interface.
+func (s *httpServer) Unsubscribe(ch <-chan Request) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for msgType, subscribers := range s.subscribers {
+		for i, subch := range subscribers {
+			if (<-chan Request)(subch) == ch {
+				s.subscribers[msgType] = append(subscribers[:i], subscribers[i+1:]...)
+				close(subch)
+				logging.Infof("%s unsubscribed from %s\n", s.logPrefix, msgType)
+				return
+			}
+		}
+	}
+}
+
 // GetStatistics for adminport daemon
 func (s *httpServer) GetStatistics() c.Statistics {
 	s.mu.Lock()
@@ -166,6 +247,7 @@ func (s *httpServer) GetStatistics() c.Statistics {
 	m := map[string]interface{}{
 		"urlPrefix": s.urlPrefix,
 		"payload":   [2]uint64{s.statsInBytes, s.statsOutBytes},
+		"dropped":   s.statsDropped,
 	}
 	for name, ns := range s.statsMessages {
 		m[name] = [3]uint64{ns[0] /*in*/, ns[1] /*out*/, ns[2] /*err*/}
@@ -184,6 +266,20 @@ func (s *httpServer) Start() (err error) {
 		return ErrorServerStarted
 	}
 
+	tlsEnabled := s.certFile != "" && s.keyFile != ""
+	if tlsEnabled {
+		cert, err := tls.LoadX509KeyPair(s.certFile, s.keyFile)
+		if err != nil {
+			logging.Errorf("%v loading certificate failed %v\n", s.logPrefix, err)
+			return err
+		}
+		// net/http negotiates HTTP/2 via ALPN for TLS connections.
+		s.srv.TLSConfig = &tls.Config{
+			Certificates: []tls.Certificate{cert},
+			NextProtos:   []string{"h2", "http/1.1"},
+		}
+	}
+
 	if s.lis, err = net.Listen("tcp", s.srv.Addr); err != nil {
 		logging.Errorf("%v listen failed %v\n", s.logPrefix, err)
 		return err
@@ -194,7 +290,12 @@ func (s *httpServer) Start() (err error) {
 		defer s.shutdown()
 
 		logging.Infof("%s starting ...\n", s.logPrefix)
-		err := s.srv.Serve(s.lis) // serve until listener is closed.
+		var err error
+		if tlsEnabled {
+			err = s.srv.ServeTLS(s.lis, "", "") // serve until listener is closed.
+		} else {
+			err = s.srv.Serve(s.lis) // serve until listener is closed.
+		}
 		// TODO: look into error message and skip logging if Stop().
 		if err != nil {
 			logging.Errorf("%s %v\n", s.logPrefix, err)
@@ -221,7 +322,15 @@ func (s *httpServer) shutdown() {
 		for _, conn := range s.conns {
 			conn.Close()
 		}
-		close(s.reqch)
+		if s.reqch != nil {
+			close(s.reqch)
+		}
+		for msgType, subscribers := range s.subscribers {
+			for _, subch := range subscribers {
+				close(subch)
+			}
+			delete(s.subscribers, msgType)
+		}
 		s.lis = nil
 	}
 }
@@ -233,11 +342,12 @@ func (s *httpServer) systemHandler(w http.ResponseWriter, r *http.Request) {
 
 	logging.Infof("%s Request %q\n", s.logPrefix, r.URL.Path)
 
-	stats := s.statsMessages[r.URL.Path]
-
+	// requests can be concurrent, multiplexed on the same HTTP/2
+	// connection, hence update the statistics under lock.
 	defer func() {
 		s.mu.Lock()
 		defer s.mu.Unlock()
+		stats := s.statsMessages[r.URL.Path]
 		if recov := recover(); recov != nil {
 			logging.Errorf("%s systemHandler() crashed: %v\n", s.logPrefix, recov)
 			logging.Errorf("%s", logging.StackTrace())
@@ -258,7 +368,9 @@ func (s *httpServer) systemHandler(w http.ResponseWriter, r *http.Request) {
 	}()
 
 	s.mu.Lock()
+	stats := s.statsMessages[r.URL.Path]
 	stats[0]++ // request count
+	s.statsMessages[r.URL.Path] = stats
 	s.mu.Unlock()
 
 	// get request message type.
@@ -267,6 +379,15 @@ func (s *httpServer) systemHandler(w http.ResponseWriter, r *http.Request) {
 		err = ErrorPathNotFound
 		http.Error(w, "path not found", http.StatusNotFound)
 		return
+	} else if _, ok := s.handlers[msg.Name()]; !ok && s.reqch == nil {
+		err = ErrorMessageUnknown
+		http.Error(w, "no handler for "+msg.Name(), http.StatusNotFound)
+		return
+	}
+	// reject request from a client that differs on message schema.
+	if err = checkMessageVersion(r.Header, msg); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
 	}
 	// read request
 	dataIn = make([]byte, r.ContentLength)
@@ -278,22 +399,29 @@ func (s *httpServer) systemHandler(w http.ResponseWriter, r *http.Request) {
 	// Get an instance of request type and decode request into that.
 	typeOfMsg := reflect.ValueOf(msg).Elem().Type()
 	msg = reflect.New(typeOfMsg).Interface().(MessageMarshaller)
-	if err = msg.Decode(dataIn); err != nil {
+	if err = decodeMessage(dataIn, msg); err != nil {
 		err = fmt.Errorf("%v, %v", ErrorDecodeRequest, err)
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
+	s.broadcast(msg.Name(), typeOfMsg, dataIn)
 
 	waitch := make(chan interface{}, 1)
+	if r.Header.Get("Accept") == StreamingContentType {
+		dataOut, err = s.streamHandler(w, msg, waitch)
+		return
+	}
+
 	// send and wait
-	s.reqch <- &httpAdminRequest{srv: s, msg: msg, waitch: waitch}
+	s.dispatch(&httpAdminRequest{srv: s, msg: msg, waitch: waitch})
 	val := <-waitch
 
 	switch v := (val).(type) {
 	case MessageMarshaller:
-		if dataOut, err = v.Encode(); err == nil {
+		if dataOut, err = encodeMessage(v); err == nil {
 			header := w.Header()
 			header["Content-Type"] = []string{v.ContentType()}
+			setMessageVersion(header, v)
 			w.Write(dataOut)
 
 		} else {
@@ -307,6 +435,137 @@ func (s *httpServer) systemHandler(w http.ResponseWriter, r *http.Request) {
 	}
 }
 
+// handle request that streams progress updates, as JSON-lines, before
+// the final response. Return the data sent to client.
+func (s *httpServer) streamHandler(
+	w http.ResponseWriter, msg MessageMarshaller,
+	waitch chan interface{}) (dataOut []byte, err error) {
+
+	progressch, donech := make(chan []byte), make(chan bool)
+	defer close(donech)
+
+	flusher, _ := w.(http.Flusher)
+	header := w.Header()
+	header["Content-Type"] = []string{StreamingContentType}
+	writeLine := func(line *streamLine) {
+		data, err := json.Marshal(line)
+		if err != nil {
+			logging.Errorf("%s encoding stream: %v\n", s.logPrefix, err)
+			return
+		}
+		data = append(data, '\n')
+		w.Write(data)
+		if flusher != nil {
+			flusher.Flush() // chunked transfer
+		}
+		dataOut = append(dataOut, data...)
+	}
+
+	// send and wait
+	req := &httpStreamingRequest{
+		httpAdminRequest: httpAdminRequest{srv: s, msg: msg, waitch: waitch},
+		progressch:       progressch,
+		donech:           donech,
+	}
+	s.dispatch(req)
+	for {
+		select {
+		case update := <-progressch:
+			writeLine(&streamLine{Progress: update})
+
+		case val := <-waitch:
+			switch v := (val).(type) {
+			case MessageMarshaller:
+				var data []byte
+				if data, err = encodeMessage(v); err == nil {
+					writeLine(&streamLine{Done: true, Response: data})
+				} else {
+					err = fmt.Errorf("%v, %v", ErrorEncodeResponse, err)
+					writeLine(&streamLine{Done: true, Error: err.Error()})
+				}
+
+			case error:
+				err = fmt.Errorf("%v, %v", ErrorInternal, v)
+				writeLine(&streamLine{Done: true, Error: v.Error()})
+			}
+			return dataOut, err
+		}
+	}
+}
+
+// dispatch request to the handler for its message, if any, otherwise
+// to the application over reqch.
+func (s *httpServer) dispatch(req Request) {
+	name := req.GetMessage().Name()
+	handler, ok := s.handlers[name]
+	if !ok {
+		s.reqch <- req
+		return
+	}
+
+	go func() {
+		defer func() {
+			if recov := recover(); recov != nil {
+				logging.Errorf("%s handler %s crashed: %v\n", s.logPrefix, name, recov)
+				logging.Errorf("%s", logging.StackTrace())
+				req.SendError(ErrorInternal)
+			}
+		}()
+		if err := handler(req); err != nil {
+			req.SendError(err) // ignored if handler has responded.
+		}
+	}()
+}
+
+// add CORS headers for allowed origins and handle preflight requests,
+// other requests are served by mux.
+func (s *httpServer) corsHandler(w http.ResponseWriter, r *http.Request) {
+	origin := r.Header.Get("Origin")
+	allowed := ""
+	for _, o := range s.corsOrigins {
+		if o == "*" || o == origin {
+			allowed = o
+			break
+		}
+	}
+	if origin != "" && allowed != "" {
+		header := w.Header()
+		header.Set("Access-Control-Allow-Origin", allowed)
+		if allowed != "*" {
+			header.Add("Vary", "Origin")
+		}
+		if r.Method == "OPTIONS" {
+			header.Set("Access-Control-Allow-Methods", s.corsMethods)
+			header.Set("Access-Control-Allow-Headers", s.corsHeaders)
+		}
+	}
+	if r.Method == "OPTIONS" && r.Header.Get("Access-Control-Request-Method") != "" {
+		w.WriteHeader(http.StatusNoContent) // preflight
+		return
+	}
+	s.mux.ServeHTTP(w, r)
+}
+
+// broadcast a copy of request to subscribers of `name`, a subscriber
+// that is not ready to receive will miss the request.
+func (s *httpServer) broadcast(name string, typeOfMsg reflect.Type, data []byte) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for _, subch := range s.subscribers[name] {
+		msg := reflect.New(typeOfMsg).Interface().(MessageMarshaller)
+		if err := decodeMessage(data, msg); err != nil {
+			logging.Errorf("%s broadcast %s: %v\n", s.logPrefix, name, err)
+			return
+		}
+		select {
+		case subch <- &readOnlyRequest{msg: msg}:
+		default:
+			s.statsDropped++
+		}
+	}
+}
+
 // handle expvar request.
 func (s *httpServer) expvarHandler(w http.ResponseWriter, r *http.Request) {
 	w.Header().Set("Content-Type", "application/json; charset=utf-8")
@@ -365,6 +624,7 @@ type httpAdminRequest struct {
 	srv    *httpServer
 	msg    MessageMarshaller
 	waitch chan interface{}
+	once   sync.Once
 }
 
 // GetMessage is part of Request interface.
@@ -374,14 +634,72 @@ func (r *httpAdminRequest) GetMessage() MessageMarshaller {
 
 // Send is part of Request interface.
 func (r *httpAdminRequest) Send(msg MessageMarshaller) error {
-	r.waitch <- msg
-	close(r.waitch)
-	return nil
+	return r.complete(msg)
 }
 
 // SendError is part of Request interface.
 func (r *httpAdminRequest) SendError(err error) error {
-	r.waitch <- err
-	close(r.waitch)
-	return nil
+	return r.complete(err)
+}
+
+// complete the request with response `val`, only the first response
+// is sent to the client.
+func (r *httpAdminRequest) complete(val interface{}) (err error) {
+	err = ErrorRequestCompleted
+	r.once.Do(func() {
+		r.waitch <- val
+		close(r.waitch)
+		err = nil
+	})
+	return err
+}
+
+// concrete type implementing Request interface for subscribers.
+type readOnlyRequest struct {
+	msg MessageMarshaller
+}
+
+// GetMessage is part of Request interface.
+func (r *readOnlyRequest) GetMessage() MessageMarshaller {
+	return r.msg
+}
+
+// Send is part of Request interface.
+func (r *readOnlyRequest) Send(msg MessageMarshaller) error {
+	return ErrorReadOnlyRequest
+}
+
+// SendError is part of Request interface.
+func (r *readOnlyRequest) SendError(err error) error {
+	return ErrorReadOnlyRequest
+}
+
+// concrete type implementing StreamingRequest interface
+type httpStreamingRequest struct {
+	httpAdminRequest
+	progressch chan []byte
+	donech     chan bool
+}
+
+// SendProgress is part of StreamingRequest interface.
+func (r *httpStreamingRequest) SendProgress(update interface{}) error {
+	data, err := json.Marshal(update)
+	if err != nil {
+		return err
+	}
+	select {
+	case r.progressch <- data:
+		return nil
+	case <-r.donech:
+		return ErrorStreamClosed
+	}
+}
+
+// streamLine is a single line in the streaming response, either a
+// progress update or the final response.
+type streamLine struct {
+	Progress json.RawMessage `json:"progress,omitempty"`
+	Done     bool            `json:"done,omitempty"`
+	Response []byte          `json:"response,omitempty"`
+	Error    string          `json:"error,omitempty"`
 }
@@ -1,9 +1,31 @@
 package adminport
 
+import "bytes"
+import "context"
+import "crypto/ecdsa"
+import "crypto/elliptic"
+import "crypto/rand"
+import "crypto/tls"
+import "crypto/x509"
+import "crypto/x509/pkix"
 import "encoding/json"
+import "encoding/pem"
+import "errors"
+import "fmt"
+import "io"
+import "io/ioutil"
 import "log"
+import "math/big"
+import "net"
+import "net/http"
+import "net/http/httptest"
+import "net/url"
+import "path/filepath"
 import "reflect"
+import "strings"
+import "sync"
 import "testing"
+import "time"
 
 import "github.com/couchbase/indexing/secondary/common"
 import "github.com/couchbase/indexing/secondary/logging"
@@ -21,9 +43,16 @@ type testMessage struct {
 	Expression      string `json:"expression"`
 }
 
+var tlsAddr = "localhost:9998"
+
 var q = make(chan bool)
 var server Server
 
+// TLS server is started on demand, by tlsClient().
+var tlsOnce sync.Once
+var tlsConfig *tls.Config
+var tlsServer Server
+
 func init() {
 	logging.SetLogLevel(logging.Silent)
 	server = doServer("http://"+addr, q)
@@ -59,6 +88,85 @@ func TestLoopback(t *testing.T) {
 	}
 }
 
+func TestRequestStat(t *testing.T) {
+	urlPrefix := common.SystemConfig["projector.adminport.urlPrefix"].String()
+	client := NewHTTPClient(addr, urlPrefix).WithTimeout(time.Second)
+	var stats common.Statistics
+	if err := client.RequestStat("/adminport", &stats); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := stats["/adminport/stats"]; !ok {
+		t.Errorf("unexpected stats %v", stats)
+	}
+}
+
+func TestRequestStatTimeout(t *testing.T) {
+	blockch := make(chan bool)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-blockch
+	}))
+	defer server.Close()
+	defer close(blockch)
+
+	addr := strings.TrimPrefix(server.URL, "http://")
+	client := NewHTTPClient(addr, "/adminport/").WithTimeout(50 * time.Millisecond)
+	defer client.(Closer).Close()
+
+	start := time.Now()
+	var stats common.Statistics
+	if err := client.RequestStat("/adminport", &stats); err == nil {
+		t.Fatal("expected timeout error")
+	}
+	if err := client.Request(&testMessage{}, &testMessage{}); err == nil {
+		t.Fatal("expected timeout error")
+	}
+	if d := time.Since(start); d > 5*time.Second {
+		t.Errorf("expected requests to timeout, took %v", d)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if err := client.RequestStatWithContext(ctx, "/adminport", &stats); err == nil {
+		t.Fatal("expected error for cancelled context")
+	}
+}
+
+func TestRequestProxy(t *testing.T) {
+	// proxy forwards every request to the adminport server.
+	var mu sync.Mutex
+	var hosts []string
+	proxy := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		hosts = append(hosts, r.URL.Host)
+		mu.Unlock()
+
+		r.URL.Host, r.RequestURI = addr, ""
+		resp, err := http.DefaultTransport.RoundTrip(r)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadGateway)
+			return
+		}
+		defer resp.Body.Close()
+		w.WriteHeader(resp.StatusCode)
+		io.Copy(w, resp.Body)
+	}))
+	defer proxy.Close()
+
+	proxyURL, _ := url.Parse(proxy.URL)
+	urlPrefix := common.SystemConfig["projector.adminport.urlPrefix"].String()
+	client := NewHTTPClientWithProxy("projector.invalid:9999", urlPrefix, proxyURL)
+	var stats common.Statistics
+	if err := client.RequestStat("/adminport", &stats); err != nil {
+		t.Fatal(err)
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	if !reflect.DeepEqual(hosts, []string{"projector.invalid:9999"}) {
+		t.Errorf("unexpected proxied hosts %v", hosts)
+	}
+}
+
 func BenchmarkClientRequest(b *testing.B) {
 	logging.SetLogLevel(logging.Silent)
 	urlPrefix := common.SystemConfig["projector.adminport.urlPrefix"].String()
@@ -83,10 +191,473 @@ func BenchmarkClientRequest(b *testing.B) {
 	}
 }
 
+func TestRequestKeepAlive(t *testing.T) {
+	// echo server counting the connections opened by client.
+	var mu sync.Mutex
+	conns := 0
+	echo := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.Copy(w, r.Body)
+	}))
+	echo.Config.ConnState = func(conn net.Conn, state http.ConnState) {
+		if state == http.StateNew {
+			mu.Lock()
+			conns++
+			mu.Unlock()
+		}
+	}
+	echo.Start()
+	defer echo.Close()
+
+	raddr := echo.Listener.Addr().String()
+	urlPrefix := common.SystemConfig["projector.adminport.urlPrefix"].String()
+	testcases := []struct {
+		keepAlive KeepAlive
+		conns     int
+	}{
+		{KeepAlive{MaxIdleConnsPerHost: 4, IdleConnTimeout: time.Minute}, 1},
+		{KeepAlive{Disable: true}, 10},
+	}
+	for _, tc := range testcases {
+		mu.Lock()
+		conns = 0
+		mu.Unlock()
+
+		client := NewHTTPClientWithKeepAlive(raddr, urlPrefix, tc.keepAlive)
+		for i := 0; i < 10; i++ {
+			req := &testMessage{DefnID: uint64(i), Bucket: "default"}
+			resp := &testMessage{}
+			if err := client.Request(req, resp); err != nil {
+				t.Fatal(err)
+			} else if resp.DefnID != uint64(i) {
+				t.Fatalf("unexpected response %v", resp)
+			}
+		}
+		client.(Closer).Close()
+
+		mu.Lock()
+		if conns != tc.conns {
+			t.Errorf("expected %v connections for %+v, got %v", tc.conns, tc.keepAlive, conns)
+		}
+		mu.Unlock()
+	}
+}
+
+func BenchmarkClientRequestKeepAlive(b *testing.B) {
+	benchmarkClientKeepAlive(b, KeepAlive{MaxIdleConnsPerHost: 4})
+}
+
+func BenchmarkClientRequestNoKeepAlive(b *testing.B) {
+	benchmarkClientKeepAlive(b, KeepAlive{Disable: true})
+}
+
+func benchmarkClientKeepAlive(b *testing.B, keepAlive KeepAlive) {
+	logging.SetLogLevel(logging.Silent)
+	urlPrefix := common.SystemConfig["projector.adminport.urlPrefix"].String()
+	client := NewHTTPClientWithKeepAlive(addr, urlPrefix, keepAlive)
+	defer client.(Closer).Close()
+	req := &testMessage{
+		DefnID:     uint64(0x1234567812345678),
+		Bucket:     "default",
+		IName:      "example-index",
+		Expression: "x+1",
+	}
+	resp := &testMessage{}
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if err := client.Request(req, resp); err != nil {
+			b.Error(err)
+		}
+	}
+}
+
+func TestSharedTransport(t *testing.T) {
+	urlPrefix := common.SystemConfig["projector.adminport.urlPrefix"].String()
+
+	// clients without options share the idle connections.
+	client1 := NewHTTPClient(addr, urlPrefix)
+	client2 := NewHTTPClientWithProxy(addr, urlPrefix, nil)
+	if client1.(*httpClient).httpc != client2.(*httpClient).httpc {
+		t.Fatal("expected clients without options to share the transport")
+	}
+	client1.(Closer).Close()
+	req := &testMessage{DefnID: 1, Bucket: "default"}
+	if err := client2.Request(req, &testMessage{}); err != nil {
+		t.Fatal(err)
+	}
+
+	keepAlive := KeepAlive{MaxIdleConnsPerHost: 4}
+	client3 := NewHTTPClientWithKeepAlive(addr, urlPrefix, keepAlive)
+	defer client3.(Closer).Close()
+	if client3.(*httpClient).httpc == client1.(*httpClient).httpc {
+		t.Fatal("expected a private transport for keep-alive options")
+	}
+}
+
+func TestMessageVersion(t *testing.T) {
+	urlPrefix := common.SystemConfig["projector.adminport.urlPrefix"].String()
+	client := NewHTTPClient(addr, urlPrefix)
+
+	req, resp := &versionedMessage{Bucket: "default"}, &versionedMessage{}
+	if err := client.Request(req, resp); err != nil {
+		t.Fatal(err)
+	} else if resp.Bucket != "default" {
+		t.Fatalf("unexpected response %v", resp)
+	}
+
+	// client with older schema for request.
+	oldreq := &oldVersionedMessage{versionedMessage{Bucket: "default"}}
+	err := client.Request(oldreq, resp)
+	if err == nil || !strings.Contains(err.Error(), ErrorMessageVersion.Error()) {
+		t.Fatalf("expected %v, got %v", ErrorMessageVersion, err)
+	}
+
+	// client with older schema for response.
+	oldresp := &oldVersionedMessage{}
+	err = client.Request(req, oldresp)
+	if err == nil || !strings.Contains(err.Error(), ErrorMessageVersion.Error()) {
+		t.Fatalf("expected %v, got %v", ErrorMessageVersion, err)
+	} else if oldresp.Bucket != "" {
+		t.Fatalf("expected response not to be decoded, got %v", oldresp)
+	}
+}
+
+func TestHandleFunc(t *testing.T) {
+	apConfig := common.SystemConfig.SectionConfig("projector.adminport.", true)
+	apConfig.SetValue("name", "test-handlefunc")
+	apConfig.SetValue("listenAddr", "localhost:9997")
+	urlPrefix := apConfig["urlPrefix"].String()
+
+	server := NewHTTPServer(apConfig, nil)
+	server.Register(&testMessage{})
+	server.Register(&versionedMessage{})
+	err := server.HandleFunc("testMessage", func(req Request) error {
+		msg := req.GetMessage().(*testMessage)
+		if msg.Bucket == "error" {
+			return ErrorInternal
+		}
+		if err := req.Send(msg); err != nil {
+			return err
+		}
+		return req.Send(msg) // second response is not sent.
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := server.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer server.Stop()
+	if err := server.HandleFunc("versionedMessage", nil); err != ErrorRegisteringRequest {
+		t.Fatalf("expected %v after start, got %v", ErrorRegisteringRequest, err)
+	}
+
+	client := NewHTTPClient("localhost:9997", urlPrefix)
+	req, resp := &testMessage{DefnID: 10, Bucket: "default"}, &testMessage{}
+	if err := client.Request(req, resp); err != nil {
+		t.Fatal(err)
+	} else if !reflect.DeepEqual(req, resp) {
+		t.Fatalf("unexpected response %v", resp)
+	}
+
+	req.Bucket = "error"
+	if err := client.Request(req, resp); err == nil || !strings.Contains(err.Error(), ErrorInternal.Error()) {
+		t.Fatalf("expected %v from handler, got %v", ErrorInternal, err)
+	}
+
+	// registered message without handler.
+	err = client.Request(&versionedMessage{}, &versionedMessage{})
+	if err == nil || !strings.Contains(err.Error(), "no handler") {
+		t.Fatalf("expected error for message without handler, got %v", err)
+	}
+}
+
+func TestRegisterCodec(t *testing.T) {
+	RegisterCodec(
+		codecMessageContentType,
+		func(msg MessageMarshaller) ([]byte, error) {
+			data, err := json.Marshal(msg)
+			return append([]byte("codec:"), data...), err
+		},
+		func(data []byte, msg MessageMarshaller) error {
+			if !bytes.HasPrefix(data, []byte("codec:")) {
+				return fmt.Errorf("missing codec prefix in %q", data)
+			}
+			return json.Unmarshal(data[len("codec:"):], msg)
+		})
+	defer RegisterCodec(codecMessageContentType, nil, nil)
+
+	apConfig := common.SystemConfig.SectionConfig("projector.adminport.", true)
+	apConfig.SetValue("name", "test-codec")
+	apConfig.SetValue("listenAddr", "localhost:9996")
+	urlPrefix := apConfig["urlPrefix"].String()
+
+	server := NewHTTPServer(apConfig, nil)
+	server.Register(&codecMessage{})
+	server.HandleFunc("codecMessage", func(req Request) error {
+		return req.Send(req.GetMessage())
+	})
+	if err := server.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer server.Stop()
+
+	client := NewHTTPClient("localhost:9996", urlPrefix)
+	req, resp := &codecMessage{Bucket: "default"}, &codecMessage{}
+	if err := client.Request(req, resp); err != nil {
+		t.Fatal(err)
+	} else if !reflect.DeepEqual(req, resp) {
+		t.Fatalf("unexpected response %v", resp)
+	}
+
+	// without codec, message's own methods are used.
+	RegisterCodec(codecMessageContentType, nil, nil)
+	if err := client.Request(req, resp); err == nil {
+		t.Fatalf("expected error from message without codec")
+	}
+}
+
+func TestRequestStreaming(t *testing.T) {
+	urlPrefix := common.SystemConfig["projector.adminport.urlPrefix"].String()
+	client := NewHTTPClient(addr, urlPrefix)
+	req := &testMessage{DefnID: uint64(0x1234), Bucket: "default"}
+	resp := &testMessage{}
+
+	updates := make([]string, 0)
+	onUpdate := func(update []byte) {
+		updates = append(updates, string(update))
+	}
+	if err := client.RequestStreaming(req, resp, onUpdate); err != nil {
+		t.Fatal(err)
+	}
+	if reflect.DeepEqual(req, resp) == false {
+		t.Error("unexpected response")
+	}
+	refupdates := []string{`{"step":0}`, `{"step":1}`, `{"step":2}`}
+	if reflect.DeepEqual(updates, refupdates) == false {
+		t.Errorf("expected %v, got %v", refupdates, updates)
+	}
+
+	// error is sent as the final response.
+	req.Bucket = "error"
+	if err := client.RequestStreaming(req, resp, onUpdate); err == nil {
+		t.Error("expected error")
+	}
+}
+
+func TestCORSPreflight(t *testing.T) {
+	preflight := func(origin string) *http.Response {
+		req, err := http.NewRequest("OPTIONS", "http://"+addr+"/adminport/testMessage", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.Header.Set("Origin", origin)
+		req.Header.Set("Access-Control-Request-Method", "POST")
+		htresp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		htresp.Body.Close()
+		return htresp
+	}
+
+	htresp := preflight("http://localhost:8091")
+	if htresp.StatusCode != http.StatusNoContent {
+		t.Errorf("unexpected status %v", htresp.Status)
+	}
+	refheaders := map[string]string{
+		"Access-Control-Allow-Origin":  "http://localhost:8091",
+		"Access-Control-Allow-Methods": "GET, POST",
+		"Access-Control-Allow-Headers": "Content-Type, Authorization",
+	}
+	for key, value := range refheaders {
+		if v := htresp.Header.Get(key); v != value {
+			t.Errorf("expected %v for %v, got %q", value, key, v)
+		}
+	}
+
+	htresp = preflight("http://example.com")
+	if v := htresp.Header.Get("Access-Control-Allow-Origin"); v != "" {
+		t.Errorf("unexpected %v for disallowed origin", v)
+	}
+}
+
+func TestSubscribe(t *testing.T) {
+	urlPrefix := common.SystemConfig["projector.adminport.urlPrefix"].String()
+	client := NewHTTPClient(addr, urlPrefix)
+	subch := server.Subscribe("testMessage")
+
+	req := &testMessage{DefnID: uint64(0x5678), Bucket: "default"}
+	resp := &testMessage{}
+	if err := client.Request(req, resp); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case subreq := <-subch:
+		if reflect.DeepEqual(subreq.GetMessage(), req) == false {
+			t.Errorf("unexpected message %v", subreq.GetMessage())
+		}
+		if err := subreq.Send(req); err != ErrorReadOnlyRequest {
+			t.Errorf("expected %v, got %v", ErrorReadOnlyRequest, err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("subscriber did not receive request")
+	}
+
+	server.Unsubscribe(subch)
+	if _, ok := <-subch; ok {
+		t.Error("expected subscriber channel to be closed")
+	}
+}
+
+func TestLoopbackHTTP2(t *testing.T) {
+	urlPrefix := common.SystemConfig["projector.adminport.urlPrefix"].String()
+	client := NewHTTPSClient(tlsAddr, urlPrefix, tlsClient(t))
+	defer client.(Closer).Close()
+
+	// check the negotiated protocol.
+	httpc := client.(*httpClient).httpc
+	htresp, err := httpc.Get("https://" + tlsAddr + "/proto")
+	if err != nil {
+		t.Fatal(err)
+	}
+	htresp.Body.Close()
+	if htresp.ProtoMajor != 2 {
+		t.Fatalf("expected HTTP/2, got %v", htresp.Proto)
+	}
+
+	// multiplexed requests on the same connection.
+	n := 16
+	var wg sync.WaitGroup
+	errch := make(chan error, n)
+	for i := 0; i < n; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			req := &testMessage{DefnID: uint64(i), Bucket: "default"}
+			resp := &testMessage{}
+			if err := client.Request(req, resp); err != nil {
+				errch <- err
+			} else if reflect.DeepEqual(req, resp) == false {
+				errch <- ErrorDecodeResponse
+			}
+		}(i)
+	}
+	wg.Wait()
+	close(errch)
+	for err := range errch {
+		t.Error(err)
+	}
+
+	stats := tlsServer.GetStatistics()
+	refstats := [3]uint64{uint64(n), uint64(n), 0}
+	if v := stats["/adminport/testMessage"]; reflect.DeepEqual(v, refstats) == false {
+		t.Errorf("expected %v, got %v", refstats, v)
+	}
+}
+
+func BenchmarkClientRequestHTTP2(b *testing.B) {
+	logging.SetLogLevel(logging.Silent)
+	urlPrefix := common.SystemConfig["projector.adminport.urlPrefix"].String()
+	client := NewHTTPSClient(tlsAddr, urlPrefix, tlsClient(b))
+	defer client.(Closer).Close()
+	req := &testMessage{
+		DefnID:          uint64(0x1234567812345678),
+		Bucket:          "default",
+		IsPrimary:       false,
+		IName:           "example-index",
+		Using:           "forrestdb",
+		ExprType:        "n1ql",
+		PartitionScheme: "simplekeypartition",
+		Expression:      "x+1",
+	}
+	resp := &testMessage{}
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if err := client.Request(req, resp); err != nil {
+			b.Error(err)
+		}
+	}
+}
+
+// tlsClient starts the TLS server, if not already started, and returns
+// the client configuration trusting its certificate.
+func tlsClient(tb testing.TB) *tls.Config {
+	tlsOnce.Do(func() {
+		dir, err := ioutil.TempDir("", "adminport")
+		if err != nil {
+			tb.Fatal(err)
+		}
+		certFile, keyFile := filepath.Join(dir, "cert.pem"), filepath.Join(dir, "key.pem")
+		certDER, err := makeCertificate(certFile, keyFile)
+		if err != nil {
+			tb.Fatal(err)
+		}
+		cert, err := x509.ParseCertificate(certDER)
+		if err != nil {
+			tb.Fatal(err)
+		}
+		pool := x509.NewCertPool()
+		pool.AddCert(cert)
+		tlsConfig = &tls.Config{RootCAs: pool}
+
+		apConfig := common.SystemConfig.SectionConfig("projector.adminport.", true)
+		apConfig.SetValue("name", "test-adminport-tls")
+		apConfig.SetValue("listenAddr", tlsAddr)
+		apConfig.SetValue("certFile", certFile)
+		apConfig.SetValue("keyFile", keyFile)
+		tlsServer = startServer(apConfig, make(chan bool))
+	})
+	if tlsConfig == nil {
+		tb.Fatal("TLS server not started")
+	}
+	return tlsConfig
+}
+
+// makeCertificate writes a self-signed certificate for localhost.
+func makeCertificate(certFile, keyFile string) ([]byte, error) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{Organization: []string{"adminport test"}},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		DNSNames:     []string{"localhost"},
+		IPAddresses:  []net.IP{net.ParseIP("127.0.0.1")},
+	}
+	certDER, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		return nil, err
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		return nil, err
+	}
+	certPEM := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: certDER})
+	keyPEM := pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER})
+	if err := ioutil.WriteFile(certFile, certPEM, 0600); err != nil {
+		return nil, err
+	}
+	if err := ioutil.WriteFile(keyFile, keyPEM, 0600); err != nil {
+		return nil, err
+	}
+	return certDER, nil
+}
+
 func doServer(addr string, quit chan bool) Server {
 	apConfig := common.SystemConfig.SectionConfig("projector.adminport.", true)
 	apConfig.SetValue("name", "test-adminport")
 	apConfig.SetValue("listenAddr", "localhost:9999")
+	return startServer(apConfig, quit)
+}
+
+func startServer(apConfig common.Config, quit chan bool) Server {
 	reqch := make(chan Request, 10)
 	server := NewHTTPServer(apConfig, reqch)
 	if err := server.Register(&testMessage{}); err != nil {
@@ -95,6 +666,16 @@ func doServer(addr string, quit chan bool) Server {
 	if err := server.Register(&common.Statistics{}); err != nil {
 		log.Fatal(err)
 	}
+	if err := server.Register(&versionedMessage{}); err != nil {
+		log.Fatal(err)
+	}
+	server.WithCORS([]string{"http://localhost:8091"}, []string{"GET", "POST"})
+	protoHandler := func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(r.Proto))
+	}
+	if err := server.RegisterHTTPHandler("/proto", protoHandler); err != nil {
+		log.Fatal(err)
+	}
 
 	if err := server.Start(); err != nil {
 		log.Fatal(err)
@@ -108,6 +689,20 @@ func doServer(addr string, quit chan bool) Server {
 				if ok {
 					switch msg := req.GetMessage().(type) {
 					case *testMessage:
+						if sreq, ok := req.(StreamingRequest); ok {
+							for i := 0; i < 3; i++ {
+								update := map[string]int{"step": i}
+								if err := sreq.SendProgress(update); err != nil {
+									log.Println(err)
+								}
+							}
+						}
+						if msg.Bucket == "error" {
+							req.SendError(ErrorRequest)
+						} else if err := req.Send(msg); err != nil {
+							log.Println(err)
+						}
+					case *versionedMessage:
 						if err := req.Send(msg); err != nil {
 							log.Println(err)
 						}
@@ -153,3 +748,60 @@ func makeLargeString() string {
 	}
 	return s
 }
+
+// versionedMessage is version 2 of a message schema.
+type versionedMessage struct {
+	Bucket string `json:"bucket"`
+}
+
+func (vm *versionedMessage) Name() string {
+	return "versionedMessage"
+}
+
+func (vm *versionedMessage) Encode() (data []byte, err error) {
+	return json.Marshal(vm)
+}
+
+func (vm *versionedMessage) Decode(data []byte) (err error) {
+	return json.Unmarshal(data, vm)
+}
+
+func (vm *versionedMessage) ContentType() string {
+	return "application/json"
+}
+
+func (vm *versionedMessage) Version() int {
+	return 2
+}
+
+// oldVersionedMessage is version 1 of versionedMessage.
+type oldVersionedMessage struct {
+	versionedMessage
+}
+
+func (vm *oldVersionedMessage) Version() int {
+	return 1
+}
+
+const codecMessageContentType = "application/x-codec-test"
+
+// codecMessage can only be encoded and decoded by a registered codec.
+type codecMessage struct {
+	Bucket string `json:"bucket"`
+}
+
+func (cm *codecMessage) Name() string {
+	return "codecMessage"
+}
+
+func (cm *codecMessage) Encode() (data []byte, err error) {
+	return nil, errors.New("codecMessage.Encode")
+}
+
+func (cm *codecMessage) Decode(data []byte) (err error) {
+	return errors.New("codecMessage.Decode")
+}
+
+func (cm *codecMessage) ContentType() string {
+	return codecMessageContentType
+}
@@ -21,6 +21,8 @@ import "github.com/couchbase/indexing/secondary/logging"
 import "github.com/couchbase/indexing/secondary/platform"
 import "unsafe"
 import "runtime"
+import "strconv"
+import "bytes"
 
 // NOTE:
 // following settings are related to each other.
@@ -234,6 +236,19 @@ var SystemConfig = Config{
 		1 << 20, // 1 MegaByte
 		true,    // immutable
 	},
+	"projector.adminport.certFile": ConfigValue{
+		"",
+		"path to TLS certificate file, if supplied along with keyFile " +
+			"adminport will serve HTTP/2 over TLS",
+		"",
+		true, // immutable
+	},
+	"projector.adminport.keyFile": ConfigValue{
+		"",
+		"path to TLS private key file, refer to certFile",
+		"",
+		true, // immutable
+	},
 	// projector dataport client parameters
 	"projector.dataport.remoteBlock": ConfigValue{
 		true,
@@ -257,6 +272,22 @@ var SystemConfig = Config{
 		100,
 		false, // mutable
 	},
+	"projector.dataport.maxVbMutations": ConfigValue{
+		10000,
+		"maximum number of mutations to buffer for a vbucket, " +
+			"endpoint will flush its buffers when a vbucket reaches " +
+			"this limit, zero for no limit.",
+		10000,
+		false, // mutable
+	},
+	"projector.dataport.initVbMutations": ConfigValue{
+		16,
+		"initial capacity of a vbucket's mutation buffer, larger value " +
+			"avoids reallocs for large batches at the cost of memory " +
+			"for every buffered vbucket, does not affect existing feeds.",
+		16,
+		true, // immutable
+	},
 	"projector.dataport.bufferTimeout": ConfigValue{
 		25,
 		"timeout in milliseconds, to flush vbucket-mutations from, " +
@@ -280,6 +311,28 @@ var SystemConfig = Config{
 		1024 * 1024, // 1MB
 		true,        // immutable
 	},
+	"projector.dataport.maxPacketSize": ConfigValue{
+		1024 * 1024,
+		"maximum estimated size, in bytes, of vbucket-mutations sent " +
+			"in a single packet, a flush is split into as many packets, " +
+			"zero for no limit, does not affect existing feeds.",
+		1024 * 1024, // 1MB
+		true,        // immutable
+	},
+	"projector.dataport.gapDetection": ConfigValue{
+		false,
+		"log and count out of order or missing seqnos for each vbucket, " +
+			"adds per vbucket state, does not affect existing feeds.",
+		false,
+		true, // immutable
+	},
+	"projector.dataport.gapThreshold": ConfigValue{
+		1000,
+		"seqno jump, beyond the expected seqno, that is counted as a gap " +
+			"when gapDetection is enabled, does not affect existing feeds.",
+		1000,
+		true, // immutable
+	},
 	// projector's adminport client, can be used by manager
 	"manager.projectorclient.retryInterval": ConfigValue{
 		16,
@@ -305,6 +358,61 @@ var SystemConfig = Config{
 		"/adminport/",
 		true, // immutable
 	},
+	"manager.projectorclient.requestTimeout": ConfigValue{
+		0,
+		"timeout, in milliseconds, for each request to projector, " +
+			"zero to derive it from the stream setup retry budget",
+		0,
+		true, // immutable
+	},
+	"manager.projectorclient.healthCheckInterval": ConfigValue{
+		60 * 1000,
+		"interval, in milliseconds, to probe cached projector clients " +
+			"and evict the unreachable ones, 0 disables the probe",
+		60 * 1000, // 60s
+		true,      // immutable
+	},
+	"manager.projectorclient.cleanupInterval": ConfigValue{
+		5 * 60 * 1000,
+		"interval, in milliseconds, to evict cached projector clients " +
+			"for nodes that are no longer in the cluster, 0 disables the cleanup",
+		5 * 60 * 1000, // 5m
+		true,          // immutable
+	},
+	"manager.clusterURL": ConfigValue{
+		"http://localhost:11209/",
+		"cluster manager's url used by manager to look up buckets and nodes",
+		"http://localhost:11209/",
+		true, // immutable
+	},
+	"manager.poolName": ConfigValue{
+		"default",
+		"name of the pool used by manager to look up buckets and nodes",
+		"default",
+		true, // immutable
+	},
+	"manager.topicPrefixByNode": ConfigValue{
+		false,
+		"prefix the stream topics by the indexer node address, so that " +
+			"multiple indexers can share the projector nodes, changes the " +
+			"topic names, enable only after all indexers are upgraded",
+		false,
+		true, // immutable
+	},
+	"manager.clusterTimeout": ConfigValue{
+		30 * 1000,
+		"timeout, in milliseconds, for manager to get bucket information " +
+			"from cluster manager",
+		30 * 1000, // 30s
+		true,      // immutable
+	},
+	"manager.vbmapCacheTTL": ConfigValue{
+		30 * 1000,
+		"time, in milliseconds, to cache the vbucket map of a bucket " +
+			"before fetching it again from cluster manager",
+		30 * 1000, // 30s
+		true,      // immutable
+	},
 	// indexer dataport parameters
 	"indexer.dataport.genServerChanSize": ConfigValue{
 		10000,
@@ -326,6 +434,21 @@ var SystemConfig = Config{
 		30 * 1000, // 10s
 		true,      // immutable
 	},
+	"indexer.dataport.gapDetection": ConfigValue{
+		false,
+		"log and report out of order or missing seqnos for each vbucket " +
+			"received from router, also refer to " +
+			"projector.dataport.gapDetection.",
+		false,
+		true, // immutable
+	},
+	"indexer.dataport.gapThreshold": ConfigValue{
+		1000,
+		"seqno jump, beyond the expected seqno, that is reported as a gap " +
+			"when gapDetection is enabled.",
+		1000,
+		true, // immutable
+	},
 	// indexer queryport configuration
 	"indexer.queryport.maxPayload": ConfigValue{
 		1000 * 1024,
@@ -445,6 +568,13 @@ var SystemConfig = Config{
 		"/adminport/",
 		true, // immutable
 	},
+	"indexer.projectorclient.requestTimeout": ConfigValue{
+		0,
+		"timeout, in milliseconds, for each request to projector, " +
+			"zero for no timeout",
+		0,
+		true, // immutable
+	},
 	"indexer.adminPort": ConfigValue{
 		"9100",
 		"port for index ddl and status operations",
@@ -463,6 +593,12 @@ var SystemConfig = Config{
 		"9102",
 		true, // immutable
 	},
+	"indexer.settingsMaxPayload": ConfigValue{
+		1024 * 1024,
+		"maximum payload, in bytes, of a settings request on httpPort",
+		1024 * 1024,
+		true, // immutable
+	},
 	"indexer.streamInitPort": ConfigValue{
 		"9103",
 		"port for inital build stream",
@@ -687,8 +823,19 @@ func NewConfig(data interface{}) (Config, error) {
 }
 
 // Update config object with data, can be a Config, map[string]interface{},
-// []byte.
+// []byte. Keys whose value cannot be set are logged and skipped.
 func (config Config) Update(data interface{}) error {
+	return config.update(data, false)
+}
+
+// UpdateStrict is like Update, except that the error of the first key whose
+// value cannot be set is returned, after applying the remaining keys.
+func (config Config) UpdateStrict(data interface{}) error {
+	return config.update(data, true)
+}
+
+func (config Config) update(data interface{}, strict bool) error {
+	var firstErr error
 	fmsg := "CONF[] skipping setting key %q value '%v': %v"
 	switch v := data.(type) {
 	case Config: // Clone
@@ -697,11 +844,15 @@ func (config Config) Update(data interface{}) error {
 		}
 
 	case []byte: // parse JSON
+		// decode numbers as json.Number, so that large integer settings
+		// are not truncated to float64.
 		m := make(map[string]interface{})
-		if err := json.Unmarshal(v, &m); err != nil {
+		dec := json.NewDecoder(bytes.NewReader(v))
+		dec.UseNumber()
+		if err := dec.Decode(&m); err != nil {
 			return err
 		}
-		config.Update(m)
+		return config.update(m, strict)
 
 	case map[string]interface{}: // transform
 		for key, value := range v {
@@ -711,6 +862,9 @@ func (config Config) Update(data interface{}) error {
 				}
 				if err := config.SetValue(key, value); err != nil {
 					logging.Warnf(fmsg, key, value, err)
+					if firstErr == nil {
+						firstErr = err
+					}
 				}
 
 			} else {
@@ -721,7 +875,10 @@ func (config Config) Update(data interface{}) error {
 	default:
 		return nil
 	}
-	return nil
+	if !strict {
+		return nil
+	}
+	return firstErr
 }
 
 // Clone a new config object.
@@ -828,6 +985,9 @@ func (config Config) SetValue(key string, value interface{}) error {
 	}
 
 	defType := reflect.TypeOf(cv.DefaultVal)
+	if num, ok := value.(json.Number); ok {
+		value = numberValue(num, defType)
+	}
 	valType := reflect.TypeOf(value)
 
 	if valType.ConvertibleTo(defType) {
@@ -847,6 +1007,23 @@ func (config Config) SetValue(key string, value interface{}) error {
 	return nil
 }
 
+// numberValue converts JSON number to an integer of type `typ`, without
+// going through float64, falls back to float64 otherwise.
+func numberValue(num json.Number, typ reflect.Type) interface{} {
+	switch typ.Kind() {
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		if v, err := strconv.ParseInt(num.String(), 10, 64); err == nil {
+			return reflect.ValueOf(v).Convert(typ).Interface()
+		}
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		if v, err := strconv.ParseUint(num.String(), 10, 64); err == nil {
+			return reflect.ValueOf(v).Convert(typ).Interface()
+		}
+	}
+	v, _ := num.Float64()
+	return v
+}
+
 // Json will marshal config into JSON string.
 func (config Config) Json() []byte {
 	kvs := make(map[string]interface{})
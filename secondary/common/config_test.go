@@ -0,0 +1,81 @@
+package common
+
+import "testing"
+
+func TestConfigUpdateLargeInteger(t *testing.T) {
+	config := SystemConfig.Clone()
+	data := []byte(`{"indexer.settings.memory_quota": 4294967296,
+        "indexer.settings.compaction.min_size": 9007199254740993,
+        "indexer.settings.max_cpu_percent": 200}`)
+	if err := config.Update(data); err != nil {
+		t.Fatal(err)
+	}
+	if v := config["indexer.settings.memory_quota"].Uint64(); v != 4294967296 {
+		t.Errorf("expected 4294967296, got %v", v)
+	}
+	if v := config["indexer.settings.compaction.min_size"].Uint64(); v != 9007199254740993 {
+		t.Errorf("expected 9007199254740993, got %v", v)
+	}
+	if v := config["indexer.settings.max_cpu_percent"].Int(); v != 200 {
+		t.Errorf("expected 200, got %v", v)
+	}
+
+	// round-trip through JSON.
+	clone := SystemConfig.Clone()
+	if err := clone.Update(config.FilterConfig(".settings.").Json()); err != nil {
+		t.Fatal(err)
+	}
+	if v := clone["indexer.settings.memory_quota"].Uint64(); v != 4294967296 {
+		t.Errorf("expected 4294967296 after round-trip, got %v", v)
+	}
+	if v := clone["indexer.settings.compaction.min_size"].Uint64(); v != 9007199254740993 {
+		t.Errorf("expected 9007199254740993 after round-trip, got %v", v)
+	}
+}
+
+func TestConfigUpdateInvalidValue(t *testing.T) {
+	config := SystemConfig.Clone()
+	data := []byte(`{"indexer.settings.memory_quota": "large",
+        "indexer.settings.max_cpu_percent": 200}`)
+	if err := config.Update(data); err != nil {
+		t.Fatalf("expected invalid value to be skipped, got %v", err)
+	}
+	if err := config.UpdateStrict(data); err == nil {
+		t.Fatalf("expected error for invalid value")
+	}
+	if v := config["indexer.settings.memory_quota"].Uint64(); v != SystemConfig["indexer.settings.memory_quota"].Uint64() {
+		t.Errorf("expected default memory_quota, got %v", v)
+	}
+	if v := config["indexer.settings.max_cpu_percent"].Int(); v != 200 {
+		t.Errorf("expected valid keys to be applied, got %v", v)
+	}
+}
+
+func TestIndexerSettings(t *testing.T) {
+	// every accessor must refer to a key of SystemConfig.
+	s := NewIndexerSettings(SystemConfig)
+	if v := s.MaxVbuckets(); v != 1024 {
+		t.Errorf("expected 1024, got %v", v)
+	}
+	if v := s.ClusterAddr(); v != "127.0.0.1:8091" {
+		t.Errorf("expected 127.0.0.1:8091, got %v", v)
+	}
+	if v := s.SettingsMaxPayload(); v != 1024*1024 {
+		t.Errorf("expected %v, got %v", 1024*1024, v)
+	}
+	if v := s.MemoryQuota(); v != 256*1024*1024 {
+		t.Errorf("expected %v, got %v", 256*1024*1024, v)
+	}
+	if v := s.MaxCpuPercent(); v != 400 {
+		t.Errorf("expected 400, got %v", v)
+	}
+	if v := s.LogLevel(); v != "debug" {
+		t.Errorf("expected debug, got %v", v)
+	}
+	if v := s.BufferPoolBlockSize(); v != 16*1024 {
+		t.Errorf("expected %v, got %v", 16*1024, v)
+	}
+	if _, ok := s.ProjectorClientConfig()["cleanupInterval"]; !ok {
+		t.Errorf("expected projector client config, got %v", s.ProjectorClientConfig())
+	}
+}
@@ -29,6 +29,9 @@ var ErrorInvalidRequest = errors.New("secondary.invalidRequest")
 // ErrorNotFound
 var ErrorNotFound = errors.New("secondary.notFound")
 
+// ErrorVbuuidMismatch
+var ErrorVbuuidMismatch = errors.New("secondary.vbuuidMismatch")
+
 // ProtobufDataPathMajorNum major version number for mutation data path.
 var ProtobufDataPathMajorNum byte // = 0
 
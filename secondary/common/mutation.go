@@ -38,9 +38,20 @@ type Payload struct {
 	Vbs     []*VbKeyVersions // for N number of vbuckets
 }
 
-// StreamID is unique id for a vbucket across buckets.
+// StreamID is unique id for a vbucket across buckets. The vbucket number
+// follows the last "/" of the id, so that buckets whose names end with
+// digits or contain "/" do not collide, e.g. ("abc1", 1) and ("abc", 11).
 func StreamID(bucket string, vbno uint16) string {
-	return bucket + fmt.Sprintf("%v", vbno)
+	return fmt.Sprintf("%v/%v", bucket, vbno)
+}
+
+// StreamCollectionID is unique id for a collection within a vbucket across
+// buckets, for the default collection (zero) it is same as StreamID.
+func StreamCollectionID(bucket string, collectionId uint32, vbno uint16) string {
+	if collectionId == 0 {
+		return StreamID(bucket, vbno)
+	}
+	return StreamID(bucket, vbno) + fmt.Sprintf(":%x", collectionId)
 }
 
 // NewStreamPayload returns a reference to payload, `nVb` provides the maximum
@@ -124,8 +135,12 @@ type VbKeyVersions struct {
 	Bucket  string
 	Vbucket uint16         // vbucket number
 	Vbuuid  uint64         // unique id to detect branch history
-	Kvs     []*KeyVersions // N number of mutations
+	Kvs     []*KeyVersions // N number of mutations, in seqno order
 	Uuid    string
+	size    int // running total of Kvs' estimated size
+	// number of mutations in Kvs for each collection, other than the
+	// default collection, nil if all of them are of default collection.
+	collections map[uint32]int
 }
 
 // NewVbKeyVersions return a reference to a single vbucket payload
@@ -139,9 +154,89 @@ func NewVbKeyVersions(bucket string, vbno uint16, vbuuid uint64, maxMutations in
 // AddKeyVersions will add KeyVersions for a single mutation.
 func (vb *VbKeyVersions) AddKeyVersions(kv *KeyVersions) error {
 	vb.Kvs = append(vb.Kvs, kv)
+	vb.size += kv.EstimatedSize()
 	return nil
 }
 
+// AddCollectionKeyVersions will add KeyVersions for a single mutation of
+// collection `collectionId`, zero for default collection. Mutations of
+// all collections are kept in the order they were added.
+func (vb *VbKeyVersions) AddCollectionKeyVersions(
+	collectionId uint32, kv *KeyVersions) error {
+
+	if collectionId != 0 {
+		if vb.collections == nil {
+			vb.collections = make(map[uint32]int)
+		}
+		vb.collections[collectionId]++
+	}
+	return vb.AddKeyVersions(kv)
+}
+
+// CollectionMutations return the number of mutations of collection
+// `collectionId`, zero for default collection.
+func (vb *VbKeyVersions) CollectionMutations(collectionId uint32) int {
+	if collectionId != 0 {
+		return vb.collections[collectionId]
+	}
+	n := len(vb.Kvs)
+	for _, count := range vb.collections {
+		n -= count
+	}
+	return n
+}
+
+// Merge appends all mutations from `other`, both must belong to the
+// same bucket, vbucket and vbuuid.
+func (vb *VbKeyVersions) Merge(other *VbKeyVersions) error {
+	if vb.Bucket != other.Bucket || vb.Vbucket != other.Vbucket {
+		return ErrorNotMyVbucket
+	} else if vb.Vbuuid != other.Vbuuid {
+		return ErrorVbuuidMismatch
+	}
+	vb.Kvs = append(vb.Kvs, other.Kvs...)
+	vb.size += other.size
+	for collectionId, count := range other.collections {
+		if vb.collections == nil {
+			vb.collections = make(map[uint32]int)
+		}
+		vb.collections[collectionId] += count
+	}
+	return nil
+}
+
+// Clone returns a copy of `vb` with its own list of mutations, so that
+// mutations added to or freed from either one do not affect the other.
+// KeyVersions are immutable once added, hence shared by both.
+func (vb *VbKeyVersions) Clone() *VbKeyVersions {
+	newVb := *vb
+	newVb.Kvs = make([]*KeyVersions, len(vb.Kvs), cap(vb.Kvs))
+	copy(newVb.Kvs, vb.Kvs)
+	if vb.collections != nil {
+		newVb.collections = make(map[uint32]int, len(vb.collections))
+		for collectionId, count := range vb.collections {
+			newVb.collections[collectionId] = count
+		}
+	}
+	return &newVb
+}
+
+// Range calls fn for each mutation in the order they were added, until
+// fn returns false. Mutations must not be added to `vb` from within fn.
+func (vb *VbKeyVersions) Range(fn func(kv *KeyVersions) bool) {
+	for _, kv := range vb.Kvs {
+		if !fn(kv) {
+			return
+		}
+	}
+}
+
+// EstimatedSize returns a lower-bound estimate of serialized size, in
+// bytes, for all mutations added via AddKeyVersions().
+func (vb *VbKeyVersions) EstimatedSize() int {
+	return vb.size
+}
+
 // Equal compare equality of two VbKeyVersions object.
 func (vb *VbKeyVersions) Equal(other *VbKeyVersions) bool {
 	if vb.Vbucket != other.Vbucket ||
@@ -165,6 +260,8 @@ func (vb *VbKeyVersions) Free() {
 		kv.Free()
 	}
 	vb.Kvs = vb.Kvs[:0]
+	vb.size = 0
+	vb.collections = nil
 	// TODO: give `vb` back to pool
 }
 
@@ -174,6 +271,8 @@ func (vb *VbKeyVersions) FreeKeyVersions() {
 		kv.Free()
 	}
 	vb.Kvs = vb.Kvs[:0]
+	vb.size = 0
+	vb.collections = nil
 }
 
 // KeyVersions for a single mutation from KV for a subset of index.
@@ -234,6 +333,19 @@ func (kv *KeyVersions) Length() int {
 	return len(kv.Uuids)
 }
 
+// EstimatedSize returns a lower-bound estimate of serialized size, in
+// bytes, of this mutation, computed from seqno, docid and key-versions.
+func (kv *KeyVersions) EstimatedSize() int {
+	size := 8 + len(kv.Docid) // seqno + docid
+	for i := range kv.Uuids {
+		size += 8 + 1 + len(kv.Keys[i]) + len(kv.Oldkeys[i]) // uuid + command
+	}
+	for _, partnkey := range kv.Partnkeys {
+		size += len(partnkey)
+	}
+	return size
+}
+
 // AddUpsert add a new keyversion for same OpMutation.
 func (kv *KeyVersions) AddUpsert(uuid uint64, key, oldkey []byte) {
 	kv.addKey(uuid, Upsert, key, oldkey)
@@ -290,8 +402,9 @@ func (kv *KeyVersions) String() string {
 
 // DataportKeyVersions accepted by this endpoint.
 type DataportKeyVersions struct {
-	Bucket string
-	Vbno   uint16
-	Vbuuid uint64
-	Kv     *KeyVersions
+	Bucket       string
+	CollectionId uint32 // zero for default collection
+	Vbno         uint16
+	Vbuuid       uint64
+	Kv           *KeyVersions
 }
@@ -4,6 +4,7 @@
 package common
 
 import (
+	"fmt"
 	"testing"
 )
 
@@ -67,6 +68,189 @@ func TestPayloadKeyVersions(t *testing.T) {
 	}
 }
 
+func TestKVEstimatedSize(t *testing.T) {
+	seqno, docid := uint64(10), []byte("document-name")
+	kv := NewKeyVersions(seqno, docid, 2)
+	kv.AddUpsert(1, []byte("key"), []byte("oldkey"))
+	kv.AddDeletion(2, []byte("oldkey"))
+	// seqno + docid + 2*(uuid + command) + keys
+	ref := 8 + len(docid) + 2*(8+1) + len("key") + 2*len("oldkey")
+	if size := kv.EstimatedSize(); size != ref {
+		t.Fatalf("expected %v, got %v", ref, size)
+	}
+
+	vb := NewVbKeyVersions("default", 1 /*vbno*/, 10 /*vbuuid*/, 10)
+	vb.AddKeyVersions(kv)
+	vb.AddKeyVersions(kv)
+	if size := vb.EstimatedSize(); size != 2*ref {
+		t.Fatalf("expected %v, got %v", 2*ref, size)
+	}
+	vb.FreeKeyVersions()
+	if size := vb.EstimatedSize(); size != 0 {
+		t.Fatalf("expected 0, got %v", size)
+	}
+}
+
+func TestVbKVMerge(t *testing.T) {
+	vb1 := NewVbKeyVersions("default", 1 /*vbno*/, 10 /*vbuuid*/, 10)
+	vb2 := NewVbKeyVersions("default", 1 /*vbno*/, 10 /*vbuuid*/, 10)
+	for seqno := uint64(1); seqno <= 4; seqno++ {
+		kv := NewKeyVersions(seqno, []byte("document-name"), 1)
+		kv.AddUpsert(1, []byte("key"), nil)
+		if seqno <= 2 {
+			vb1.AddKeyVersions(kv)
+		} else {
+			vb2.AddKeyVersions(kv)
+		}
+	}
+	size := vb1.EstimatedSize() + vb2.EstimatedSize()
+
+	if err := vb1.Merge(vb2); err != nil {
+		t.Fatal(err)
+	}
+	if len(vb1.Kvs) != 4 || vb1.EstimatedSize() != size {
+		t.Fatalf("unexpected merge %v", vb1.Kvs)
+	}
+	for i, kv := range vb1.Kvs {
+		if kv.Seqno != uint64(i+1) {
+			t.Fatalf("expected seqno %v, got %v", i+1, kv.Seqno)
+		}
+	}
+
+	vb3 := NewVbKeyVersions("default", 1 /*vbno*/, 20 /*vbuuid*/, 10)
+	if err := vb1.Merge(vb3); err != ErrorVbuuidMismatch {
+		t.Fatalf("expected %v, got %v", ErrorVbuuidMismatch, err)
+	}
+	vb4 := NewVbKeyVersions("default", 2 /*vbno*/, 10 /*vbuuid*/, 10)
+	if err := vb1.Merge(vb4); err != ErrorNotMyVbucket {
+		t.Fatalf("expected %v, got %v", ErrorNotMyVbucket, err)
+	}
+}
+
+func TestVbKVClone(t *testing.T) {
+	vb := NewVbKeyVersions("default", 1 /*vbno*/, 10 /*vbuuid*/, 10)
+	for seqno := uint64(1); seqno <= 2; seqno++ {
+		kv := NewKeyVersions(seqno, []byte("document-name"), 1)
+		kv.AddUpsert(1, []byte("key"), nil)
+		vb.AddCollectionKeyVersions(8, kv)
+	}
+
+	clone := vb.Clone()
+	if !clone.Equal(vb) || clone.Uuid != vb.Uuid || clone.CollectionMutations(8) != 2 ||
+		clone.EstimatedSize() != vb.EstimatedSize() {
+		t.Fatalf("expected %v, got %v", vb, clone)
+	}
+
+	// clone is not affected by mutations added to or freed from `vb`.
+	size := clone.EstimatedSize()
+	kv := NewKeyVersions(3, []byte("document-name"), 1)
+	kv.AddUpsert(1, []byte("key"), nil)
+	vb.AddKeyVersions(kv)
+	vb.Free()
+	if len(clone.Kvs) != 2 || clone.Kvs[1].Seqno != 2 || clone.EstimatedSize() != size ||
+		clone.CollectionMutations(8) != 2 {
+		t.Fatalf("unexpected clone %v", clone.Kvs)
+	}
+}
+
+func TestVbKVCollections(t *testing.T) {
+	vb1 := NewVbKeyVersions("default", 1 /*vbno*/, 10 /*vbuuid*/, 10)
+	vb2 := NewVbKeyVersions("default", 1 /*vbno*/, 10 /*vbuuid*/, 10)
+	for seqno := uint64(1); seqno <= 6; seqno++ {
+		vb := vb1
+		if seqno > 3 {
+			vb = vb2
+		}
+		kv := NewKeyVersions(seqno, []byte("document-name"), 1)
+		vb.AddCollectionKeyVersions(uint32(seqno%3), kv) // 1, 2, 0, ...
+	}
+
+	// mutations of all collections are merged in order.
+	if err := vb1.Merge(vb2); err != nil {
+		t.Fatal(err)
+	}
+	for i, kv := range vb1.Kvs {
+		if kv.Seqno != uint64(i+1) {
+			t.Fatalf("unexpected seqnos %v", vb1.Kvs)
+		}
+	}
+	for collectionId := uint32(0); collectionId < 3; collectionId++ {
+		if n := vb1.CollectionMutations(collectionId); n != 2 {
+			t.Fatalf("expected 2 mutations for collection %v, got %v", collectionId, n)
+		}
+	}
+
+	vb1.Free()
+	if n := vb1.CollectionMutations(1); n != 0 {
+		t.Fatalf("expected no mutations after free, got %v", n)
+	}
+}
+
+func TestVbKVRange(t *testing.T) {
+	vb := NewVbKeyVersions("default", 1 /*vbno*/, 10 /*vbuuid*/, 10)
+	for seqno := uint64(1); seqno <= 5; seqno++ {
+		vb.AddKeyVersions(NewKeyVersions(seqno, []byte("document-name"), 1))
+	}
+
+	seqnos := make([]uint64, 0)
+	vb.Range(func(kv *KeyVersions) bool {
+		seqnos = append(seqnos, kv.Seqno)
+		return true
+	})
+	if len(seqnos) != 5 || seqnos[0] != 1 || seqnos[4] != 5 {
+		t.Fatalf("unexpected seqnos %v", seqnos)
+	}
+
+	// stop early
+	seqnos = seqnos[:0]
+	vb.Range(func(kv *KeyVersions) bool {
+		seqnos = append(seqnos, kv.Seqno)
+		return kv.Seqno < 3
+	})
+	if len(seqnos) != 3 || seqnos[2] != 3 {
+		t.Fatalf("unexpected seqnos %v", seqnos)
+	}
+}
+
+func TestStreamID(t *testing.T) {
+	if a, b := StreamID("abc1", 1), StreamID("abc", 11); a == b {
+		t.Fatalf("unexpected collision %v", a)
+	}
+	if a, b := StreamID("b0:", 1), StreamCollectionID("b", 1, 0); a == b {
+		t.Fatalf("unexpected collision %v", a)
+	}
+
+	ids := make(map[string]string)
+	buckets := []string{"a", "a1", "a/1", "a1/", "a/", "1", "a:1"}
+	for _, bucket := range buckets {
+		for _, vbno := range []uint16{0, 1, 11, 111} {
+			for _, collectionId := range []uint32{0, 1, 0x11} {
+				id := StreamCollectionID(bucket, collectionId, vbno)
+				key := fmt.Sprintf("(%q, %v, %v)", bucket, collectionId, vbno)
+				if other, ok := ids[id]; ok {
+					t.Fatalf("%v and %v collide on %q", key, other, id)
+				}
+				ids[id] = key
+			}
+		}
+	}
+}
+
+func BenchmarkVbKVRange(b *testing.B) {
+	vb := NewVbKeyVersions("default", 1 /*vbno*/, 10 /*vbuuid*/, 1000)
+	for seqno := uint64(1); seqno <= 1000; seqno++ {
+		vb.AddKeyVersions(NewKeyVersions(seqno, []byte("document-name"), 1))
+	}
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		var n int
+		vb.Range(func(kv *KeyVersions) bool {
+			n++
+			return true
+		})
+	}
+}
+
 func BenchmarkKVEqual(b *testing.B) {
 	seqno, docid, maxCount := uint64(10), []byte("document-name"), 10
 	kv1 := NewKeyVersions(seqno, docid, maxCount)
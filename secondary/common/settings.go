@@ -57,3 +57,55 @@ func SetupSettingsNotifier(callb func(Config), cancelCh chan struct{}) {
 
 	return
 }
+
+// IndexerSettings is a typed accessor over the commonly used settings
+// in a config with full (untrimmed) keys, like SystemConfig.
+type IndexerSettings struct {
+	config Config
+}
+
+func NewIndexerSettings(config Config) IndexerSettings {
+	return IndexerSettings{config: config}
+}
+
+// MaxVbuckets is the number of vbuckets configured in KV.
+func (s IndexerSettings) MaxVbuckets() int {
+	return s.config["maxVbuckets"].Int()
+}
+
+// ClusterAddr is the local cluster manager address.
+func (s IndexerSettings) ClusterAddr() string {
+	return s.config["indexer.clusterAddr"].String()
+}
+
+// SettingsMaxPayload is the maximum payload, in bytes, of a settings
+// request.
+func (s IndexerSettings) SettingsMaxPayload() int {
+	return s.config["indexer.settingsMaxPayload"].Int()
+}
+
+// MemoryQuota is the maximum memory used by the indexer buffercache.
+func (s IndexerSettings) MemoryQuota() uint64 {
+	return s.config["indexer.settings.memory_quota"].Uint64()
+}
+
+// MaxCpuPercent is the maximum percent of CPU that indexer can use.
+func (s IndexerSettings) MaxCpuPercent() int {
+	return s.config["indexer.settings.max_cpu_percent"].Int()
+}
+
+// LogLevel is the indexer logging level.
+func (s IndexerSettings) LogLevel() string {
+	return s.config["indexer.settings.log_level"].String()
+}
+
+// BufferPoolBlockSize is the size of memory block in memory pool.
+func (s IndexerSettings) BufferPoolBlockSize() int {
+	return s.config["indexer.settings.bufferPoolBlockSize"].Int()
+}
+
+// ProjectorClientConfig is the config section for projector clients,
+// with the "manager.projectorclient." prefix trimmed.
+func (s IndexerSettings) ProjectorClientConfig() Config {
+	return s.config.SectionConfig("manager.projectorclient.", true)
+}
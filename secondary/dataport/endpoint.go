@@ -37,10 +37,16 @@ type RouterEndpoint struct {
 	logPrefix string
 	keyChSize int // channel size for key-versions
 	// live update is possible
-	block      bool          // should endpoint block when remote is slow
-	bufferSize int           // size of buffer to wait till flush
-	bufferTm   time.Duration // timeout to flush endpoint-buffer
-	harakiriTm time.Duration // timeout after which endpoint commits harakiri
+	block           bool          // should endpoint block when remote is slow
+	bufferSize      int           // size of buffer to wait till flush
+	bufferTm        time.Duration // timeout to flush endpoint-buffer
+	harakiriTm      time.Duration // timeout after which endpoint commits harakiri
+	maxVbMutations  int           // flush when a vbucket has these many mutations
+	initVbMutations int           // initial capacity of a vbucket's mutations
+	maxPacketSize   int           // split flush into packets of this size
+	// seqno gap detection, does not support live update
+	gapDetection bool
+	gapThreshold uint64
 	// gen-server
 	ch    chan []interface{} // carries control commands
 	finch chan bool
@@ -61,15 +67,21 @@ func NewRouterEndpoint(
 	}
 
 	endpoint := &RouterEndpoint{
-		topic:      topic,
-		raddr:      raddr,
-		finch:      make(chan bool),
-		timestamp:  time.Now().UnixNano(),
-		keyChSize:  config["keyChanSize"].Int(),
-		block:      config["remoteBlock"].Bool(),
-		bufferSize: config["bufferSize"].Int(),
-		bufferTm:   time.Duration(config["bufferTimeout"].Int()),
-		harakiriTm: time.Duration(config["harakiriTimeout"].Int()),
+		topic:           topic,
+		raddr:           raddr,
+		finch:           make(chan bool),
+		timestamp:       time.Now().UnixNano(),
+		keyChSize:       config["keyChanSize"].Int(),
+		block:           config["remoteBlock"].Bool(),
+		bufferSize:      config["bufferSize"].Int(),
+		bufferTm:        time.Duration(config["bufferTimeout"].Int()),
+		harakiriTm:      time.Duration(config["harakiriTimeout"].Int()),
+		maxVbMutations:  config["maxVbMutations"].Int(),
+		initVbMutations: config["initVbMutations"].Int(),
+		maxPacketSize:   config["maxPacketSize"].Int(),
+		// seqno gap detection
+		gapDetection: config["gapDetection"].Bool(),
+		gapThreshold: uint64(config["gapThreshold"].Int()),
 	}
 	endpoint.ch = make(chan []interface{}, endpoint.keyChSize)
 	endpoint.conn = conn
@@ -167,6 +179,18 @@ func (endpoint *RouterEndpoint) run(ch chan []interface{}) {
 	flushTimeout := time.Tick(endpoint.bufferTm * time.Millisecond)
 	harakiri := time.After(endpoint.harakiriTm * time.Millisecond)
 	buffers := newEndpointBuffers(raddr)
+	buffers.maxVbMutations = endpoint.maxVbMutations
+	if endpoint.initVbMutations >= 0 {
+		buffers.initVbMutations = endpoint.initVbMutations
+	}
+	buffers.maxPacketSize = endpoint.maxPacketSize
+	buffers.GapDetectionEnabled = endpoint.gapDetection
+	buffers.GapThreshold = endpoint.gapThreshold
+	// A failed flush may leave a partial packet on the connection, so the
+	// buffers retained by flushBuffers() are not resent on it. Instead the
+	// endpoint exits and they are released here, the downstream is expected
+	// to repair the endpoint and restart the vbuckets.
+	defer buffers.Reset() // release buffered mutations on shutdown.
 
 	messageCount := int64(0)
 	flushCount := int64(0)
@@ -202,14 +226,15 @@ loop:
 				}
 
 				kv := data.Kv
-				buffers.addKeyVersions(data.Bucket, data.Vbno, data.Vbuuid, kv)
+				vbfull := buffers.addKeyVersions(
+					data.Bucket, data.CollectionId, data.Vbno, data.Vbuuid, kv)
 				logging.Tracef("%v added %v keyversions <%v:%v:%v> to %q\n",
 					endpoint.logPrefix, kv.Length(), data.Vbno, kv.Seqno,
 					kv.Commands, buffers.raddr)
 				messageCount++ // count cummulative mutations
 				// reload harakiri
 				mutationCount++ // count queued up mutations.
-				if mutationCount > int64(endpoint.bufferSize) {
+				if vbfull || mutationCount > int64(endpoint.bufferSize) {
 					if err := flushBuffers(); err != nil {
 						break loop
 					}
@@ -225,6 +250,10 @@ loop:
 				if cv, ok := config["bufferSize"]; ok {
 					endpoint.bufferSize = cv.Int()
 				}
+				if cv, ok := config["maxVbMutations"]; ok {
+					endpoint.maxVbMutations = cv.Int()
+					buffers.maxVbMutations = endpoint.maxVbMutations
+				}
 				if cv, ok := config["bufferTimeout"]; ok {
 					endpoint.bufferTm = time.Duration(cv.Int())
 					flushTimeout = time.Tick(endpoint.bufferTm * time.Millisecond)
@@ -245,6 +274,9 @@ loop:
 				stats := endpoint.newStats()
 				stats.Set("messageCount", float64(messageCount))
 				stats.Set("flushCount", float64(flushCount))
+				for key, value := range buffers.Stats() {
+					stats.Set(key, value)
+				}
 				respch <- []interface{}{map[string]interface{}(stats)}
 
 			case endpCmdClose:
@@ -277,6 +309,13 @@ func (endpoint *RouterEndpoint) newStats() c.Statistics {
 	m := map[string]interface{}{
 		"messageCount": float64(0),
 		"flushCount":   float64(0),
+		// seqno gap detection
+		"seqnoGaps":       float64(0),
+		"seqnoDuplicates": float64(0),
+		// buffer depth
+		"bufferedVbuckets":  float64(0),
+		"bufferedMutations": float64(0),
+		"bufferedBytes":     float64(0),
 	}
 	stats, _ := c.NewStatistics(m)
 	return stats
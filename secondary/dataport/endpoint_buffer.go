@@ -1,47 +1,398 @@
 package dataport
 
+import "errors"
+import "fmt"
 import "net"
+import "sort"
+import "strings"
+import "sync"
 
 import c "github.com/couchbase/indexing/secondary/common"
 import "github.com/couchbase/indexing/secondary/transport"
+import "github.com/couchbase/indexing/secondary/logging"
+
+// ErrorNoEndpoint is returned when there is no connection left to flush.
+var ErrorNoEndpoint = errors.New("dataport.noEndpoint")
+
+// endpointErrors is returned by flushBuffers() with the error of every
+// connection that failed, keyed by remote address.
+type endpointErrors map[string]error
+
+func (errs endpointErrors) Error() string {
+	raddrs := make([]string, 0, len(errs))
+	for raddr := range errs {
+		raddrs = append(raddrs, raddr)
+	}
+	sort.Strings(raddrs)
+	msgs := make([]string, 0, len(raddrs))
+	for _, raddr := range raddrs {
+		msgs = append(msgs, fmt.Sprintf("%q: %v", raddr, errs[raddr]))
+	}
+	return strings.Join(msgs, "; ")
+}
 
 type endpointBuffers struct {
 	raddr string
+	// additional endpoints to fan-out the mutations, protected by mu.
+	raddrs []string
+	conns  []net.Conn
+	// mu protects buffered mutations, endpoints and gap detection state,
+	// so that they can be updated while buffers are being flushed.
+	mu    sync.Mutex
 	vbs   map[string]*c.VbKeyVersions
+	size  int // estimated size, in bytes, of buffered mutations
+	nMuts int // number of buffered mutations
+	// advise flush when a vbucket has buffered these many mutations,
+	// zero for no limit.
+	maxVbMutations int
+	// initial capacity of mutations for a newly buffered vbucket. Larger
+	// value avoids reallocs when vbuckets see large batches between
+	// flushes, but is allocated upfront for every buffered vbucket, even
+	// the ones that see a single mutation.
+	initVbMutations int
+	// split a flush into packets of at most these many bytes, estimated
+	// by whole vbuckets, zero for no limit.
+	maxPacketSize int
+	// list of vbuckets to send, reused across flushes. Not protected by
+	// mu, flushBuffers() is called by a single routine.
+	flushList []*c.VbKeyVersions
+
+	// seqno gap detection, disabled by default.
+	GapDetectionEnabled bool
+	GapThreshold        uint64
+	lastSeqnos          map[string]uint64 // vbucket -> last seqno
+	seqnoGaps           uint64
+	seqnoDuplicates     uint64
+}
+
+// pool of empty vbucket maps, shared by all endpoint buffers, so that
+// maps are not reallocated on every flush.
+var vbsPool = sync.Pool{
+	New: func() interface{} {
+		return make(map[string]*c.VbKeyVersions)
+	},
 }
 
 func newEndpointBuffers(raddr string) *endpointBuffers {
-	vbs := make(map[string]*c.VbKeyVersions)
-	b := &endpointBuffers{raddr, vbs}
+	vbs := vbsPool.Get().(map[string]*c.VbKeyVersions)
+	b := &endpointBuffers{raddr: raddr, vbs: vbs, initVbMutations: 16}
 	return b
 }
 
-// addKeyVersions, add a mutation's keyversions to buffer.
+// AddEndpoint to fan-out the buffered mutations to `raddr` as well.
+func (b *endpointBuffers) AddEndpoint(raddr string, conn net.Conn) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.removeEndpoint(raddr)
+	b.raddrs = append(b.raddrs, raddr)
+	b.conns = append(b.conns, conn)
+}
+
+// RemoveEndpoint `raddr`, the connection is not closed.
+func (b *endpointBuffers) RemoveEndpoint(raddr string) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.removeEndpoint(raddr)
+}
+
+// removeEndpoint `raddr`, `b.mu` must be held. The endpoint slices are
+// copied, so that a flush can send on a snapshot of them.
+func (b *endpointBuffers) removeEndpoint(raddr string) {
+	for i, addr := range b.raddrs {
+		if addr == raddr {
+			raddrs := make([]string, 0, len(b.raddrs)-1)
+			b.raddrs = append(append(raddrs, b.raddrs[:i]...), b.raddrs[i+1:]...)
+			conns := make([]net.Conn, 0, len(b.conns)-1)
+			b.conns = append(append(conns, b.conns[:i]...), b.conns[i+1:]...)
+			return
+		}
+	}
+}
+
+// addKeyVersions, add a mutation's keyversions to buffer. Mutations of
+// all collections of a vbucket are buffered together in seqno order,
+// and accounted for each collection, `collectionId` is zero for the
+// default collection. Return true if the vbucket has reached
+// maxVbMutations, and buffers must be flushed to keep them bounded.
 func (b *endpointBuffers) addKeyVersions(
-	bucket string, vbno uint16, vbuuid uint64, kv *c.KeyVersions) {
+	bucket string, collectionId uint32, vbno uint16, vbuuid uint64,
+	kv *c.KeyVersions) bool {
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
 
 	if kv != nil && kv.Length() > 0 {
 		uuid := c.StreamID(bucket, vbno)
+		if b.GapDetectionEnabled {
+			b.detectGap(uuid, kv)
+		}
 		if _, ok := b.vbs[uuid]; !ok {
-			nMuts := 16 // to avoid reallocs.
-			b.vbs[uuid] = c.NewVbKeyVersions(bucket, vbno, vbuuid, nMuts)
+			b.vbs[uuid] = c.NewVbKeyVersions(bucket, vbno, vbuuid, b.initVbMutations)
+		}
+		b.vbs[uuid].AddCollectionKeyVersions(collectionId, kv)
+		b.size += kv.EstimatedSize()
+		b.nMuts++
+		if b.maxVbMutations > 0 && len(b.vbs[uuid].Kvs) >= b.maxVbMutations {
+			return true
+		}
+	}
+	return false
+}
+
+// detectGap in seqno for data mutations, control commands like Sync
+// carry the last seqno and hence are ignored.
+func (b *endpointBuffers) detectGap(uuid string, kv *c.KeyVersions) {
+	if kv.Commands[0] > c.UpsertDeletion {
+		return
+	}
+	if b.lastSeqnos == nil {
+		b.lastSeqnos = make(map[string]uint64)
+	}
+	last, ok := b.lastSeqnos[uuid]
+	b.lastSeqnos[uuid] = kv.Seqno
+	if !ok {
+		return
+	}
+
+	if expected := last + 1; kv.Seqno < expected {
+		b.seqnoDuplicates++
+		b.lastSeqnos[uuid] = last
+		fmsg := "endpointBuffers %q possible duplicate for %v, seqno %v <= %v\n"
+		logging.Warnf(fmsg, b.raddr, uuid, kv.Seqno, last)
+
+	} else if kv.Seqno > expected+b.GapThreshold {
+		b.seqnoGaps++
+		fmsg := "endpointBuffers %q possible gap for %v, seqno %v after %v\n"
+		logging.Warnf(fmsg, b.raddr, uuid, kv.Seqno, last)
+	}
+}
+
+// Stats return buffer depth and seqno gap detection statistics.
+func (b *endpointBuffers) Stats() c.Statistics {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	stats, _ := c.NewStatistics(nil)
+	stats.Set("seqnoGaps", float64(b.seqnoGaps))
+	stats.Set("seqnoDuplicates", float64(b.seqnoDuplicates))
+	stats.Set("bufferedVbuckets", float64(len(b.vbs)))
+	stats.Set("bufferedMutations", float64(b.nMuts))
+	stats.Set("bufferedBytes", float64(b.size))
+	return stats
+}
+
+// NumVbuckets return the number of vbuckets buffered so far.
+func (b *endpointBuffers) NumVbuckets() int {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return len(b.vbs)
+}
+
+// NumMutations return the number of mutations buffered so far.
+func (b *endpointBuffers) NumMutations() int {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.nMuts
+}
+
+// BufferedBytes return the estimated size of mutations buffered so far.
+func (b *endpointBuffers) BufferedBytes() int {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.size
+}
+
+// MergeFrom merges buffered mutations from `other`. If the same vbucket
+// is buffered with different vbuuid, the one with higher seqno is kept.
+// Merged vbuckets are cloned, hence not affected by a later flush or
+// reset of `other`.
+func (b *endpointBuffers) MergeFrom(other *endpointBuffers) error {
+	other.mu.Lock()
+	ovbs := make(map[string]*c.VbKeyVersions, len(other.vbs))
+	for uuid, ovb := range other.vbs {
+		ovbs[uuid] = ovb.Clone()
+	}
+	other.mu.Unlock()
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.mergeVbs(ovbs)
+}
+
+// mergeVbs merges vbuckets into buffers, `b.mu` must be held.
+func (b *endpointBuffers) mergeVbs(ovbs map[string]*c.VbKeyVersions) error {
+	for uuid, ovb := range ovbs {
+		vb, ok := b.vbs[uuid]
+		if !ok {
+			b.vbs[uuid] = ovb
+			b.size += ovb.EstimatedSize()
+			b.nMuts += len(ovb.Kvs)
+			continue
+		}
+
+		err := vb.Merge(ovb)
+		if err == c.ErrorVbuuidMismatch {
+			if lastSeqno(ovb) > lastSeqno(vb) {
+				b.vbs[uuid] = ovb
+				b.size += ovb.EstimatedSize() - vb.EstimatedSize()
+				b.nMuts += len(ovb.Kvs) - len(vb.Kvs)
+			}
+			continue
+		} else if err != nil {
+			return err
+		}
+		b.size += ovb.EstimatedSize()
+		b.nMuts += len(ovb.Kvs)
+	}
+	return nil
+}
+
+// Reset drops all buffered mutations and per vbucket state, so that
+// they can be reclaimed even if `b` is referenced for longer. Statistics
+// on seqno gaps and duplicates are retained.
+func (b *endpointBuffers) Reset() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	for uuid, vb := range b.vbs {
+		vb.Free()
+		delete(b.vbs, uuid)
+	}
+	b.lastSeqnos = nil
+	b.size, b.nMuts = 0, 0
+}
+
+// lastSeqno return the seqno of the latest mutation buffered for vbucket.
+func lastSeqno(vb *c.VbKeyVersions) uint64 {
+	if len(vb.Kvs) == 0 {
+		return 0
+	}
+	return vb.Kvs[len(vb.Kvs)-1].Seqno
+}
+
+// splitPackets split vbuckets into packets whose estimated size is at
+// most maxSize bytes, a vbucket larger than maxSize is sent in a packet
+// by itself. Zero maxSize sends all vbuckets in a single packet.
+func splitPackets(vbs []*c.VbKeyVersions, maxSize int) [][]*c.VbKeyVersions {
+	if maxSize <= 0 || len(vbs) == 0 {
+		return [][]*c.VbKeyVersions{vbs}
+	}
+	packets := make([][]*c.VbKeyVersions, 0)
+	start, size := 0, 0
+	for i, vb := range vbs {
+		if i > start && size+vb.EstimatedSize() > maxSize {
+			packets = append(packets, vbs[start:i])
+			start, size = i, 0
 		}
-		b.vbs[uuid].AddKeyVersions(kv)
+		size += vb.EstimatedSize()
 	}
+	return append(packets, vbs[start:])
 }
 
-// flush the buffers to the other end.
+// sendPackets send packets on conn, in order, stops at the first failure.
+func sendPackets(
+	conn net.Conn, pkt *transport.TransportPacket,
+	packets [][]*c.VbKeyVersions) error {
+
+	for _, vbs := range packets {
+		if err := pkt.Send(conn, vbs); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// flush the buffers to the other end, `conn` can be nil if mutations
+// are only sent to endpoints added by AddEndpoint(). Buffers are sent to
+// every connection, and the added endpoints that fail are removed from
+// the list. If sending on `conn` fails, the errors of all connections
+// are returned. Buffers are cleared only after a successful send, on
+// error they are retained so that the next flush can resend them,
+// subsequent mutations are appended in order. Buffers are sent in
+// packets of maxPacketSize, hence the packets sent before a failure, and
+// the buffers sent to the added endpoints, are resent as well. Retained
+// buffers are only useful to callers that resend them on a sound
+// connection, RouterEndpoint does not, refer RouterEndpoint.run().
+//
+// Buffers are swapped with empty ones before sending, mutations added
+// during the flush are buffered for the next flush.
 func (b *endpointBuffers) flushBuffers(
 	conn net.Conn, pkt *transport.TransportPacket) error {
 
-	vbs := make([]*c.VbKeyVersions, 0, len(b.vbs))
-	for _, vb := range b.vbs {
+	b.mu.Lock()
+	flushVbs, size, nMuts := b.vbs, b.size, b.nMuts
+	b.vbs = vbsPool.Get().(map[string]*c.VbKeyVersions)
+	b.size, b.nMuts = 0, 0
+	raddrs, conns := b.raddrs, b.conns
+	b.mu.Unlock()
+
+	vbs := b.flushList[:0]
+	for _, vb := range flushVbs {
 		vbs = append(vbs, vb)
 	}
-	b.vbs = make(map[string]*c.VbKeyVersions)
+	defer func() {
+		// drop references to flushed vbuckets, but retain the capacity.
+		for i := range vbs {
+			vbs[i] = nil
+		}
+		b.flushList = vbs[:0]
+	}()
+	packets := splitPackets(vbs, b.maxPacketSize)
 
-	if err := pkt.Send(conn, vbs); err != nil {
-		return err
+	errs := make(endpointErrors)
+	if conn != nil {
+		if err := sendPackets(conn, pkt, packets); err != nil {
+			errs[b.raddr] = err
+		}
+	}
+	for i, conn := range conns {
+		if err := sendPackets(conn, pkt, packets); err != nil {
+			logging.Warnf("endpointBuffers removing endpoint %q: %v\n", raddrs[i], err)
+			b.RemoveEndpoint(raddrs[i])
+			errs[raddrs[i]] = err
+		}
+	}
+
+	if _, ok := errs[b.raddr]; conn != nil && ok {
+		b.restore(flushVbs, size, nMuts)
+		return errs
+	}
+	if conn == nil && b.numEndpoints() == 0 {
+		b.restore(flushVbs, size, nMuts)
+		return ErrorNoEndpoint
 	}
+
+	putVbs(flushVbs)
 	return nil
 }
+
+// numEndpoints return the number of endpoints added by AddEndpoint().
+func (b *endpointBuffers) numEndpoints() int {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return len(b.conns)
+}
+
+// restore buffers that failed to flush, mutations added during the flush
+// are appended to them in order.
+func (b *endpointBuffers) restore(
+	vbs map[string]*c.VbKeyVersions, size, nMuts int) {
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	added := b.vbs
+	b.vbs, b.size, b.nMuts = vbs, size, nMuts
+	b.mergeVbs(added)
+	putVbs(added)
+}
+
+// putVbs back to pool, pooled maps must be empty.
+func putVbs(vbs map[string]*c.VbKeyVersions) {
+	for uuid := range vbs {
+		delete(vbs, uuid)
+	}
+	vbsPool.Put(vbs)
+}
@@ -0,0 +1,536 @@
+package dataport
+
+import "net"
+import "testing"
+import "time"
+
+import c "github.com/couchbase/indexing/secondary/common"
+import "github.com/couchbase/indexing/secondary/logging"
+import protobuf "github.com/couchbase/indexing/secondary/protobuf/data"
+import "github.com/couchbase/indexing/secondary/transport"
+
+func TestEndpointBuffersFanout(t *testing.T) {
+	logging.SetLogLevel(logging.Silent)
+
+	flags := transport.TransportFlag(0).SetProtobuf()
+	pkt := transport.NewTransportPacket(1000*1024, flags)
+	pkt.SetEncoder(transport.EncodingProtobuf, protobufEncode)
+	pkt.SetDecoder(transport.EncodingProtobuf, protobufDecode)
+
+	good := &testEndpointConn{newTestConnection()}
+	good.reset()
+	bad, other := net.Pipe()
+	other.Close()
+	bad.Close()
+
+	b := newEndpointBuffers("localhost:8888")
+	b.AddEndpoint("localhost:8889", bad)
+	b.AddEndpoint("localhost:8890", good)
+	for _, vb := range constructVbKeyVersions("default", 1, 4, 5, 5) {
+		for _, kv := range vb.Kvs {
+			b.addKeyVersions("default", 0, vb.Vbucket, vb.Vbuuid, kv)
+		}
+	}
+
+	// failing endpoint shall not abort the send to other endpoints.
+	if err := b.flushBuffers(nil, pkt); err != nil {
+		t.Fatal(err)
+	}
+	if len(b.raddrs) != 1 || b.raddrs[0] != "localhost:8890" {
+		t.Fatalf("expected failed endpoint to be removed, got %v", b.raddrs)
+	}
+	if good.woff == 0 {
+		t.Fatal("expected mutations to be sent on the remaining endpoint")
+	}
+
+	b.RemoveEndpoint("localhost:8890")
+	if err := b.flushBuffers(nil, pkt); err != ErrorNoEndpoint {
+		t.Fatalf("expected %v, got %v", ErrorNoEndpoint, err)
+	}
+}
+
+func TestEndpointBuffersFanoutPrimaryError(t *testing.T) {
+	logging.SetLogLevel(logging.Silent)
+
+	flags := transport.TransportFlag(0).SetProtobuf()
+	pkt := transport.NewTransportPacket(1000*1024, flags)
+	pkt.SetEncoder(transport.EncodingProtobuf, protobufEncode)
+
+	good := &testEndpointConn{newTestConnection()}
+	good.reset()
+	bad, other := net.Pipe()
+	other.Close()
+	bad.Close()
+
+	b := newEndpointBuffers("localhost:8888")
+	b.AddEndpoint("localhost:8890", good)
+	for _, vb := range constructVbKeyVersions("default", 1, 4, 5, 5) {
+		for _, kv := range vb.Kvs {
+			b.addKeyVersions("default", 0, vb.Vbucket, vb.Vbuuid, kv)
+		}
+	}
+	nMuts := b.NumMutations()
+
+	// failing primary connection shall not skip the other endpoints.
+	err := b.flushBuffers(bad, pkt)
+	if errs, ok := err.(endpointErrors); !ok || len(errs) != 1 || errs["localhost:8888"] == nil {
+		t.Fatalf("expected error for primary connection, got %v", err)
+	}
+	if good.woff == 0 {
+		t.Fatal("expected mutations to be sent on the added endpoint")
+	}
+	if b.NumMutations() != nMuts {
+		t.Fatalf("expected %v mutations to be retained, got %v", nMuts, b.NumMutations())
+	}
+}
+
+func TestEndpointBuffersConcurrentEndpoints(t *testing.T) {
+	logging.SetLogLevel(logging.Silent)
+
+	flags := transport.TransportFlag(0).SetProtobuf()
+	pkt := transport.NewTransportPacket(1000*1024, flags)
+	pkt.SetEncoder(transport.EncodingProtobuf, protobufEncode)
+
+	b := newEndpointBuffers("localhost:8888")
+	donech := make(chan bool)
+	go func() {
+		defer close(donech)
+		for i := 0; i < 100; i++ {
+			conn := &testEndpointConn{newTestConnection()}
+			conn.reset()
+			b.AddEndpoint("localhost:8890", conn)
+			b.RemoveEndpoint("localhost:8890")
+		}
+	}()
+
+	good := &testEndpointConn{newTestConnection()}
+	good.reset()
+	b.AddEndpoint("localhost:8889", good)
+	for i := 0; i < 100; i++ {
+		kv := c.NewKeyVersions(uint64(i+1), []byte("Bourne"), 1)
+		kv.AddUpsert(1, []byte("bangalore"), nil)
+		b.addKeyVersions("default", 0, 0, 10, kv)
+		if err := b.flushBuffers(nil, pkt); err != nil {
+			t.Fatal(err)
+		}
+		good.reset()
+	}
+	<-donech
+}
+
+func TestEndpointBuffersMerge(t *testing.T) {
+	addMutation := func(b *endpointBuffers, vbno uint16, vbuuid, seqno uint64) {
+		kv := c.NewKeyVersions(seqno, []byte("Bourne"), 1)
+		kv.AddUpsert(1, []byte("bangalore"), nil)
+		b.addKeyVersions("default", 0, vbno, vbuuid, kv)
+	}
+
+	b1 := newEndpointBuffers("localhost:8888")
+	addMutation(b1, 0, 10, 1)
+	addMutation(b1, 1, 10, 5)
+	b2 := newEndpointBuffers("localhost:8889")
+	addMutation(b2, 0, 10, 2)
+	addMutation(b2, 1, 20, 3) // older vbuuid with lower seqno
+	addMutation(b2, 2, 10, 1)
+
+	size := b1.BufferedBytes()
+	if err := b1.MergeFrom(b2); err != nil {
+		t.Fatal(err)
+	}
+
+	vb := b1.vbs[c.StreamID("default", 0)]
+	if len(vb.Kvs) != 2 || vb.Kvs[0].Seqno != 1 || vb.Kvs[1].Seqno != 2 {
+		t.Fatalf("expected mutations in seqno order, got %v", vb.Kvs)
+	}
+	vb = b1.vbs[c.StreamID("default", 1)]
+	if vb.Vbuuid != 10 || len(vb.Kvs) != 1 || vb.Kvs[0].Seqno != 5 {
+		t.Fatalf("expected vbucket with higher seqno to be retained")
+	}
+	if _, ok := b1.vbs[c.StreamID("default", 2)]; !ok {
+		t.Fatalf("expected vbucket 2 to be merged")
+	}
+	if ref := size + 2*vb.EstimatedSize(); b1.BufferedBytes() != ref {
+		t.Fatalf("expected %v, got %v", ref, b1.BufferedBytes())
+	}
+	if b1.NumVbuckets() != 3 || b1.NumMutations() != 4 {
+		t.Fatalf("expected 3 vbuckets and 4 mutations, got %v and %v",
+			b1.NumVbuckets(), b1.NumMutations())
+	}
+}
+
+func TestEndpointBuffersGapDetection(t *testing.T) {
+	logging.SetLogLevel(logging.Silent)
+
+	b := newEndpointBuffers("localhost:8888")
+	b.GapDetectionEnabled, b.GapThreshold = true, 10
+	for _, seqno := range []uint64{1, 2, 5, 3, 100, 101} {
+		kv := c.NewKeyVersions(seqno, []byte("Bourne"), 1)
+		kv.AddUpsert(1, []byte("bangalore"), nil)
+		b.addKeyVersions("default", 0, 0, 10, kv)
+	}
+	// control commands carry the last seqno.
+	kv := c.NewKeyVersions(101, nil, 1)
+	kv.AddSync()
+	b.addKeyVersions("default", 0, 0, 10, kv)
+
+	stats := b.Stats()
+	if v := stats["seqnoGaps"].(float64); v != 1 {
+		t.Fatalf("expected 1 gap, got %v", v)
+	}
+	if v := stats["seqnoDuplicates"].(float64); v != 1 {
+		t.Fatalf("expected 1 duplicate, got %v", v)
+	}
+}
+
+func TestEndpointBuffersFlushError(t *testing.T) {
+	logging.SetLogLevel(logging.Silent)
+
+	flags := transport.TransportFlag(0).SetProtobuf()
+	pkt := transport.NewTransportPacket(1000*1024, flags)
+	pkt.SetEncoder(transport.EncodingProtobuf, protobufEncode)
+
+	addMutation := func(b *endpointBuffers, vbno uint16, seqno uint64) {
+		kv := c.NewKeyVersions(seqno, []byte("Bourne"), 1)
+		kv.AddUpsert(1, []byte("bangalore"), nil)
+		b.addKeyVersions("default", 0, vbno, 10, kv)
+	}
+
+	b := newEndpointBuffers("localhost:8888")
+	addMutation(b, 0, 1)
+	addMutation(b, 1, 1)
+	size := b.BufferedBytes()
+
+	bad, other := net.Pipe()
+	other.Close()
+	bad.Close()
+	if err := b.flushBuffers(bad, pkt); err == nil {
+		t.Fatal("expected flush to fail")
+	}
+	if len(b.vbs) != 2 || b.BufferedBytes() != size {
+		t.Fatalf("expected mutations to be retained, got %v", b.vbs)
+	}
+
+	// retry, along with new mutations
+	addMutation(b, 0, 2)
+	vb := b.vbs[c.StreamID("default", 0)]
+	if len(vb.Kvs) != 2 || vb.Kvs[0].Seqno != 1 || vb.Kvs[1].Seqno != 2 {
+		t.Fatalf("expected mutations in seqno order, got %v", vb.Kvs)
+	}
+	if b.NumVbuckets() != 2 || b.NumMutations() != 3 {
+		t.Fatalf("expected 2 vbuckets and 3 mutations, got %v and %v",
+			b.NumVbuckets(), b.NumMutations())
+	}
+	good := &testEndpointConn{newTestConnection()}
+	good.reset()
+	if err := b.flushBuffers(good, pkt); err != nil {
+		t.Fatal(err)
+	}
+	if b.NumVbuckets() != 0 || b.NumMutations() != 0 || b.BufferedBytes() != 0 {
+		t.Fatalf("expected buffers to be cleared, got %v", b.vbs)
+	}
+}
+
+func TestEndpointBuffersMaxVbMutations(t *testing.T) {
+	b := newEndpointBuffers("localhost:8888")
+	b.maxVbMutations = 3
+	for seqno := uint64(1); seqno <= 3; seqno++ {
+		kv := c.NewKeyVersions(seqno, []byte("Bourne"), 1)
+		kv.AddUpsert(1, []byte("bangalore"), nil)
+		flush := b.addKeyVersions("default", 0, 0, 10, kv)
+		if flush != (seqno == 3) {
+			t.Fatalf("unexpected flush advice %v for seqno %v", flush, seqno)
+		}
+	}
+	// other vbuckets are not affected.
+	kv := c.NewKeyVersions(1, []byte("Bourne"), 1)
+	kv.AddUpsert(1, []byte("bangalore"), nil)
+	if b.addKeyVersions("default", 0, 1, 10, kv) {
+		t.Fatal("unexpected flush advice for vbucket 1")
+	}
+}
+
+func TestEndpointBuffersCollections(t *testing.T) {
+	logging.SetLogLevel(logging.Silent)
+
+	b := newEndpointBuffers("localhost:8888")
+	b.GapDetectionEnabled, b.maxVbMutations = true, 4
+	for seqno := uint64(1); seqno <= 3; seqno++ {
+		kv := c.NewKeyVersions(seqno, []byte("Bourne"), 1)
+		kv.AddUpsert(1, []byte("bangalore"), nil)
+		collectionId := uint32(8 + seqno%2) // 9, 8, 9
+		if b.addKeyVersions("default", collectionId, 0, 10, kv) {
+			t.Fatalf("unexpected flush advice for seqno %v", seqno)
+		}
+	}
+
+	// collections of a vbucket are buffered together, in seqno order.
+	if b.NumVbuckets() != 1 || b.NumMutations() != 3 {
+		t.Fatalf("expected 1 vbucket and 3 mutations, got %v and %v",
+			b.NumVbuckets(), b.NumMutations())
+	}
+	vb := b.vbs[c.StreamID("default", 0)]
+	if vb.CollectionMutations(8) != 1 || vb.CollectionMutations(9) != 2 {
+		t.Fatalf("unexpected collection mutations %v and %v",
+			vb.CollectionMutations(8), vb.CollectionMutations(9))
+	}
+	for i, kv := range vb.Kvs {
+		if kv.Seqno != uint64(i+1) {
+			t.Fatalf("unexpected seqno %v at %v", kv.Seqno, i)
+		}
+	}
+	// seqnos are contiguous across collections of the vbucket.
+	if v := b.Stats()["seqnoGaps"].(float64); v != 0 {
+		t.Fatalf("expected no gaps, got %v", v)
+	}
+
+	// default collection is accounted in the same vbucket, and the
+	// vbucket is bounded across its collections.
+	kv := c.NewKeyVersions(4, []byte("Bourne"), 1)
+	kv.AddUpsert(1, []byte("bangalore"), nil)
+	if !b.addKeyVersions("default", 0, 0, 10, kv) {
+		t.Fatal("expected flush advice for the vbucket")
+	}
+	if vb.CollectionMutations(0) != 1 || len(vb.Kvs) != 4 {
+		t.Fatalf("unexpected buffer for default collection: %v", vb.Kvs)
+	}
+}
+
+func TestEndpointBuffersCollectionsOrder(t *testing.T) {
+	logging.SetLogLevel(logging.Silent)
+
+	flags := transport.TransportFlag(0).SetProtobuf()
+	pkt := transport.NewTransportPacket(1000*1024, flags)
+	pkt.SetEncoder(transport.EncodingProtobuf, protobufEncode)
+	pkt.SetDecoder(transport.EncodingProtobuf, protobufDecode)
+	conn := &testEndpointConn{newTestConnection()}
+	conn.reset()
+
+	// interleave two collections on each vbucket, and split the flush
+	// into several packets.
+	b := newEndpointBuffers("localhost:8888")
+	b.maxPacketSize = 1
+	for seqno := uint64(1); seqno <= 10; seqno++ {
+		for vbno := uint16(0); vbno < 4; vbno++ {
+			kv := c.NewKeyVersions(seqno, []byte("Bourne"), 1)
+			kv.AddUpsert(1, []byte("bangalore"), nil)
+			b.addKeyVersions("default", uint32(8+seqno%2), vbno, 10, kv)
+		}
+	}
+	if err := b.flushBuffers(conn, pkt); err != nil {
+		t.Fatal(err)
+	}
+
+	// every vbucket is received once, in seqno order.
+	lastSeqnos := make(map[string]uint64)
+	for conn.roff < conn.woff {
+		payload, err := pkt.Receive(conn)
+		if err != nil {
+			t.Fatal(err)
+		}
+		vbs := protobuf2VbKeyVersions(payload.([]*protobuf.VbKeyVersions))
+		for _, vb := range vbs {
+			uuid := c.StreamID(vb.Bucket, vb.Vbucket)
+			if _, ok := lastSeqnos[uuid]; ok {
+				t.Fatalf("vbucket %v received more than once", uuid)
+			}
+			for _, kv := range vb.Kvs {
+				if kv.Seqno != lastSeqnos[uuid]+1 {
+					t.Fatalf("unexpected seqno %v after %v for %v",
+						kv.Seqno, lastSeqnos[uuid], uuid)
+				}
+				lastSeqnos[uuid] = kv.Seqno
+			}
+		}
+	}
+	if len(lastSeqnos) != 4 {
+		t.Fatalf("expected 4 vbuckets, got %v", lastSeqnos)
+	}
+	for uuid, seqno := range lastSeqnos {
+		if seqno != 10 {
+			t.Fatalf("expected last seqno 10 for %v, got %v", uuid, seqno)
+		}
+	}
+}
+
+func TestEndpointBuffersInitVbMutations(t *testing.T) {
+	b := newEndpointBuffers("localhost:8888")
+	if b.initVbMutations != 16 {
+		t.Fatalf("expected default of 16, got %v", b.initVbMutations)
+	}
+	b.initVbMutations = 64
+	kv := c.NewKeyVersions(1, []byte("Bourne"), 1)
+	kv.AddUpsert(1, []byte("bangalore"), nil)
+	b.addKeyVersions("default", 0, 0, 10, kv)
+	if vb := b.vbs[c.StreamID("default", 0)]; cap(vb.Kvs) != 64 {
+		t.Fatalf("expected capacity of 64, got %v", cap(vb.Kvs))
+	}
+}
+
+func TestEndpointBuffersReset(t *testing.T) {
+	b := newEndpointBuffers("localhost:8888")
+	b.GapDetectionEnabled = true
+	for vbno := uint16(0); vbno < 4; vbno++ {
+		kv := c.NewKeyVersions(1, []byte("Bourne"), 1)
+		kv.AddUpsert(1, []byte("bangalore"), nil)
+		b.addKeyVersions("default", 0, vbno, 10, kv)
+	}
+
+	b.Reset()
+	if b.NumVbuckets() != 0 || b.NumMutations() != 0 || b.BufferedBytes() != 0 {
+		t.Fatalf("expected buffers to be released, got %v", b.vbs)
+	}
+	if b.lastSeqnos != nil {
+		t.Fatalf("expected gap detection state to be released")
+	}
+
+	// buffers are usable after reset.
+	kv := c.NewKeyVersions(2, []byte("Bourne"), 1)
+	kv.AddUpsert(1, []byte("bangalore"), nil)
+	b.addKeyVersions("default", 0, 0, 10, kv)
+	if b.NumVbuckets() != 1 || b.NumMutations() != 1 {
+		t.Fatalf("expected 1 vbucket and 1 mutation, got %v and %v",
+			b.NumVbuckets(), b.NumMutations())
+	}
+}
+
+func TestEndpointBuffersMaxPacketSize(t *testing.T) {
+	// encoder that records the vbuckets sent in each packet, the list of
+	// vbuckets is reused by the next flush, hence copied.
+	var packets [][]*c.VbKeyVersions
+	flags := transport.TransportFlag(0).SetProtobuf()
+	pkt := transport.NewTransportPacket(1000*1024, flags)
+	pkt.SetEncoder(transport.EncodingProtobuf, func(payload interface{}) ([]byte, error) {
+		vbs := payload.([]*c.VbKeyVersions)
+		packets = append(packets, append([]*c.VbKeyVersions(nil), vbs...))
+		return []byte{}, nil
+	})
+	conn := &testEndpointConn{newTestConnection()}
+
+	// 10MB of mutations in 100 vbuckets.
+	key := make([]byte, 100*1024)
+	b := newEndpointBuffers("localhost:8888")
+	b.maxPacketSize = 1024 * 1024
+	for vbno := uint16(0); vbno < 100; vbno++ {
+		kv := c.NewKeyVersions(1, []byte("Bourne"), 1)
+		kv.AddUpsert(1, key, nil)
+		b.addKeyVersions("default", 0, vbno, 10, kv)
+	}
+	vbSize := b.BufferedBytes() / 100
+	perPacket := b.maxPacketSize / vbSize
+
+	if err := b.flushBuffers(conn, pkt); err != nil {
+		t.Fatal(err)
+	}
+	if ref := (100 + perPacket - 1) / perPacket; len(packets) != ref {
+		t.Fatalf("expected %v packets, got %v", ref, len(packets))
+	}
+	sent := make(map[uint16]bool)
+	for _, vbs := range packets {
+		size := 0
+		for _, vb := range vbs {
+			size += vb.EstimatedSize()
+			sent[vb.Vbucket] = true
+		}
+		if size > b.maxPacketSize {
+			t.Fatalf("expected packet of at most %v bytes, got %v", b.maxPacketSize, size)
+		}
+	}
+	if len(sent) != 100 {
+		t.Fatalf("expected all vbuckets to be sent, got %v", len(sent))
+	}
+
+	// vbucket larger than the limit is sent by itself.
+	if packets := splitPackets(packets[0], vbSize/2); len(packets) != perPacket {
+		t.Fatalf("expected %v packets, got %v", perPacket, len(packets))
+	}
+	if packets := splitPackets(packets[0], 0); len(packets) != 1 {
+		t.Fatalf("expected a single packet without limit, got %v", len(packets))
+	}
+}
+
+func TestEndpointBuffersConcurrentFlush(t *testing.T) {
+	sent := 0
+	flags := transport.TransportFlag(0).SetProtobuf()
+	pkt := transport.NewTransportPacket(1000*1024, flags)
+	pkt.SetEncoder(transport.EncodingProtobuf, func(payload interface{}) ([]byte, error) {
+		for _, vb := range payload.([]*c.VbKeyVersions) {
+			sent += len(vb.Kvs)
+		}
+		return []byte{}, nil
+	})
+	conn := &testEndpointConn{newTestConnection()}
+
+	// mutations added during a flush are retained for the next flush.
+	b := newEndpointBuffers("localhost:8888")
+	n := 10000
+	donech := make(chan bool)
+	go func() {
+		for seqno := 1; seqno <= n; seqno++ {
+			kv := c.NewKeyVersions(uint64(seqno), []byte("Bourne"), 1)
+			kv.AddUpsert(1, []byte("bangalore"), nil)
+			b.addKeyVersions("default", 0, uint16(seqno%4), 10, kv)
+		}
+		close(donech)
+	}()
+	for done := false; !done; {
+		select {
+		case <-donech:
+			done = true
+		default:
+		}
+		conn.reset()
+		if err := b.flushBuffers(conn, pkt); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if sent != n || b.NumMutations() != 0 {
+		t.Fatalf("expected %v mutations to be sent, got %v", n, sent)
+	}
+}
+
+func BenchmarkEndpointBuffers_Alloc(b *testing.B) {
+	flags := transport.TransportFlag(0).SetProtobuf()
+	pkt := transport.NewTransportPacket(1000*1024, flags)
+	pkt.SetEncoder(transport.EncodingProtobuf, protobufEncode)
+	conn := &testEndpointConn{newTestConnection()}
+
+	kvs := make([]*c.KeyVersions, 64)
+	for vbno := range kvs {
+		kvs[vbno] = c.NewKeyVersions(1, []byte("Bourne"), 1)
+		kvs[vbno].AddUpsert(1, []byte("bangalore"), nil)
+	}
+
+	buffers := newEndpointBuffers("localhost:8888")
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		for vbno, kv := range kvs {
+			buffers.addKeyVersions("default", 0, uint16(vbno), 10, kv)
+		}
+		conn.reset()
+		if err := buffers.flushBuffers(conn, pkt); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+// testEndpointConn wraps testConnection to implement net.Conn.
+type testEndpointConn struct {
+	*testConnection
+}
+
+func (tc *testEndpointConn) Close() error {
+	return nil
+}
+
+func (tc *testEndpointConn) SetDeadline(t time.Time) error {
+	return nil
+}
+
+func (tc *testEndpointConn) SetReadDeadline(t time.Time) error {
+	return nil
+}
+
+func (tc *testEndpointConn) SetWriteDeadline(t time.Time) error {
+	return nil
+}
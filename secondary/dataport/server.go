@@ -83,6 +83,12 @@ var ErrorDuplicateClient = errors.New("dataport.duplicateClient")
 // ErrorWorkerKilled
 var ErrorWorkerKilled = errors.New("dataport.workerKilled")
 
+// ErrorSeqnoRegression
+var ErrorSeqnoRegression = errors.New("dataport.seqnoRegression")
+
+// ErrorSeqnoGap
+var ErrorSeqnoGap = errors.New("dataport.seqnoGap")
+
 type activeVb struct {
 	raddr  string // remote connection carrying this vbucket.
 	bucket string
@@ -138,7 +144,13 @@ type Server struct {
 	genChSize    int           // channel size for genServer routine
 	maxPayload   int           // maximum payload length from router
 	readDeadline time.Duration // timeout, in millisecond, reading from socket
+	gapDetection bool          // detect seqno going backward or jumping
+	gapThreshold uint64
 	logPrefix    string
+
+	// statistics
+	seqnoGaps        uint64
+	seqnoRegressions uint64
 }
 
 // NewServer creates a new dataport daemon.
@@ -162,6 +174,8 @@ func NewServer(
 		genChSize:    genChSize,
 		maxPayload:   config["maxPayload"].Int(),
 		readDeadline: time.Duration(config["tcpReadDeadline"].Int()),
+		gapDetection: config["gapDetection"].Bool(),
+		gapThreshold: uint64(config["gapThreshold"].Int()),
 	}
 	s.logPrefix = fmt.Sprintf("DATP[->dataport %q]", laddr)
 	if s.lis, err = net.Listen("tcp", laddr); err != nil {
@@ -230,7 +244,8 @@ func (s *Server) genServer(reqch chan []interface{}) {
 	}()
 
 	hostUuids := make(keeper) // id() -> activeVb
-	parseVbs := func(msg serverMessage) []*protobuf.VbKeyVersions {
+	parseVbs := func(msg serverMessage) ([]*protobuf.VbKeyVersions, []SeqnoError) {
+		var seqnoErrs []SeqnoError
 		vbs := msg.args[0].([]*protobuf.VbKeyVersions)
 		prune_off := 0
 		for i := 0; i < len(vbs); i++ { //for each vbucket
@@ -247,7 +262,7 @@ func (s *Server) genServer(reqch chan []interface{}) {
 				logging.Warnf(fmsg, s.logPrefix, len(kvs), id)
 				continue
 			}
-			vbok := false
+			vbok, seqnoErr := false, false
 			for _, kv := range kvs {
 				if len(kv.GetCommands()) == 0 {
 					continue
@@ -269,7 +284,17 @@ func (s *Server) genServer(reqch chan []interface{}) {
 					}
 				case c.Upsert, c.Deletion, c.UpsertDeletion:
 					if avbok && avb != nil {
-						avb.seqno = kv.GetSeqno()
+						seqno := kv.GetSeqno()
+						if err, ok := s.checkSeqno(avb, seqno); ok {
+							if !seqnoErr { // one per vbucket per batch
+								seqnoErrs = append(seqnoErrs, err)
+								seqnoErr = true
+							}
+							if err.Err == ErrorSeqnoRegression {
+								seqno = avb.seqno // retain the latest seqno
+							}
+						}
+						avb.seqno = seqno
 						avb.kvers++
 					}
 				}
@@ -285,7 +310,7 @@ func (s *Server) genServer(reqch chan []interface{}) {
 			logging.Tracef("%v {%v, %v}\n", s.logPrefix, bucket, vbno)
 		}
 		vbs = vbs[:prune_off]
-		return vbs
+		return vbs, seqnoErrs
 	}
 
 loop:
@@ -323,7 +348,11 @@ loop:
 				s.startWorker(msg.raddr)
 
 			case serverCmdVbKeyVersions:
-				s.appch <- parseVbs(msg)
+				vbs, seqnoErrs := parseVbs(msg)
+				s.appch <- vbs
+				for _, err := range seqnoErrs {
+					s.appch <- err
+				}
 
 			case serverCmdClose: // This execution path never panics !!
 				// before closing the dataport-server log a consolidated
@@ -347,6 +376,30 @@ loop:
 	}
 }
 
+// checkSeqno of a mutation received for `avb`, if gapDetection is
+// enabled, return error if seqno goes backward or jumps beyond
+// gapThreshold from the last mutation.
+func (s *Server) checkSeqno(avb *activeVb, seqno uint64) (SeqnoError, bool) {
+	if !s.gapDetection || avb.kvers == 0 { // first mutation of vbucket
+		return SeqnoError{}, false
+	}
+
+	err := SeqnoError{
+		Bucket: avb.bucket, Vbno: avb.vbno, Last: avb.seqno, Seqno: seqno,
+	}
+	if seqno <= avb.seqno {
+		s.seqnoRegressions++
+		err.Err = ErrorSeqnoRegression
+	} else if seqno > avb.seqno+1+s.gapThreshold {
+		s.seqnoGaps++
+		err.Err = ErrorSeqnoGap
+	} else {
+		return SeqnoError{}, false
+	}
+	logging.Errorf("%v %v\n", s.logPrefix, err)
+	return err, true
+}
+
 // shutdown this gen server and all its routines.
 func (s *Server) handleClose() {
 	defer func() {
@@ -435,6 +488,11 @@ func (s *Server) jumboErrorHandler(
 }
 
 func (s *Server) logStats(hostUuids keeper) {
+	if s.gapDetection {
+		fmsg := "%v seqno gaps: %v, seqno regressions: %v\n"
+		logging.Infof(fmsg, s.logPrefix, s.seqnoGaps, s.seqnoRegressions)
+	}
+
 	bucketkvs := make(map[string][]uint64)    // bucket -> []count
 	bucketseqnos := make(map[string][]uint64) // bucket -> []seqno
 	for _, avb := range hostUuids {
@@ -630,6 +688,21 @@ func (ce ConnectionError) Append(hostUuids keeper, raddr string) keeper {
 	return finished
 }
 
+// SeqnoError to application, when a mutation's seqno goes backward or
+// jumps for a vbucket, refer indexer.dataport.gapDetection.
+type SeqnoError struct {
+	Bucket string
+	Vbno   uint16
+	Last   uint64 // seqno of the last mutation received for vbucket
+	Seqno  uint64
+	Err    error // ErrorSeqnoRegression or ErrorSeqnoGap
+}
+
+func (se SeqnoError) Error() string {
+	fmsg := "%v for {%v, %v}, seqno %v after %v"
+	return fmt.Sprintf(fmsg, se.Err, se.Bucket, se.Vbno, se.Seqno, se.Last)
+}
+
 func newTransportPkt(maxPayload int) *transport.TransportPacket {
 	flags := transport.TransportFlag(0).SetProtobuf()
 	pkt := transport.NewTransportPacket(maxPayload, flags)
@@ -258,6 +258,39 @@ func BenchmarkLoopback(b *testing.B) {
 	daemon.Close()
 }
 
+func TestCheckSeqno(t *testing.T) {
+	logging.SetLogLevel(logging.Silent)
+
+	s := &Server{gapThreshold: 10}
+	avb := &activeVb{bucket: "default", vbno: 1}
+	avb.seqno, avb.kvers = 100, 1
+	if _, ok := s.checkSeqno(avb, 50); ok {
+		t.Fatalf("unexpected seqno error with gap detection disabled")
+	}
+
+	s.gapDetection = true
+	if _, ok := (&Server{gapDetection: true}).checkSeqno(&activeVb{}, 50); ok {
+		t.Fatalf("unexpected seqno error for first mutation")
+	}
+	if _, ok := s.checkSeqno(avb, 101); ok {
+		t.Fatalf("unexpected seqno error for next seqno")
+	}
+	if _, ok := s.checkSeqno(avb, 111); ok {
+		t.Fatalf("unexpected seqno error for jump within threshold")
+	}
+	if err, ok := s.checkSeqno(avb, 100); !ok || err.Err != ErrorSeqnoRegression {
+		t.Fatalf("expected %v for duplicate seqno, got %v", ErrorSeqnoRegression, err)
+	}
+	if err, ok := s.checkSeqno(avb, 112); !ok || err.Err != ErrorSeqnoGap {
+		t.Fatalf("expected %v for jump beyond threshold, got %v", ErrorSeqnoGap, err)
+	} else if err.Bucket != "default" || err.Vbno != 1 || err.Last != 100 || err.Seqno != 112 {
+		t.Fatalf("unexpected seqno error %+v", err)
+	}
+	if s.seqnoRegressions != 1 || s.seqnoGaps != 1 {
+		t.Fatalf("unexpected stats %v regressions, %v gaps", s.seqnoRegressions, s.seqnoGaps)
+	}
+}
+
 func makeVbmaps(maxvbuckets int, maxBuckets int) []*c.VbConnectionMap {
 	vbmaps := make([]*c.VbConnectionMap, 0, maxBuckets)
 	for i := 0; i < maxBuckets; i++ {
@@ -2,6 +2,7 @@ package couchbase
 
 import (
 	"errors"
+	"sync"
 	"time"
 
 	"github.com/couchbase/indexing/secondary/dcp/transport/client"
@@ -10,6 +11,14 @@ import (
 var errClosedPool = errors.New("the pool is closed")
 var errNoPool = errors.New("no pool")
 
+// ErrPoolExhausted is returned by Get when no connection becomes available
+// within the pool's acquire timeout.
+var ErrPoolExhausted = errors.New("timeout acquiring connection, pool and overflow exhausted")
+
+// ErrConnectionLimit is returned by Get when a new connection cannot be
+// created because TotalConnectionLimit connections are already open.
+var ErrConnectionLimit = errors.New("total connection limit reached")
+
 // GenericMcdAuthHandler is a kind of AuthHandler that performs
 // special auth exchange (like non-standard auth, possibly followed by
 // select-bucket).
@@ -26,21 +35,56 @@ var ConnPoolTimeout = time.Hour * 24 * 30
 // one.
 var ConnPoolAvailWaitTime = time.Millisecond
 
+// TotalConnectionLimit is the maximum number of connections that can be
+// open across all connection pools in this process, including the ones
+// handed to TAP and DCP feeds.
+var TotalConnectionLimit = 4096
+
+// semaphore counting connections open across all connection pools.
+var totalConns struct {
+	sync.Mutex
+	count int
+}
+
+// acquire a slot from TotalConnectionLimit, return false if exhausted.
+func acquireTotalConn() bool {
+	totalConns.Lock()
+	defer totalConns.Unlock()
+	if totalConns.count >= TotalConnectionLimit {
+		return false
+	}
+	totalConns.count++
+	return true
+}
+
+// release a slot acquired by acquireTotalConn().
+func releaseTotalConn() {
+	totalConns.Lock()
+	defer totalConns.Unlock()
+	if totalConns.count > 0 {
+		totalConns.count--
+	}
+}
+
 type connectionPool struct {
-	host        string
-	mkConn      func(host string, ah AuthHandler) (*memcached.Client, error)
-	auth        AuthHandler
-	connections chan *memcached.Client
-	createsem   chan bool
+	host           string
+	mkConn         func(host string, ah AuthHandler) (*memcached.Client, error)
+	auth           AuthHandler
+	connections    chan *memcached.Client
+	createsem      chan bool
+	acquireTimeout time.Duration
 }
 
-func newConnectionPool(host string, ah AuthHandler, poolSize, poolOverflow int) *connectionPool {
+func newConnectionPool(host string, ah AuthHandler, poolSize, poolOverflow int,
+	acquireTimeout time.Duration) *connectionPool {
+
 	return &connectionPool{
-		host:        host,
-		connections: make(chan *memcached.Client, poolSize),
-		createsem:   make(chan bool, poolSize+poolOverflow),
-		mkConn:      defaultMkConn,
-		auth:        ah,
+		host:           host,
+		connections:    make(chan *memcached.Client, poolSize),
+		createsem:      make(chan bool, poolSize+poolOverflow),
+		mkConn:         defaultMkConn,
+		auth:           ah,
+		acquireTimeout: acquireTimeout,
 	}
 }
 
@@ -77,6 +121,7 @@ func (cp *connectionPool) Close() (err error) {
 	close(cp.connections)
 	for c := range cp.connections {
 		c.Close()
+		releaseTotalConn()
 	}
 	return
 }
@@ -133,10 +178,15 @@ func (cp *connectionPool) GetWithTimeout(d time.Duration) (rv *memcached.Client,
 			// Build a connection if we can't get a real one.
 			// This can potentially be an overflow connection, or
 			// a pooled connection.
+			if !acquireTotalConn() {
+				<-cp.createsem
+				return nil, ErrConnectionLimit
+			}
 			rv, err := cp.mkConn(cp.host, cp.auth)
 			if err != nil {
 				// On error, release our create hold
 				<-cp.createsem
+				releaseTotalConn()
 			}
 			return rv, err
 		case <-t.C:
@@ -145,8 +195,21 @@ func (cp *connectionPool) GetWithTimeout(d time.Duration) (rv *memcached.Client,
 	}
 }
 
+// Get a connection from the pool, waiting for at most the pool's acquire
+// timeout. Return ErrPoolExhausted if no connection became available.
+// A pool without acquire timeout waits for ConnPoolTimeout.
 func (cp *connectionPool) Get() (*memcached.Client, error) {
-	return cp.GetWithTimeout(ConnPoolTimeout)
+	if cp == nil {
+		return nil, errNoPool
+	}
+	if cp.acquireTimeout <= 0 {
+		return cp.GetWithTimeout(ConnPoolTimeout)
+	}
+	rv, err := cp.GetWithTimeout(cp.acquireTimeout)
+	if err == ErrTimeout {
+		return nil, ErrPoolExhausted
+	}
+	return rv, err
 }
 
 func (cp *connectionPool) Return(c *memcached.Client) {
@@ -166,6 +229,7 @@ func (cp *connectionPool) Return(c *memcached.Client) {
 				// connection to it anyway.  Just close the
 				// connection.
 				c.Close()
+				releaseTotalConn()
 			}
 		}()
 
@@ -175,10 +239,12 @@ func (cp *connectionPool) Return(c *memcached.Client) {
 			// Overflow connection.
 			<-cp.createsem
 			c.Close()
+			releaseTotalConn()
 		}
 	} else {
 		<-cp.createsem
 		c.Close()
+		releaseTotalConn()
 	}
 }
 
@@ -192,10 +258,17 @@ func (cp *connectionPool) StartTapFeed(args *memcached.TapArguments) (*memcached
 	}
 
 	// A connection can't be used after TAP; Dont' count it against the
-	// connection pool capacity
+	// connection pool capacity, but against TotalConnectionLimit until
+	// the feed closes the connection.
 	<-cp.createsem
+	mc.OnClose(releaseTotalConn)
 
-	return mc.StartTapFeed(*args)
+	tf, err := mc.StartTapFeed(*args)
+	if err != nil {
+		mc.Close()
+		return nil, err
+	}
+	return tf, nil
 }
 
 const DEFAULT_WINDOW_SIZE = uint32(20 * 1024 * 1024) // 20 Mb
@@ -215,8 +288,10 @@ func (cp *connectionPool) StartDcpFeed(
 		return nil, err
 	}
 	// A connection can't be used after it has been allocated to DCP;
-	// Dont' count it against the connection pool capacity
+	// Dont' count it against the connection pool capacity, but against
+	// TotalConnectionLimit until the feed closes the connection.
 	<-cp.createsem
+	mc.OnClose(releaseTotalConn)
 
 	dcpf, err := memcached.NewDcpFeed(mc, name, outch, opaque, config)
 	if err == nil {
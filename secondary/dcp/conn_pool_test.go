@@ -37,7 +37,7 @@ func testMkConn(h string, ah AuthHandler) (*memcached.Client, error) {
 }
 
 func TestConnPool(t *testing.T) {
-	cp := newConnectionPool("h", &basicAuth{}, 3, 6)
+	cp := newConnectionPool("h", &basicAuth{}, 3, 6, ConnPoolTimeout)
 	cp.mkConn = testMkConn
 
 	seenClients := map[*memcached.Client]bool{}
@@ -129,7 +129,7 @@ func TestConnPoolSoonAvailable(t *testing.T) {
 		timings = append(timings, time.Since(start))
 	}
 
-	cp := newConnectionPool("h", &basicAuth{}, 3, 4)
+	cp := newConnectionPool("h", &basicAuth{}, 3, 4, ConnPoolTimeout)
 	cp.mkConn = testMkConn
 
 	seenClients := map[*memcached.Client]bool{}
@@ -170,7 +170,7 @@ func TestConnPoolSoonAvailable(t *testing.T) {
 }
 
 func TestConnPoolClosedFull(t *testing.T) {
-	cp := newConnectionPool("h", &basicAuth{}, 3, 4)
+	cp := newConnectionPool("h", &basicAuth{}, 3, 4, ConnPoolTimeout)
 	cp.mkConn = testMkConn
 
 	seenClients := map[*memcached.Client]bool{}
@@ -197,7 +197,7 @@ func TestConnPoolClosedFull(t *testing.T) {
 }
 
 func TestConnPoolWaitFull(t *testing.T) {
-	cp := newConnectionPool("h", &basicAuth{}, 3, 4)
+	cp := newConnectionPool("h", &basicAuth{}, 3, 4, ConnPoolTimeout)
 	cp.mkConn = testMkConn
 
 	seenClients := map[*memcached.Client]bool{}
@@ -226,7 +226,7 @@ func TestConnPoolWaitFull(t *testing.T) {
 }
 
 func TestConnPoolWaitFailFull(t *testing.T) {
-	cp := newConnectionPool("h", &basicAuth{}, 3, 4)
+	cp := newConnectionPool("h", &basicAuth{}, 3, 4, ConnPoolTimeout)
 	cp.mkConn = testMkConn
 
 	seenClients := map[*memcached.Client]bool{}
@@ -257,7 +257,7 @@ func TestConnPoolWaitFailFull(t *testing.T) {
 }
 
 func TestConnPoolWaitDoubleFailFull(t *testing.T) {
-	cp := newConnectionPool("h", &basicAuth{}, 3, 4)
+	cp := newConnectionPool("h", &basicAuth{}, 3, 4, ConnPoolTimeout)
 	cp.mkConn = testMkConn
 
 	seenClients := map[*memcached.Client]bool{}
@@ -303,7 +303,7 @@ func TestConnPoolNil(t *testing.T) {
 }
 
 func TestConnPoolClosed(t *testing.T) {
-	cp := newConnectionPool("h", &basicAuth{}, 3, 6)
+	cp := newConnectionPool("h", &basicAuth{}, 3, 6, ConnPoolTimeout)
 	cp.mkConn = testMkConn
 	c, err := cp.Get()
 	if err != nil {
@@ -324,7 +324,7 @@ func TestConnPoolClosed(t *testing.T) {
 }
 
 func TestConnPoolCloseWrongPool(t *testing.T) {
-	cp := newConnectionPool("h", &basicAuth{}, 3, 6)
+	cp := newConnectionPool("h", &basicAuth{}, 3, 6, ConnPoolTimeout)
 	cp.mkConn = testMkConn
 	c, err := cp.Get()
 	if err != nil {
@@ -333,7 +333,7 @@ func TestConnPoolCloseWrongPool(t *testing.T) {
 	cp.Close()
 
 	// Return to a different pool.  Should still be OK.
-	cp = newConnectionPool("h", &basicAuth{}, 3, 6)
+	cp = newConnectionPool("h", &basicAuth{}, 3, 6, ConnPoolTimeout)
 	cp.mkConn = testMkConn
 	c, err = cp.Get()
 	if err != nil {
@@ -348,7 +348,7 @@ func TestConnPoolCloseWrongPool(t *testing.T) {
 }
 
 func TestConnPoolCloseNil(t *testing.T) {
-	cp := newConnectionPool("h", &basicAuth{}, 3, 6)
+	cp := newConnectionPool("h", &basicAuth{}, 3, 6, ConnPoolTimeout)
 	cp.mkConn = testMkConn
 	c, err := cp.Get()
 	if err != nil {
@@ -371,7 +371,7 @@ func TestConnPoolStartTapFeed(t *testing.T) {
 		t.Errorf("Expected no pool error with no pool, got %v/%v", tf, err)
 	}
 
-	cp = newConnectionPool("h", &basicAuth{}, 3, 6)
+	cp = newConnectionPool("h", &basicAuth{}, 3, 6, ConnPoolTimeout)
 	cp.mkConn = testMkConn
 
 	tf, err = cp.StartTapFeed(&args)
@@ -386,8 +386,67 @@ func TestConnPoolStartTapFeed(t *testing.T) {
 	}
 }
 
+// testFeedConn accepts writes and blocks reads until eofch is closed.
+type testFeedConn struct {
+	eofch chan bool
+}
+
+func (t *testFeedConn) Read([]byte) (int, error) {
+	<-t.eofch
+	return 0, io.EOF
+}
+
+func (t *testFeedConn) Write(b []byte) (int, error) {
+	return len(b), nil
+}
+
+func (t *testFeedConn) Close() error {
+	return nil
+}
+
+func TestConnPoolStartTapFeedTotalConnection(t *testing.T) {
+	count := func() int {
+		totalConns.Lock()
+		defer totalConns.Unlock()
+		return totalConns.count
+	}
+
+	conn := &testFeedConn{eofch: make(chan bool)}
+	cp := newConnectionPool("h", &basicAuth{}, 3, 6, ConnPoolTimeout)
+	cp.mkConn = func(h string, ah AuthHandler) (*memcached.Client, error) {
+		return memcached.Wrap(conn)
+	}
+	defer cp.Close()
+
+	// the feed's connection is counted until the feed closes it.
+	before := count()
+	args := memcached.DefaultTapArguments()
+	tf, err := cp.StartTapFeed(&args)
+	if err != nil {
+		t.Fatalf("Error starting tap feed: %v", err)
+	}
+	if n := count(); n != before+1 {
+		t.Fatalf("Expected %v connections during the feed, got %v", before+1, n)
+	}
+	close(conn.eofch)
+	for range tf.C {
+	}
+	if n := count(); n != before {
+		t.Fatalf("Expected %v connections after the feed, got %v", before, n)
+	}
+
+	// a feed that fails to start releases its connection.
+	cp.mkConn = testMkConn
+	if _, err := cp.StartTapFeed(&args); err != io.EOF {
+		t.Fatalf("Expected to fail a tap feed with EOF, got %v", err)
+	}
+	if n := count(); n != before {
+		t.Fatalf("Expected %v connections after the failed feed, got %v", before, n)
+	}
+}
+
 func BenchmarkBestCaseCPGet(b *testing.B) {
-	cp := newConnectionPool("h", &basicAuth{}, 3, 6)
+	cp := newConnectionPool("h", &basicAuth{}, 3, 6, ConnPoolTimeout)
 	cp.mkConn = testMkConn
 
 	for i := 0; i < b.N; i++ {
@@ -398,3 +457,73 @@ func BenchmarkBestCaseCPGet(b *testing.B) {
 		cp.Return(c)
 	}
 }
+
+func TestConnPoolAcquireTimeout(t *testing.T) {
+	cp := newConnectionPool("h", &basicAuth{}, 1, 1, 10*time.Millisecond)
+	cp.mkConn = testMkConn
+
+	// exhaust the pool and its overflow
+	for i := 0; i < 2; i++ {
+		if _, err := cp.Get(); err != nil {
+			t.Fatalf("Error getting connection from pool: %v", err)
+		}
+	}
+
+	start := time.Now()
+	sc, err := cp.Get()
+	if err != ErrPoolExhausted {
+		t.Fatalf("Expected ErrPoolExhausted, got %v/%v", sc, err)
+	}
+	if d := time.Since(start); d > time.Second {
+		t.Errorf("Expected Get to fail after acquire timeout, took %v", d)
+	}
+}
+
+func TestConnPoolNoAcquireTimeout(t *testing.T) {
+	defer func(d time.Duration) { ConnPoolTimeout = d }(ConnPoolTimeout)
+	ConnPoolTimeout = 10 * time.Millisecond
+
+	cp := newConnectionPool("h", &basicAuth{}, 1, 1, 0)
+	cp.mkConn = testMkConn
+
+	for i := 0; i < 2; i++ {
+		if _, err := cp.Get(); err != nil {
+			t.Fatalf("Error getting connection from pool: %v", err)
+		}
+	}
+
+	if sc, err := cp.Get(); err != ErrTimeout {
+		t.Fatalf("Expected ErrTimeout, got %v/%v", sc, err)
+	}
+}
+
+func TestConnPoolTotalConnectionLimit(t *testing.T) {
+	defer func(limit int) { TotalConnectionLimit = limit }(TotalConnectionLimit)
+
+	totalConns.Lock()
+	TotalConnectionLimit = totalConns.count + 1
+	totalConns.Unlock()
+
+	cp := newConnectionPool("h", &basicAuth{}, 3, 6, ConnPoolTimeout)
+	cp.mkConn = testMkConn
+
+	sc, err := cp.Get()
+	if err != nil {
+		t.Fatalf("Error getting connection from pool: %v", err)
+	}
+	if _, err := cp.Get(); err != ErrConnectionLimit {
+		t.Fatalf("Expected ErrConnectionLimit, got %v", err)
+	}
+
+	cp.Return(sc)
+
+	// closing the pool should release its connections.
+	cp.Close()
+	cp = newConnectionPool("h", &basicAuth{}, 3, 6, ConnPoolTimeout)
+	cp.mkConn = testMkConn
+	if sc, err = cp.Get(); err != nil {
+		t.Fatalf("Error getting connection after release: %v", err)
+	}
+	cp.Return(sc)
+	cp.Close()
+}
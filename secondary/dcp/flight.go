@@ -0,0 +1,83 @@
+package couchbase
+
+import (
+	"context"
+	"sync"
+)
+
+// flightCall is an in-flight or completed flightGroup.Do call.
+type flightCall struct {
+	done    chan struct{}
+	val     []byte
+	err     error
+	waiters int
+	cancel  context.CancelFunc
+}
+
+// flightGroup coalesces concurrent calls for the same key into a single
+// call, whose result is shared among all the waiters.
+type flightGroup struct {
+	mu sync.Mutex
+	m  map[string]*flightCall
+}
+
+// Do calls fn for key, unless a call for key is already in-flight in
+// which case it waits for that call and returns its result. fn is
+// cancelled only after every waiter has given up on it, while a waiter
+// returns ctx.Err() as soon as its own ctx is done.
+func (g *flightGroup) Do(
+	ctx context.Context, key string,
+	fn func(ctx context.Context) ([]byte, error)) ([]byte, error) {
+
+	g.mu.Lock()
+	if g.m == nil {
+		g.m = make(map[string]*flightCall)
+	}
+	c, ok := g.m[key]
+	if ok {
+		c.waiters++
+	} else {
+		fctx, cancel := context.WithCancel(context.Background())
+		c = &flightCall{done: make(chan struct{}), waiters: 1, cancel: cancel}
+		g.m[key] = c
+		go func() {
+			c.val, c.err = fn(fctx)
+			g.forget(key, c)
+			close(c.done)
+			cancel()
+		}()
+	}
+	g.mu.Unlock()
+
+	select {
+	case <-c.done:
+		return c.val, c.err
+	case <-ctx.Done():
+		g.leave(key, c)
+		return nil, ctx.Err()
+	}
+}
+
+// leave an in-flight call, cancel it if there are no more waiters.
+func (g *flightGroup) leave(key string, c *flightCall) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	c.waiters--
+	if c.waiters == 0 {
+		c.cancel()
+		if g.m[key] == c {
+			delete(g.m, key)
+		}
+	}
+}
+
+// forget a completed call, so that later calls for key invoke fn again.
+func (g *flightGroup) forget(key string, c *flightCall) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	if g.m[key] == c {
+		delete(g.m, key)
+	}
+}
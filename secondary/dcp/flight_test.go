@@ -0,0 +1,64 @@
+package couchbase
+
+import (
+	"context"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestFlightGroupDo(t *testing.T) {
+	var g flightGroup
+	var calls int32
+	fn := func(ctx context.Context) ([]byte, error) {
+		atomic.AddInt32(&calls, 1)
+		time.Sleep(50 * time.Millisecond)
+		return []byte("ok"), nil
+	}
+
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			val, err := g.Do(context.Background(), "key", fn)
+			if err != nil || string(val) != "ok" {
+				t.Errorf("Unexpected %q/%v", val, err)
+			}
+		}()
+	}
+	wg.Wait()
+	if n := atomic.LoadInt32(&calls); n != 1 {
+		t.Errorf("Expected 1 call, got %v", n)
+	}
+
+	// completed calls are not shared.
+	if _, err := g.Do(context.Background(), "key", fn); err != nil {
+		t.Fatal(err)
+	}
+	if n := atomic.LoadInt32(&calls); n != 2 {
+		t.Errorf("Expected 2 calls, got %v", n)
+	}
+}
+
+func TestFlightGroupCancel(t *testing.T) {
+	var g flightGroup
+	cancelled := make(chan bool, 1)
+	fn := func(ctx context.Context) ([]byte, error) {
+		<-ctx.Done()
+		cancelled <- true
+		return nil, ctx.Err()
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	if _, err := g.Do(ctx, "key", fn); err != context.DeadlineExceeded {
+		t.Errorf("Expected %v, got %v", context.DeadlineExceeded, err)
+	}
+	select {
+	case <-cancelled:
+	case <-time.After(time.Second):
+		t.Errorf("Expected call to be cancelled after the last waiter left")
+	}
+}
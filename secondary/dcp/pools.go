@@ -2,6 +2,9 @@ package couchbase
 
 import (
 	"bufio"
+	"bytes"
+	"compress/gzip"
+	"context"
 	"encoding/base64"
 	"encoding/json"
 	"errors"
@@ -16,7 +19,10 @@ import (
 	"net/url"
 	"runtime"
 	"sort"
+	"strconv"
 	"strings"
+	"sync"
+	"time"
 	"unsafe"
 )
 
@@ -25,6 +31,25 @@ var MaxIdleConnsPerHost = 256
 var HTTPTransport = &http.Transport{MaxIdleConnsPerHost: MaxIdleConnsPerHost}
 var HTTPClient = &http.Client{Transport: HTTPTransport}
 
+// SetHTTPProxy routes the REST calls of HTTPClient via proxyURL, an empty
+// proxyURL disables the proxy. Any scheme supported by http.ProxyURL, like
+// socks5, is accepted. It should be called before making REST calls.
+func SetHTTPProxy(proxyURL string) error {
+	if proxyURL == "" {
+		HTTPTransport.Proxy = nil
+		return nil
+	}
+	u, err := url.Parse(proxyURL)
+	if err != nil {
+		return fmt.Errorf("invalid proxy URL: %s", proxyURL)
+	} else if u.Scheme == "" || u.Host == "" {
+		return fmt.Errorf("missing scheme or host in proxy URL: %s", proxyURL)
+	}
+	HTTPTransport.Proxy = http.ProxyURL(u)
+	HTTPTransport.CloseIdleConnections()
+	return nil
+}
+
 // PoolSize is the size of each connection pool (per host).
 var PoolSize = 64
 
@@ -32,6 +57,26 @@ var PoolSize = 64
 // pool.
 var PoolOverflow = PoolSize
 
+// PoolAcquireTimeout is the maximum time to wait for a connection when
+// the pool and its overflow are exhausted. Zero waits for ConnPoolTimeout.
+var PoolAcquireTimeout = time.Duration(0)
+
+// BucketStatsTTL is the duration for which bucket statistics fetched
+// by GetRestStats() are cached.
+var BucketStatsTTL = 10 * time.Second
+
+// WaitForBucketInterval is the interval between polls by WaitForBucket(),
+// the first few polls back off exponentially up to this interval.
+var WaitForBucketInterval = time.Second
+
+// ErrBucketNotFound is returned by WaitForBucket() if the bucket does not
+// become available before the context is done.
+var ErrBucketNotFound = errors.New("bucket not found")
+
+// BucketListTTL is the duration for which bucket lists fetched by
+// ListBuckets() are cached.
+var BucketListTTL = 10 * time.Second
+
 // AuthHandler is a callback that gets the auth username and password
 // for the given bucket.
 type AuthHandler interface {
@@ -81,6 +126,21 @@ type Pool struct {
 	BucketURL map[string]string `json:"buckets"`
 
 	client Client
+	// guards BucketMap, shared by copies of the pool. nil for a pool
+	// that was not obtained via GetPool().
+	lock *sync.RWMutex
+}
+
+func (p *Pool) rlock() {
+	if p.lock != nil {
+		p.lock.RLock()
+	}
+}
+
+func (p *Pool) runlock() {
+	if p.lock != nil {
+		p.lock.RUnlock()
+	}
 }
 
 // VBucketServerMap is the a mapping of vbuckets to nodes.
@@ -96,6 +156,8 @@ type Bucket struct {
 	connPools        unsafe.Pointer // *[]*connectionPool
 	vBucketServerMap unsafe.Pointer // *VBucketServerMap
 	nodeList         unsafe.Pointer // *[]Node
+	stats            unsafe.Pointer // *bucketStatsCache
+	vbOwners         unsafe.Pointer // *vbOwnersCache
 
 	AuthType            string                 `json:"authType"`
 	Capabilities        []string               `json:"bucketCapabilities"`
@@ -136,13 +198,144 @@ type NodeServices struct {
 	ThisNode bool           `json:"thisNode"`
 }
 
+// HasService returns true if service `name` is running on this node.
+func (ns *NodeServices) HasService(name string) bool {
+	_, ok := ns.Services[name]
+	return ok
+}
+
+// ServicePort returns the port on which service `name` is listening,
+// second return value is false if service is not running on this node.
+func (ns *NodeServices) ServicePort(name string) (int, bool) {
+	port, ok := ns.Services[name]
+	return port, ok
+}
+
+// IsKV returns true if this node runs the data service.
+func (ns *NodeServices) IsKV() bool {
+	return ns.HasService("kv")
+}
+
+// IsIndexer returns true if this node runs the indexer service.
+func (ns *NodeServices) IsIndexer() bool {
+	return ns.HasService("indexAdmin")
+}
+
+// IsProjector returns true if this node runs the projector service.
+func (ns *NodeServices) IsProjector() bool {
+	return ns.HasService("projector")
+}
+
+// NodeForKVAddr returns the node that serves data service at kvaddr
+// (hostname:port), or nil if there is no such node.
+func (ps *PoolServices) NodeForKVAddr(kvaddr string) *NodeServices {
+	host, port, err := net.SplitHostPort(kvaddr)
+	if err != nil {
+		return nil
+	}
+
+	for i, ns := range ps.NodesExt {
+		kvport, ok := ns.ServicePort("kv")
+		if !ok || strconv.Itoa(kvport) != port {
+			continue
+		}
+		if ns.Hostname == host || (isLocalHost(ns.Hostname) && isLocalHost(host)) {
+			return &ps.NodesExt[i]
+		}
+	}
+	return nil
+}
+
+// isLocalHost returns true if host is a loopback address or one of the
+// addresses of this machine.
+func isLocalHost(host string) bool {
+	if host == "localhost" {
+		return true
+	}
+	ip := net.ParseIP(host)
+	if ip == nil {
+		return false
+	} else if ip.IsLoopback() {
+		return true
+	}
+	addrs, err := net.InterfaceAddrs()
+	if err != nil {
+		return false
+	}
+	for _, addr := range addrs {
+		if ipnet, ok := addr.(*net.IPNet); ok && ipnet.IP.Equal(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// BucketServices is a bucket along with the services running on the
+// nodes of its pool.
+type BucketServices struct {
+	*Bucket
+	Services *PoolServices
+}
+
+// NodeAddressesByService gets the (sorted) list of memcached node
+// addresses (hostname:port) whose node runs service `name`.
+func (bs *BucketServices) NodeAddressesByService(name string) []string {
+	rv := []string{}
+	for _, addr := range bs.NodeAddresses() {
+		if ns := bs.Services.NodeForKVAddr(addr); ns != nil && ns.HasService(name) {
+			rv = append(rv, addr)
+		}
+	}
+	return rv
+}
+
+// BucketStats is the per-minute statistics of a bucket as returned
+// from the bucket stats REST API.
+type BucketStats struct {
+	Op struct {
+		Samples      map[string][]float64 `json:"samples"`
+		SamplesCount int                  `json:"samplesCount"`
+		IsPersistent bool                 `json:"isPersistent"`
+		LastTStamp   float64              `json:"lastTStamp"`
+		Interval     int                  `json:"interval"`
+	} `json:"op"`
+}
+
+// Latest returns the most recent sample for stat `key`, second return
+// value is false if stat is not available.
+func (s *BucketStats) Latest(key string) (float64, bool) {
+	samples, ok := s.Op.Samples[key]
+	if !ok || len(samples) == 0 {
+		return 0, false
+	}
+	return samples[len(samples)-1], true
+}
+
+type bucketStatsCache struct {
+	stats   *BucketStats
+	fetched time.Time
+}
+
+// vbOwnersCache is the reverse index of a VBucketServerMap.
+type vbOwnersCache struct {
+	vbmap  *VBucketServerMap
+	owners []string // vbno -> kv address of the active copy, "" if none
+}
+
 // VBServerMap returns the current VBucketServerMap.
 func (b *Bucket) VBServerMap() *VBucketServerMap {
 	return (*VBucketServerMap)(platform.LoadPointer(&(b.vBucketServerMap)))
 }
 
+// GetVBmap returns a map of kv address to the list of vbuckets whose
+// active copy is hosted by the node. Vbuckets without an active owner
+// (-1, e.g. during rebalance) are skipped.
 func (b *Bucket) GetVBmap(addrs []string) (map[string][]uint16, error) {
 	vbmap := b.VBServerMap()
+	if vbmap.HashAlgorithm != "CRC" {
+		return nil, fmt.Errorf("unexpected hash algorithm %q in vbucket map", vbmap.HashAlgorithm)
+	}
+
 	servers := vbmap.ServerList
 	if addrs == nil {
 		addrs = vbmap.ServerList
@@ -153,6 +346,13 @@ func (b *Bucket) GetVBmap(addrs []string) (map[string][]uint16, error) {
 		m[addr] = make([]uint16, 0)
 	}
 	for vbno, idxs := range vbmap.VBucketMap {
+		if len(idxs) == 0 {
+			return nil, fmt.Errorf("no owner for vbucket %d in vbucket map", vbno)
+		} else if idxs[0] < 0 {
+			continue
+		} else if idxs[0] >= len(servers) {
+			return nil, fmt.Errorf("invalid owner %d for vbucket %d in vbucket map", idxs[0], vbno)
+		}
 		addr := servers[idxs[0]]
 		if _, ok := m[addr]; ok {
 			m[addr] = append(m[addr], uint16(vbno))
@@ -161,6 +361,53 @@ func (b *Bucket) GetVBmap(addrs []string) (map[string][]uint16, error) {
 	return m, nil
 }
 
+// NodeForVbucket returns the kv address of the node hosting the active
+// copy of vbucket `vbno`. Lookups are served from a reverse index, that
+// is built once for each vbucket map and rebuilt after a refresh changes
+// the map.
+func (b *Bucket) NodeForVbucket(vbno uint16) (string, error) {
+	vbmap := b.VBServerMap()
+	cache := (*vbOwnersCache)(platform.LoadPointer(&b.vbOwners))
+	if cache == nil || cache.vbmap != vbmap {
+		owners, err := vbmap.owners()
+		if err != nil {
+			return "", err
+		}
+		cache = &vbOwnersCache{vbmap: vbmap, owners: owners}
+		platform.StorePointer(&b.vbOwners, unsafe.Pointer(cache))
+	}
+
+	if int(vbno) >= len(cache.owners) {
+		return "", fmt.Errorf("invalid vbucket %d in vbucket map", vbno)
+	} else if cache.owners[vbno] == "" {
+		return "", fmt.Errorf("no active owner for vbucket %d in vbucket map", vbno)
+	}
+	return cache.owners[vbno], nil
+}
+
+// owners return the kv address of the active copy of each vbucket, ""
+// for vbuckets without an active owner.
+func (vbmap *VBucketServerMap) owners() ([]string, error) {
+	if vbmap == nil {
+		return nil, errors.New("no vbucket map")
+	} else if vbmap.HashAlgorithm != "CRC" {
+		return nil, fmt.Errorf("unexpected hash algorithm %q in vbucket map", vbmap.HashAlgorithm)
+	}
+
+	owners := make([]string, len(vbmap.VBucketMap))
+	for vbno, idxs := range vbmap.VBucketMap {
+		if len(idxs) == 0 {
+			return nil, fmt.Errorf("no owner for vbucket %d in vbucket map", vbno)
+		} else if idxs[0] < 0 {
+			continue
+		} else if idxs[0] >= len(vbmap.ServerList) {
+			return nil, fmt.Errorf("invalid owner %d for vbucket %d in vbucket map", idxs[0], vbno)
+		}
+		owners[vbno] = vbmap.ServerList[idxs[0]]
+	}
+	return owners, nil
+}
+
 // Nodes returns teh current list of nodes servicing this bucket.
 func (b Bucket) Nodes() []Node {
 	return *(*[]Node)(platform.LoadPointer(&b.nodeList))
@@ -249,6 +496,17 @@ func maybeAddAuth(req *http.Request, ah AuthHandler) {
 }
 
 func queryRestAPI(
+	baseURL *url.URL,
+	path string,
+	authHandler AuthHandler,
+	out interface{}) error {
+	return queryRestAPIWithContext(context.Background(), baseURL, path, authHandler, out)
+}
+
+// queryRestAPIWithContext is same as queryRestAPI, except that the
+// request is cancelled when ctx is done.
+func queryRestAPIWithContext(
+	ctx context.Context,
 	baseURL *url.URL,
 	path string,
 	authHandler AuthHandler,
@@ -261,29 +519,78 @@ func queryRestAPI(
 	} else {
 		u.Path = path
 	}
+	// keep escaped path segments, like bucket names, as they are.
+	if p, err := url.PathUnescape(u.Path); err == nil && p != u.Path {
+		u.Path, u.RawPath = p, u.Path
+	}
 
-	req, err := http.NewRequest("GET", u.String(), nil)
+	// concurrent requests for the same URL and credentials share a
+	// single REST call.
+	key := u.String()
+	if authHandler != nil {
+		user, pass := authHandler.GetCredentials()
+		key = user + ":" + pass + "@" + key
+	}
+	data, err := restGroup.Do(ctx, key, func(ctx context.Context) ([]byte, error) {
+		return getRestAPI(ctx, u.String(), authHandler)
+	})
 	if err != nil {
 		return err
 	}
+	return json.NewDecoder(bytes.NewReader(data)).Decode(&out)
+}
+
+// restGroup coalesces concurrent REST calls, refer queryRestAPIWithContext.
+var restGroup flightGroup
+
+// getRestAPI returns the body of the successful response from GET url.
+// The response is requested gzip compressed, and decompressed here, so
+// that it does not depend on the compression setting of HTTPTransport.
+func getRestAPI(ctx context.Context, url string, authHandler AuthHandler) ([]byte, error) {
+	req, err := http.NewRequestWithContext(ctx, "GET", url, nil)
+	if err != nil {
+		return nil, err
+	}
 	maybeAddAuth(req, authHandler)
+	req.Header.Set("Accept-Encoding", "gzip")
 
 	res, err := HTTPClient.Do(req)
 	if err != nil {
-		return err
+		return nil, err
 	}
 	defer res.Body.Close()
+
+	body := io.Reader(res.Body)
+	if res.Header.Get("Content-Encoding") == "gzip" {
+		gz, err := gzip.NewReader(res.Body)
+		if err != nil {
+			return nil, err
+		}
+		defer gz.Close()
+		body = gz
+	}
 	if res.StatusCode != 200 {
-		bod, _ := ioutil.ReadAll(io.LimitReader(res.Body, 512))
-		return fmt.Errorf("HTTP error %v getting %q: %s",
-			res.Status, u.String(), bod)
+		bod, _ := ioutil.ReadAll(io.LimitReader(body, 512))
+		msg := fmt.Sprintf("HTTP error %v getting %q: %s", res.Status, url, bod)
+		return nil, &httpError{statusCode: res.StatusCode, msg: msg}
 	}
+	return ioutil.ReadAll(body)
+}
 
-	d := json.NewDecoder(res.Body)
-	if err = d.Decode(&out); err != nil {
-		return err
-	}
-	return nil
+// httpError is returned by getRestAPI() for a response other than 200.
+type httpError struct {
+	statusCode int
+	msg        string
+}
+
+func (e *httpError) Error() string {
+	return e.msg
+}
+
+// isNotFound returns true if err is a 404 response from the cluster.
+func isNotFound(err error) bool {
+	var herr *httpError
+	return errors.As(err, &herr) && herr.statusCode == http.StatusNotFound
 }
 
 // Pool streaming API based observe-callback wrapper
@@ -312,6 +619,19 @@ func (c *Client) RunObserveNodeServices(pool string, callb func(interface{}) err
 	return c.runObserveStreamingEndpoint(path, decoder, callb, cancel)
 }
 
+// Bucket streaming API based observe-callback wrapper
+func (c *Client) RunObserveBucket(pool, bucket string, callb func(interface{}) error, cancel chan bool) error {
+
+	path := "/pools/" + pool + "/bucketsStreaming/" + bucket
+	decoder := func(bs []byte) (interface{}, error) {
+		var b Bucket
+		err := json.Unmarshal(bs, &b)
+		return &b, err
+	}
+
+	return c.runObserveStreamingEndpoint(path, decoder, callb, cancel)
+}
+
 // Helper for observing and calling back streaming endpoint
 func (c *Client) runObserveStreamingEndpoint(path string,
 	decoder func([]byte) (interface{}, error),
@@ -383,6 +703,10 @@ func (c *Client) parseURLResponse(path string, out interface{}) error {
 	return queryRestAPI(c.BaseURL, path, c.ah, out)
 }
 
+func (c *Client) parseURLResponseWithContext(ctx context.Context, path string, out interface{}) error {
+	return queryRestAPIWithContext(ctx, c.BaseURL, path, c.ah, out)
+}
+
 func (b *Bucket) parseURLResponse(path string, out interface{}) error {
 	nodes := b.Nodes()
 	if len(nodes) == 0 {
@@ -435,13 +759,7 @@ func basicAuthFromURL(us string) (ah AuthHandler) {
 // ConnectWithAuth connects to a couchbase cluster with the given
 // authentication handler.
 func ConnectWithAuth(baseU string, ah AuthHandler) (c Client, err error) {
-	c.BaseURL, err = ParseURL(baseU)
-	if err != nil {
-		return
-	}
-	c.ah = ah
-
-	return c, c.parseURLResponse("/pools", &c.Info)
+	return connectWithContext(context.Background(), baseU, ah)
 }
 
 // Connect to a couchbase cluster.  An authentication handler will be
@@ -450,10 +768,31 @@ func Connect(baseU string) (Client, error) {
 	return ConnectWithAuth(baseU, basicAuthFromURL(baseU))
 }
 
+// ConnectWithContext is same as Connect, except that the request to the
+// cluster is cancelled when ctx is done.
+func ConnectWithContext(ctx context.Context, baseU string) (Client, error) {
+	return connectWithContext(ctx, baseU, basicAuthFromURL(baseU))
+}
+
+func connectWithContext(
+	ctx context.Context, baseU string, ah AuthHandler) (c Client, err error) {
+
+	c.BaseURL, err = ParseURL(baseU)
+	if err != nil {
+		return
+	}
+	c.ah = ah
+
+	return c, c.parseURLResponseWithContext(ctx, "/pools", &c.Info)
+}
+
 //Get SASL buckets
 type BucketInfo struct {
-	Name     string // name of bucket
-	Password string // SASL password of bucket
+	Name        string // name of bucket
+	Password    string // SASL password of bucket
+	UUID        string // uuid of bucket
+	Type        string // type of bucket, e.g. "membase"
+	NumReplicas int    // number of replicas
 }
 
 func GetBucketList(baseU string) (bInfo []BucketInfo, err error) {
@@ -478,10 +817,81 @@ func GetBucketList(baseU string) (bInfo []BucketInfo, err error) {
 	return bInfo, err
 }
 
+// bucket lists cached by ListBuckets(), keyed by credentials and URL. The
+// expired entries are evicted when a bucket list is added.
+var bucketListCache struct {
+	mu      sync.Mutex
+	entries map[string]*bucketListEntry
+}
+
+type bucketListEntry struct {
+	buckets []BucketInfo
+	fetched time.Time
+}
+
+// ListBuckets returns the topology metadata of buckets in pool, without
+// refreshing the pool. Unlike GetBucketList, bucket passwords are not
+// fetched. The list is cached for BucketListTTL.
+func (c *Client) ListBuckets(pool string) ([]BucketInfo, error) {
+	return c.ListBucketsWithContext(context.Background(), pool)
+}
+
+// ListBucketsWithContext is ListBuckets, the request to the cluster is
+// cancelled once ctx is done.
+func (c *Client) ListBucketsWithContext(ctx context.Context, pool string) ([]BucketInfo, error) {
+	path := "/pools/" + pool + "/buckets?basic_stats=false"
+	key := c.BaseURL.String() + path
+	if c.ah != nil {
+		user, pass := c.ah.GetCredentials()
+		key = user + ":" + pass + "@" + key
+	}
+
+	bucketListCache.mu.Lock()
+	entry, ok := bucketListCache.entries[key]
+	bucketListCache.mu.Unlock()
+	if ok && time.Since(entry.fetched) < BucketListTTL {
+		return append([]BucketInfo(nil), entry.buckets...), nil
+	}
+
+	var buckets []Bucket
+	if err := c.parseURLResponseWithContext(ctx, path, &buckets); err != nil {
+		return nil, err
+	}
+	bInfo := make([]BucketInfo, 0, len(buckets))
+	for _, bucket := range buckets {
+		bInfo = append(bInfo, BucketInfo{
+			Name:        bucket.Name,
+			UUID:        bucket.UUID,
+			Type:        bucket.Type,
+			NumReplicas: bucket.Replicas,
+		})
+	}
+
+	bucketListCache.mu.Lock()
+	if bucketListCache.entries == nil {
+		bucketListCache.entries = make(map[string]*bucketListEntry)
+	}
+	for k, entry := range bucketListCache.entries {
+		if time.Since(entry.fetched) >= BucketListTTL {
+			delete(bucketListCache.entries, k)
+		}
+	}
+	bucketListCache.entries[key] = &bucketListEntry{buckets: bInfo, fetched: time.Now()}
+	bucketListCache.mu.Unlock()
+
+	return append([]BucketInfo(nil), bInfo...), nil
+}
+
 func (b *Bucket) Refresh() error {
+	return b.RefreshWithContext(context.Background())
+}
+
+// RefreshWithContext refreshes the bucket's metadata from the cluster,
+// the REST call is aborted when ctx is done.
+func (b *Bucket) RefreshWithContext(ctx context.Context) error {
 	pool := b.pool
 	tmpb := &Bucket{}
-	err := pool.client.parseURLResponse(b.URI, tmpb)
+	err := pool.client.parseURLResponseWithContext(ctx, b.URI, tmpb)
 	if err != nil {
 		return err
 	}
@@ -490,6 +900,46 @@ func (b *Bucket) Refresh() error {
 	return nil
 }
 
+// GetRestStats returns the latest value for each of the stats in
+// `statKeys` using the bucket stats REST API, unlike GetStats() this does
+// not require a connection to KV nodes. Stats that are not available for
+// the bucket are skipped. Statistics are cached for BucketStatsTTL.
+func (b *Bucket) GetRestStats(statKeys []string) (map[string]float64, error) {
+	var stats *BucketStats
+
+	cache := (*bucketStatsCache)(platform.LoadPointer(&b.stats))
+	if cache != nil && time.Since(cache.fetched) < BucketStatsTTL {
+		stats = cache.stats
+	} else {
+		stats = &BucketStats{}
+		path := b.bucketsPath() + "/" + url.PathEscape(b.Name) + "/stats?zoom=minute"
+		if err := b.pool.client.parseURLResponse(path, stats); err != nil {
+			return nil, err
+		}
+		cache = &bucketStatsCache{stats: stats, fetched: time.Now()}
+		platform.StorePointer(&b.stats, unsafe.Pointer(cache))
+	}
+
+	m := make(map[string]float64)
+	for _, key := range statKeys {
+		if val, ok := stats.Latest(key); ok {
+			m[key] = val
+		}
+	}
+	return m, nil
+}
+
+// bucketsPath returns the path of the buckets REST API of the bucket's
+// pool, without query.
+func (b *Bucket) bucketsPath() string {
+	if b.pool != nil {
+		if u, err := url.Parse(b.pool.BucketURL["uri"]); err == nil && u.Path != "" {
+			return strings.TrimSuffix(u.Path, "/")
+		}
+	}
+	return "/pools/default/buckets"
+}
+
 func (b *Bucket) init(nb *Bucket) {
 	connHost, _, _ := net.SplitHostPort(b.pool.client.BaseURL.Host)
 	for i := range nb.NodesJSON {
@@ -501,7 +951,7 @@ func (b *Bucket) init(nb *Bucket) {
 		nb.VBSMJson.ServerList[i] = normalizeHost(connHost, nb.VBSMJson.ServerList[i])
 		newcps[i] = newConnectionPool(
 			nb.VBSMJson.ServerList[i],
-			b.authHandler(), PoolSize, PoolOverflow)
+			b.authHandler(), PoolSize, PoolOverflow, PoolAcquireTimeout)
 	}
 	b.replaceConnPools(newcps)
 	platform.StorePointer(&b.vBucketServerMap, unsafe.Pointer(&nb.VBSMJson))
@@ -509,17 +959,21 @@ func (b *Bucket) init(nb *Bucket) {
 }
 
 func (p *Pool) refresh() (err error) {
-	p.BucketMap = make(map[string]Bucket)
+	return p.refreshWithContext(context.Background())
+}
+
+func (p *Pool) refreshWithContext(ctx context.Context) (err error) {
+	bucketMap := make(map[string]Bucket)
 
 loop:
 	buckets := []Bucket{}
-	err = p.client.parseURLResponse(p.BucketURL["uri"], &buckets)
+	err = p.client.parseURLResponseWithContext(ctx, p.BucketURL["uri"], &buckets)
 	if err != nil {
 		return err
 	}
 	for _, b := range buckets {
 		nb := &Bucket{}
-		err = p.client.parseURLResponse(p.BucketURL["terseBucketsBase"]+b.Name, nb)
+		err = p.client.parseURLResponseWithContext(ctx, p.BucketURL["terseBucketsBase"]+b.Name, nb)
 		if err != nil {
 			// bucket list is out of sync with cluster bucket list
 			// bucket might have got deleted.
@@ -531,14 +985,28 @@ loop:
 		}
 		b.pool = p
 		b.init(nb)
-		p.BucketMap[b.Name] = b
+		bucketMap[b.Name] = b
+	}
+
+	if p.lock == nil {
+		p.BucketMap = bucketMap
+		return nil
 	}
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	p.BucketMap = bucketMap
 	return nil
 }
 
 // GetPool gets a pool from within the couchbase cluster (usually
 // "default").
 func (c *Client) GetPool(name string) (p Pool, err error) {
+	return c.GetPoolWithContext(context.Background(), name)
+}
+
+// GetPoolWithContext is same as GetPool, except that the requests to the
+// cluster are cancelled when ctx is done.
+func (c *Client) GetPoolWithContext(ctx context.Context, name string) (p Pool, err error) {
 	var poolURI string
 	for _, p := range c.Info.Pools {
 		if p.Name == name {
@@ -549,17 +1017,93 @@ func (c *Client) GetPool(name string) (p Pool, err error) {
 		return p, errors.New("No pool named " + name)
 	}
 
-	err = c.parseURLResponse(poolURI, &p)
+	err = c.parseURLResponseWithContext(ctx, poolURI, &p)
 
 	p.client = *c
+	p.lock = &sync.RWMutex{}
 
-	err = p.refresh()
+	err = p.refreshWithContext(ctx)
 	return
 }
 
+// GetAllPools returns every pool in this client's Info.Pools, keyed by
+// pool name, each resolved and refreshed.
+func (c *Client) GetAllPools() (map[string]Pool, error) {
+	pools := make(map[string]Pool, len(c.Info.Pools))
+	for _, rp := range c.Info.Pools {
+		p, err := c.GetPool(rp.Name)
+		if err != nil {
+			return nil, err
+		}
+		pools[rp.Name] = p
+	}
+	return pools, nil
+}
+
+// WaitForBucket polls for bucket in pool until it becomes available or
+// ctx is done. Communication errors are retried like a missing bucket,
+// and the last one is returned if ctx is done, otherwise ErrBucketNotFound.
+// A poll interrupted by ctx does not replace the last error.
+func (c *Client) WaitForBucket(
+	ctx context.Context, poolname, bucketname string) (*Bucket, error) {
+
+	var lastErr error
+	interval := WaitForBucketInterval / 8
+	for {
+		b, err := c.getBucket(ctx, poolname, bucketname)
+		if err == nil {
+			return b, nil
+		} else if ctx.Err() != nil && lastErr != nil {
+			return nil, lastErr // poll interrupted by ctx.
+		} else if err != ErrBucketNotFound {
+			logging.Warnf("WaitForBucket(%v): %v", bucketname, err)
+		}
+		lastErr = err
+
+		if interval < WaitForBucketInterval {
+			interval *= 2
+		}
+		if interval > WaitForBucketInterval {
+			interval = WaitForBucketInterval
+		}
+		select {
+		case <-ctx.Done():
+			return nil, lastErr
+		case <-time.After(interval):
+		}
+	}
+}
+
+// getBucket returns ErrBucketNotFound if bucket or its bucket list is
+// not found, the requests to the cluster are cancelled when ctx is done.
+func (c *Client) getBucket(
+	ctx context.Context, poolname, bucketname string) (*Bucket, error) {
+
+	p, err := c.GetPoolWithContext(ctx, poolname)
+	if err != nil {
+		if isNotFound(err) {
+			return nil, ErrBucketNotFound
+		}
+		return nil, err
+	}
+	b, err := p.GetBucket(bucketname)
+	if err != nil {
+		return nil, ErrBucketNotFound
+	}
+	return b, nil
+}
+
 // GetPoolServices returns all the bucket-independent services in a pool.
 // (See "Exposing services outside of bucket context" in http://goo.gl/uuXRkV)
 func (c *Client) GetPoolServices(name string) (ps PoolServices, err error) {
+	return c.GetPoolServicesWithContext(context.Background(), name)
+}
+
+// GetPoolServicesWithContext is same as GetPoolServices, except that the
+// request to the cluster is cancelled when ctx is done.
+func (c *Client) GetPoolServicesWithContext(
+	ctx context.Context, name string) (ps PoolServices, err error) {
+
 	var poolName string
 	for _, p := range c.Info.Pools {
 		if p.Name == name {
@@ -571,7 +1115,7 @@ func (c *Client) GetPoolServices(name string) (ps PoolServices, err error) {
 	}
 
 	poolURI := "/pools/" + poolName + "/nodeServices"
-	err = c.parseURLResponse(poolURI, &ps)
+	err = c.parseURLResponseWithContext(ctx, poolURI, &ps)
 
 	return
 }
@@ -597,7 +1141,9 @@ func bucketFinalizer(b *Bucket) {
 
 // GetBucket gets a bucket from within this pool.
 func (p *Pool) GetBucket(name string) (*Bucket, error) {
+	p.rlock()
 	rv, ok := p.BucketMap[name]
+	p.runlock()
 	if !ok {
 		return nil, errors.New("No bucket named " + name)
 	}
@@ -605,6 +1151,19 @@ func (p *Pool) GetBucket(name string) (*Bucket, error) {
 	return &rv, nil
 }
 
+// GetBucketNames gets the sorted names of all buckets within this pool.
+func (p *Pool) GetBucketNames() []string {
+	p.rlock()
+	defer p.runlock()
+
+	names := make([]string, 0, len(p.BucketMap))
+	for name := range p.BucketMap {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
 // GetPool gets the pool to which this bucket belongs.
 func (b *Bucket) GetPool() *Pool {
 	return b.pool
@@ -618,13 +1177,20 @@ func (p *Pool) GetClient() *Client {
 // GetBucket is a convenience function for getting a named bucket from
 // a URL
 func GetBucket(endpoint, poolname, bucketname string) (*Bucket, error) {
-	var err error
-	client, err := Connect(endpoint)
+	return GetBucketWithContext(context.Background(), endpoint, poolname, bucketname)
+}
+
+// GetBucketWithContext is same as GetBucket, except that the requests to
+// the cluster are cancelled when ctx is done.
+func GetBucketWithContext(
+	ctx context.Context, endpoint, poolname, bucketname string) (*Bucket, error) {
+
+	client, err := ConnectWithContext(ctx, endpoint)
 	if err != nil {
 		return nil, err
 	}
 
-	pool, err := client.GetPool(poolname)
+	pool, err := client.GetPoolWithContext(ctx, poolname)
 	if err != nil {
 		return nil, err
 	}
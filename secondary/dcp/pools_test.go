@@ -1,9 +1,17 @@
 package couchbase
 
 import (
+	"compress/gzip"
+	"context"
 	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"reflect"
+	"strings"
 	"sync"
 	"testing"
+	"time"
 	"unsafe"
 )
 
@@ -289,6 +297,438 @@ func TestPool(t *testing.T) {
 	assert(t, "len(pools)", 5, len(res.Nodes))
 }
 
+var samplePoolServices = `{
+    "rev": 32,
+    "nodesExt": [
+        {
+            "services": {
+                "mgmt": 8091,
+                "kv": 11210,
+                "projector": 9999
+            },
+            "thisNode": true
+        },
+        {
+            "services": {
+                "mgmt": 8091,
+                "indexAdmin": 9100,
+                "indexScan": 9101
+            },
+            "hostname": "192.168.1.2"
+        }
+    ]
+}`
+
+func TestPoolServices(t *testing.T) {
+	res := PoolServices{}
+	testParse(t, samplePoolServices, &res)
+	assert(t, "len(nodesExt)", 2, len(res.NodesExt))
+
+	kv, idx := res.NodesExt[0], res.NodesExt[1]
+	assert(t, "kv.IsKV", true, kv.IsKV())
+	assert(t, "kv.IsProjector", true, kv.IsProjector())
+	assert(t, "kv.IsIndexer", false, kv.IsIndexer())
+	assert(t, "idx.IsKV", false, idx.IsKV())
+	assert(t, "idx.IsIndexer", true, idx.IsIndexer())
+	assert(t, "idx.HasService", true, idx.HasService("indexScan"))
+
+	port, ok := kv.ServicePort("projector")
+	assert(t, "projector port", 9999, port)
+	assert(t, "projector ok", true, ok)
+	_, ok = idx.ServicePort("projector")
+	assert(t, "missing port", false, ok)
+}
+
+var sampleBucketStats = `{
+    "op": {
+        "samples": {
+            "timestamp": [1417074780000, 1417074781000],
+            "curr_items": [100, 120],
+            "ep_queue_size": [3, 0]
+        },
+        "samplesCount": 60,
+        "isPersistent": true,
+        "lastTStamp": 1417074781000,
+        "interval": 1000
+    }
+}`
+
+func TestBucketStats(t *testing.T) {
+	res := BucketStats{}
+	testParse(t, sampleBucketStats, &res)
+	assert(t, "samplesCount", 60, res.Op.SamplesCount)
+
+	val, ok := res.Latest("curr_items")
+	assert(t, "curr_items", float64(120), val)
+	assert(t, "curr_items ok", true, ok)
+	val, ok = res.Latest("ep_queue_size")
+	assert(t, "ep_queue_size", float64(0), val)
+	_, ok = res.Latest("vb_active_num")
+	assert(t, "missing stat", false, ok)
+}
+
+func TestBucketGetRestStats(t *testing.T) {
+	defer func(ttl time.Duration) { BucketStatsTTL = ttl }(BucketStatsTTL)
+
+	var mu sync.Mutex
+	var statsPaths []string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/pools":
+			w.Write([]byte(`{"pools": [{"name": "other", "uri": "/pools/other"}]}`))
+		case "/pools/other":
+			w.Write([]byte(`{"nodes": [], "buckets": {"uri": "/pools/other/buckets?v=1",
+                "terseBucketsBase": "/pools/other/b/"}}`))
+		case "/pools/other/buckets":
+			w.Write([]byte(`[{"name": "test%bucket"}]`))
+		case "/pools/other/buckets/test%bucket/stats":
+			mu.Lock()
+			statsPaths = append(statsPaths, r.URL.EscapedPath())
+			mu.Unlock()
+			w.Write([]byte(sampleBucketStats))
+		default:
+			w.Write([]byte(`{"nodes": [], "vBucketServerMap": {}}`))
+		}
+	}))
+	defer server.Close()
+
+	client, err := Connect(server.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	p, err := client.GetPool("other")
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := p.GetBucket("test%bucket")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	BucketStatsTTL = time.Hour
+	for i := 0; i < 2; i++ {
+		stats, err := b.GetRestStats([]string{"curr_items", "vb_active_num"})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(stats, map[string]float64{"curr_items": 120}) {
+			t.Fatalf("Unexpected stats %v", stats)
+		}
+	}
+	mu.Lock()
+	assert(t, "cached requests", 1, len(statsPaths))
+	mu.Unlock()
+
+	BucketStatsTTL = 0
+	if _, err := b.GetRestStats([]string{"curr_items"}); err != nil {
+		t.Fatal(err)
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	expected := []string{"/pools/other/buckets/test%25bucket/stats"}
+	if !reflect.DeepEqual(statsPaths, append(expected, expected...)) {
+		t.Errorf("Unexpected stats requests %v", statsPaths)
+	}
+}
+
+func TestBucketGetVBmap(t *testing.T) {
+	vbmap := &VBucketServerMap{
+		HashAlgorithm: "CRC",
+		ServerList:    []string{"server1:11210", "server2:11210"},
+		VBucketMap:    [][]int{{0, 1}, {1, 0}, {-1, -1}, {1, -1}},
+	}
+	b := Bucket{vBucketServerMap: unsafe.Pointer(vbmap)}
+
+	m, err := b.GetVBmap(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(m["server1:11210"], []uint16{0}) ||
+		!reflect.DeepEqual(m["server2:11210"], []uint16{1, 3}) {
+		t.Fatalf("Unexpected vbmap %v", m)
+	}
+
+	vbmap.VBucketMap = [][]int{{0}, {2}}
+	if _, err := b.GetVBmap(nil); err == nil {
+		t.Errorf("Expected error for out of range owner")
+	}
+
+	vbmap.VBucketMap = [][]int{{0}, {}}
+	if _, err := b.GetVBmap(nil); err == nil {
+		t.Errorf("Expected error for vbucket without owner")
+	}
+
+	vbmap.VBucketMap = [][]int{{0}, {1}}
+	vbmap.HashAlgorithm = "MD5"
+	if _, err := b.GetVBmap(nil); err == nil {
+		t.Errorf("Expected error for unexpected hash algorithm")
+	}
+}
+
+func TestBucketNodeForVbucket(t *testing.T) {
+	vbmap := &VBucketServerMap{
+		HashAlgorithm: "CRC",
+		ServerList:    []string{"server1:11210", "server2:11210"},
+		VBucketMap:    [][]int{{0, 1}, {1, 0}, {-1, -1}, {1, -1}},
+	}
+	b := Bucket{vBucketServerMap: unsafe.Pointer(vbmap)}
+
+	for vbno, expected := range []string{"server1:11210", "server2:11210", "", "server2:11210"} {
+		addr, err := b.NodeForVbucket(uint16(vbno))
+		if expected == "" && err == nil {
+			t.Errorf("Expected error for vbucket %v without active owner, got %v", vbno, addr)
+		} else if expected != "" && (err != nil || addr != expected) {
+			t.Errorf("Expected owner %v for vbucket %v, got %v %v", expected, vbno, addr, err)
+		}
+	}
+	if _, err := b.NodeForVbucket(4); err == nil {
+		t.Errorf("Expected error for out of range vbucket")
+	}
+
+	// the index is rebuilt for a new vbucket map.
+	b.vBucketServerMap = unsafe.Pointer(&VBucketServerMap{
+		HashAlgorithm: "CRC",
+		ServerList:    []string{"server1:11210", "server2:11210"},
+		VBucketMap:    [][]int{{1}, {0}},
+	})
+	if addr, err := b.NodeForVbucket(0); err != nil || addr != "server2:11210" {
+		t.Errorf("Expected owner server2:11210 after refresh, got %v %v", addr, err)
+	}
+
+	b.vBucketServerMap = unsafe.Pointer(&VBucketServerMap{
+		HashAlgorithm: "CRC",
+		ServerList:    []string{"server1:11210"},
+		VBucketMap:    [][]int{{0}, {2}},
+	})
+	if _, err := b.NodeForVbucket(0); err == nil {
+		t.Errorf("Expected error for out of range owner")
+	}
+
+	b.vBucketServerMap = unsafe.Pointer(&VBucketServerMap{
+		HashAlgorithm: "CRC",
+		ServerList:    []string{"server1:11210"},
+		VBucketMap:    [][]int{{0}, {}},
+	})
+	if _, err := b.NodeForVbucket(0); err == nil {
+		t.Errorf("Expected error for vbucket without owner list")
+	}
+
+	b.vBucketServerMap = nil
+	if _, err := b.NodeForVbucket(0); err == nil {
+		t.Errorf("Expected error for missing vbucket map")
+	}
+}
+
+func TestBucketRefreshWithContext(t *testing.T) {
+	blockch := make(chan bool)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-blockch
+	}))
+	defer server.Close()
+	defer close(blockch)
+
+	u, err := url.Parse(server.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b := &Bucket{pool: &Pool{client: Client{BaseURL: u}}, URI: "/pools/default/buckets/default"}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+
+	start := time.Now()
+	if err := b.RefreshWithContext(ctx); err == nil {
+		t.Fatalf("Expected error refreshing from a blocked server")
+	}
+	if d := time.Since(start); d > 5*time.Second {
+		t.Errorf("Expected refresh to be cancelled, took %v", d)
+	}
+}
+
+func TestGetBucketWithContext(t *testing.T) {
+	blockch := make(chan bool)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/pools" {
+			w.Write([]byte(`{"pools": [{"name": "default", "uri": "/pools/default"}]}`))
+			return
+		}
+		<-blockch
+	}))
+	defer server.Close()
+	defer close(blockch)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+
+	start := time.Now()
+	if _, err := GetBucketWithContext(ctx, server.URL, "default", "default"); err == nil {
+		t.Fatalf("Expected error getting bucket from a blocked server")
+	}
+	if d := time.Since(start); d > 5*time.Second {
+		t.Errorf("Expected GetBucket to be cancelled, took %v", d)
+	}
+
+	client, err := ConnectWithContext(context.Background(), server.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel = context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	if _, err := client.GetPoolServicesWithContext(ctx, "default"); err == nil {
+		t.Fatalf("Expected error getting pool services from a blocked server")
+	}
+}
+
+func TestQueryRestAPIGzip(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body := []byte(`{"pools": [{"name": "default", "uri": "/pools/default"}]}`)
+		if r.URL.Path == "/plain" || r.Header.Get("Accept-Encoding") != "gzip" {
+			w.Write(body)
+			return
+		}
+		w.Header().Set("Content-Encoding", "gzip")
+		if r.URL.Path == "/error" {
+			w.WriteHeader(http.StatusInternalServerError)
+			body = []byte("internal error")
+		}
+		gz := gzip.NewWriter(w)
+		gz.Write(body)
+		gz.Close()
+	}))
+	defer server.Close()
+
+	u, err := url.Parse(server.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, path := range []string{"/pools", "/plain"} {
+		var info Pools
+		if err := queryRestAPI(u, path, nil, &info); err != nil {
+			t.Fatalf("%v: %v", path, err)
+		}
+		if len(info.Pools) != 1 || info.Pools[0].Name != "default" {
+			t.Errorf("%v: unexpected pools %v", path, info.Pools)
+		}
+	}
+
+	var info Pools
+	err = queryRestAPI(u, "/error", nil, &info)
+	if err == nil || !strings.Contains(err.Error(), "internal error") {
+		t.Errorf("Expected decompressed error body, got %v", err)
+	}
+}
+
+func TestGetAllPools(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/pools/default", "/pools/other":
+			w.Write([]byte(`{"nodes": [], "buckets": {"uri": "` + r.URL.Path + `/buckets"}}`))
+		default:
+			w.Write([]byte(`[]`))
+		}
+	}))
+	defer server.Close()
+
+	u, err := url.Parse(server.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c := Client{BaseURL: u}
+	c.Info.Pools = []RestPool{
+		{Name: "default", URI: "/pools/default"},
+		{Name: "other", URI: "/pools/other"},
+	}
+
+	pools, err := c.GetAllPools()
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert(t, "len(pools)", 2, len(pools))
+	for _, name := range []string{"default", "other"} {
+		if p, ok := pools[name]; !ok {
+			t.Errorf("Expected pool %q", name)
+		} else if p.BucketMap == nil {
+			t.Errorf("Expected pool %q to be refreshed", name)
+		}
+	}
+}
+
+func TestGetBucketCoalesced(t *testing.T) {
+	var mu sync.Mutex
+	requests := map[string]int{}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		requests[r.URL.Path]++
+		mu.Unlock()
+		time.Sleep(50 * time.Millisecond)
+
+		switch r.URL.Path {
+		case "/pools":
+			w.Write([]byte(`{"pools": [{"name": "default", "uri": "/pools/default"}]}`))
+		case "/pools/default":
+			w.Write([]byte(`{"nodes": [], "buckets": {"uri": "/pools/default/buckets",
+                "terseBucketsBase": "/pools/default/b/"}}`))
+		case "/pools/default/buckets":
+			w.Write([]byte(`[{"name": "default", "uri": "/pools/default/buckets/default"}]`))
+		default:
+			w.Write([]byte(`{"name": "default", "nodes": [], "vBucketServerMap": {}}`))
+		}
+	}))
+	defer server.Close()
+
+	var wg sync.WaitGroup
+	for i := 0; i < 100; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			b, err := GetBucket(server.URL, "default", "default")
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			b.Close()
+		}()
+	}
+	wg.Wait()
+
+	mu.Lock()
+	defer mu.Unlock()
+	for path, n := range requests {
+		if n > 2 {
+			t.Errorf("Expected at most 2 requests for %v, got %v", path, n)
+		}
+	}
+}
+
+func TestRunObserveBucket(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/pools/default/bucketsStreaming/default" {
+			http.NotFound(w, r)
+			return
+		}
+		w.Write([]byte(`{"name": "default", "vBucketServerMap": {"serverList": ["s1:11210"]}}` + "\n\n"))
+		w.Write([]byte(`{"name": "default", "vBucketServerMap": {"serverList": ["s2:11210"]}}` + "\n"))
+	}))
+	defer server.Close()
+
+	u, err := url.Parse(server.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c := Client{BaseURL: u}
+
+	servers := []string{}
+	callb := func(obj interface{}) error {
+		b := obj.(*Bucket)
+		servers = append(servers, b.VBSMJson.ServerList...)
+		return nil
+	}
+	c.RunObserveBucket("default", "default", callb, nil)
+	if !reflect.DeepEqual(servers, []string{"s1:11210", "s2:11210"}) {
+		t.Errorf("Unexpected servers %v", servers)
+	}
+}
+
 func TestCommonAddressSuffixEmpty(t *testing.T) {
 	b := Bucket{nodeList: mkNL([]Node{})}
 	assert(t, "empty", "", b.CommonAddressSuffix())
@@ -344,3 +784,291 @@ func TestBucketConnPoolConcurrent(t *testing.T) {
 func mkNL(in []Node) unsafe.Pointer {
 	return unsafe.Pointer(&in)
 }
+
+func TestPoolConcurrentRefresh(t *testing.T) {
+	t.Parallel()
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/pools":
+			w.Write([]byte(`{"pools": [{"name": "default", "uri": "/pools/default"}]}`))
+		case "/pools/default":
+			w.Write([]byte(`{"nodes": [], "buckets": {"uri": "/pools/default/buckets",
+                "terseBucketsBase": "/pools/default/b/"}}`))
+		case "/pools/default/buckets":
+			w.Write([]byte(`[{"name": "default"}, {"name": "other"}]`))
+		default:
+			w.Write([]byte(`{"nodes": [], "vBucketServerMap": {}}`))
+		}
+	}))
+	defer server.Close()
+
+	client, err := Connect(server.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	p, err := client.GetPool("default")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(3)
+		go func() {
+			defer wg.Done()
+			if _, err := client.GetPool("default"); err != nil {
+				t.Error(err)
+			}
+		}()
+		go func() {
+			defer wg.Done()
+			if err := p.refresh(); err != nil {
+				t.Error(err)
+			}
+		}()
+		go func() {
+			defer wg.Done()
+			if _, err := p.GetBucket("default"); err != nil {
+				t.Error(err)
+			}
+			if names := p.GetBucketNames(); !reflect.DeepEqual(names, []string{"default", "other"}) {
+				t.Errorf("Expected 2 buckets, got %v", names)
+			}
+		}()
+	}
+	wg.Wait()
+}
+
+func TestPoolZeroValue(t *testing.T) {
+	var p Pool
+	if _, err := p.GetBucket("default"); err == nil {
+		t.Errorf("Expected error for missing bucket")
+	}
+	if names := p.GetBucketNames(); len(names) != 0 {
+		t.Errorf("Expected no buckets, got %v", names)
+	}
+
+	p.BucketMap = map[string]Bucket{"default": {Name: "default"}}
+	if b, err := p.GetBucket("default"); err != nil || b.Name != "default" {
+		t.Errorf("Expected bucket default, got %v %v", b, err)
+	}
+}
+
+func TestListBuckets(t *testing.T) {
+	var mu sync.Mutex
+	requests := 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/pools/default/buckets" || r.URL.Query().Get("basic_stats") != "false" {
+			t.Errorf("Unexpected request %v", r.URL)
+		}
+		mu.Lock()
+		requests++
+		mu.Unlock()
+		w.Write([]byte(`[{"name": "default", "uuid": "1234", "bucketType": "membase",
+            "replicaNumber": 1, "saslPassword": "secret"}]`))
+	}))
+	defer server.Close()
+
+	client := Client{}
+	client.BaseURL, _ = ParseURL(server.URL)
+
+	for i := 0; i < 2; i++ {
+		buckets, err := client.ListBuckets("default")
+		if err != nil {
+			t.Fatal(err)
+		}
+		expected := []BucketInfo{{Name: "default", UUID: "1234", Type: "membase", NumReplicas: 1}}
+		if !reflect.DeepEqual(buckets, expected) {
+			t.Fatalf("Expected %v, got %v", expected, buckets)
+		}
+	}
+	assert(t, "requests", 1, requests)
+
+	// clients with other credentials do not share the cached list.
+	for _, pass := range []string{"pass1", "pass2", "pass1"} {
+		authClient := Client{BaseURL: client.BaseURL, ah: basicAuth{"user", pass}}
+		if _, err := authClient.ListBuckets("default"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	assert(t, "requests", 3, requests)
+
+	// expired lists are evicted when a list is added.
+	defer func(ttl time.Duration) {
+		BucketListTTL = ttl
+	}(BucketListTTL)
+	BucketListTTL = 0
+	if _, err := client.ListBuckets("default"); err != nil {
+		t.Fatal(err)
+	}
+	bucketListCache.mu.Lock()
+	entries := len(bucketListCache.entries)
+	bucketListCache.mu.Unlock()
+	assert(t, "entries", 1, entries)
+}
+
+func TestWaitForBucket(t *testing.T) {
+	defer func(interval time.Duration) {
+		WaitForBucketInterval = interval
+	}(WaitForBucketInterval)
+	WaitForBucketInterval = 40 * time.Millisecond
+
+	var mu sync.Mutex
+	notFound := 3
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/pools":
+			w.Write([]byte(`{"pools": [{"name": "default", "uri": "/pools/default"}]}`))
+		case "/pools/default":
+			w.Write([]byte(`{"nodes": [], "buckets": {"uri": "/pools/default/buckets",
+                "terseBucketsBase": "/pools/default/b/"}}`))
+		case "/pools/default/buckets":
+			mu.Lock()
+			defer mu.Unlock()
+			if notFound > 0 {
+				notFound--
+				http.NotFound(w, r)
+				return
+			}
+			w.Write([]byte(`[{"name": "waitbucket"}]`))
+		default:
+			w.Write([]byte(`{"nodes": [], "vBucketServerMap": {}}`))
+		}
+	}))
+	defer server.Close()
+
+	client, err := Connect(server.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	b, err := client.WaitForBucket(ctx, "default", "waitbucket")
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert(t, "bucket", "waitbucket", b.Name)
+	assert(t, "notFound", 0, notFound)
+
+	ctx, cancel = context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	if _, err = client.WaitForBucket(ctx, "default", "missing"); err != ErrBucketNotFound {
+		t.Fatalf("Expected ErrBucketNotFound, got %v", err)
+	}
+}
+
+func TestWaitForBucketHung(t *testing.T) {
+	blockch := make(chan bool)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/pools":
+			w.Write([]byte(`{"pools": [{"name": "default", "uri": "/pools/default"}]}`))
+		case "/pools/default":
+			<-blockch
+		}
+	}))
+	defer server.Close()
+	defer close(blockch)
+
+	client, err := Connect(server.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	donech := make(chan error, 1)
+	go func() {
+		_, err := client.WaitForBucket(ctx, "default", "waitbucket")
+		donech <- err
+	}()
+	select {
+	case err := <-donech:
+		if err == nil {
+			t.Fatal("Expected error for a hung cluster")
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("WaitForBucket is blocked past the deadline")
+	}
+}
+
+func TestIsNotFound(t *testing.T) {
+	var notFound, other error
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/missing" {
+			http.NotFound(w, r)
+			return
+		}
+		http.Error(w, "HTTP error 404", http.StatusInternalServerError)
+	}))
+	defer server.Close()
+
+	_, notFound = getRestAPI(context.Background(), server.URL+"/missing", nil)
+	_, other = getRestAPI(context.Background(), server.URL+"/other", nil)
+	if !isNotFound(notFound) {
+		t.Fatalf("Expected not found, got %v", notFound)
+	}
+	if other == nil || isNotFound(other) {
+		t.Fatalf("Expected error other than not found, got %v", other)
+	}
+}
+
+func TestNodeAddressesByService(t *testing.T) {
+	vbmap := &VBucketServerMap{
+		ServerList: []string{"server2:11210", "server1:11210", "server3:11210"},
+	}
+	ps := &PoolServices{NodesExt: []NodeServices{
+		{Hostname: "server1", Services: map[string]int{"kv": 11210, "projector": 9999}},
+		{Hostname: "server2", Services: map[string]int{"kv": 11210}},
+		{Hostname: "server3", Services: map[string]int{"kv": 12000, "projector": 9999}},
+		{Hostname: "127.0.0.1", Services: map[string]int{"kv": 12000, "projector": 10000}},
+	}}
+	bs := &BucketServices{Bucket: &Bucket{vBucketServerMap: unsafe.Pointer(vbmap)}, Services: ps}
+
+	if addrs := bs.NodeAddressesByService("projector"); !reflect.DeepEqual(addrs, []string{"server1:11210"}) {
+		t.Fatalf("Unexpected projector nodes %v", addrs)
+	}
+	if addrs := bs.NodeAddressesByService("kv"); !reflect.DeepEqual(addrs, []string{"server1:11210", "server2:11210"}) {
+		t.Fatalf("Unexpected kv nodes %v", addrs)
+	}
+	if ns := ps.NodeForKVAddr("localhost:12000"); ns == nil || ns.Services["projector"] != 10000 {
+		t.Fatalf("Unexpected node for local kv address %v", ns)
+	}
+}
+
+func TestSetHTTPProxy(t *testing.T) {
+	var mu sync.Mutex
+	var hosts []string
+	proxy := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		hosts = append(hosts, r.URL.Host)
+		mu.Unlock()
+		w.Write([]byte(`{"pools": [{"name": "default", "uri": "/pools/default"}]}`))
+	}))
+	defer proxy.Close()
+
+	if err := SetHTTPProxy("proxy:3128"); err == nil {
+		t.Fatalf("Expected error for proxy URL without scheme")
+	}
+	if err := SetHTTPProxy("socks5://proxy:1080"); err != nil {
+		t.Fatalf("Unexpected error for socks5 proxy: %v", err)
+	}
+	if err := SetHTTPProxy(proxy.URL); err != nil {
+		t.Fatal(err)
+	}
+	defer SetHTTPProxy("")
+
+	client, err := Connect("http://couchbase.invalid:8091/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert(t, "pool", "default", client.Info.Pools[0].Name)
+
+	mu.Lock()
+	defer mu.Unlock()
+	if !reflect.DeepEqual(hosts, []string{"couchbase.invalid:8091"}) {
+		t.Errorf("Unexpected proxied hosts %v", hosts)
+	}
+}
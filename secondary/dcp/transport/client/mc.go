@@ -8,6 +8,7 @@ import (
 	"math"
 	"net"
 	"strings"
+	"sync/atomic"
 	"time"
 
 	"github.com/couchbase/indexing/secondary/dcp/transport"
@@ -22,6 +23,9 @@ type Client struct {
 	healthy bool
 
 	hdrBuf []byte
+
+	onClose func() // refer OnClose()
+	closed  int32
 }
 
 var dialFun = net.Dial
@@ -46,7 +50,18 @@ func Wrap(rwc io.ReadWriteCloser) (rv *Client, err error) {
 
 // Close the connection when you're done.
 func (c *Client) Close() error {
-	return c.conn.Close()
+	err := c.conn.Close()
+	if atomic.CompareAndSwapInt32(&c.closed, 0, 1) && c.onClose != nil {
+		c.onClose()
+	}
+	return err
+}
+
+// OnClose sets a callback that is called once, when the connection is
+// closed for the first time. It must be set before the connection is
+// handed to other routines, like a TAP or DCP feed.
+func (c *Client) OnClose(fn func()) {
+	c.onClose = fn
 }
 
 // IsHealthy returns true unless the client is belived to have
@@ -15,35 +15,63 @@ func CleanupHost(h, commonSuffix string) string {
 }
 
 // FindCommonSuffix returns the longest common suffix from the given
-// strings.
+// strings, or "" if there are less than two strings. A suffix within
+// the brackets of an IPv6 host ("[::1]:11210") is trimmed to the port,
+// unless all the strings are equal.
 func FindCommonSuffix(input []string) string {
-	rv := ""
 	if len(input) < 2 {
 		return ""
 	}
-	from := input
-	for i := len(input[0]); i > 0; i-- {
-		common := true
-		suffix := input[0][i:]
-		for _, s := range from {
-			if !strings.HasSuffix(s, suffix) {
-				common = false
-				break
-			}
-		}
-		if common {
-			rv = suffix
+
+	rv, equal := input[0], true
+	for _, s := range input[1:] {
+		n := 0
+		for n < len(rv) && n < len(s) && rv[len(rv)-1-n] == s[len(s)-1-n] {
+			n++
 		}
+		rv = rv[len(rv)-n:]
+		equal = equal && s == input[0]
+	}
+	if equal {
+		return rv
+	}
+	if i := strings.LastIndex(rv, "]"); i >= 0 {
+		rv = rv[i+1:]
 	}
 	return rv
 }
 
-// ParseURL is a wrapper around url.Parse with some sanity-checking
-func ParseURL(urlStr string) (result *url.URL, err error) {
-	result, err = url.Parse(urlStr)
-	if result != nil && result.Scheme == "" {
-		result = nil
-		err = fmt.Errorf("invalid URL <%s>", urlStr)
-	}
-	return
+// ParseURL is a wrapper around url.Parse with some sanity-checking, the
+// URL must have a http or https scheme and a host.
+func ParseURL(urlStr string) (*url.URL, error) {
+	if !strings.Contains(urlStr, "://") {
+		return nil, fmt.Errorf("missing scheme in URL: %s", urlStr)
+	}
+	result, err := url.Parse(urlStr)
+	if err != nil {
+		return nil, fmt.Errorf("invalid URL: %s", urlStr)
+	}
+	if result.Scheme != "http" && result.Scheme != "https" {
+		return nil, fmt.Errorf("unsupported scheme %q in URL: %s", result.Scheme, urlStr)
+	}
+	if result.Host == "" || result.Hostname() == "" {
+		return nil, fmt.Errorf("missing host in URL: %s", urlStr)
+	}
+	return result, nil
+}
+
+// AdminPort and AdminSSLPort are the standard ports of cluster manager
+// REST API.
+const (
+	AdminPort    = "8091"
+	AdminSSLPort = "18091"
+)
+
+// IsAdminPort returns true if u points to the standard admin port of its
+// scheme.
+func IsAdminPort(u *url.URL) bool {
+	if u.Scheme == "https" {
+		return u.Port() == AdminSSLPort
+	}
+	return u.Port() == AdminPort
 }
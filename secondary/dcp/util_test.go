@@ -31,6 +31,14 @@ func TestFindCommonSuffix(t *testing.T) {
 		{"empty", "", nil},
 		{"one", "", []string{"blah"}},
 		{"two", ".com", []string{"blah.com", "foo.com"}},
+		{"none", "", []string{"blah.com", "foo.org"}},
+		{"equal", "blah.com", []string{"blah.com", "blah.com", "blah.com"}},
+		{"prefix of other", "blah.com", []string{"blah.com", "xblah.com"}},
+		{"empty string", "", []string{"", "blah.com"}},
+		{"hostport", ".example.com:11210",
+			[]string{"s1.example.com:11210", "s2.example.com:11210", "s3.example.com:11210"}},
+		{"ipv6", ":11210", []string{"[fe80::1]:11210", "[fe80::2]:11210"}},
+		{"ipv6 equal", "[::1]:11210", []string{"[::1]:11210", "[::1]:11210"}},
 	}
 
 	for _, test := range tests {
@@ -49,7 +57,11 @@ func TestParseURL(t *testing.T) {
 	}{
 		{"", false},
 		{"http://whatever/", true},
+		{"https://whatever:18091", true},
 		{"http://%/", false},
+		{"couchbase-server:8091", false},
+		{"ftp://whatever/", false},
+		{"http:///pools", false},
 	}
 
 	for _, test := range tests {
@@ -64,3 +76,33 @@ func TestParseURL(t *testing.T) {
 		}
 	}
 }
+
+func TestParseURLError(t *testing.T) {
+	_, err := ParseURL("couchbase-server:8091")
+	if err == nil || err.Error() != "missing scheme in URL: couchbase-server:8091" {
+		t.Errorf("Expected missing scheme error, got %v", err)
+	}
+}
+
+func TestIsAdminPort(t *testing.T) {
+	tests := []struct {
+		in  string
+		exp bool
+	}{
+		{"http://whatever:8091/", true},
+		{"http://whatever:9000/", false},
+		{"http://whatever/", false},
+		{"https://whatever:18091/", true},
+		{"https://whatever:8091/", false},
+	}
+
+	for _, test := range tests {
+		u, err := ParseURL(test.in)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := IsAdminPort(u); got != test.exp {
+			t.Errorf("Expected %v for %v, got %v", test.exp, test.in, got)
+		}
+	}
+}
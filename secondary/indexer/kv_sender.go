@@ -722,7 +722,7 @@ func sendDelInstancesRequest(ap *projClient.Client,
 	logging.Infof("KVSender::sendDelInstancesRequest Projector %v Topic %v Instances %v",
 		ap, topic, uuids)
 
-	if err := ap.DelInstances(topic, uuids); err != nil {
+	if err := ap.DelInstances(topic, uuids, 0); err != nil {
 		logging.Fatalf("KVSender::sendDelInstancesRequest Unexpected Error During "+
 			"Del Instances Request Projector %v Topic %v Instances %v. Err %v", ap,
 			topic, uuids, err)
@@ -11,27 +11,89 @@ package indexer
 
 import (
 	"bytes"
+	"encoding/json"
 	"errors"
+	"fmt"
 	"github.com/couchbase/cbauth/metakv"
 	"github.com/couchbase/indexing/secondary/common"
 	"github.com/couchbase/indexing/secondary/logging"
 	"github.com/couchbase/indexing/secondary/pipeline"
+	"io"
 	"io/ioutil"
+	"mime"
 	"net/http"
+	"strconv"
+	"sync"
 	"time"
 )
 
 const (
 	indexCompactonMetaPath = common.IndexingMetaDir + "triggerCompaction"
+	// buffer size of settings subscriber channel, on overflow the oldest
+	// config is dropped.
+	settingsSubscriberChSize = 1
+	// number of settings revisions kept in history.
+	settingsHistorySize = 10
 )
 
 // Implements dynamic settings management for indexer
 type settingsManager struct {
 	supvCmdch       MsgChannel
 	supvMsgch       MsgChannel
+	configMu        *sync.Mutex // protects config, settings and settingsRev
+	applyMu         *sync.Mutex // serializes applySettings
 	config          common.Config
+	settings        []byte      // last settings received from metakv
+	settingsRev     interface{} // metakv revision of settings
 	cancelCh        chan struct{}
 	compactionToken []byte
+	subscribers     *settingsSubscribers
+	history         *settingsHistory
+	writes          *settingsWrites
+	observer        *settingsObserver
+}
+
+// State of the metakv observer, shared by all copies of settingsManager.
+// The observer is connected once a callback is received, and disconnected
+// while it is restarting after a failure.
+type settingsObserver struct {
+	mu        sync.Mutex
+	connected bool
+	lastSync  time.Time
+	lastErr   error
+}
+
+// In-flight metakv writes, shared by all copies of settingsManager.
+// Once closed, new writes are rejected and shutdown waits for the
+// in-flight writes to complete.
+type settingsWrites struct {
+	mu     sync.Mutex
+	closed bool
+	wg     sync.WaitGroup
+}
+
+var errSettingsShutdown = errors.New("Settings manager is shutting down")
+
+// Subscribers to settings change, shared by all copies of settingsManager.
+type settingsSubscribers struct {
+	mu    sync.Mutex
+	chans map[<-chan common.Config]chan common.Config
+}
+
+// Recent settings received from metakv, shared by all copies of
+// settingsManager. Revisions are numbered locally, since metakv
+// revisions are opaque and older metakv revisions are not retrievable.
+type settingsHistory struct {
+	mu      sync.Mutex
+	revs    []settingsRevision
+	nextRev uint64
+}
+
+type settingsRevision struct {
+	Rev      uint64    `json:"rev"`
+	Time     time.Time `json:"time"`
+	Good     bool      `json:"good"` // settings applied without error
+	Settings string    `json:"settings"`
 }
 
 func NewSettingsManager(supvCmdch MsgChannel,
@@ -39,8 +101,16 @@ func NewSettingsManager(supvCmdch MsgChannel,
 	s := settingsManager{
 		supvCmdch: supvCmdch,
 		supvMsgch: supvMsgch,
+		configMu:  &sync.Mutex{},
+		applyMu:   &sync.Mutex{},
 		config:    config,
 		cancelCh:  make(chan struct{}),
+		subscribers: &settingsSubscribers{
+			chans: make(map[<-chan common.Config]chan common.Config),
+		},
+		history:  &settingsHistory{nextRev: 1},
+		writes:   &settingsWrites{},
+		observer: &settingsObserver{},
 	}
 
 	config, err := common.GetSettingsConfig(config)
@@ -53,20 +123,23 @@ func NewSettingsManager(supvCmdch MsgChannel,
 			}}
 	}
 
-	ncpu := common.SetNumCPUs(config["indexer.settings.max_cpu_percent"].Int())
+	ncpu := common.SetNumCPUs(common.NewIndexerSettings(config).MaxCpuPercent())
 	logging.Infof("Setting maxcpus = %d", ncpu)
 
 	setBlockPoolSize(nil, config)
 	setLogger(config)
 
 	http.HandleFunc("/settings", s.handleSettingsReq)
+	http.HandleFunc("/settings/history", s.handleSettingsHistoryReq)
 	http.HandleFunc("/triggerCompaction", s.handleCompactionTrigger)
+	http.HandleFunc("/healthz", s.handleHealthReq)
 	go func() {
 		for {
 			err := metakv.RunObserveChildren("/", s.metaKVCallback, s.cancelCh)
 			if err == nil {
 				return
 			} else {
+				s.observer.disconnected(err)
 				logging.Errorf("IndexerSettingsManager: metakv notifier failed (%v)..Restarting", err)
 			}
 		}
@@ -86,6 +159,16 @@ func (s *settingsManager) writeError(w http.ResponseWriter, err error) {
 	w.Write([]byte(err.Error() + "\n"))
 }
 
+func (s *settingsManager) writeUnavailable(w http.ResponseWriter, err error) {
+	w.WriteHeader(http.StatusServiceUnavailable)
+	w.Write([]byte(err.Error() + "\n"))
+}
+
+func (s *settingsManager) writeUnsupportedMediaType(w http.ResponseWriter, err error) {
+	w.WriteHeader(http.StatusUnsupportedMediaType)
+	w.Write([]byte(err.Error() + "\n"))
+}
+
 func (s *settingsManager) writeJson(w http.ResponseWriter, json []byte) {
 	header := w.Header()
 	header["Content-Type"] = []string{"application/json"}
@@ -95,7 +178,7 @@ func (s *settingsManager) writeJson(w http.ResponseWriter, json []byte) {
 }
 
 func (s *settingsManager) validateAuth(w http.ResponseWriter, r *http.Request) bool {
-	valid, err := common.IsAuthValid(r, s.config["indexer.clusterAddr"].String())
+	valid, err := common.IsAuthValid(r, common.NewIndexerSettings(s.getConfig()).ClusterAddr())
 	if err != nil {
 		s.writeError(w, err)
 	} else if valid == false {
@@ -111,9 +194,23 @@ func (s *settingsManager) handleSettingsReq(w http.ResponseWriter, r *http.Reque
 	}
 
 	if r.Method == "POST" {
-		bytes, _ := ioutil.ReadAll(r.Body)
+		if err := checkSettingsContentType(r); err != nil {
+			s.writeUnsupportedMediaType(w, err)
+			return
+		}
+		bytes, err := s.readSettingsBody(r)
+		if err != nil {
+			s.writeError(w, err)
+			return
+		}
 
-		config := s.config.Clone()
+		if !s.writes.begin() {
+			s.writeUnavailable(w, errSettingsShutdown)
+			return
+		}
+		defer s.writes.end()
+
+		config := s.getConfig().Clone()
 		current, rev, err := metakv.Get(common.IndexingSettingsMetaPath)
 		if err == nil {
 			if len(current) > 0 {
@@ -134,23 +231,256 @@ func (s *settingsManager) handleSettingsReq(w http.ResponseWriter, r *http.Reque
 			return
 		}
 		s.writeOk(w)
+	} else if r.Method == "GET" || r.Method == "HEAD" {
+		// the current config has the settings of metakv applied.
+		settingsConfig, current, rev := s.getSettings()
+
+		// clients can poll with If-None-Match to detect settings change.
+		if etag := settingsETag(rev); etag != "" {
+			w.Header().Set("ETag", etag)
+			if r.Header.Get("If-None-Match") == etag {
+				w.WriteHeader(http.StatusNotModified)
+				return
+			}
+		}
+
+		// any section of the effective config, with the source of each value.
+		if prefix := r.URL.Query().Get("section"); prefix != "" {
+			data, err := settingsSectionJson(settingsConfig, current, prefix)
+			if err != nil {
+				s.writeError(w, err)
+				return
+			}
+			s.writeJson(w, data)
+			return
+		}
+		s.writeJson(w, settingsConfig.FilterConfig(".settings.").Json())
+	} else {
+		s.writeError(w, errors.New("Unsupported method"))
+		return
+	}
+}
+
+// checkSettingsContentType accepts JSON settings, and form encoded or
+// untyped content for clients that post JSON with the default content
+// type, like curl.
+func checkSettingsContentType(r *http.Request) error {
+	contentType := r.Header.Get("Content-Type")
+	if contentType == "" {
+		return nil
+	}
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	if err == nil && (mediaType == "application/json" ||
+		mediaType == "application/x-www-form-urlencoded") {
+		return nil
+	}
+	return fmt.Errorf("Unsupported content type %q, expected application/json", contentType)
+}
+
+// readSettingsBody reads settings posted in request body, which must be a
+// JSON object of at most indexer.settingsMaxPayload bytes.
+func (s *settingsManager) readSettingsBody(r *http.Request) ([]byte, error) {
+	if r.Body == nil {
+		return nil, errors.New("Empty settings")
+	}
+	maxPayload := common.NewIndexerSettings(s.getConfig()).SettingsMaxPayload()
+	data, err := ioutil.ReadAll(io.LimitReader(r.Body, int64(maxPayload)+1))
+	if err != nil {
+		return nil, fmt.Errorf("Failed to read settings (%v)", err)
+	} else if len(data) == 0 {
+		return nil, errors.New("Empty settings")
+	} else if len(data) > maxPayload {
+		return nil, fmt.Errorf("Settings larger than %v bytes", maxPayload)
+	}
+
+	var settings map[string]interface{}
+	if err := json.Unmarshal(data, &settings); err != nil {
+		return nil, fmt.Errorf("Invalid settings JSON (%v)", err)
+	}
+	return data, nil
+}
+
+// Source of an effective config value, refer settingsSectionJson().
+const (
+	settingsSourceDefault  = "default"
+	settingsSourceMetakv   = "metakv"
+	settingsSourceConstant = "constant"
+)
+
+type settingsSourceValue struct {
+	Value  interface{} `json:"value"`
+	Source string      `json:"source"`
+}
+
+// settingsSectionJson returns the keys of config with prefix, along with the
+// source of each value: overridden by metakv settings in current, an
+// immutable constant, or the default.
+func settingsSectionJson(config common.Config, current []byte, prefix string) ([]byte, error) {
+	overrides := make(map[string]interface{})
+	if len(current) > 0 {
+		if err := json.Unmarshal(current, &overrides); err != nil {
+			return nil, fmt.Errorf("Invalid settings in metakv (%v)", err)
+		}
+	}
+
+	kvs := make(map[string]settingsSourceValue)
+	for key, cv := range config.SectionConfig(prefix, false) {
+		source := settingsSourceDefault
+		if _, ok := overrides[key]; ok {
+			source = settingsSourceMetakv
+		} else if cv.Immutable {
+			source = settingsSourceConstant
+		}
+		kvs[key] = settingsSourceValue{Value: cv.Value, Source: source}
+	}
+	return json.Marshal(kvs)
+}
+
+// handleSettingsHistoryReq returns recent settings revisions on GET, and
+// restores the settings of revision `revert` on POST.
+func (s *settingsManager) handleSettingsHistoryReq(w http.ResponseWriter, r *http.Request) {
+	if !s.validateAuth(w, r) {
+		return
+	}
+
+	if r.Method == "POST" {
+		rev, err := strconv.ParseUint(r.URL.Query().Get("revert"), 10, 64)
+		if err != nil {
+			s.writeError(w, fmt.Errorf("Invalid revert revision (%v)", err))
+			return
+		}
+		if err = s.Revert(rev); err == errSettingsShutdown {
+			s.writeUnavailable(w, err)
+			return
+		} else if err != nil {
+			s.writeError(w, err)
+			return
+		}
+		s.writeOk(w)
 	} else if r.Method == "GET" {
-		settingsConfig, err := common.GetSettingsConfig(s.config)
+		data, err := json.Marshal(s.history.list())
 		if err != nil {
 			s.writeError(w, err)
 			return
 		}
-		s.writeJson(w, settingsConfig.FilterConfig(".settings.").Json())
+		s.writeJson(w, data)
 	} else {
 		s.writeError(w, errors.New("Unsupported method"))
 		return
 	}
 }
 
+// Revert restores the settings of revision `rev` from history.
+func (s *settingsManager) Revert(rev uint64) error {
+	revision, ok := s.history.get(rev)
+	if !ok {
+		return fmt.Errorf("Settings revision %v not found in history", rev)
+	}
+	return s.restoreSettings(revision)
+}
+
+// RevertToLastGood restores the last settings, prior to the current
+// settings, that were applied without error.
+func (s *settingsManager) RevertToLastGood() error {
+	revision, ok := s.history.lastGood()
+	if !ok {
+		return errors.New("No last good settings in history")
+	}
+	return s.restoreSettings(revision)
+}
+
+// restoreSettings sets settings of revision in metakv, with CAS against
+// the current metakv revision.
+func (s *settingsManager) restoreSettings(revision settingsRevision) error {
+	if !s.writes.begin() {
+		return errSettingsShutdown
+	}
+	defer s.writes.end()
+
+	_, rev, err := metakv.Get(common.IndexingSettingsMetaPath)
+	if err != nil {
+		return err
+	}
+	logging.Infof("Reverting settings to revision %v", revision.Rev)
+	return metakv.Set(common.IndexingSettingsMetaPath, []byte(revision.Settings), rev)
+}
+
+// record settings received from metakv as the latest revision.
+func (h *settingsHistory) record(value []byte, good bool) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	if n := len(h.revs); n > 0 && h.revs[n-1].Settings == string(value) {
+		return
+	}
+	h.revs = append(h.revs, settingsRevision{
+		Rev:      h.nextRev,
+		Time:     time.Now(),
+		Good:     good,
+		Settings: string(value),
+	})
+	h.nextRev++
+	if len(h.revs) > settingsHistorySize {
+		h.revs = h.revs[len(h.revs)-settingsHistorySize:]
+	}
+}
+
+// list revisions, latest first.
+func (h *settingsHistory) list() []settingsRevision {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	revs := make([]settingsRevision, 0, len(h.revs))
+	for i := len(h.revs) - 1; i >= 0; i-- {
+		revs = append(revs, h.revs[i])
+	}
+	return revs
+}
+
+func (h *settingsHistory) get(rev uint64) (settingsRevision, bool) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	for _, revision := range h.revs {
+		if revision.Rev == rev {
+			return revision, true
+		}
+	}
+	return settingsRevision{}, false
+}
+
+// lastGood returns the latest good revision prior to the current one.
+func (h *settingsHistory) lastGood() (settingsRevision, bool) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	for i := len(h.revs) - 2; i >= 0; i-- {
+		if h.revs[i].Good {
+			return h.revs[i], true
+		}
+	}
+	return settingsRevision{}, false
+}
+
+// settingsETag returns the ETag of settings at metakv revision rev, or
+// "" if there is no revision.
+func settingsETag(rev interface{}) string {
+	if rev == nil {
+		return ""
+	}
+	return fmt.Sprintf("\"%x\"", rev)
+}
+
 func (s *settingsManager) handleCompactionTrigger(w http.ResponseWriter, r *http.Request) {
 	if !s.validateAuth(w, r) {
 		return
 	}
+	if !s.writes.begin() {
+		s.writeUnavailable(w, errSettingsShutdown)
+		return
+	}
+	defer s.writes.end()
+
 	_, rev, err := metakv.Get(indexCompactonMetaPath)
 	if err != nil {
 		s.writeError(w, err)
@@ -174,6 +504,7 @@ loop:
 			if ok {
 				if cmd.GetMsgType() == STORAGE_MGR_SHUTDOWN {
 					logging.Infof("SettingsManager::run Shutting Down")
+					s.writes.shutdown()
 					close(s.cancelCh)
 					s.supvCmdch <- &MsgSuccess{}
 					break loop
@@ -185,23 +516,189 @@ loop:
 	}
 }
 
-func (s *settingsManager) metaKVCallback(path string, value []byte, rev interface{}) error {
-	if path == common.IndexingSettingsMetaPath {
-		logging.Infof("New settings received: \n%s", string(value))
-		config := s.config.Clone()
-		config.Update(value)
-		setBlockPoolSize(s.config, config)
-		s.config = config
+// begin a metakv write, returns false if shutdown has begun.
+func (sw *settingsWrites) begin() bool {
+	sw.mu.Lock()
+	defer sw.mu.Unlock()
+
+	if sw.closed {
+		return false
+	}
+	sw.wg.Add(1)
+	return true
+}
 
-		ncpu := common.SetNumCPUs(config["indexer.settings.max_cpu_percent"].Int())
-		logging.Infof("Setting maxcpus = %d", ncpu)
+func (sw *settingsWrites) end() {
+	sw.wg.Done()
+}
+
+// shutdown rejects new writes and waits for in-flight writes.
+func (sw *settingsWrites) shutdown() {
+	sw.mu.Lock()
+	sw.closed = true
+	sw.mu.Unlock()
+
+	sw.wg.Wait()
+}
+
+// Subscribe returns a channel on which a copy of the config is delivered
+// on every settings change. A slow subscriber only misses the older
+// configs, it never blocks the notifier.
+func (s *settingsManager) Subscribe() <-chan common.Config {
+	s.subscribers.mu.Lock()
+	defer s.subscribers.mu.Unlock()
 
-		setLogger(config)
+	ch := make(chan common.Config, settingsSubscriberChSize)
+	s.subscribers.chans[ch] = ch
+	return ch
+}
 
-		indexerConfig := s.config.SectionConfig("indexer.", true)
-		s.supvMsgch <- &MsgConfigUpdate{
-			cfg: indexerConfig,
+// Unsubscribe a channel returned by Subscribe, the channel is closed.
+func (s *settingsManager) Unsubscribe(ch <-chan common.Config) {
+	s.subscribers.mu.Lock()
+	defer s.subscribers.mu.Unlock()
+
+	if c, ok := s.subscribers.chans[ch]; ok {
+		delete(s.subscribers.chans, ch)
+		close(c)
+	}
+}
+
+// notify subscribers with config, dropping the oldest undelivered
+// config of a subscriber if its channel is full.
+func (s *settingsManager) notify(config common.Config) {
+	s.subscribers.mu.Lock()
+	defer s.subscribers.mu.Unlock()
+
+	for _, ch := range s.subscribers.chans {
+		for {
+			select {
+			case ch <- config.Clone():
+			default:
+				select {
+				case <-ch:
+				default:
+				}
+				continue
+			}
+			break
 		}
+	}
+}
+
+// handleHealthReq returns 200 if the metakv observer is connected,
+// otherwise 503, along with the last successful metakv sync time.
+func (s *settingsManager) handleHealthReq(w http.ResponseWriter, r *http.Request) {
+	status := s.observer.status()
+	data, err := json.Marshal(status)
+	if err != nil {
+		s.writeError(w, err)
+		return
+	}
+
+	header := w.Header()
+	header["Content-Type"] = []string{"application/json"}
+	if status.Connected {
+		w.WriteHeader(http.StatusOK)
+	} else {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}
+	w.Write(data)
+	w.Write([]byte("\n"))
+}
+
+type settingsObserverStatus struct {
+	Connected bool      `json:"connected"`
+	LastSync  time.Time `json:"lastSync"`
+	Error     string    `json:"error,omitempty"`
+}
+
+func (so *settingsObserver) synced() {
+	so.mu.Lock()
+	defer so.mu.Unlock()
+
+	so.connected = true
+	so.lastSync = time.Now()
+	so.lastErr = nil
+}
+
+func (so *settingsObserver) disconnected(err error) {
+	so.mu.Lock()
+	defer so.mu.Unlock()
+
+	so.connected = false
+	so.lastErr = err
+}
+
+func (so *settingsObserver) status() settingsObserverStatus {
+	so.mu.Lock()
+	defer so.mu.Unlock()
+
+	status := settingsObserverStatus{Connected: so.connected, LastSync: so.lastSync}
+	if so.lastErr != nil {
+		status.Error = so.lastErr.Error()
+	}
+	return status
+}
+
+// getConfig returns the current config, which is never modified in place.
+func (s *settingsManager) getConfig() common.Config {
+	s.configMu.Lock()
+	defer s.configMu.Unlock()
+
+	return s.config
+}
+
+// getSettings returns the current config, along with the settings and the
+// revision last received from metakv, refer metaKVCallback.
+func (s *settingsManager) getSettings() (common.Config, []byte, interface{}) {
+	s.configMu.Lock()
+	defer s.configMu.Unlock()
+
+	return s.config, s.settings, s.settingsRev
+}
+
+// applySettings applies settings value to a copy of the current config,
+// makes it the current config and notifies the supervisor and subscribers.
+// The whole sequence is serialized by applyMu, so that concurrent updates
+// are not lost and the latest config is the last one notified.  configMu
+// is not held while notifying, so that getConfig() does not block on the
+// supervisor.
+func (s *settingsManager) applySettings(value []byte, rev interface{}) {
+	s.applyMu.Lock()
+	defer s.applyMu.Unlock()
+
+	oldConfig := s.getConfig()
+	config := oldConfig.Clone()
+	err := config.UpdateStrict(value)
+	if err != nil {
+		logging.Errorf("Failed to apply settings (%v)", err)
+	}
+	s.history.record(value, err == nil)
+	setBlockPoolSize(oldConfig, config)
+
+	s.configMu.Lock()
+	s.config, s.settings, s.settingsRev = config, value, rev
+	s.configMu.Unlock()
+
+	ncpu := common.SetNumCPUs(common.NewIndexerSettings(config).MaxCpuPercent())
+	logging.Infof("Setting maxcpus = %d", ncpu)
+
+	setLogger(config)
+
+	indexerConfig := config.SectionConfig("indexer.", true)
+	s.supvMsgch <- &MsgConfigUpdate{
+		cfg: indexerConfig,
+	}
+	s.notify(config)
+}
+
+func (s *settingsManager) metaKVCallback(path string, value []byte, rev interface{}) error {
+	s.observer.synced()
+
+	if path == common.IndexingSettingsMetaPath {
+		logging.Infof("New settings received: \n%s", string(value))
+		s.applySettings(value, rev)
 	} else if path == indexCompactonMetaPath {
 		currentToken := s.compactionToken
 		s.compactionToken = value
@@ -238,7 +735,7 @@ func (s *settingsManager) metaKVCallback(path string, value []byte, rev interfac
 }
 
 func setLogger(config common.Config) {
-	logLevel := config["indexer.settings.log_level"].String()
+	logLevel := common.NewIndexerSettings(config).LogLevel()
 	level := logging.Level(logLevel)
 	logging.Infof("Setting log level to %v", level)
 	logging.SetLogLevel(level)
@@ -247,10 +744,10 @@ func setLogger(config common.Config) {
 func setBlockPoolSize(o, n common.Config) {
 	var oldSz, newSz int
 	if o != nil {
-		oldSz = o["indexer.settings.bufferPoolBlockSize"].Int()
+		oldSz = common.NewIndexerSettings(o).BufferPoolBlockSize()
 	}
 
-	newSz = n["indexer.settings.bufferPoolBlockSize"].Int()
+	newSz = common.NewIndexerSettings(n).BufferPoolBlockSize()
 
 	if oldSz < newSz {
 		pipeline.SetupBlockPool(newSz)
@@ -393,6 +393,12 @@ func (r *mutationStreamReader) handleStreamInfoMsg(msg interface{}) {
 			r.supvRespch <- supvMsg
 		}
 
+	case dataport.SeqnoError:
+		//reported only when indexer.dataport.gapDetection is enabled, the
+		//mutations are still processed.
+		logging.Errorf("MutationStreamReader::handleStreamInfoMsg \n\tReceived SeqnoError "+
+			"from Client for Stream %v %v.", r.streamId, msg.(dataport.SeqnoError))
+
 	default:
 		logging.Errorf("MutationStreamReader::handleStreamError \n\tReceived Unknown Message "+
 			"from Client for Stream %v.", r.streamId)
@@ -46,6 +46,39 @@ var TIME_INTERVAL = time.Duration(2000) * time.Millisecond
 // Stream Monitor (2m)
 var MONITOR_INTERVAL = time.Duration(120000) * time.Millisecond
 
+// Wait for stream to be active (100ms)
+var WAIT_ACTIVE_POLL_INTERVAL = time.Duration(100) * time.Millisecond
+
+// Window to collect concurrent requests of BatchAddIndexesToStream (100ms)
+var ADD_INDEX_BATCH_WINDOW = time.Duration(100) * time.Millisecond
+
+// Missing vbuckets tolerated for a low priority bucket before forcing a retry
+var LOW_PRIORITY_VB_BUDGET = 64
+
+// Concurrent stream setups (of NUM_VB vbuckets each) admitted by ProjectorAdmin
+var MAX_CONCURRENT_STREAM_SETUPS = 4
+
+// Retries of RestartStreamIfNecessary with a changed vbmap before giving up
+var MAX_VBMAP_CHANGE_RETRIES = 10
+
+// Initial backoff of RestartStreamIfNecessary before retrying vbuckets without owner (100ms)
+var UNLOCATED_VB_RETRY_INTERVAL = time.Duration(100) * time.Millisecond
+
+// Maximum backoff of RestartStreamIfNecessary before retrying vbuckets without owner (5s)
+var MAX_UNLOCATED_VB_RETRY_INTERVAL = time.Duration(5) * time.Second
+
+// Retries of RestartStreamIfNecessary for vbuckets without owner before giving up
+var MAX_UNLOCATED_VB_RETRIES = 60
+
+// Time to cache the pool services to look up the projector of a node (30s)
+var POOL_SERVICES_CACHE_TTL = time.Duration(30) * time.Second
+
+// Time to use the default projector address of a node whose projector cannot be looked up (5s)
+var PROJECTOR_ADDR_FALLBACK_TTL = time.Duration(5) * time.Second
+
+// Time for a projector to respond to the ping of ProjectorAdmin.PreflightPing (5s)
+var PROJECTOR_PING_TIMEOUT = time.Duration(5) * time.Second
+
 /////////////////////////////////////////////
 // Constant
 /////////////////////////////////////////////
@@ -65,7 +98,12 @@ const MAINT_TOPIC = "MAINT_STREAM_TOPIC"
 const CATCHUP_TOPIC = "CATCHUP_STREAM_TOPIC"
 const INIT_TOPIC = "INIT_STREAM_TOPIC"
 
-const MAX_PROJECTOR_RETRY_ELAPSED_TIME = int64(time.Minute) * 5
+const MAX_PROJECTOR_RETRY_ELAPSED_TIME = time.Minute * 5
+
+// Expected number of attempts within MAX_PROJECTOR_RETRY_ELAPSED_TIME, each
+// request to projector is bounded by the share of a single attempt.
+const MAX_PROJECTOR_RETRY_ATTEMPTS = 10
+const MIN_PROJECTOR_REQUEST_TIMEOUT = time.Second * 10
 
 // Timer
 const TIMESTAMP_HISTORY_COUNT = 10
@@ -10,6 +10,7 @@
 package manager
 
 import (
+	"errors"
 	"fmt"
 )
 
@@ -45,16 +46,17 @@ const (
 	ERROR_WATCH_NO_ADDR_AVAIL = 251
 
 	// Stream (301-350)
-	ERROR_STREAM_INVALID_ARGUMENT   = 301
-	ERROR_STREAM_NOT_OPEN           = 302
-	ERROR_STREAM_REQUEST_ERROR      = 303
-	ERROR_STREAM_WRONG_VBUCKET      = 304
-	ERROR_STREAM_INVALID_TIMESTAMP  = 305
-	ERROR_STREAM_PROJECTOR_TIMEOUT  = 306
-	ERROR_STREAM_INVALID_KVADDRS    = 307
-	ERROR_STREAM_STREAM_END         = 308
-	ERROR_STREAM_FEEDER             = 309
-	ERROR_STREAM_INCONSISTENT_VBMAP = 310
+	ERROR_STREAM_INVALID_ARGUMENT      = 301
+	ERROR_STREAM_NOT_OPEN              = 302
+	ERROR_STREAM_REQUEST_ERROR         = 303
+	ERROR_STREAM_WRONG_VBUCKET         = 304
+	ERROR_STREAM_INVALID_TIMESTAMP     = 305
+	ERROR_STREAM_PROJECTOR_TIMEOUT     = 306
+	ERROR_STREAM_INVALID_KVADDRS       = 307
+	ERROR_STREAM_STREAM_END            = 308
+	ERROR_STREAM_FEEDER                = 309
+	ERROR_STREAM_INCONSISTENT_VBMAP    = 310
+	ERROR_STREAM_PROJECTOR_UNREACHABLE = 311
 )
 
 type errSeverity int16
@@ -83,6 +85,11 @@ type Error struct {
 	category errCategory
 	cause    error
 	msg      string
+
+	// optional context of the error
+	op     string
+	bucket string
+	node   string
 }
 
 func NewError(code errCode, severity errSeverity, category errCategory, cause error, msg string) Error {
@@ -118,8 +125,38 @@ func NewError2(code errCode, category errCategory) Error {
 }
 
 func (e Error) Error() string {
-	return fmt.Sprintf("Error :: code= %d, severity= %s, category= %s, reason= %s, cause= %s",
+	str := fmt.Sprintf("Error :: code= %d, severity= %s, category= %s, reason= %s, cause= %s",
 		e.code, severity(e.severity), category(e.category), e.msg, e.cause)
+
+	if e.op != "" {
+		str += fmt.Sprintf(", op= %s", e.op)
+	}
+	if e.bucket != "" {
+		str += fmt.Sprintf(", bucket= %s", e.bucket)
+	}
+	if e.node != "" {
+		str += fmt.Sprintf(", node= %s", e.node)
+	}
+	return str
+}
+
+//
+// Is reports whether target is an Error with the same code, so that
+// errors.Is(err, NewError2(code, category)) matches on the code only.
+//
+func (e Error) Is(target error) bool {
+	t, ok := target.(Error)
+	return ok && t.code == e.code
+}
+
+//
+// AsStreamError returns err as an Error.  It returns false if err is not an
+// Error, e.g. a raw network error from the projector client.
+//
+func AsStreamError(err error) (Error, bool) {
+	var e Error
+	ok := errors.As(err, &e)
+	return e, ok
 }
 
 func category(category errCategory) string {
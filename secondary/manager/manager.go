@@ -115,7 +115,17 @@ type RequestServer interface {
 //
 func NewIndexManager(addrProvider common.ServiceAddressProvider, config common.Config) (mgr *IndexManager, err error) {
 
-	return NewIndexManagerInternal(addrProvider, NewProjectorAdmin(nil, nil, nil), config)
+	// If enabled, topics are prefixed by the indexer node address, so that the streams
+	// of multiple indexers sharing the projector nodes do not collide.  It is off by
+	// default, since the prefix changes the topic names of existing streams.
+	admin := NewProjectorAdmin(nil, nil, nil, common.SystemConfig["manager.poolName"].String())
+	if common.SystemConfig["manager.topicPrefixByNode"].Bool() {
+		if addr, err := addrProvider.GetLocalServiceAddress(common.INDEX_ADMIN_SERVICE); err == nil {
+			admin.TopicPrefix = addr + "/"
+		}
+	}
+
+	return NewIndexManagerInternal(addrProvider, admin, config)
 }
 
 //
@@ -254,6 +264,10 @@ func (m *IndexManager) Close() {
 		m.repo.Close()
 	}
 
+	if closer, ok := m.admin.(interface{ Close() }); ok {
+		closer.Close()
+	}
+
 	m.isClosed = true
 }
 
@@ -600,11 +614,15 @@ func (m *IndexManager) startMasterService() error {
 		// listening node.   This goroutine will be started when
 		// the indexer node becomes the coordinator master.
 		m.timestampPersistInterval = TIMESTAMP_PERSIST_INTERVAL
-		m.timer = newTimer(m.repo)
+		poolName := DEFAULT_POOL_NAME
+		if pa, ok := admin.(interface{ PoolName() string }); ok {
+			poolName = pa.PoolName()
+		}
+		m.timer = newTimer(m.repo, poolName)
 		m.timekeeperStopCh = make(chan bool)
 		go m.runTimestampKeeper()
 
-		monitor := NewStreamMonitor(m, m.timer)
+		monitor := NewStreamMonitor(m, m.timer, poolName)
 
 		// Initialize the stream manager.
 		admin.Initialize(monitor)
@@ -10,14 +10,20 @@
 package manager
 
 import (
-	"github.com/couchbase/indexing/secondary/logging"
+	"context"
+	"fmt"
+	ap "github.com/couchbase/indexing/secondary/adminport"
 	"github.com/couchbase/indexing/secondary/common"
+	"github.com/couchbase/indexing/secondary/logging"
 	couchbase "github.com/couchbase/indexing/secondary/dcp"
 	projectorC "github.com/couchbase/indexing/secondary/projector/client"
 	protobuf "github.com/couchbase/indexing/secondary/protobuf/projector"
 	"net"
+	"net/url"
+	"sort"
 	"strconv"
 	"strings"
+	"sync"
 	"time"
 )
 
@@ -68,10 +74,84 @@ type VbMap map[string][]uint16
 //       timestamp received so far (in this case, it will be the consolidated active timestamp).  This step is just to ensure
 //       liveness property in presence of bugs or race conditions (when projector protocol is not honored).
 //
+// ProjectorAdmin is safe for concurrent use, including concurrent requests for the same stream and
+// Initialize().  The state of ProjectorAdmin (including the stream monitor) is guarded by its mutex,
+// while the factory, env and StreamMonitor are safe for concurrent use on their own.  Concurrent
+// AddIndexToStream() for the same stream are serialized, so that each MutationTopicRequest sees the
+// topic left by the previous one.  Other requests for the same stream are not ordered with respect
+// to each other though, the caller must serialize them if the order matters (e.g. AddIndexToStream
+// followed by DeleteIndexFromStream).
+//
 type ProjectorAdmin struct {
 	factory ProjectorStreamClientFactory
 	env     ProjectorClientEnv
-	monitor *StreamMonitor
+	monitor *StreamMonitor // protected by mutex, refer getMonitor()
+
+	// instances that have been successfully added to each stream
+	instances map[common.StreamId]map[uint64]string
+	// nodes that each stream has been sent to
+	nodes map[common.StreamId]map[string]string
+	// last version sent to projector for each instance
+	versions map[uint64]uint64
+	mutex    sync.Mutex
+
+	// pending batch of BatchAddIndexesToStream requests for each stream
+	batches map[common.StreamId]*addIndexBatch
+	// serialize AddIndexToStream for each stream, refer lockStream()
+	streamLocks map[common.StreamId]chan bool
+
+	// Priority of each bucket, higher value is higher priority.  Buckets not
+	// in the map have priority 0.  AddIndexToStream() starts the buckets of
+	// higher priority first.  The missing vbuckets of a bucket with negative
+	// priority are tolerated, refer validateActiveVb().  Must not be modified
+	// while the admin is in use.
+	BucketPriority map[string]int
+
+	// Admission control of concurrent stream setups in AddIndexToStream().
+	// No admission control if nil.
+	Admission *StreamAdmissionController
+
+	// Prepended to the topic of each stream, so that the topics of multiple
+	// indexers sharing the projector nodes do not collide.  Empty prefix
+	// uses the topic as is.  IndexManager sets it only if
+	// manager.topicPrefixByNode is enabled.
+	TopicPrefix string
+
+	// If set, upon ErrorTopicExist from a projector node, the instances are
+	// added to the live topic with AddInstances(), and the active timestamps
+	// of the topic are used for that node.  Otherwise ErrorTopicExist fails
+	// AddIndexToStream().  Set by default, refer NewProjectorAdmin().
+	TreatTopicExistAsSuccess bool
+
+	// If set, AddIndexToStream() pings the projector of each node before
+	// sending any request, and fails with ERROR_STREAM_PROJECTOR_UNREACHABLE
+	// if a projector does not respond within PROJECTOR_PING_TIMEOUT, instead
+	// of retrying the node until MAX_PROJECTOR_RETRY_ELAPSED_TIME.
+	PreflightPing bool
+
+	// pool of the buckets served by the streams, refer NewProjectorAdmin()
+	poolName string
+}
+
+//
+// AddIndexRequest is a request to add index instances to a stream, refer
+// BatchAddIndexesToStream().
+//
+type AddIndexRequest struct {
+	Buckets           []string
+	Instances         []*protobuf.Instance
+	RequestTimestamps []*common.TsVbuuid
+}
+
+type addIndexBatch struct {
+	requests []AddIndexRequest
+	donech   chan bool
+	err      error
+
+	// cancelled once the ctx of all the waiting requests are done
+	ctx     context.Context
+	cancel  context.CancelFunc
+	waiting int
 }
 
 type adminWorker struct {
@@ -79,50 +159,148 @@ type adminWorker struct {
 	server           string
 	streamId         common.StreamId
 	activeTimestamps []*protobuf.TsVbuuid
+	completeBuckets  map[string]bool
+	topicActive      bool
 	err              error
 	killch           chan bool
+	killOnce         sync.Once
 }
 
 type ProjectorStreamClient interface {
 	MutationTopicRequest(topic, endpointType string, reqTimestamps []*protobuf.TsVbuuid,
 		instances []*protobuf.Instance) (*protobuf.TopicResponse, error)
-	DelInstances(topic string, uuids []uint64) error
+	AddInstances(topic string, instances []*protobuf.Instance) (*protobuf.TimestampResponse, error)
+	DelInstances(topic string, uuids []uint64, version uint64) error
 	RepairEndpoints(topic string, endpoints []string) error
 	InitialRestartTimestamp(pooln, bucketn string) (*protobuf.TsVbuuid, error)
 	RestartVbuckets(topic string, restartTimestamps []*protobuf.TsVbuuid) (*protobuf.TopicResponse, error)
+	GetActiveTopics() ([]string, error)
+	GetFailoverLogs(pooln, bucketn string, vbnos []uint32) (*protobuf.FailoverLogResponse, error)
+	Ping() error
 }
 
 type ProjectorStreamClientFactory interface {
 	GetClientForNode(server string) ProjectorStreamClient
+	CloseClientForNode(server string)
 }
 
 type ProjectorStreamClientFactoryImpl struct {
+	clientCache map[string]*projectorClientEntry // projector addr -> client
+	nodeAddrs   map[string]string                // node -> projector addr
+	env         ProjectorClientEnv
+	clusterURL  string
+	poolName    string
+	timeout     time.Duration
+	mutex       sync.Mutex
+	stopch      chan bool
+	stopOnce    sync.Once
+
+	// pool services to look up the projector address of a node, cached
+	// for POOL_SERVICES_CACHE_TTL
+	poolServices        *couchbase.PoolServices
+	poolServicesFetched time.Time
+	fetchPoolServices   func() (*couchbase.PoolServices, error)
+
+	// nodes using the default projector address because the lookup failed,
+	// and when to look up the projector again
+	fallbackExpiry map[string]time.Time
+
+	// If set, requests to projector are sent via the proxy.  It must be set
+	// before the first call to GetClientForNode().
+	ProxyURL *url.URL
+
+	// Projector address for a node, used as is instead of looking up the
+	// cluster services, e.g. to point tests at a projector mock.  It must be
+	// set before the first call to GetClientForNode().
+	NodeToProjectorMap map[string]string
+}
+
+type projectorClientEntry struct {
+	once   sync.Once
+	client *projectorC.Client // protected by the factory mutex
 }
 
 type ProjectorClientEnv interface {
 	GetNodeListForBuckets(buckets []string) (map[string]string, error)
 	GetNodeListForTimestamps(timestamps []*common.TsVbuuid) (map[string][]*protobuf.TsVbuuid, error)
+	GetPartialNodeListForTimestamps(timestamps []*common.TsVbuuid) (map[string][]*protobuf.TsVbuuid, []*common.TsVbuuid, error)
 	FilterTimestampsForNode(timestamps []*protobuf.TsVbuuid, node string) ([]*protobuf.TsVbuuid, error)
 }
 
+//
+// Optionally implemented by a ProjectorClientEnv to cancel the requests to the
+// cluster once ctx is done, refer getNodeListForBuckets() and
+// filterTimestampsForNode().
+//
+type ProjectorClientEnvWithContext interface {
+	GetNodeListForBucketsWithContext(ctx context.Context, buckets []string) (map[string]string, error)
+	GetNodeListForTimestampsWithContext(ctx context.Context,
+		timestamps []*common.TsVbuuid) (map[string][]*protobuf.TsVbuuid, error)
+	GetPartialNodeListForTimestampsWithContext(ctx context.Context,
+		timestamps []*common.TsVbuuid) (map[string][]*protobuf.TsVbuuid, []*common.TsVbuuid, error)
+	FilterTimestampsForNodeWithContext(ctx context.Context,
+		timestamps []*protobuf.TsVbuuid, node string) ([]*protobuf.TsVbuuid, error)
+}
+
 type ProjectorClientEnvImpl struct {
+	clusterURL string
+	poolName   string
+	timeout    time.Duration
+
+	// vbmap cache, keyed by bucket
+	vbmapTTL   time.Duration
+	vbmapCache map[string]*vbmapCacheEntry
+	fetchVBMap func(ctx context.Context, bucket string) (vbOwnerLookup, error)
+	mutex      sync.Mutex
+}
+
+type vbmapCacheEntry struct {
+	vbmap   vbOwnerLookup
+	fetched time.Time
+}
+
+//
+// Lookup the kv node hosting the active copy of a vbucket, refer
+// couchbase.Bucket.NodeForVbucket.
+//
+type vbOwnerLookup interface {
+	NodeForVbucket(vbno uint16) (string, error)
 }
 
 /////////////////////////////////////////////////////////////////////////
 // ProjectorAdmin - Public Function
 /////////////////////////////////////////////////////////////////////////
 
-func NewProjectorAdmin(factory ProjectorStreamClientFactory, env ProjectorClientEnv, monitor *StreamMonitor) *ProjectorAdmin {
-	if factory == nil {
-		factory = newProjectorStreamClientFactoryImpl()
+//
+// Create a ProjectorAdmin for the buckets in the given pool.  An empty pool
+// name defaults to DEFAULT_POOL_NAME.  A nil env or factory is created for
+// that pool from the system config.
+//
+func NewProjectorAdmin(factory ProjectorStreamClientFactory, env ProjectorClientEnv, monitor *StreamMonitor,
+	poolName string) *ProjectorAdmin {
+
+	if poolName == "" {
+		poolName = DEFAULT_POOL_NAME
 	}
 	if env == nil {
-		env = newProjectorClientEnvImpl()
+		env = newProjectorClientEnvImpl(poolName)
+	}
+	if factory == nil {
+		interval := common.SystemConfig["manager.projectorclient.cleanupInterval"].Int()
+		factory = newProjectorStreamClientFactoryImpl(env, poolName, time.Duration(interval)*time.Millisecond)
 	}
 	return &ProjectorAdmin{
-		factory: factory,
-		env:     env,
-		monitor: monitor}
+		factory:   factory,
+		env:       env,
+		monitor:   monitor,
+		poolName:  poolName,
+		instances: make(map[common.StreamId]map[uint64]string),
+		nodes:     make(map[common.StreamId]map[string]string),
+		versions:  make(map[uint64]uint64),
+		batches:   make(map[common.StreamId]*addIndexBatch),
+		Admission: NewStreamAdmissionController(MAX_CONCURRENT_STREAM_SETUPS),
+
+		TreatTopicExistAsSuccess: true}
 }
 
 //
@@ -133,7 +311,22 @@ func (p *ProjectorAdmin) AddIndexToStream(streamId common.StreamId,
 	instances []*protobuf.Instance,
 	requestTimestamps []*common.TsVbuuid) error {
 
-	logging.Debugf("ProjectorAdmin::AddIndexToStream(): streamId=%v", streamId)
+	return p.AddIndexToStreamWithContext(context.Background(), streamId, buckets, instances, requestTimestamps)
+}
+
+//
+// Add new index instances to a stream.  The context bounds the whole stream setup,
+// including the admission, refer StreamAdmissionController, the node lookup and the
+// retries of the projector requests.  Returns ctx.Err() once ctx is done; the
+// requests that have been sent to projector are not rolled back.
+//
+func (p *ProjectorAdmin) AddIndexToStreamWithContext(ctx context.Context,
+	streamId common.StreamId,
+	buckets []string,
+	instances []*protobuf.Instance,
+	requestTimestamps []*common.TsVbuuid) error {
+
+	logging.Debugf("ProjectorAdmin::AddIndexToStream(): start. %v", p.streamLogFields(streamId))
 
 	// If there is no bucket or index instances, nothing to start.
 	if len(buckets) == 0 || len(instances) == 0 {
@@ -142,100 +335,460 @@ func (p *ProjectorAdmin) AddIndexToStream(streamId common.StreamId,
 		return nil
 	}
 
-	shouldRetry := true
-	for shouldRetry {
-		shouldRetry = false
+	if err := p.lockStream(ctx, streamId); err != nil {
+		return err
+	}
+	defer p.unlockStream(streamId)
 
-		nodes, err := p.env.GetNodeListForBuckets(buckets)
+	instances = p.findInstancesToAdd(streamId, buckets, instances)
+	if len(instances) == 0 {
+		return nil
+	}
+
+	if p.Admission != nil {
+		numVb := activatingVbCount(buckets, requestTimestamps)
+		logging.Debugf("ProjectorAdmin::AddIndexToStream(): wait for admission. numVb=%v, waiting=%v. %v",
+			numVb, p.Admission.WaitingCount(), p.streamLogFields(streamId))
+		tokens, err := p.Admission.Acquire(ctx, numVb)
 		if err != nil {
 			return err
 		}
-		logging.Debugf("ProjectorAdmin::AddIndexToStream(): len(nodes)=%v", len(nodes))
+		defer p.Admission.Release(tokens)
+	}
 
-		// start worker to create mutation stream
-		workers := make(map[string]*adminWorker)
-		var activeTimestamps []*protobuf.TsVbuuid = nil
-		donech := make(chan *adminWorker, len(nodes))
+	// Start the buckets of higher priority first, so that their streams are not
+	// held up by the buckets of lower priority.
+	levels := p.groupBucketsByPriority(buckets)
+	for _, level := range levels {
+		levelInstances := instances
+		if len(levels) > 1 {
+			levelInstances = filterInstancesByBucket(instances, level)
+		}
+		if err := p.startBuckets(ctx, streamId, buckets, level, levelInstances, requestTimestamps); err != nil {
+			return err
+		}
+	}
 
-		for _, server := range nodes {
-			worker := &adminWorker{
-				admin:            p,
-				server:           server,
-				streamId:         streamId,
-				killch:           make(chan bool, 1),
-				activeTimestamps: nil,
-				err:              nil}
-			workers[server] = worker
-			go worker.addInstances(instances, buckets, requestTimestamps, donech)
+	p.recordInstanceVersions(instances)
+	p.addActiveInstances(streamId, instances)
+	return nil
+}
+
+//
+// Find the instances to send to projector.  The instances that have been sent with a
+// newer version by a concurrent request are skipped.  So are the instances that are
+// already streaming, unless the topic is no longer alive on some projector, in which
+// case all the instances are sent again.  If the topics cannot be listed, e.g. the
+// projector is unreachable or does not support listing topics, the instances are
+// sent again as well, which is safe with TreatTopicExistAsSuccess.
+//
+func (p *ProjectorAdmin) findInstancesToAdd(streamId common.StreamId, buckets []string,
+	instances []*protobuf.Instance) []*protobuf.Instance {
+
+	instances = p.filterStaleInstances(instances)
+	if len(instances) == 0 {
+		logging.Debugf("ProjectorAdmin::AddIndexToStream(): all instances are stale. %v", p.streamLogFields(streamId))
+		return nil
+	}
+
+	delta := p.filterActiveInstances(streamId, instances)
+	if len(delta) != 0 {
+		return delta
+	}
+
+	active, err := p.isTopicActive(streamId, buckets)
+	if err != nil {
+		if isUnsupportedRequestError(err) {
+			logging.Debugf("ProjectorAdmin::AddIndexToStream(): projector does not support listing topics. Send instances again. %v",
+				p.streamLogFields(streamId))
+		} else {
+			logging.Warnf("ProjectorAdmin::AddIndexToStream(): unable to list topics. Send instances again. %v error=%v",
+				p.streamLogFields(streamId), err)
 		}
+		return instances
+	}
+	if active {
+		logging.Debugf("ProjectorAdmin::AddIndexToStream(): all instances are already active. %v", p.streamLogFields(streamId))
+		return nil
+	}
 
-		logging.Debugf("ProjectorAdmin::AddIndexToStream(): len(workers)=%v", len(workers))
+	p.resetActiveInstances(streamId)
+	return instances
+}
 
-		// now wait for the worker to be done
-		// TODO: timeout?
-		for len(workers) != 0 {
-			worker := <-donech
+//
+// Start the stream for the buckets on every node of allBuckets, and retry until each
+// vbucket of the buckets has an active timestamp on one node, refer validateActiveVb().
+// The active timestamps are then handed to the stream monitor.
+//
+func (p *ProjectorAdmin) startBuckets(ctx context.Context,
+	streamId common.StreamId,
+	allBuckets []string,
+	buckets []string,
+	instances []*protobuf.Instance,
+	requestTimestamps []*common.TsVbuuid) error {
 
-			logging.Debugf("ProjectorAdmin::AddIndexToStream(): worker %v done", worker.server)
-			activeTimestamps = append(activeTimestamps, worker.activeTimestamps...)
-			delete(workers, worker.server)
+	// count the missing vbuckets tolerated for low priority buckets across retries.
+	budget := make(map[string]int)
 
-			if worker.err != nil {
-				logging.Debugf("ProjectorAdmin::AddIndexToStream(): worker % has error=%v", worker.server, worker.err)
+	// active timestamps of the <node, bucket> that have returned all the requested
+	// vbuckets.  On retry, only the remaining <node, bucket> are sent to projector.
+	completed := make(map[string]map[string]*protobuf.TsVbuuid)
 
-				// cleanup : kill the other workers
-				for _, worker := range workers {
-					worker.killch <- true
-				}
+	for {
+		if err := ctx.Err(); err != nil {
+			logging.Debugf("ProjectorAdmin::AddIndexToStream(): stop retry. %v error=%v", p.streamLogFields(streamId), err)
+			return err
+		}
 
-				// if it is not a recoverable error, then just return
-				if worker.err.(Error).code != ERROR_STREAM_WRONG_VBUCKET &&
-					worker.err.(Error).code != ERROR_STREAM_INVALID_TIMESTAMP &&
-					worker.err.(Error).code != ERROR_STREAM_INVALID_KVADDRS &&
-					worker.err.(Error).code != ERROR_STREAM_PROJECTOR_TIMEOUT {
-					return worker.err
+		nodes, err := p.findStreamNodes(ctx, streamId, allBuckets)
+		if err != nil {
+			return err
+		}
+
+		for server := range completed {
+			if _, ok := nodes[server]; !ok {
+				delete(completed, server)
+			}
+		}
+
+		activeTimestamps, err := p.runAddInstancesWorkers(ctx, streamId, nodes, buckets, instances,
+			requestTimestamps, completed)
+		if err != nil {
+			// if it is not a recoverable error, then just return
+			if !isRecoverableError(err, ERROR_STREAM_WRONG_VBUCKET, ERROR_STREAM_INVALID_TIMESTAMP,
+				ERROR_STREAM_INVALID_KVADDRS, ERROR_STREAM_PROJECTOR_TIMEOUT) {
+				return err
+			}
+
+			// The vbuckets have moved (e.g. rebalance), possibly onto the nodes
+			// that have completed.  Re-send the request to all the nodes.
+			if isRecoverableError(err, ERROR_STREAM_WRONG_VBUCKET) {
+				completed = make(map[string]map[string]*protobuf.TsVbuuid)
+			}
+
+			logging.Debugf("ProjectorAdmin::AddIndexToStream(): retry adding instances to nodes")
+			continue
+		}
+
+		// TODO: This does not STOP the existing stream if two projectors return active timestamps on
+		// the same vbucket.  This could cause the dataport to have interleaved mutations on the same vbucket.
+		// Need to verify if this situation can happen (e.g. during rebalancing or kv split brain).
+		if !p.validateActiveVb(buckets, activeTimestamps, requestTimestamps, budget) {
+			// The vbuckets could have moved across nodes (e.g. duplicate active timestamps).
+			// Re-send the request to all the nodes.
+			completed = make(map[string]map[string]*protobuf.TsVbuuid)
+			continue
+		}
+
+		p.monitorStream(streamId, consolidateActiveTimestamps(activeTimestamps))
+		p.monitorStream(streamId, toleratedTimestamps(p.poolName, buckets, activeTimestamps, requestTimestamps))
+		return nil
+	}
+}
+
+//
+// Get the nodes of the buckets, and record them as the nodes of the stream.  If
+// PreflightPing is set, fail if the projector of any node is unreachable.
+//
+func (p *ProjectorAdmin) findStreamNodes(ctx context.Context, streamId common.StreamId,
+	buckets []string) (map[string]string, error) {
+
+	nodes, err := getNodeListForBuckets(ctx, p.env, buckets)
+	if err != nil {
+		return nil, err
+	}
+	logging.Debugf("ProjectorAdmin::AddIndexToStream(): len(nodes)=%v", len(nodes))
+
+	if p.PreflightPing {
+		if err := p.pingNodes(nodes); err != nil {
+			return nil, err
+		}
+	}
+	p.updateStreamNodes(streamId, nodes)
+
+	return nodes, nil
+}
+
+//
+// Send the instances to the nodes, skipping the <node, bucket> that have completed.
+// Returns the active timestamps of all the nodes, or the error of the first worker
+// that fails.  The <node, bucket> completed by the workers are added to completed.
+//
+func (p *ProjectorAdmin) runAddInstancesWorkers(ctx context.Context,
+	streamId common.StreamId,
+	nodes map[string]string,
+	buckets []string,
+	instances []*protobuf.Instance,
+	requestTimestamps []*common.TsVbuuid,
+	completed map[string]map[string]*protobuf.TsVbuuid) ([]*protobuf.TsVbuuid, error) {
+
+	// start worker to create mutation stream
+	workers := make(map[string]*adminWorker)
+	var activeTimestamps []*protobuf.TsVbuuid = nil
+	donech := make(chan *adminWorker, len(nodes))
+
+	for _, server := range nodes {
+		pending := make([]string, 0, len(buckets))
+		for _, bucket := range buckets {
+			if ts, ok := completed[server][bucket]; ok {
+				if ts != nil {
+					activeTimestamps = append(activeTimestamps, ts)
 				}
+			} else {
+				pending = append(pending, bucket)
+			}
+		}
+		if len(pending) == 0 {
+			logging.Debugf("ProjectorAdmin::AddIndexToStream(): skip completed node %v. %v", server, p.streamLogFields(streamId))
+			continue
+		}
 
-				logging.Debugf("ProjectorAdmin::AddIndexToStream(): retry adding instances to nodes")
-				shouldRetry = true
+		worker := &adminWorker{
+			admin:            p,
+			server:           server,
+			streamId:         streamId,
+			killch:           make(chan bool, 1),
+			activeTimestamps: nil,
+			err:              nil}
+		workers[server] = worker
+		go worker.addInstances(ctx, instances, pending, requestTimestamps, donech)
+	}
+
+	logging.Debugf("ProjectorAdmin::AddIndexToStream(): len(workers)=%v", len(workers))
+
+	// now wait for the worker to be done
+	for len(workers) != 0 {
+		var worker *adminWorker
+		select {
+		case worker = <-donech:
+		case <-ctx.Done():
+			for _, worker := range workers {
+				worker.kill()
+			}
+			logging.Debugf("ProjectorAdmin::AddIndexToStream(): stop waiting for workers. %v error=%v",
+				p.streamLogFields(streamId), ctx.Err())
+			return nil, ctx.Err()
+		}
+
+		logging.Debugf("ProjectorAdmin::AddIndexToStream(): worker done. %v", worker.logFields())
+		activeTimestamps = append(activeTimestamps, worker.activeTimestamps...)
+		delete(workers, worker.server)
+
+		if worker.err != nil {
+			logging.Debugf("ProjectorAdmin::AddIndexToStream(): worker has error. %v error=%v", worker.logFields(), worker.err)
+
+			// cleanup : kill the other workers
+			for _, worker := range workers {
+				worker.kill()
+			}
+			return nil, worker.err
+		}
+
+		recordCompleteBuckets(completed, worker)
+	}
+
+	return activeTimestamps, nil
+}
+
+//
+// Add index instances of the requests to a stream.  Concurrent calls for the same
+// stream within ADD_INDEX_BATCH_WINDOW are batched together, so that a single
+// MutationTopicRequest is sent to each projector node for all the instances.
+// Returns the error of the batch, or ctx.Err() if ctx is done before the batch
+// completes.  The batch is still applied unless the ctx of all its requests are
+// done, in which case the batch is cancelled.
+//
+func (p *ProjectorAdmin) BatchAddIndexesToStream(ctx context.Context, streamId common.StreamId,
+	requests []AddIndexRequest) error {
+
+	p.mutex.Lock()
+	if p.batches == nil {
+		p.batches = make(map[common.StreamId]*addIndexBatch)
+	}
+	batch, ok := p.batches[streamId]
+	if !ok {
+		batch = &addIndexBatch{donech: make(chan bool)}
+		batch.ctx, batch.cancel = context.WithCancel(context.Background())
+		p.batches[streamId] = batch
+		go p.runAddIndexBatch(streamId, batch)
+	}
+	batch.requests = append(batch.requests, requests...)
+	batch.waiting++
+	p.mutex.Unlock()
+
+	select {
+	case <-batch.donech:
+		return batch.err
+	case <-ctx.Done():
+		p.mutex.Lock()
+		batch.waiting--
+		if batch.waiting == 0 {
+			// requests arriving later start a new batch.
+			if p.batches[streamId] == batch {
+				delete(p.batches, streamId)
+			}
+			batch.cancel()
+		}
+		p.mutex.Unlock()
+		return ctx.Err()
+	}
+}
+
+//
+// Wait for the batching window to collect requests, then add the instances of
+// all the requests to the stream.
+//
+func (p *ProjectorAdmin) runAddIndexBatch(streamId common.StreamId, batch *addIndexBatch) {
+
+	defer close(batch.donech)
+	defer batch.cancel()
+
+	time.Sleep(ADD_INDEX_BATCH_WINDOW)
+
+	p.mutex.Lock()
+	if p.batches[streamId] == batch {
+		delete(p.batches, streamId)
+	}
+	requests := batch.requests
+	p.mutex.Unlock()
+
+	if err := batch.ctx.Err(); err != nil {
+		batch.err = err
+		return
+	}
+
+	buckets, instances, requestTimestamps := mergeAddIndexRequests(requests)
+	logging.Debugf("ProjectorAdmin::runAddIndexBatch(): len(requests)=%v, len(instances)=%v. %v",
+		len(requests), len(instances), p.streamLogFields(streamId))
+
+	batch.err = p.AddIndexToStreamWithContext(batch.ctx, streamId, buckets, instances, requestTimestamps)
+}
+
+//
+// Record the active timestamps of the buckets that the worker has completed.
+//
+func recordCompleteBuckets(completed map[string]map[string]*protobuf.TsVbuuid, worker *adminWorker) {
+
+	if len(worker.completeBuckets) == 0 {
+		return
+	}
+
+	if _, ok := completed[worker.server]; !ok {
+		completed[worker.server] = make(map[string]*protobuf.TsVbuuid)
+	}
+
+	activeTsMap := indexTimestampsByBucket(worker.activeTimestamps)
+	for bucket := range worker.completeBuckets {
+		completed[worker.server][bucket] = activeTsMap[bucket]
+	}
+}
+
+//
+// Number of vbuckets activated by a stream setup.  A bucket without request
+// timestamp activates all vbuckets.  Otherwise, only the vbuckets with a seqno
+// or vbuuid in the request timestamp are activated.
+//
+func activatingVbCount(buckets []string, requestTimestamps []*common.TsVbuuid) int {
+
+	count := 0
+	for _, bucket := range buckets {
+		numVb := NUM_VB
+		for _, ts := range requestTimestamps {
+			if ts != nil && ts.Bucket == bucket {
+				numVb = 0
+				for i, seqno := range ts.Seqnos {
+					if seqno != 0 || ts.Vbuuids[i] != 0 {
+						numVb++
+					}
+				}
 				break
 			}
 		}
+		count += numVb
+	}
+	return count
+}
 
-		if !shouldRetry {
-			// TODO: This does not STOP the existing stream if two projectors return active timestamps on
-			// the same vbucket.  This could cause the dataport to have interleaved mutations on the same vbucket.
-			// Need to verify if this situation can happen (e.g. during rebalancing or kv split brain).
-			shouldRetry = !p.validateActiveVb(buckets, activeTimestamps)
+//
+// Merge the requests, buckets and instances are deduplicated.  If more than one
+// request has a request timestamp for the same bucket, the first one is used.
+// For duplicate instances, the last one is used.
+//
+func mergeAddIndexRequests(requests []AddIndexRequest) ([]string, []*protobuf.Instance, []*common.TsVbuuid) {
+
+	var buckets []string = nil
+	var instances []*protobuf.Instance = nil
+	var requestTimestamps []*common.TsVbuuid = nil
+
+	seenBuckets := make(map[string]bool)
+	seenTimestamps := make(map[string]bool)
+	offsets := make(map[uint64]int)
+
+	for _, request := range requests {
+		for _, bucket := range request.Buckets {
+			if !seenBuckets[bucket] {
+				seenBuckets[bucket] = true
+				buckets = append(buckets, bucket)
+			}
 		}
 
-		if !shouldRetry {
-			p.monitorStream(streamId, activeTimestamps)
+		for _, instance := range request.Instances {
+			if offset, ok := offsets[instance.GetUuid()]; ok {
+				instances[offset] = instance
+				continue
+			}
+			offsets[instance.GetUuid()] = len(instances)
+			instances = append(instances, instance)
+		}
+
+		for _, ts := range request.RequestTimestamps {
+			if ts != nil && !seenTimestamps[ts.Bucket] {
+				seenTimestamps[ts.Bucket] = true
+				requestTimestamps = append(requestTimestamps, ts)
+			}
 		}
 	}
 
-	return nil
+	return buckets, instances, requestTimestamps
+}
+
+//
+// Delete the same list of index instances from stream for all the given buckets.
+//
+func (p *ProjectorAdmin) DeleteIndexListFromStream(streamId common.StreamId, buckets []string, instances []uint64) error {
+
+	bucketInstances := make(map[string][]uint64)
+	for _, bucket := range buckets {
+		bucketInstances[bucket] = instances
+	}
+
+	return p.DeleteIndexFromStream(streamId, bucketInstances)
 }
 
 //
-// Delete Index from stream
+// Delete Index from stream.  Each node only deletes the index instances of the buckets
+// that it owns.
 //
-func (p *ProjectorAdmin) DeleteIndexFromStream(streamId common.StreamId, buckets []string, instances []uint64) error {
+func (p *ProjectorAdmin) DeleteIndexFromStream(streamId common.StreamId, bucketInstances map[string][]uint64) error {
 
-	logging.Debugf("StreamAdmin::DeleteIndexFromStream(): streamId=%d", streamId.String())
+	logging.Debugf("ProjectorAdmin::DeleteIndexFromStream(): start. %v", p.streamLogFields(streamId))
 
 	// If there is no bucket or index instances, nothing to start.
-	if len(buckets) == 0 || len(instances) == 0 {
-		logging.Debugf("ProjectorAdmin::DeleteIndexToStream(): len(buckets)=%v, len(instances)=%v",
-			len(buckets), len(instances))
+	if len(bucketInstances) == 0 {
+		logging.Debugf("ProjectorAdmin::DeleteIndexFromStream(): len(buckets)=%v", len(bucketInstances))
 		return nil
 	}
 
+	// Instances that are re-added with a newer version while this request is
+	// in progress are not deleted.
+	versions := p.getInstanceVersions(bucketInstances)
+
 	shouldRetry := true
 	for shouldRetry {
 		shouldRetry = false
 
-		nodes, err := p.env.GetNodeListForBuckets(buckets)
+		nodes, err := p.getNodeInstancesForBuckets(bucketInstances)
 		if err != nil {
 			return err
 		}
@@ -244,7 +797,7 @@ func (p *ProjectorAdmin) DeleteIndexFromStream(streamId common.StreamId, buckets
 		workers := make(map[string]*adminWorker)
 		donech := make(chan *adminWorker, len(nodes))
 
-		for _, server := range nodes {
+		for server, instances := range nodes {
 			worker := &adminWorker{
 				admin:            p,
 				server:           server,
@@ -253,42 +806,82 @@ func (p *ProjectorAdmin) DeleteIndexFromStream(streamId common.StreamId, buckets
 				activeTimestamps: nil,
 				err:              nil}
 			workers[server] = worker
-			go worker.deleteInstances(instances, donech)
+			go worker.deleteInstances(instances, versions, donech)
 		}
 
-		logging.Debugf("ProjectorAdmin::DeleteIndexToStream(): len(workers)=%v", len(workers))
+		logging.Debugf("ProjectorAdmin::DeleteIndexFromStream(): len(workers)=%v", len(workers))
 
 		// now wait for the worker to be done
 		// TODO: timeout?
 		for len(workers) != 0 {
 			worker := <-donech
 
-			logging.Debugf("ProjectorAdmin::DeleteIndexToStream(): worker %v done", worker.server)
+			logging.Debugf("ProjectorAdmin::DeleteIndexFromStream(): worker done. %v", worker.logFields())
 			delete(workers, worker.server)
 
 			if worker.err != nil {
-				logging.Debugf("ProjectorAdmin::DeleteIndexFromStream(): worker % has error=%v", worker.server, worker.err)
+				logging.Debugf("ProjectorAdmin::DeleteIndexFromStream(): worker has error. %v error=%v", worker.logFields(), worker.err)
 
 				// cleanup : kill the other workers
 				for _, worker := range workers {
-					worker.killch <- true
+					worker.kill()
 				}
 
 				// if it is not a recoverable error, then just return
-				if worker.err.(Error).code != ERROR_STREAM_PROJECTOR_TIMEOUT {
+				if !isRecoverableError(worker.err, ERROR_STREAM_PROJECTOR_TIMEOUT) {
 					return worker.err
 				}
 
-				logging.Debugf("ProjectorAdmin::DeleteIndexToStream(): retry adding instances to nodes")
+				logging.Debugf("ProjectorAdmin::DeleteIndexFromStream(): retry adding instances to nodes")
 				shouldRetry = true
 				break
 			}
 		}
 	}
 
+	for _, instances := range bucketInstances {
+		p.removeActiveInstances(streamId, p.filterReaddedInstances(instances, versions))
+	}
+
 	return nil
 }
 
+//
+// Get the index instances to delete for each node, based on the buckets that the node owns.
+//
+func (p *ProjectorAdmin) getNodeInstancesForBuckets(bucketInstances map[string][]uint64) (map[string][]uint64, error) {
+
+	nodeInstances := make(map[string][]uint64)
+	// A node that serves more than one bucket gets the same instance once
+	// (e.g. DeleteIndexListFromStream deletes the same instances for all buckets).
+	added := make(map[string]map[uint64]bool)
+
+	for bucket, instances := range bucketInstances {
+		if len(instances) == 0 {
+			continue
+		}
+
+		nodes, err := p.env.GetNodeListForBuckets([]string{bucket})
+		if err != nil {
+			return nil, err
+		}
+
+		for _, server := range nodes {
+			if _, ok := added[server]; !ok {
+				added[server] = make(map[uint64]bool)
+			}
+			for _, instance := range instances {
+				if !added[server][instance] {
+					added[server][instance] = true
+					nodeInstances[server] = append(nodeInstances[server], instance)
+				}
+			}
+		}
+	}
+
+	return nodeInstances, nil
+}
+
 //
 // Repair the stream by asking the provider to reconnect to the list of endpoints.
 // Once connected, the provider will stream mutations from the current vbucket seqno.
@@ -298,7 +891,7 @@ func (p *ProjectorAdmin) RepairEndpointForStream(streamId common.StreamId,
 	bucketVbnosMap map[string][]uint16,
 	endpoint string) error {
 
-	logging.Debugf("ProjectorAdmin::RepairStreamForEndpoint(): streamId = %d", streamId.String())
+	logging.Debugf("ProjectorAdmin::RepairEndpointForStream(): start. %v endpoint=%v", p.streamLogFields(streamId), endpoint)
 
 	// If there is no bucket, nothing to start.
 	if len(bucketVbnosMap) == 0 {
@@ -342,15 +935,15 @@ func (p *ProjectorAdmin) RepairEndpointForStream(streamId common.StreamId,
 			delete(workers, worker.server)
 
 			if worker.err != nil {
-				logging.Debugf("ProjectorAdmin::RepairEndpointFromStream(): worker % has error=%v", worker.server, worker.err)
+				logging.Debugf("ProjectorAdmin::RepairEndpointForStream(): worker has error. %v error=%v", worker.logFields(), worker.err)
 
 				// cleanup : kill the other workers
 				for _, worker := range workers {
-					worker.killch <- true
+					worker.kill()
 				}
 
 				// if it is not a recoverable error, then just return
-				if worker.err.(Error).code != ERROR_STREAM_PROJECTOR_TIMEOUT {
+				if !isRecoverableError(worker.err, ERROR_STREAM_PROJECTOR_TIMEOUT) {
 					return worker.err
 				}
 
@@ -371,7 +964,7 @@ func (p *ProjectorAdmin) RepairEndpointForStream(streamId common.StreamId,
 func (p *ProjectorAdmin) RestartStreamIfNecessary(streamId common.StreamId,
 	restartTimestamps []*common.TsVbuuid) error {
 
-	logging.Debugf("ProjectorAdmin::RestartStreamIfNecessary(): streamId=%v", streamId)
+	logging.Debugf("ProjectorAdmin::RestartStreamIfNecessary(): start. %v", p.streamLogFields(streamId))
 
 	if len(restartTimestamps) == 0 {
 		logging.Debugf("ProjectorAdmin::RestartStreamIfNecessary(): len(restartTimestamps)=%v",
@@ -379,24 +972,46 @@ func (p *ProjectorAdmin) RestartStreamIfNecessary(streamId common.StreamId,
 		return nil
 	}
 
+	// Node of each <bucket, vbucket> in the previous iterations.  If the vbmap keeps
+	// changing between retries (e.g. flapping rebalance), give up rather than restarting
+	// the vbuckets on a different node on every retry.
+	owners := make(map[string]map[uint32]string)
+	vbmapChanges := 0
+
+	// Backoff before retrying the unlocatable vbuckets, so the vbmap has time to settle.
+	// If the vbuckets still have no owner after MAX_UNLOCATED_VB_RETRIES (e.g. bucket
+	// deleted), give up rather than blocking the caller.
+	backoff := UNLOCATED_VB_RETRY_INTERVAL
+	unlocatedRetries := 0
+
 	shouldRetry := true
 	for shouldRetry {
 		shouldRetry = false
 
-		nodes, err := p.env.GetNodeListForTimestamps(restartTimestamps)
+		// Restart the vbuckets that can be located in the vbmap, and retry only the
+		// unlocatable ones (e.g. during rebalance) in the next iteration.
+		nodes, unlocated, err := p.env.GetPartialNodeListForTimestamps(restartTimestamps)
 		if err != nil {
-			if err.(Error).code == ERROR_STREAM_INCONSISTENT_VBMAP {
-				shouldRetry = true
-				continue
-			}
 			return err
 		}
-		logging.Debugf("ProjectorAdmin::RestartStreamIfNecessary(): len(nodes)=%v", len(nodes))
+		logging.Debugf("ProjectorAdmin::RestartStreamIfNecessary(): len(nodes)=%v len(unlocated)=%v",
+			len(nodes), len(unlocated))
+
+		if moved := updateVbOwners(owners, nodes); len(moved) != 0 {
+			vbmapChanges++
+			logging.Warnf("ProjectorAdmin::RestartStreamIfNecessary(): vbmap changed between retries. %v changes=%v moved=%v",
+				p.streamLogFields(streamId), vbmapChanges, moved)
+
+			if vbmapChanges > MAX_VBMAP_CHANGE_RETRIES {
+				msg := fmt.Sprintf("vbmap changed in %v retries, rebalance may be unstable", vbmapChanges)
+				return enrichError(NewError4(ERROR_STREAM_INCONSISTENT_VBMAP, NORMAL, STREAM, msg),
+					"RestartStreamIfNecessary", "", "")
+			}
+		}
 
 		// start worker to create mutation stream
 		workers := make(map[string]*adminWorker)
 		donech := make(chan *adminWorker, len(nodes))
-		var activeTimestamps []*protobuf.TsVbuuid = nil
 
 		for server, timestamps := range nodes {
 			worker := &adminWorker{
@@ -414,74 +1029,423 @@ func (p *ProjectorAdmin) RestartStreamIfNecessary(streamId common.StreamId,
 
 		// now wait for the worker to be done
 		// TODO: timeout?
-		for len(workers) != 0 {
-			worker := <-donech
-
-			logging.Debugf("ProjectorAdmin::RestartStreamIfNecessary(): worker %v done", worker.server)
-			activeTimestamps = append(activeTimestamps, worker.activeTimestamps...)
-			delete(workers, worker.server)
+		var activeTimestamps []*protobuf.TsVbuuid
+		activeTimestamps, shouldRetry, err = waitForWorkers(workers, donech, ERROR_STREAM_WRONG_VBUCKET,
+			ERROR_STREAM_INVALID_TIMESTAMP, ERROR_STREAM_FEEDER, ERROR_STREAM_STREAM_END, ERROR_STREAM_PROJECTOR_TIMEOUT)
+		if err != nil {
+			return err
+		}
 
-			if worker.err != nil {
-				logging.Debugf("ProjectorAdmin::RestartStreamIfNecessary(): worker % has error=%v", worker.server, worker.err)
+		if !shouldRetry {
+			p.monitorStream(streamId, consolidateActiveTimestamps(activeTimestamps))
+
+			if len(unlocated) != 0 {
+				if unlocatedRetries++; unlocatedRetries > MAX_UNLOCATED_VB_RETRIES {
+					msg := fmt.Sprintf("vbuckets without owner after %v retries: %v",
+						MAX_UNLOCATED_VB_RETRIES, formatUnlocatedVbuckets(unlocated))
+					return enrichError(NewError4(ERROR_STREAM_INCONSISTENT_VBMAP, NORMAL, STREAM, msg),
+						"RestartStreamIfNecessary", unlocated[0].Bucket, "")
+				}
 
-				// cleanup : kill the other workers
-				for _, worker := range workers {
-					worker.killch <- true
+				logging.Debugf("ProjectorAdmin::RestartStreamIfNecessary(): retry unlocatable vbuckets. %v",
+					p.streamLogFields(streamId))
+				time.Sleep(backoff)
+				if backoff *= 2; backoff > MAX_UNLOCATED_VB_RETRY_INTERVAL {
+					backoff = MAX_UNLOCATED_VB_RETRY_INTERVAL
 				}
+				restartTimestamps = unlocated
+				shouldRetry = true
+			}
+		}
+	}
 
-				// if it is not a recoverable error, then just return.
-				if worker.err.(Error).code != ERROR_STREAM_WRONG_VBUCKET &&
-					worker.err.(Error).code != ERROR_STREAM_INVALID_TIMESTAMP &&
-					worker.err.(Error).code != ERROR_STREAM_FEEDER &&
-					worker.err.(Error).code != ERROR_STREAM_STREAM_END &&
-					worker.err.(Error).code != ERROR_STREAM_PROJECTOR_TIMEOUT {
+	return nil
+}
 
-					return worker.err
-				}
+//
+// Format the vbuckets of the timestamps, e.g. "bucket1:[0 5]", for error messages.
+//
+func formatUnlocatedVbuckets(timestamps []*common.TsVbuuid) string {
 
-				logging.Debugf("ProjectorAdmin::RestartStreamIfNecessary(): retry adding instances to nodes")
-				shouldRetry = true
-				break
+	var result []string = nil
+	for _, ts := range timestamps {
+		var vbnos []int = nil
+		for i, seqno := range ts.Seqnos {
+			if seqno != 0 {
+				vbnos = append(vbnos, i)
 			}
 		}
+		result = append(result, fmt.Sprintf("%v:%v", ts.Bucket, vbnos))
+	}
+	return strings.Join(result, " ")
+}
 
-		if !shouldRetry {
-			p.monitorStream(streamId, activeTimestamps)
+//
+// Wait for the workers to be done and collect their active timestamps.  If a worker
+// fails, the other workers are killed.  The worker error is returned unless it has one
+// of the recoverable codes, in which case the request should be retried.
+//
+func waitForWorkers(workers map[string]*adminWorker, donech chan *adminWorker,
+	codes ...errCode) ([]*protobuf.TsVbuuid, bool, error) {
+
+	var activeTimestamps []*protobuf.TsVbuuid = nil
+
+	for len(workers) != 0 {
+		worker := <-donech
+
+		logging.Debugf("ProjectorAdmin::waitForWorkers(): worker done. %v", worker.logFields())
+		activeTimestamps = append(activeTimestamps, worker.activeTimestamps...)
+		delete(workers, worker.server)
+
+		if worker.err != nil {
+			logging.Debugf("ProjectorAdmin::waitForWorkers(): worker has error. %v error=%v", worker.logFields(), worker.err)
+
+			// cleanup : kill the other workers
+			for _, worker := range workers {
+				worker.kill()
+			}
+
+			// if it is not a recoverable error, then just return.
+			if !isRecoverableError(worker.err, codes...) {
+				return activeTimestamps, false, worker.err
+			}
+
+			logging.Debugf("ProjectorAdmin::waitForWorkers(): retry request to nodes")
+			return activeTimestamps, true, nil
 		}
 	}
 
-	return nil
+	return activeTimestamps, false, nil
 }
 
-func (p *ProjectorAdmin) validateActiveVb(buckets []string, activeTimestamps []*protobuf.TsVbuuid) bool {
+//
+// Record the node of each <bucket, vbucket> in nodes, and return the vbuckets that
+// have moved to another node since they were last recorded, as "bucket:vbno from->to".
+//
+func updateVbOwners(owners map[string]map[uint32]string, nodes map[string][]*protobuf.TsVbuuid) []string {
 
-	for _, bucket := range buckets {
-		for vb := 0; vb < NUM_VB; vb++ {
-			found := false
-			for _, ts := range activeTimestamps {
-				if ts.GetBucket() == bucket {
-					for _, ts_vb := range ts.GetVbnos() {
-						if uint32(vb) == ts_vb {
-							if found {
-								logging.Debugf("validateActiveVb(): find duplicate active timestamp for bucket %s vb %d", bucket, vb)
-								return false
-							}
-							found = true
-						}
-					}
+	var moved []string
+	for server, timestamps := range nodes {
+		for _, ts := range timestamps {
+			bucketOwners, ok := owners[ts.GetBucket()]
+			if !ok {
+				bucketOwners = make(map[uint32]string)
+				owners[ts.GetBucket()] = bucketOwners
+			}
+			for _, vbno := range ts.GetVbnos() {
+				if prev, ok := bucketOwners[vbno]; ok && prev != server {
+					moved = append(moved, fmt.Sprintf("%v:%v %v->%v", ts.GetBucket(), vbno, prev, server))
 				}
+				bucketOwners[vbno] = server
 			}
+		}
+	}
+
+	sort.Strings(moved)
+	return moved
+}
+
+//
+// List the projector nodes (for the given buckets) and whether each node
+// believes that the topic for the stream is active.  This can be used to
+// reconcile the intended stream state with the projector, e.g. to detect
+// orphaned topics after indexer restart.
+//
+func (p *ProjectorAdmin) ListActiveStreams(streamId common.StreamId, buckets []string) (map[string]bool, error) {
+
+	logging.Debugf("ProjectorAdmin::ListActiveStreams(): start. %v", p.streamLogFields(streamId))
+
+	result := make(map[string]bool)
+
+	// If there is no bucket, there is no projector node to ask.
+	if len(buckets) == 0 {
+		return result, nil
+	}
+
+	nodes, err := p.env.GetNodeListForBuckets(buckets)
+	if err != nil {
+		return nil, err
+	}
+
+	// start worker to list topics
+	workers := make(map[string]*adminWorker)
+	donech := make(chan *adminWorker, len(nodes))
+
+	for _, server := range nodes {
+		worker := &adminWorker{
+			admin:            p,
+			server:           server,
+			streamId:         streamId,
+			killch:           make(chan bool, 1),
+			activeTimestamps: nil,
+			err:              nil}
+		workers[server] = worker
+		go worker.listTopics(donech)
+	}
+
+	// now wait for the worker to be done
+	for len(workers) != 0 {
+		worker := <-donech
+		delete(workers, worker.server)
+
+		if worker.err != nil {
+			logging.Debugf("ProjectorAdmin::ListActiveStreams(): worker has error. %v error=%v", worker.logFields(), worker.err)
+			return nil, worker.err
+		}
+
+		result[worker.server] = worker.topicActive
+	}
+
+	return result, nil
+}
+
+//
+// Wait until the stream monitor confirms that every vbucket in the timestamps is
+// receiving data, or the context is done.  It returns the vbuckets (per bucket)
+// that have not become active.
+//
+func (p *ProjectorAdmin) WaitForActive(ctx context.Context,
+	streamId common.StreamId,
+	timestamps []*protobuf.TsVbuuid) (map[string][]uint16, error) {
+
+	logging.Debugf("ProjectorAdmin::WaitForActive(): start. %v", p.streamLogFields(streamId))
+
+	ticker := time.NewTicker(WAIT_ACTIVE_POLL_INTERVAL)
+	defer ticker.Stop()
+
+	for {
+		inactive := p.findInactiveVbs(streamId, timestamps)
+		if len(inactive) == 0 {
+			return nil, nil
+		}
+
+		if p.getMonitor() == nil {
+			return inactive, enrichError(NewError4(ERROR_STREAM_INVALID_ARGUMENT, NORMAL, STREAM,
+				"No stream monitor to confirm the stream is active"), "WaitForActive", "", "")
+		}
+
+		select {
+		case <-ctx.Done():
+			logging.Debugf("ProjectorAdmin::WaitForActive(): stream is not active. %v error=%v", p.streamLogFields(streamId), ctx.Err())
+			return inactive, ctx.Err()
+		case <-ticker.C:
+		}
+	}
+}
+
+//
+// Get the failover log of the vbuckets for the bucket.  The failover log
+// contains the branch history (vbuuid, seqno) of each vbucket, latest first.
+// This can be used to decide the rollback point during recovery.
+//
+func (p *ProjectorAdmin) GetFailoverLogs(bucket string, vbnos []uint16) (couchbase.FailoverLog, error) {
+
+	logging.Debugf("ProjectorAdmin::GetFailoverLogs(): bucket=%v len(vbnos)=%v", bucket, len(vbnos))
+
+	nodes, err := p.env.GetNodeListForBuckets([]string{bucket})
+	if err != nil {
+		return nil, err
+	}
+
+	vbnos32 := make([]uint32, len(vbnos))
+	for i, vbno := range vbnos {
+		vbnos32[i] = uint32(vbno)
+	}
+
+	// Projector gets the failover log from the data service, so it only
+	// needs to be fetched from one node.  Try the next node upon error.
+	for _, server := range nodes {
+		client := p.factory.GetClientForNode(server)
+		if client == nil {
+			continue
+		}
+
+		resp, err1 := client.GetFailoverLogs(p.poolName, bucket, vbnos32)
+		if err1 != nil {
+			logging.Debugf("ProjectorAdmin::GetFailoverLogs(): fail to get failover log from node %v. Error=%v", server, err1)
+			err = err1
+			continue
+		}
+
+		return resp.ToFailoverLog(vbnos), nil
+	}
+
+	if err == nil {
+		err = NewError4(ERROR_STREAM_INVALID_KVADDRS, NORMAL, STREAM, "No node available for bucket "+bucket)
+	}
+	return nil, enrichError(NewError(ERROR_STREAM_REQUEST_ERROR, NORMAL, STREAM, err, "Unable to get failover log"),
+		"GetFailoverLogs", bucket, "")
+}
 
-			if !found {
-				logging.Debugf("validateActiveVb(): Cannot find active timestamp for bucket %s vb %d", bucket, vb)
+//
+// Validate that every vbucket of the buckets has exactly one active timestamp.
+// Buckets are validated in priority order.  A duplicate active timestamp, or a
+// missing one for a bucket that is not of low priority, fails the validation
+// immediately.  The vbuckets missing for a low priority bucket are added to its
+// budget instead, and the validation fails only when the budget exceeds
+// LOW_PRIORITY_VB_BUDGET; the stream monitor restarts the tolerated vbuckets
+// from the request timestamp, refer toleratedTimestamps().
+//
+func (p *ProjectorAdmin) validateActiveVb(buckets []string, activeTimestamps []*protobuf.TsVbuuid,
+	requestTimestamps []*common.TsVbuuid, budget map[string]int) bool {
+
+	activeTsMap := indexTimestampsByBucket(activeTimestamps)
+
+	vbnos := make([]uint16, NUM_VB)
+	for vb := range vbnos {
+		vbnos[vb] = uint16(vb)
+	}
+
+	for _, bucket := range p.sortBucketsByPriority(buckets) {
+		ts, ok := activeTsMap[bucket]
+
+		active := make(map[uint32]bool)
+		for _, ts_vb := range ts.GetVbnos() {
+			if active[ts_vb] {
+				logging.Debugf("validateActiveVb(): find duplicate active timestamp for bucket %s vb %d", bucket, ts_vb)
 				return false
 			}
+			active[ts_vb] = true
+		}
+
+		missing := ts.CoversVbuckets(vbnos)
+		if len(missing) == 0 {
+			continue
+		}
+		logging.Debugf("validateActiveVb(): Cannot find active timestamp for bucket %s vbs %v", bucket, missing)
+
+		// The stream monitor can only restart vbuckets of a bucket that has
+		// started, so a bucket without any active timestamp is never tolerated.
+		// Nor is a bucket without request timestamp, since there is no timestamp
+		// to restart its missing vbuckets from.
+		if !ok || p.getBucketPriority(bucket) >= 0 || findRequestTimestamp(bucket, requestTimestamps) == nil {
+			return false
+		}
+
+		budget[bucket] += len(missing)
+		if budget[bucket] > LOW_PRIORITY_VB_BUDGET {
+			logging.Debugf("validateActiveVb(): budget exhausted for low priority bucket %s, missing %d vbs",
+				bucket, budget[bucket])
+			budget[bucket] = 0
+			return false
 		}
 	}
 
 	return true
 }
 
+func (p *ProjectorAdmin) getBucketPriority(bucket string) int {
+	return p.BucketPriority[bucket]
+}
+
+//
+// Return a copy of buckets sorted by descending priority.  Buckets of the same
+// priority retain their order.
+//
+func (p *ProjectorAdmin) sortBucketsByPriority(buckets []string) []string {
+
+	priority := make(map[string]int)
+	for _, bucket := range buckets {
+		priority[bucket] = p.getBucketPriority(bucket)
+	}
+
+	sorted := append([]string(nil), buckets...)
+	sort.SliceStable(sorted, func(i, j int) bool {
+		return priority[sorted[i]] > priority[sorted[j]]
+	})
+	return sorted
+}
+
+//
+// Group the buckets of the same priority, in descending priority.  A later group
+// is added to the topic created by the earlier groups, so the buckets are in a
+// single group unless TreatTopicExistAsSuccess is set.
+//
+func (p *ProjectorAdmin) groupBucketsByPriority(buckets []string) [][]string {
+
+	if !p.TreatTopicExistAsSuccess {
+		return [][]string{buckets}
+	}
+
+	var levels [][]string = nil
+	for i, bucket := range p.sortBucketsByPriority(buckets) {
+		if i == 0 || p.getBucketPriority(bucket) != p.getBucketPriority(levels[len(levels)-1][0]) {
+			levels = append(levels, nil)
+		}
+		levels[len(levels)-1] = append(levels[len(levels)-1], bucket)
+	}
+	return levels
+}
+
+//
+// Return the instances of the buckets.
+//
+func filterInstancesByBucket(instances []*protobuf.Instance, buckets []string) []*protobuf.Instance {
+
+	var result []*protobuf.Instance = nil
+	for _, instance := range instances {
+		bucket := instance.GetIndexInstance().GetDefinition().GetBucket()
+		for _, b := range buckets {
+			if b == bucket {
+				result = append(result, instance)
+				break
+			}
+		}
+	}
+	return result
+}
+
+//
+// Return the request timestamp of the bucket, or nil if there is none.
+//
+func findRequestTimestamp(bucket string, requestTimestamps []*common.TsVbuuid) *common.TsVbuuid {
+
+	for _, ts := range requestTimestamps {
+		if ts.Bucket == bucket {
+			return ts
+		}
+	}
+	return nil
+}
+
+//
+// Return the request timestamp of the vbuckets that are tolerated without an
+// active timestamp, so that the stream monitor restarts them from the request
+// timestamp rather than from seqno 0.  Buckets without request timestamp are
+// skipped.
+//
+func toleratedTimestamps(pool string, buckets []string, activeTimestamps []*protobuf.TsVbuuid,
+	requestTimestamps []*common.TsVbuuid) []*protobuf.TsVbuuid {
+
+	activeTsMap := indexTimestampsByBucket(activeTimestamps)
+
+	var result []*protobuf.TsVbuuid = nil
+	for _, bucket := range buckets {
+		requestTs := findRequestTimestamp(bucket, requestTimestamps)
+		if requestTs == nil {
+			continue
+		}
+
+		var missing []uint16 = nil
+		if active, ok := activeTsMap[bucket]; ok {
+			missing = active.CoversVbuckets(requestTs.GetVbnos())
+		} else {
+			missing = requestTs.GetVbnos()
+		}
+		if len(missing) == 0 {
+			continue
+		}
+
+		ts := protobuf.NewTsVbuuid(pool, bucket, len(missing))
+		for _, vb := range missing {
+			snapshot := requestTs.Snapshots[vb]
+			ts.Append(vb, requestTs.Seqnos[vb], requestTs.Vbuuids[vb], snapshot[0], snapshot[1])
+		}
+		result = append(result, ts)
+	}
+	return result
+}
+
 //
 // Close a stream
 //
@@ -514,15 +1478,349 @@ func CloseStreamFor(streamId StreamId) error {
 */
 
 func (p *ProjectorAdmin) Initialize(monitor *StreamMonitor) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
 	p.monitor = monitor
 }
 
+//
+// Close the projector client factory, which stops its background health check
+// and cleanup.
+//
+func (p *ProjectorAdmin) Close() {
+	if closer, ok := p.factory.(interface{ Close() }); ok {
+		closer.Close()
+	}
+}
+
+//
+// Get the pool of the buckets served by the streams.
+//
+func (p *ProjectorAdmin) PoolName() string {
+	return p.poolName
+}
+
+func (p *ProjectorAdmin) getMonitor() *StreamMonitor {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	return p.monitor
+}
+
 func (p *ProjectorAdmin) monitorStream(streamId common.StreamId, timestamps []*protobuf.TsVbuuid) {
-	if p.monitor != nil {
+	if monitor := p.getMonitor(); monitor != nil {
 		for _, ts := range timestamps {
-			p.monitor.StartStream(streamId, ts.GetBucket(), ts)
+			monitor.StartStream(streamId, ts.GetBucket(), ts)
+		}
+	}
+}
+
+//
+// Get the latest known active timestamp of each bucket of the stream from the stream
+// monitor.  The caller can compare it with the intended timestamps to decide whether
+// to call RestartStreamIfNecessary().
+//
+func (p *ProjectorAdmin) StreamState(streamId common.StreamId) map[string]*protobuf.TsVbuuid {
+	monitor := p.getMonitor()
+	if monitor == nil {
+		return nil
+	}
+	return monitor.ActiveTimestamps(streamId)
+}
+
+func (p *ProjectorAdmin) findInactiveVbs(streamId common.StreamId, timestamps []*protobuf.TsVbuuid) map[string][]uint16 {
+
+	inactive := make(map[string][]uint16)
+	monitor := p.getMonitor()
+
+	for _, ts := range timestamps {
+		for _, vb := range ts.GetVbnos() {
+			if monitor == nil || !monitor.IsActive(streamId, ts.GetBucket(), uint16(vb)) {
+				inactive[ts.GetBucket()] = append(inactive[ts.GetBucket()], uint16(vb))
+			}
 		}
 	}
+
+	return inactive
+}
+
+//
+// Check if the topic for the stream is active on every projector node of the buckets.
+//
+func (p *ProjectorAdmin) isTopicActive(streamId common.StreamId, buckets []string) (bool, error) {
+
+	nodes, err := p.ListActiveStreams(streamId, buckets)
+	if err != nil {
+		logging.Debugf("ProjectorAdmin::isTopicActive(): fail to list active streams. Error=%v", err)
+		return false, err
+	}
+
+	for server, active := range nodes {
+		if !active {
+			logging.Debugf("ProjectorAdmin::isTopicActive(): topic is not active on node %v", server)
+			return false, nil
+		}
+	}
+
+	return true, nil
+}
+
+//
+// Ping the projector of each node concurrently.  Returns ERROR_STREAM_PROJECTOR_UNREACHABLE
+// for the first node whose projector fails the ping or does not respond within
+// PROJECTOR_PING_TIMEOUT.
+//
+func (p *ProjectorAdmin) pingNodes(nodes map[string]string) error {
+
+	pending := make(map[string]bool)
+	donech := make(chan string, len(nodes))
+	errch := make(chan error, len(nodes))
+
+	for _, server := range nodes {
+		pending[server] = true
+		go func(server string) {
+			// A missing client is reported by the worker for the node.  A projector
+			// that does not support the ping (e.g. an older projector) is reachable.
+			if client := p.factory.GetClientForNode(server); client != nil {
+				if err := client.Ping(); err != nil && !isUnsupportedRequestError(err) {
+					logging.Debugf("ProjectorAdmin::pingNodes(): projector for node %v is down. Error=%v", server, err)
+					errch <- enrichError(NewError(ERROR_STREAM_PROJECTOR_UNREACHABLE, NORMAL, STREAM, err, "Projector is unreachable."),
+						"Ping", "", server)
+					return
+				}
+			}
+			donech <- server
+		}(server)
+	}
+
+	timer := time.NewTimer(PROJECTOR_PING_TIMEOUT)
+	defer timer.Stop()
+
+	for len(pending) != 0 {
+		select {
+		case server := <-donech:
+			delete(pending, server)
+		case err := <-errch:
+			return err
+		case <-timer.C:
+			for server := range pending {
+				return enrichError(NewError4(ERROR_STREAM_PROJECTOR_UNREACHABLE, NORMAL, STREAM, "Projector ping timeout."),
+					"Ping", "", server)
+			}
+		}
+	}
+	return nil
+}
+
+//
+// Filter out the instances whose version is older than the version last sent to
+// projector, refer recordInstanceVersions().
+//
+func (p *ProjectorAdmin) filterStaleInstances(instances []*protobuf.Instance) []*protobuf.Instance {
+
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	var result []*protobuf.Instance = nil
+	for _, instance := range instances {
+		uuid, version := instance.GetUuid(), instance.GetVersion()
+		if last, ok := p.versions[uuid]; ok && version < last {
+			logging.Debugf("ProjectorAdmin::filterStaleInstances(): skip instance %v, version %v < %v",
+				uuid, version, last)
+			continue
+		}
+		result = append(result, instance)
+	}
+
+	return result
+}
+
+//
+// Remember the version of the instances that have been sent to projector successfully.
+//
+func (p *ProjectorAdmin) recordInstanceVersions(instances []*protobuf.Instance) {
+
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	if p.versions == nil {
+		p.versions = make(map[uint64]uint64)
+	}
+
+	for _, instance := range instances {
+		uuid, version := instance.GetUuid(), instance.GetVersion()
+		if last, ok := p.versions[uuid]; !ok || version > last {
+			p.versions[uuid] = version
+		}
+	}
+}
+
+//
+// Get the version last sent to projector for each of the instances.
+//
+func (p *ProjectorAdmin) getInstanceVersions(bucketInstances map[string][]uint64) map[uint64]uint64 {
+
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	versions := make(map[uint64]uint64)
+	for _, instances := range bucketInstances {
+		for _, uuid := range instances {
+			versions[uuid] = p.versions[uuid]
+		}
+	}
+	return versions
+}
+
+//
+// Filter out the instances that have been re-added with a version newer than `versions`.
+//
+func (p *ProjectorAdmin) filterReaddedInstances(instances []uint64, versions map[uint64]uint64) []uint64 {
+
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	var result []uint64 = nil
+	for _, uuid := range instances {
+		if p.versions[uuid] > versions[uuid] {
+			logging.Debugf("ProjectorAdmin::filterReaddedInstances(): skip instance %v, version %v > %v",
+				uuid, p.versions[uuid], versions[uuid])
+			continue
+		}
+		result = append(result, uuid)
+	}
+	return result
+}
+
+//
+// Filter out the instances that have already been added to the stream.  An instance
+// that has been changed (e.g. new endpoint) is not filtered out.
+//
+func (p *ProjectorAdmin) filterActiveInstances(streamId common.StreamId,
+	instances []*protobuf.Instance) []*protobuf.Instance {
+
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	active := p.instances[streamId]
+
+	var delta []*protobuf.Instance = nil
+	for _, instance := range instances {
+		if str, ok := active[instance.GetUuid()]; !ok || str != instance.String() {
+			delta = append(delta, instance)
+		}
+	}
+
+	return delta
+}
+
+func (p *ProjectorAdmin) addActiveInstances(streamId common.StreamId, instances []*protobuf.Instance) {
+
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	active, ok := p.instances[streamId]
+	if !ok {
+		active = make(map[uint64]string)
+		p.instances[streamId] = active
+	}
+
+	for _, instance := range instances {
+		active[instance.GetUuid()] = instance.String()
+	}
+}
+
+func (p *ProjectorAdmin) removeActiveInstances(streamId common.StreamId, instances []uint64) {
+
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	if active, ok := p.instances[streamId]; ok {
+		for _, uuid := range instances {
+			delete(active, uuid)
+		}
+	}
+}
+
+func (p *ProjectorAdmin) resetActiveInstances(streamId common.StreamId) {
+
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	delete(p.instances, streamId)
+}
+
+//
+// Wait for the stream to be free of other AddIndexToStream(), or ctx to be done.
+//
+func (p *ProjectorAdmin) lockStream(ctx context.Context, streamId common.StreamId) error {
+
+	p.mutex.Lock()
+	if p.streamLocks == nil {
+		p.streamLocks = make(map[common.StreamId]chan bool)
+	}
+	lock, ok := p.streamLocks[streamId]
+	if !ok {
+		lock = make(chan bool, 1)
+		p.streamLocks[streamId] = lock
+	}
+	p.mutex.Unlock()
+
+	select {
+	case lock <- true:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+func (p *ProjectorAdmin) unlockStream(streamId common.StreamId) {
+
+	p.mutex.Lock()
+	lock := p.streamLocks[streamId]
+	p.mutex.Unlock()
+
+	<-lock
+}
+
+//
+// Record the nodes for the stream.  If a node is no longer in the node list
+// of any stream (e.g. it is removed from the cluster during rebalance), release
+// its projector client.
+//
+func (p *ProjectorAdmin) updateStreamNodes(streamId common.StreamId, nodes map[string]string) {
+
+	var removed []string = nil
+
+	p.mutex.Lock()
+	oldNodes := p.nodes[streamId]
+	p.nodes[streamId] = nodes
+
+	for server, _ := range oldNodes {
+		if _, ok := nodes[server]; ok {
+			continue
+		}
+
+		inUse := false
+		for _, streamNodes := range p.nodes {
+			if _, ok := streamNodes[server]; ok {
+				inUse = true
+				break
+			}
+		}
+
+		if !inUse {
+			removed = append(removed, server)
+		}
+	}
+	p.mutex.Unlock()
+
+	for _, server := range removed {
+		logging.Debugf("ProjectorAdmin::updateStreamNodes(): release client for node. %v server=%v",
+			p.streamLogFields(streamId), server)
+		p.factory.CloseClientForNode(server)
+	}
 }
 
 /////////////////////////////////////////////////////////////////////////
@@ -532,7 +1830,8 @@ func (p *ProjectorAdmin) monitorStream(streamId common.StreamId, timestamps []*p
 //
 // Add index instances to a specific projector node
 //
-func (worker *adminWorker) addInstances(instances []*protobuf.Instance,
+func (worker *adminWorker) addInstances(ctx context.Context,
+	instances []*protobuf.Instance,
 	buckets []string,
 	requestTimestamps []*common.TsVbuuid,
 	doneCh chan *adminWorker) {
@@ -541,15 +1840,17 @@ func (worker *adminWorker) addInstances(instances []*protobuf.Instance,
 		doneCh <- worker
 	}()
 
-	logging.Debugf("adminWorker::addInstances(): start")
+	logging.Debugf("adminWorker::addInstances(): start. %v", worker.logFields())
 
 	// Get projector client for the particular node.  This function does not
 	// return an error even if the server is an invalid host name, but subsequent
-	// call to client may fail.  Also note that there is no method to close the client
-	// (no need to close upon termination).
+	// call to client may fail.  The client is released by the factory when the node
+	// is no longer part of any stream.
 	client := worker.admin.factory.GetClientForNode(worker.server)
 	if client == nil {
-		logging.Debugf("adminWorker::addInstances(): no client returns from factory")
+		logging.Debugf("adminWorker::addInstances(): no client returns from factory. %v", worker.logFields())
+		worker.err = enrichError(NewError4(ERROR_STREAM_PROJECTOR_UNREACHABLE, NORMAL, STREAM, "No projector client for node."),
+			"MutationTopicRequest", "", worker.server)
 		return
 	}
 
@@ -559,48 +1860,86 @@ func (worker *adminWorker) addInstances(instances []*protobuf.Instance,
 	var timestamps []*protobuf.TsVbuuid = nil
 	for _, bucket := range buckets {
 
-		var bucketTs *common.TsVbuuid = nil
-		for _, requestTs := range requestTimestamps {
-			if requestTs.Bucket == bucket {
-				bucketTs = requestTs
-				break
-			}
-		}
-
-		ts, err := makeRestartTimestamp(client, bucket, bucketTs)
+		bucketTs := findRequestTimestamp(bucket, requestTimestamps)
+		ts, err := makeRestartTimestamp(client, worker.admin.poolName, bucket, bucketTs)
 		if err != nil {
 			// udpate the error string and put myself in the done channel
-			worker.err = NewError(ERROR_STREAM_REQUEST_ERROR, NORMAL, STREAM, err, "Unable to make restart timestamp")
+			op := "InitialRestartTimestamp"
+			if bucketTs != nil {
+				op = "ConvertRestartTimestamp"
+			}
+			worker.err = enrichError(NewError(ERROR_STREAM_REQUEST_ERROR, NORMAL, STREAM, err, "Unable to make restart timestamp"),
+				op, bucket, worker.server)
 			return
 		}
 		timestamps = append(timestamps, ts)
 	}
 
-	timestamps, err := worker.admin.env.FilterTimestampsForNode(timestamps, worker.server)
+	timestamps, err := filterTimestampsForNode(ctx, worker.admin.env, timestamps, worker.server)
 	if err != nil {
-		worker.err = NewError(ERROR_STREAM_REQUEST_ERROR, NORMAL, STREAM, err, "Unable to filter restart timestamp")
+		worker.err = enrichError(NewError(ERROR_STREAM_REQUEST_ERROR, NORMAL, STREAM, err, "Unable to filter restart timestamp"),
+			"FilterTimestampsForNode", "", worker.server)
 		return
 	}
 
 	// open the stream for the specific node for the set of <bucket, timestamp>
-	topic := getTopicForStreamId(worker.streamId)
+	topic, err := worker.admin.topicForStreamId(worker.streamId)
+	if err != nil {
+		worker.err = enrichError(err, "MutationTopicRequest", "", worker.server)
+		return
+	}
 
 	retry := true
-	startTime := time.Now().Unix()
+	startTime := time.Now()
 	for retry {
 		select {
 		case <-worker.killch:
 			return
+		case <-ctx.Done():
+			worker.err = ctx.Err()
+			return
 		default:
 			response, err := client.MutationTopicRequest(topic, "dataport", timestamps, instances)
 			if err == nil {
 				// no error, it is successful for this node
-				worker.activeTimestamps = response.GetActiveTimestamps()
+				worker.activeTimestamps = filterTimestampsByBucket(response.GetActiveTimestamps(), buckets)
+				worker.completeBuckets = findCompleteBuckets(buckets, timestamps, worker.activeTimestamps)
 				worker.err = nil
 				return
 			}
 
-			timestamps, err = worker.shouldRetryAddInstances(timestamps, response, err)
+			if worker.admin.TreatTopicExistAsSuccess && strings.Contains(err.Error(), projectorC.ErrorTopicExist.Error()) {
+				// The topic is already streaming for this node (e.g. request is retried
+				// by a higher layer).  Add the instances to the live topic, and use the
+				// active timestamps of the topic.
+				logging.Debugf("adminWorker::addInstances(): topic already exists. %v", worker.logFields())
+				var tsResponse *protobuf.TimestampResponse
+				tsResponse, err = client.AddInstances(topic, instances)
+				if err != nil {
+					timestamps, err = worker.shouldRetryAddInstances(timestamps, nil, err)
+				} else {
+					worker.activeTimestamps = filterTimestampsByBucket(tsResponse.GetCurrentTimestamps(), buckets)
+					worker.completeBuckets = findCompleteBuckets(buckets, timestamps, worker.activeTimestamps)
+					if len(worker.completeBuckets) == len(buckets) {
+						worker.err = nil
+						return
+					}
+
+					// Some requested vbuckets are not active on the topic.  RestartVbuckets
+					// skips vbuckets that are already active, and returns the active
+					// timestamps of the topic.
+					response, err = client.RestartVbuckets(topic, timestamps)
+					if err == nil {
+						worker.activeTimestamps = filterTimestampsByBucket(response.GetActiveTimestamps(), buckets)
+						worker.completeBuckets = findCompleteBuckets(buckets, timestamps, worker.activeTimestamps)
+						worker.err = nil
+						return
+					}
+					timestamps, err = worker.shouldRetryRestartVbuckets(timestamps, response, err)
+				}
+			} else {
+				timestamps, err = worker.shouldRetryAddInstances(timestamps, response, err)
+			}
 			if err != nil {
 				// Either it is a non-recoverable error or an error that cannot be retry by this worker.
 				// Terminate this worker.
@@ -609,14 +1948,15 @@ func (worker *adminWorker) addInstances(instances []*protobuf.Instance,
 				return
 			}
 
-			retry = time.Now().Unix()-startTime < MAX_PROJECTOR_RETRY_ELAPSED_TIME
+			retry = time.Since(startTime) < MAX_PROJECTOR_RETRY_ELAPSED_TIME
 		}
 	}
 
 	// When we reach here, it passes the elaspse time that the projector is supposed to response.
 	// Projector may die or it can be a network partition, need to return an error since it may
 	// require another worker to retry.
-	worker.err = NewError4(ERROR_STREAM_PROJECTOR_TIMEOUT, NORMAL, STREAM, "Projector Call timeout after retry.")
+	worker.err = enrichError(NewError4(ERROR_STREAM_PROJECTOR_TIMEOUT, NORMAL, STREAM, "Projector Call timeout after retry."),
+		"MutationTopicRequest", "", worker.server)
 }
 
 //
@@ -628,12 +1968,11 @@ func (worker *adminWorker) addInstances(instances []*protobuf.Instance,
 //      * ErrorFeeder
 // 2) Non Recoverable error
 //      * ErrorInconsistentFeed
+//      * ErrorTopicExist (unless TreatTopicExistAsSuccess, handled by the caller)
 // 3) Recoverable error by other worker
 //      * ErrorInvalidVbucketBranch
 //      * ErrorNotMyVbucket
 //      * ErrorInvalidKVaddrs
-// 4) Error that may not need retry
-//      * ErrorTopicExist
 //
 func (worker *adminWorker) shouldRetryAddInstances(requestTs []*protobuf.TsVbuuid,
 	response *protobuf.TopicResponse,
@@ -643,30 +1982,30 @@ func (worker *adminWorker) shouldRetryAddInstances(requestTs []*protobuf.TsVbuui
 
 	// First of all, let's check for any non-recoverable error.
 	errStr := err.Error()
-	logging.Debugf("adminWorker::shouldRetryAddInstances(): Error encountered when calling MutationTopicRequest. Error=%v", errStr)
+	logging.Debugf("adminWorker::shouldRetryAddInstances(): Error encountered when calling MutationTopicRequest. %v error=%v",
+		worker.logFields(), errStr)
 
-	if strings.Contains(errStr, projectorC.ErrorTopicExist.Error()) {
-		// TODO: Need pratap to define the semantic of ErrorTopExist.   Right now return as an non-recoverable error.
-		return nil, NewError(ERROR_STREAM_REQUEST_ERROR, NORMAL, STREAM, err, "")
-
-	} else if strings.Contains(errStr, projectorC.ErrorInconsistentFeed.Error()) {
+	if strings.Contains(errStr, projectorC.ErrorInconsistentFeed.Error()) {
 		// This is fatal error.  Should only happen due to coding error.   Need to return this error.
 		// For those projectors that have already been opened, let's leave it open. Eventually those
 		// projectors will fill up the buffer and terminate the connection by itself.
-		return nil, NewError(ERROR_STREAM_REQUEST_ERROR, NORMAL, STREAM, err, "")
+		return nil, enrichError(NewError(ERROR_STREAM_REQUEST_ERROR, NORMAL, STREAM, err, ""), "MutationTopicRequest", "", worker.server)
+
+	} else if strings.Contains(errStr, projectorC.ErrorTopicExist.Error()) {
+		return nil, enrichError(NewError(ERROR_STREAM_REQUEST_ERROR, NORMAL, STREAM, err, ""), "MutationTopicRequest", "", worker.server)
 
 	} else if strings.Contains(errStr, projectorC.ErrorNotMyVbucket.Error()) {
-		return nil, NewError(ERROR_STREAM_WRONG_VBUCKET, NORMAL, STREAM, err, "")
+		return nil, enrichError(NewError(ERROR_STREAM_WRONG_VBUCKET, NORMAL, STREAM, err, ""), "MutationTopicRequest", "", worker.server)
 
 	} else if strings.Contains(errStr, projectorC.ErrorInvalidVbucketBranch.Error()) {
-		return nil, NewError(ERROR_STREAM_INVALID_TIMESTAMP, NORMAL, STREAM, err, "")
+		return nil, enrichError(NewError(ERROR_STREAM_INVALID_TIMESTAMP, NORMAL, STREAM, err, ""), "MutationTopicRequest", "", worker.server)
 
 	} else if strings.Contains(errStr, projectorC.ErrorInvalidKVaddrs.Error()) {
-		return nil, NewError(ERROR_STREAM_INVALID_KVADDRS, NORMAL, STREAM, err, "")
+		return nil, enrichError(NewError(ERROR_STREAM_INVALID_KVADDRS, NORMAL, STREAM, err, ""), "MutationTopicRequest", "", worker.server)
 	}
 
 	// There is no non-recoverable error, so we can retry.  For retry, recompute the new set of timestamps based on the response.
-	rollbackTimestamps := response.GetRollbackTimestamps()
+	rollbackTimestamps := indexTimestampsByBucket(response.GetRollbackTimestamps())
 	var newRequestTs []*protobuf.TsVbuuid = nil
 	for _, ts := range requestTs {
 		ts = recomputeRequestTimestamp(ts, rollbackTimestamps)
@@ -679,112 +2018,205 @@ func (worker *adminWorker) shouldRetryAddInstances(requestTs []*protobuf.TsVbuui
 //
 // Delete index instances from a specific projector node
 //
-func (worker *adminWorker) deleteInstances(instances []uint64, doneCh chan *adminWorker) {
+func (worker *adminWorker) deleteInstances(instances []uint64, versions map[uint64]uint64, doneCh chan *adminWorker) {
+
+	defer func() {
+		doneCh <- worker
+	}()
+
+	logging.Debugf("adminWorker::deleteInstances(): start. %v", worker.logFields())
+
+	// Get projector client for the particular node.  This function does not
+	// return an error even if the server is an invalid host name, but subsequent
+	// call to client may fail.  The client is released by the factory when the node
+	// is no longer part of any stream.
+	client := worker.admin.factory.GetClientForNode(worker.server)
+	if client == nil {
+		logging.Debugf("adminWorker::deleteInstances(): no client returns from factory. %v", worker.logFields())
+		worker.err = enrichError(NewError4(ERROR_STREAM_PROJECTOR_UNREACHABLE, NORMAL, STREAM, "No projector client for node."),
+			"DelInstances", "", worker.server)
+		return
+	}
+
+	// open the stream for the specific node for the set of <bucket, timestamp>
+	topic, err := worker.admin.topicForStreamId(worker.streamId)
+	if err != nil {
+		worker.err = enrichError(err, "DelInstances", "", worker.server)
+		return
+	}
+
+	retry := true
+	startTime := time.Now()
+	for retry {
+		select {
+		case <-worker.killch:
+			return
+		default:
+			err := worker.delInstancesByVersion(client, topic, instances, versions)
+			if err == nil {
+				// no error, it is successful for this node
+				worker.err = nil
+				return
+			}
+
+			logging.Debugf("adminWorker::deleteInstances(): Error encountered when calling DelInstances. %v error=%v",
+				worker.logFields(), err)
+			if strings.Contains(err.Error(), projectorC.ErrorTopicMissing.Error()) {
+				// It is OK if topic is missing
+				worker.err = nil
+				return
+			}
+
+			if isPermanentNetError(err) {
+				// The projector cannot be reached (e.g. unknown host or connection refused).
+				// There is no point to retry until timeout.
+				worker.err = enrichError(NewError(ERROR_STREAM_PROJECTOR_UNREACHABLE, NORMAL, STREAM, err, "Projector is unreachable."),
+					"DelInstances", "", worker.server)
+				return
+			}
+
+			retry = time.Since(startTime) < MAX_PROJECTOR_RETRY_ELAPSED_TIME
+		}
+	}
+
+	// When we reach here, it passes the elaspse time that the projector is supposed to response.
+	// Projector may die or it can be a network partition, need to return an error since it may
+	// require another worker to retry.
+	worker.err = enrichError(NewError4(ERROR_STREAM_PROJECTOR_TIMEOUT, NORMAL, STREAM, "Projector Call timeout after retry."),
+		"DelInstances", "", worker.server)
+}
+
+//
+// Delete instances from projector, grouped by the version that was last sent for each
+// instance.  Instances that have been re-added with a newer version are skipped.
+//
+func (worker *adminWorker) delInstancesByVersion(client ProjectorStreamClient, topic string,
+	instances []uint64, versions map[uint64]uint64) error {
+
+	groups := make(map[uint64][]uint64)
+	for _, uuid := range worker.admin.filterReaddedInstances(instances, versions) {
+		groups[versions[uuid]] = append(groups[versions[uuid]], uuid)
+	}
+
+	for version, uuids := range groups {
+		if err := client.DelInstances(topic, uuids, version); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+//
+// Repair endpoint for a specific projector node
+//
+func (worker *adminWorker) repairEndpoint(endpoint string, doneCh chan *adminWorker) {
 
 	defer func() {
 		doneCh <- worker
 	}()
 
-	logging.Debugf("adminWorker::deleteInstances(): start")
+	logging.Debugf("adminWorker::repairEndpoint(): start. %v", worker.logFields())
 
 	// Get projector client for the particular node.  This function does not
 	// return an error even if the server is an invalid host name, but subsequent
-	// call to client may fail.  Also note that there is no method to close the client
-	// (no need to close upon termination).
+	// call to client may fail.  The client is released by the factory when the node
+	// is no longer part of any stream.
 	client := worker.admin.factory.GetClientForNode(worker.server)
 	if client == nil {
-		logging.Debugf("adminWorker::deleteInstances(): no client returns from factory")
+		logging.Debugf("adminWorker::repairEndpoint(): no client returns from factory. %v", worker.logFields())
+		worker.err = enrichError(NewError4(ERROR_STREAM_PROJECTOR_UNREACHABLE, NORMAL, STREAM, "No projector client for node."),
+			"RepairEndpoints", "", worker.server)
 		return
 	}
 
 	// open the stream for the specific node for the set of <bucket, timestamp>
-	topic := getTopicForStreamId(worker.streamId)
+	topic, err := worker.admin.topicForStreamId(worker.streamId)
+	if err != nil {
+		worker.err = enrichError(err, "RepairEndpoints", "", worker.server)
+		return
+	}
 
 	retry := true
-	startTime := time.Now().Unix()
+	startTime := time.Now()
 	for retry {
 		select {
 		case <-worker.killch:
 			return
 		default:
-			err := client.DelInstances(topic, instances)
+
+			err := client.RepairEndpoints(topic, []string{endpoint})
 			if err == nil {
 				// no error, it is successful for this node
 				worker.err = nil
 				return
 			}
 
-			logging.Debugf("adminWorker::deleteInstances(): Error encountered when calling DelInstances. Error=%v", err.Error())
+			logging.Debugf("adminWorker::repairEndpoint(): Error encountered when calling RepairEndpoint. %v error=%v",
+				worker.logFields(), err)
 			if strings.Contains(err.Error(), projectorC.ErrorTopicMissing.Error()) {
 				// It is OK if topic is missing
 				worker.err = nil
 				return
 			}
 
-			retry = time.Now().Unix()-startTime < MAX_PROJECTOR_RETRY_ELAPSED_TIME
+			if isPermanentNetError(err) {
+				// The projector cannot be reached (e.g. unknown host or connection refused).
+				// There is no point to retry until timeout.
+				worker.err = enrichError(NewError(ERROR_STREAM_PROJECTOR_UNREACHABLE, NORMAL, STREAM, err, "Projector is unreachable."),
+					"RepairEndpoints", "", worker.server)
+				return
+			}
+
+			retry = time.Since(startTime) < MAX_PROJECTOR_RETRY_ELAPSED_TIME
 		}
 	}
 
 	// When we reach here, it passes the elaspse time that the projector is supposed to response.
 	// Projector may die or it can be a network partition, need to return an error since it may
 	// require another worker to retry.
-	worker.err = NewError4(ERROR_STREAM_PROJECTOR_TIMEOUT, NORMAL, STREAM, "Projector Call timeout after retry.")
+	worker.err = enrichError(NewError4(ERROR_STREAM_PROJECTOR_TIMEOUT, NORMAL, STREAM, "Projector Call timeout after retry."),
+		"RepairEndpoints", "", worker.server)
 }
 
 //
-// Repair endpoint for a specific projector node
+// List the active topics on a specific projector node
 //
-func (worker *adminWorker) repairEndpoint(endpoint string, doneCh chan *adminWorker) {
+func (worker *adminWorker) listTopics(doneCh chan *adminWorker) {
 
 	defer func() {
 		doneCh <- worker
 	}()
 
-	logging.Debugf("adminWorker::repairEndpoint(): start")
+	logging.Debugf("adminWorker::listTopics(): start. %v", worker.logFields())
 
-	// Get projector client for the particular node.  This function does not
-	// return an error even if the server is an invalid host name, but subsequent
-	// call to client may fail.  Also note that there is no method to close the client
-	// (no need to close upon termination).
+	// Without a client, it is unknown whether the topic is active on the node.
 	client := worker.admin.factory.GetClientForNode(worker.server)
 	if client == nil {
-		logging.Debugf("adminWorker::repairEndpoints(): no client returns from factory")
+		logging.Debugf("adminWorker::listTopics(): no client returns from factory. %v", worker.logFields())
+		worker.err = enrichError(NewError4(ERROR_STREAM_PROJECTOR_UNREACHABLE, NORMAL, STREAM, "No projector client for node."),
+			"GetActiveTopics", "", worker.server)
 		return
 	}
 
-	// open the stream for the specific node for the set of <bucket, timestamp>
-	topic := getTopicForStreamId(worker.streamId)
-
-	retry := true
-	startTime := time.Now().Unix()
-	for retry {
-		select {
-		case <-worker.killch:
-			return
-		default:
-
-			err := client.RepairEndpoints(topic, []string{endpoint})
-			if err == nil {
-				// no error, it is successful for this node
-				worker.err = nil
-				return
-			}
+	topics, err := client.GetActiveTopics()
+	if err != nil {
+		worker.err = enrichError(NewError(ERROR_STREAM_REQUEST_ERROR, NORMAL, STREAM, err, "Unable to get active topics"),
+			"GetActiveTopics", "", worker.server)
+		return
+	}
 
-			logging.Debugf("adminWorker::repairEndpiont(): Error encountered when calling RepairEndpoint. Error=%v", err.Error())
-			if strings.Contains(err.Error(), projectorC.ErrorTopicMissing.Error()) {
-				// It is OK if topic is missing
-				worker.err = nil
-				return
-			}
+	topic, err := worker.admin.topicForStreamId(worker.streamId)
+	if err != nil {
+		worker.err = enrichError(err, "GetActiveTopics", "", worker.server)
+		return
+	}
 
-			retry = time.Now().Unix()-startTime < MAX_PROJECTOR_RETRY_ELAPSED_TIME
+	for _, active := range topics {
+		if active == topic {
+			worker.topicActive = true
+			break
 		}
 	}
-
-	// When we reach here, it passes the elaspse time that the projector is supposed to response.
-	// Projector may die or it can be a network partition, need to return an error since it may
-	// require another worker to retry.
-	worker.err = NewError4(ERROR_STREAM_PROJECTOR_TIMEOUT, NORMAL, STREAM, "Projector Call timeout after retry.")
 }
 
 //
@@ -796,23 +2228,29 @@ func (worker *adminWorker) restartStream(timestamps []*protobuf.TsVbuuid, doneCh
 		doneCh <- worker
 	}()
 
-	logging.Debugf("adminWorker::restartStream(): start")
+	logging.Debugf("adminWorker::restartStream(): start. %v", worker.logFields())
 
 	// Get projector client for the particular node.  This function does not
 	// return an error even if the server is an invalid host name, but subsequent
-	// call to client may fail.  Also note that there is no method to close the client
-	// (no need to close upon termination).
+	// call to client may fail.  The client is released by the factory when the node
+	// is no longer part of any stream.
 	client := worker.admin.factory.GetClientForNode(worker.server)
 	if client == nil {
-		logging.Debugf("adminWorker::restartStream(): no client returns from factory")
+		logging.Debugf("adminWorker::restartStream(): no client returns from factory. %v", worker.logFields())
+		worker.err = enrichError(NewError4(ERROR_STREAM_PROJECTOR_UNREACHABLE, NORMAL, STREAM, "No projector client for node."),
+			"RestartVbuckets", "", worker.server)
 		return
 	}
 
 	// open the stream for the specific node for the set of <bucket, timestamp>
-	topic := getTopicForStreamId(worker.streamId)
+	topic, err := worker.admin.topicForStreamId(worker.streamId)
+	if err != nil {
+		worker.err = enrichError(err, "RestartVbuckets", "", worker.server)
+		return
+	}
 
 	retry := true
-	startTime := time.Now().Unix()
+	startTime := time.Now()
 	for retry {
 		select {
 		case <-worker.killch:
@@ -835,14 +2273,15 @@ func (worker *adminWorker) restartStream(timestamps []*protobuf.TsVbuuid, doneCh
 				return
 			}
 
-			retry = time.Now().Unix()-startTime < MAX_PROJECTOR_RETRY_ELAPSED_TIME
+			retry = time.Since(startTime) < MAX_PROJECTOR_RETRY_ELAPSED_TIME
 		}
 	}
 
 	// When we reach here, it passes the elaspse time that the projector is supposed to response.
 	// Projector may die or it can be a network partition, need to return an error since it may
 	// require another worker to retry.
-	worker.err = NewError4(ERROR_STREAM_PROJECTOR_TIMEOUT, NORMAL, STREAM, "Projector Call timeout after retry.")
+	worker.err = enrichError(NewError4(ERROR_STREAM_PROJECTOR_TIMEOUT, NORMAL, STREAM, "Projector Call timeout after retry."),
+		"RestartVbuckets", "", worker.server)
 }
 
 //
@@ -868,29 +2307,30 @@ func (worker *adminWorker) shouldRetryRestartVbuckets(requestTs []*protobuf.TsVb
 
 	// First of all, let's check for any non-recoverable error.
 	errStr := err.Error()
-	logging.Debugf("adminWorker::shouldRetryRestartVbuckets(): Error encountered when calling RestartVbuckets. Error=%v", errStr)
+	logging.Debugf("adminWorker::shouldRetryRestartVbuckets(): Error encountered when calling RestartVbuckets. %v error=%v",
+		worker.logFields(), errStr)
 
 	if strings.Contains(errStr, projectorC.ErrorTopicMissing.Error()) {
-		return nil, NewError(ERROR_STREAM_REQUEST_ERROR, NORMAL, STREAM, err, "")
+		return nil, enrichError(NewError(ERROR_STREAM_REQUEST_ERROR, NORMAL, STREAM, err, ""), "RestartVbuckets", "", worker.server)
 
 	} else if strings.Contains(errStr, projectorC.ErrorInvalidBucket.Error()) {
-		return nil, NewError(ERROR_STREAM_REQUEST_ERROR, NORMAL, STREAM, err, "")
+		return nil, enrichError(NewError(ERROR_STREAM_REQUEST_ERROR, NORMAL, STREAM, err, ""), "RestartVbuckets", "", worker.server)
 
 	} else if strings.Contains(errStr, projectorC.ErrorFeeder.Error()) {
-		return nil, NewError(ERROR_STREAM_FEEDER, NORMAL, STREAM, err, "")
+		return nil, enrichError(NewError(ERROR_STREAM_FEEDER, NORMAL, STREAM, err, ""), "RestartVbuckets", "", worker.server)
 
 	} else if strings.Contains(errStr, projectorC.ErrorNotMyVbucket.Error()) {
-		return nil, NewError(ERROR_STREAM_WRONG_VBUCKET, NORMAL, STREAM, err, "")
+		return nil, enrichError(NewError(ERROR_STREAM_WRONG_VBUCKET, NORMAL, STREAM, err, ""), "RestartVbuckets", "", worker.server)
 
 	} else if strings.Contains(errStr, projectorC.ErrorInvalidVbucketBranch.Error()) {
-		return nil, NewError(ERROR_STREAM_INVALID_TIMESTAMP, NORMAL, STREAM, err, "")
+		return nil, enrichError(NewError(ERROR_STREAM_INVALID_TIMESTAMP, NORMAL, STREAM, err, ""), "RestartVbuckets", "", worker.server)
 
 	} else if strings.Contains(errStr, projectorC.ErrorStreamEnd.Error()) {
-		return nil, NewError(ERROR_STREAM_STREAM_END, NORMAL, STREAM, err, "")
+		return nil, enrichError(NewError(ERROR_STREAM_STREAM_END, NORMAL, STREAM, err, ""), "RestartVbuckets", "", worker.server)
 	}
 
 	// There is no non-recoverable error, so we can retry.  For retry, recompute the new set of timestamps based on the response.
-	rollbackTimestamps := response.GetRollbackTimestamps()
+	rollbackTimestamps := indexTimestampsByBucket(response.GetRollbackTimestamps())
 	var newRequestTs []*protobuf.TsVbuuid = nil
 	for _, ts := range requestTs {
 		ts = recomputeRequestTimestamp(ts, rollbackTimestamps)
@@ -908,6 +2348,7 @@ func (worker *adminWorker) shouldRetryRestartVbuckets(requestTs []*protobuf.TsVb
 // Create the restart timetamp
 //
 func makeRestartTimestamp(client ProjectorStreamClient,
+	pool string,
 	bucket string,
 	requestTs *common.TsVbuuid) (*protobuf.TsVbuuid, error) {
 
@@ -920,15 +2361,10 @@ func makeRestartTimestamp(client ProjectorStreamClient,
 		// 1) rebalancing - should be fine since vbuuid remains unchanged
 		// 2) failover.  This can mean that the timestamp can have stale vbuuid.   Subsequent
 		//    call to projector will detect this.
-		return client.InitialRestartTimestamp(DEFAULT_POOL_NAME, bucket)
+		return client.InitialRestartTimestamp(pool, bucket)
 
 	} else {
-		newTs := protobuf.NewTsVbuuid(DEFAULT_POOL_NAME, requestTs.Bucket, len(requestTs.Seqnos))
-		for i, _ := range requestTs.Seqnos {
-			newTs.Append(uint16(i), requestTs.Seqnos[i], requestTs.Vbuuids[i],
-				requestTs.Snapshots[i][0], requestTs.Snapshots[i][1])
-		}
-		return newTs, nil
+		return protobuf.NewTsVbuuidFromNative(pool, requestTs), nil
 	}
 }
 
@@ -937,17 +2373,19 @@ func makeRestartTimestamp(client ProjectorStreamClient,
 // If all the vb is active for the given requestTs, then this function returns nil.
 //
 func recomputeRequestTimestamp(requestTs *protobuf.TsVbuuid,
-	rollbackTimestamps []*protobuf.TsVbuuid) *protobuf.TsVbuuid {
+	rollbackTimestamps map[string]*protobuf.TsVbuuid) *protobuf.TsVbuuid {
 
-	newTs := protobuf.NewTsVbuuid(DEFAULT_POOL_NAME, requestTs.GetBucket(), len(requestTs.GetVbnos()))
-	rollbackTs := findTimestampForBucket(rollbackTimestamps, requestTs.GetBucket())
+	newTs := protobuf.NewTsVbuuid(requestTs.GetPool(), requestTs.GetBucket(), len(requestTs.GetVbnos()))
+	rollbackTs := rollbackTimestamps[requestTs.GetBucket()]
+	rollbackOffsets := indexTimestampOffsets(rollbackTs)
 
 	for i, vbno := range requestTs.GetVbnos() {
-		offset := findTimestampOffsetForVb(rollbackTs, vbno)
-		if offset != -1 {
+		if offset, ok := rollbackOffsets[vbno]; ok {
 			// there is a failover Ts for this vbno.  Use that one for retry.
-			newTs.Append(uint16(vbno), rollbackTs.Seqnos[offset], rollbackTs.Vbuuids[offset],
+			seqno := rollbackTs.Seqnos[offset]
+			start, end := clampSnapshot(requestTs.GetBucket(), vbno, seqno,
 				rollbackTs.Snapshots[offset].GetStart(), rollbackTs.Snapshots[offset].GetEnd())
+			newTs.Append(uint16(vbno), seqno, rollbackTs.Vbuuids[offset], start, end)
 		} else {
 			// the vb is not active, just copy from the original requestTS
 			newTs.Append(uint16(vbno), requestTs.Seqnos[i], requestTs.Vbuuids[i],
@@ -959,90 +2397,599 @@ func recomputeRequestTimestamp(requestTs *protobuf.TsVbuuid,
 }
 
 //
-// Find timestamp for the corresponding bucket withing the array of timestamps
+// Clamp the snapshot window <start, end> so that it contains seqno.  Projector
+// rejects a restart timestamp whose seqno lies outside its snapshot window.
+//
+func clampSnapshot(bucket string, vbno uint32, seqno, start, end uint64) (uint64, uint64) {
+
+	if start <= seqno && seqno <= end {
+		return start, end
+	}
+
+	logging.Warnf("clampSnapshot(): seqno %d outside snapshot {%d, %d} for bucket %s vb %d",
+		seqno, start, end, bucket, vbno)
+	if seqno < start {
+		start = seqno
+	}
+	if seqno > end {
+		end = seqno
+	}
+	return start, end
+}
+
+//
+// Keep only the timestamps of the given buckets.
 //
-func findTimestampForBucket(timestamps []*protobuf.TsVbuuid, bucket string) *protobuf.TsVbuuid {
+func filterTimestampsByBucket(timestamps []*protobuf.TsVbuuid, buckets []string) []*protobuf.TsVbuuid {
 
+	var result []*protobuf.TsVbuuid = nil
 	for _, ts := range timestamps {
-		if ts.GetBucket() == bucket {
-			return ts
+		for _, bucket := range buckets {
+			if ts.GetBucket() == bucket {
+				result = append(result, ts)
+				break
+			}
+		}
+	}
+	return result
+}
+
+//
+// Find the buckets whose requested vbuckets all have active timestamps.  A bucket
+// without requested vbuckets on the node is complete.
+//
+func findCompleteBuckets(buckets []string, requestTs []*protobuf.TsVbuuid,
+	activeTs []*protobuf.TsVbuuid) map[string]bool {
+
+	requestTsMap := indexTimestampsByBucket(requestTs)
+	activeTsMap := indexTimestampsByBucket(activeTs)
+
+	result := make(map[string]bool)
+	for _, bucket := range buckets {
+		active := make(map[uint32]bool)
+		if ts, ok := activeTsMap[bucket]; ok {
+			for _, vbno := range ts.GetVbnos() {
+				active[vbno] = true
+			}
+		}
+
+		complete := true
+		if ts, ok := requestTsMap[bucket]; ok {
+			for _, vbno := range ts.GetVbnos() {
+				if !active[vbno] {
+					complete = false
+					break
+				}
+			}
+		}
+		if complete {
+			result[bucket] = true
+		}
+	}
+	return result
+}
+
+//
+// Index the timestamps by bucket.  If there is more than one timestamp for
+// a bucket, the vbnos are merged into a single timestamp in the given order.
+//
+func indexTimestampsByBucket(timestamps []*protobuf.TsVbuuid) map[string]*protobuf.TsVbuuid {
+
+	result := make(map[string]*protobuf.TsVbuuid)
+
+	for _, ts := range timestamps {
+		existing, ok := result[ts.GetBucket()]
+		if !ok {
+			result[ts.GetBucket()] = ts
+			continue
+		}
+
+		merged := protobuf.NewTsVbuuid(existing.GetPool(), existing.GetBucket(),
+			len(existing.GetVbnos())+len(ts.GetVbnos()))
+		for _, t := range []*protobuf.TsVbuuid{existing, ts} {
+			for i, vbno := range t.GetVbnos() {
+				merged.Append(uint16(vbno), t.Seqnos[i], t.Vbuuids[i],
+					t.Snapshots[i].GetStart(), t.Snapshots[i].GetEnd())
+			}
+		}
+		result[ts.GetBucket()] = merged
+	}
+
+	return result
+}
+
+//
+// Reconcile the active timestamps of the nodes into a single authoritative timestamp
+// per bucket, in the order the buckets first appear.  The active timestamps are expected
+// to be validated (refer validateActiveVb), if a vbno is active in more than one node,
+// the latter one is kept.
+//
+func consolidateActiveTimestamps(timestamps []*protobuf.TsVbuuid) []*protobuf.TsVbuuid {
+
+	byBucket := make(map[string]*protobuf.TsVbuuid)
+	var buckets []string
+
+	for _, ts := range timestamps {
+		existing, ok := byBucket[ts.GetBucket()]
+		if !ok {
+			buckets = append(buckets, ts.GetBucket())
+		}
+		byBucket[ts.GetBucket()] = existing.Union(ts)
+	}
+
+	result := make([]*protobuf.TsVbuuid, 0, len(buckets))
+	for _, bucket := range buckets {
+		result = append(result, byBucket[bucket])
+	}
+	return result
+}
+
+//
+// Map each vbno of the timestamp to its offset.  If a vbno appears more than
+// once, the first offset is used.
+//
+func indexTimestampOffsets(ts *protobuf.TsVbuuid) map[uint32]int {
+
+	offsets := make(map[uint32]int)
+	if ts == nil {
+		return offsets
+	}
+
+	for i, vbno := range ts.GetVbnos() {
+		if _, ok := offsets[vbno]; !ok {
+			offsets[vbno] = i
+		}
+	}
+
+	return offsets
+}
+
+/////////////////////////////////////////////////////////////////////////
+// Private Function -  ProjectorStreamClientFactory
+/////////////////////////////////////////////////////////////////////////
+
+func newProjectorStreamClientFactoryImpl(env ProjectorClientEnv,
+	poolName string,
+	cleanupInterval time.Duration) ProjectorStreamClientFactory {
+
+	// look up the cluster of the env, if known.
+	clusterURL := COUCHBASE_INTERNAL_BUCKET_URL
+	timeout := time.Duration(common.SystemConfig["manager.clusterTimeout"].Int()) * time.Millisecond
+	if envImpl, ok := env.(*ProjectorClientEnvImpl); ok {
+		clusterURL = envImpl.clusterURL
+		timeout = envImpl.timeout
+	}
+
+	p := &ProjectorStreamClientFactoryImpl{
+		clientCache:    make(map[string]*projectorClientEntry),
+		nodeAddrs:      make(map[string]string),
+		fallbackExpiry: make(map[string]time.Time),
+		env:            env,
+		clusterURL:     clusterURL,
+		poolName:       poolName,
+		timeout:        timeout,
+		stopch:         make(chan bool)}
+
+	// An interval of 0 or less disables the health check.
+	interval := common.SystemConfig["manager.projectorclient.healthCheckInterval"].Int()
+	if interval > 0 {
+		go p.runHealthCheck(time.Duration(interval) * time.Millisecond)
+	}
+	// A cleanup interval of 0 or less disables the cleanup.
+	if cleanupInterval > 0 {
+		go p.runCleanup(cleanupInterval)
+	}
+
+	return p
+}
+
+//
+// Get the projector client for the given node.  The client is cached by projector
+// address, so that concurrent requests to the same node share the same client.
+//
+func (p *ProjectorStreamClientFactoryImpl) GetClientForNode(server string) ProjectorStreamClient {
+
+	p.mutex.Lock()
+	projAddr, ok := p.nodeAddrs[server]
+	expiry, fallback := p.fallbackExpiry[server]
+	p.mutex.Unlock()
+
+	// The default projector address may be wrong (e.g. cluster_run).  Look up
+	// the projector again once the fallback expires.
+	prevAddr := ""
+	if ok && fallback && time.Now().After(expiry) {
+		prevAddr, ok = projAddr, false
+	}
+
+	if !ok {
+		if projAddr, ok = p.NodeToProjectorMap[server]; ok {
+			logging.Debugf("StreamAdmin::GetClientForNode(): Projector Addr: %v from override", projAddr)
+		}
+	}
+
+	if !ok && p.ProxyURL != nil {
+		// The cluster services may not be reachable except through the proxy.
+		// Use the default projector port on the same host, and let the proxy
+		// route the request.
+		projAddr = defaultProjectorAddr(server)
+		logging.Debugf("StreamAdmin::GetClientForNode(): Projector Addr: %v via proxy %v", projAddr, p.ProxyURL)
+	} else if !ok {
+		var err error
+		projAddr, err = p.getProjectorAddrForNode(server)
+		if err != nil {
+			// Cannot find the projector from the cluster services.  Fall back to
+			// the default projector port on the same host, until the fallback expires.
+			projAddr = defaultProjectorAddr(server)
+			logging.Warnf("StreamAdmin::GetClientForNode(): Unable to find projector for node %v (%v). Use %v",
+				server, err, projAddr)
+		}
+		logging.Debugf("StreamAdmin::GetClientForNode(): Projector Addr: %v", projAddr)
+
+		if prevAddr != "" && prevAddr != projAddr {
+			p.EvictNode(server)
+		}
+
+		p.mutex.Lock()
+		if p.fallbackExpiry == nil {
+			p.fallbackExpiry = make(map[string]time.Time)
+		}
+		if err != nil {
+			p.fallbackExpiry[server] = time.Now().Add(PROJECTOR_ADDR_FALLBACK_TTL)
+		} else {
+			delete(p.fallbackExpiry, server)
+		}
+		p.mutex.Unlock()
+	}
+
+	p.mutex.Lock()
+	p.nodeAddrs[server] = projAddr
+	entry, ok := p.clientCache[projAddr]
+	if !ok {
+		entry = new(projectorClientEntry)
+		p.clientCache[projAddr] = entry
+	}
+	p.mutex.Unlock()
+
+	entry.once.Do(func() {
+		//create client for node's projectors
+		settings := common.NewIndexerSettings(common.SystemConfig)
+		config := settings.ProjectorClientConfig()
+		maxvbs := settings.MaxVbuckets()
+		if config["requestTimeout"].Int() <= 0 {
+			// A projector that accepts the request but never responds must not hold
+			// the worker beyond its share of the retry budget.
+			timeout := projectorRequestTimeout(MAX_PROJECTOR_RETRY_ELAPSED_TIME, MAX_PROJECTOR_RETRY_ATTEMPTS)
+			config.SetValue("requestTimeout", int(timeout/time.Millisecond))
+		}
+		client := projectorC.NewClientWithProxy(HTTP_PREFIX+projAddr+"/adminport/", maxvbs, config, p.ProxyURL)
+
+		p.mutex.Lock()
+		entry.client = client
+		p.mutex.Unlock()
+	})
+
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	return entry.client
+}
+
+//
+// The projector address at the default projector port on the host of the given
+// node.  A node address without port is taken as the host.
+//
+func defaultProjectorAddr(server string) string {
+	host, _, err := net.SplitHostPort(server)
+	if err != nil {
+		host = server
+	}
+	return net.JoinHostPort(host, PROJECTOR_PORT)
+}
+
+//
+// Timeout of each request to projector, such that a hung request leaves room for
+// retry within the elapsed time budget.
+//
+func projectorRequestTimeout(maxElapsed time.Duration, maxAttempts int) time.Duration {
+	timeout := maxElapsed
+	if maxAttempts > 0 {
+		timeout = maxElapsed / time.Duration(maxAttempts)
+	}
+	if timeout < MIN_PROJECTOR_REQUEST_TIMEOUT {
+		timeout = MIN_PROJECTOR_REQUEST_TIMEOUT
+	}
+	return timeout
+}
+
+//
+// Find the projector address for the node that serves KV at the given address
+//
+func (p *ProjectorStreamClientFactoryImpl) getProjectorAddrForNode(kvaddr string) (string, error) {
+
+	ps, err := p.getPoolServices(false)
+	if err != nil {
+		return "", err
+	}
+
+	ns := ps.NodeForKVAddr(kvaddr)
+	if ns == nil {
+		// The node may have joined the cluster after the pool services are cached.
+		if ps, err = p.getPoolServices(true); err != nil {
+			return "", err
+		}
+		ns = ps.NodeForKVAddr(kvaddr)
+	}
+	if ns == nil {
+		return "", enrichError(NewError4(ERROR_STREAM_INVALID_KVADDRS, NORMAL, STREAM, "Cannot find node for kv address "+kvaddr),
+			"getProjectorAddrForNode", "", kvaddr)
+	}
+
+	port, ok := ns.ServicePort("projector")
+	if !ok {
+		return "", enrichError(NewError4(ERROR_STREAM_INVALID_KVADDRS, NORMAL, STREAM, "Projector is not running on node "+ns.Hostname),
+			"getProjectorAddrForNode", "", kvaddr)
+	}
+
+	return net.JoinHostPort(ns.Hostname, strconv.Itoa(port)), nil
+}
+
+//
+// Get the pool services of the cluster.  They are cached for POOL_SERVICES_CACHE_TTL,
+// unless refresh is set.
+//
+func (p *ProjectorStreamClientFactoryImpl) getPoolServices(refresh bool) (*couchbase.PoolServices, error) {
+
+	p.mutex.Lock()
+	ps, fetched := p.poolServices, p.poolServicesFetched
+	p.mutex.Unlock()
+
+	if ps != nil && !refresh && time.Since(fetched) < POOL_SERVICES_CACHE_TTL {
+		return ps, nil
+	}
+
+	var err error
+	if p.fetchPoolServices != nil {
+		ps, err = p.fetchPoolServices()
+	} else {
+		err = callWithTimeout(context.Background(), func(ctx context.Context) (err error) {
+			ps, err = getPoolServices(ctx, p.clusterURL, p.poolName)
+			return
+		}, p.timeout)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	p.mutex.Lock()
+	p.poolServices, p.poolServicesFetched = ps, time.Now()
+	p.mutex.Unlock()
+
+	return ps, nil
+}
+
+//
+// Release the projector client for the given node.
+//
+func (p *ProjectorStreamClientFactoryImpl) CloseClientForNode(server string) {
+	p.EvictNode(server)
+}
+
+//
+// Remove the cached projector client for the given node.  The client is closed
+// unless it is shared with another node at the same projector address.
+//
+func (p *ProjectorStreamClientFactoryImpl) EvictNode(server string) {
+
+	var client *projectorC.Client = nil
+
+	p.mutex.Lock()
+	delete(p.fallbackExpiry, server)
+	if projAddr, ok := p.nodeAddrs[server]; ok {
+		delete(p.nodeAddrs, server)
+		if !p.isSharedNoLock(projAddr) {
+			if entry, ok := p.clientCache[projAddr]; ok {
+				client = entry.client
+			}
+			delete(p.clientCache, projAddr)
+		}
+	}
+	p.mutex.Unlock()
+
+	if client != nil {
+		client.Close()
+	}
+}
+
+//
+// Check if any node is using the client at the given projector address.
+//
+func (p *ProjectorStreamClientFactoryImpl) isSharedNoLock(projAddr string) bool {
+
+	for _, addr := range p.nodeAddrs {
+		if addr == projAddr {
+			return true
+		}
+	}
+	return false
+}
+
+//
+// Stop the background health check and cleanup, and close the cached clients.
+//
+func (p *ProjectorStreamClientFactoryImpl) Close() {
+
+	p.stopOnce.Do(func() {
+		if p.stopch != nil {
+			close(p.stopch)
+		}
+	})
+
+	p.mutex.Lock()
+	clientCache := p.clientCache
+	p.clientCache = make(map[string]*projectorClientEntry)
+	p.nodeAddrs = make(map[string]string)
+	p.fallbackExpiry = make(map[string]time.Time)
+	p.mutex.Unlock()
+
+	for _, entry := range clientCache {
+		p.mutex.Lock()
+		client := entry.client
+		p.mutex.Unlock()
+
+		if client != nil {
+			client.Close()
+		}
+	}
+}
+
+func (p *ProjectorStreamClientFactoryImpl) runHealthCheck(interval time.Duration) {
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			p.checkClients()
+		case <-p.stopch:
+			return
+		}
+	}
+}
+
+func (p *ProjectorStreamClientFactoryImpl) runCleanup(interval time.Duration) {
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			p.cleanupClients()
+		case <-p.stopch:
+			return
+		}
+	}
+}
+
+//
+// Evict the cached projector clients for the nodes that are no longer
+// serving any bucket in the cluster.
+//
+func (p *ProjectorStreamClientFactoryImpl) cleanupClients() {
+
+	buckets, err := getBucketNames(p.clusterURL, p.poolName, p.timeout)
+	if err != nil {
+		logging.Debugf("StreamAdmin::cleanupClients(): fail to get bucket list. Error=%v", err)
+		return
+	}
+
+	nodes, err := p.env.GetNodeListForBuckets(buckets)
+	if err != nil {
+		logging.Debugf("StreamAdmin::cleanupClients(): fail to get node list. Error=%v", err)
+		return
+	}
+
+	var stale []string = nil
+
+	p.mutex.Lock()
+	for server, _ := range p.nodeAddrs {
+		if _, ok := nodes[server]; !ok {
+			stale = append(stale, server)
 		}
 	}
+	p.mutex.Unlock()
 
-	return nil
+	for _, server := range stale {
+		logging.Debugf("StreamAdmin::cleanupClients(): evict projector client for stale node %v", server)
+		p.EvictNode(server)
+	}
 }
 
 //
-// Find the offset/index in the timestamp for the given vbucket no.  Return
-// -1 if no matching vbno being found.
+// Probe every cached projector client and evict the ones that are unreachable.
+// A projector that does not support the probe (e.g. an older projector) is
+// reachable.
 //
-func findTimestampOffsetForVb(ts *protobuf.TsVbuuid, vbno uint32) int {
+func (p *ProjectorStreamClientFactoryImpl) checkClients() {
 
-	if ts == nil {
-		return -1
-	}
+	clients := make(map[string]*projectorC.Client)
 
-	for i, ts_vbno := range ts.GetVbnos() {
-		if ts_vbno == vbno {
-			return i
+	p.mutex.Lock()
+	for server, projAddr := range p.nodeAddrs {
+		if entry, ok := p.clientCache[projAddr]; ok && entry.client != nil {
+			clients[server] = entry.client
 		}
 	}
+	p.mutex.Unlock()
 
-	return -1
+	for server, client := range clients {
+		if err := client.Ping(); err != nil && !isUnsupportedRequestError(err) {
+			logging.Debugf("StreamAdmin::checkClients(): evict projector client for node %v. Error=%v", server, err)
+			p.EvictNode(server)
+		}
+	}
 }
 
 /////////////////////////////////////////////////////////////////////////
-// Private Function -  ProjectorStreamClientFactory
+// Private Function -  ProjectorClientEnv
 /////////////////////////////////////////////////////////////////////////
 
-func newProjectorStreamClientFactoryImpl() ProjectorStreamClientFactory {
-	return new(ProjectorStreamClientFactoryImpl)
+//
+// Get the set of nodes for all the given buckets from env.  The requests to the
+// cluster are cancelled once ctx is done if env implements ProjectorClientEnvWithContext.
+//
+func getNodeListForBuckets(ctx context.Context, env ProjectorClientEnv, buckets []string) (map[string]string, error) {
+
+	if envCtx, ok := env.(ProjectorClientEnvWithContext); ok {
+		return envCtx.GetNodeListForBucketsWithContext(ctx, buckets)
+	}
+	return env.GetNodeListForBuckets(buckets)
 }
 
 //
-// Get the projector client for the given node
+// Filter the timestamps based on vb list on a certain node from env.  The requests to
+// the cluster are cancelled once ctx is done if env implements ProjectorClientEnvWithContext.
 //
-func (p *ProjectorStreamClientFactoryImpl) GetClientForNode(server string) ProjectorStreamClient {
+func filterTimestampsForNode(ctx context.Context, env ProjectorClientEnv,
+	timestamps []*protobuf.TsVbuuid, node string) ([]*protobuf.TsVbuuid, error) {
 
-	var projAddr string
-
-	if host, port, err := net.SplitHostPort(server); err == nil {
-		if common.IsIPLocal(host) {
+	if envCtx, ok := env.(ProjectorClientEnvWithContext); ok {
+		return envCtx.FilterTimestampsForNodeWithContext(ctx, timestamps, node)
+	}
+	return env.FilterTimestampsForNode(timestamps, node)
+}
 
-			if port == KV_DCP_PORT {
-				projAddr = LOCALHOST + ":" + PROJECTOR_PORT
+func newProjectorClientEnvImpl(poolName string) ProjectorClientEnv {
+	clusterURL := common.SystemConfig["manager.clusterURL"].String()
+	timeout := common.SystemConfig["manager.clusterTimeout"].Int()
+	return NewProjectorClientEnvImpl(clusterURL, poolName, time.Duration(timeout)*time.Millisecond)
+}
 
-			} else {
-				iportProj, _ := strconv.Atoi(PROJECTOR_PORT)
-				iportKV, _ := strconv.Atoi(port)
-				iportKV0, _ := strconv.Atoi(KV_DCP_PORT_CLUSTER_RUN)
-
-				//In cluster_run, port number increments by 2
-				nodeNum := (iportKV - iportKV0) / 2
-				p := iportProj + nodeNum
-				projAddr = LOCALHOST + ":" + strconv.Itoa(p)
-			}
-			logging.Debugf("StreamAdmin::GetClientForNode(): Local Projector Addr: %v", projAddr)
+//
+// Create a ProjectorClientEnv that looks up the buckets and nodes from
+// the given cluster and pool.  Each request to the cluster fails after timeout.
+// An empty cluster url or pool name defaults to the local cluster and default pool.
+//
+func NewProjectorClientEnvImpl(clusterURL, poolName string, timeout time.Duration) ProjectorClientEnv {
 
-		} else {
-			projAddr = host + ":" + PROJECTOR_PORT
-			logging.Debugf("StreamAdmin::GetClientForNode(): Remote Projector Addr: %v", projAddr)
-		}
+	if clusterURL == "" {
+		clusterURL = COUCHBASE_INTERNAL_BUCKET_URL
+	}
+	if poolName == "" {
+		poolName = DEFAULT_POOL_NAME
 	}
 
-	//create client for node's projectors
-	config := common.SystemConfig.SectionConfig("manager.projectorclient.", true)
-	maxvbs := common.SystemConfig["maxVbuckets"].Int()
-	ap := projectorC.NewClient(HTTP_PREFIX+projAddr+"/adminport/", maxvbs, config)
-	return ap
-}
-
-/////////////////////////////////////////////////////////////////////////
-// Private Function -  ProjectorClientEnv
-/////////////////////////////////////////////////////////////////////////
+	ttl := common.SystemConfig["manager.vbmapCacheTTL"].Int()
 
-func newProjectorClientEnvImpl() ProjectorClientEnv {
-	return new(ProjectorClientEnvImpl)
+	p := &ProjectorClientEnvImpl{
+		clusterURL: clusterURL,
+		poolName:   poolName,
+		timeout:    timeout,
+		vbmapTTL:   time.Duration(ttl) * time.Millisecond,
+		vbmapCache: make(map[string]*vbmapCacheEntry)}
+	p.fetchVBMap = p.getVBMapFromCluster
+	return p
 }
 
 //
@@ -1050,25 +2997,58 @@ func newProjectorClientEnvImpl() ProjectorClientEnv {
 //
 func (p *ProjectorClientEnvImpl) GetNodeListForBuckets(buckets []string) (map[string]string, error) {
 
+	return p.GetNodeListForBucketsWithContext(context.Background(), buckets)
+}
+
+//
+// Get the set of nodes for all the given buckets.  The requests to the cluster
+// are cancelled once ctx is done.
+//
+func (p *ProjectorClientEnvImpl) GetNodeListForBucketsWithContext(ctx context.Context,
+	buckets []string) (map[string]string, error) {
+
 	logging.Debugf("ProjectorCLientEnvImpl::getNodeListForBuckets(): start")
 
 	nodes := make(map[string]string)
 
+	var ps *couchbase.PoolServices
+	err := callWithTimeout(ctx, func(ctx context.Context) (err error) {
+		ps, err = getPoolServices(ctx, p.clusterURL, p.poolName)
+		return
+	}, p.timeout)
+	if err != nil {
+		return nil, enrichError(err, "GetPoolServices", "", "")
+	}
+
 	for _, bucket := range buckets {
 
-		bucketRef, err := couchbase.GetBucket(COUCHBASE_INTERNAL_BUCKET_URL, DEFAULT_POOL_NAME, bucket)
+		bucketRef, err := p.getBucket(ctx, bucket)
 		if err != nil {
 			return nil, err
 		}
 
-		if err := bucketRef.Refresh(); err != nil {
-			return nil, err
+		if err := refreshWithTimeout(ctx, bucketRef, p.timeout); err != nil {
+			p.invalidateVBMap(bucket)
+			return nil, enrichError(err, "Refresh", bucket, "")
 		}
 
-		for _, node := range bucketRef.NodeAddresses() {
-			// TODO: This may not work for cluster_run when all processes are run in the same node.  Need to check.
+		// The vbuckets may have moved (e.g. upon ErrorNotMyVbucket).  Replace the
+		// cached vbmap, so that FilterTimestampsForNode uses the refreshed one.
+		p.setVBMap(bucket, bucketRef)
+
+		// only the nodes that run projector can serve the stream
+		bs := &couchbase.BucketServices{Bucket: bucketRef, Services: ps}
+		projectors := make(map[string]bool)
+		for _, node := range bs.NodeAddressesByService("projector") {
 			logging.Debugf("ProjectorCLientEnvImpl::getNodeListForBuckets(): node=%v for bucket %v", node, bucket)
 			nodes[node] = node
+			projectors[node] = true
+		}
+		for _, node := range bs.NodeAddresses() {
+			if !projectors[node] {
+				logging.Warnf("ProjectorCLientEnvImpl::getNodeListForBuckets(): node %v of bucket %v does not run projector. Skip.",
+					node, bucket)
+			}
 		}
 	}
 
@@ -1080,53 +3060,82 @@ func (p *ProjectorClientEnvImpl) GetNodeListForBuckets(buckets []string) (map[st
 //
 func (p *ProjectorClientEnvImpl) GetNodeListForTimestamps(timestamps []*common.TsVbuuid) (map[string][]*protobuf.TsVbuuid, error) {
 
+	return p.GetNodeListForTimestampsWithContext(context.Background(), timestamps)
+}
+
+//
+// Get the set of nodes for all the given timestamps.  The requests to the cluster
+// are cancelled once ctx is done.
+//
+func (p *ProjectorClientEnvImpl) GetNodeListForTimestampsWithContext(ctx context.Context,
+	timestamps []*common.TsVbuuid) (map[string][]*protobuf.TsVbuuid, error) {
+
 	logging.Debugf("ProjectorCLientEnvImpl::getNodeListForTimestamps(): start")
 
-	nodes := make(map[string][]*protobuf.TsVbuuid)
+	nodes, unlocated, err := p.GetPartialNodeListForTimestampsWithContext(ctx, timestamps)
+	if err != nil {
+		return nil, err
+	}
 
-	for _, ts := range timestamps {
+	if len(unlocated) != 0 {
+		return nil, enrichError(NewError2(ERROR_STREAM_INCONSISTENT_VBMAP, STREAM), "GetNodeListForTimestamps", unlocated[0].Bucket, "")
+	}
 
-		bucketRef, err := couchbase.GetBucket(COUCHBASE_INTERNAL_BUCKET_URL, DEFAULT_POOL_NAME, ts.Bucket)
-		if err != nil {
-			return nil, err
-		}
+	return nodes, nil
+}
 
-		if err := bucketRef.Refresh(); err != nil {
-			return nil, err
-		}
+//
+// Get the set of nodes for the given timestamps.  Unlike GetNodeListForTimestamps, a vbucket
+// that cannot be located in the vbmap does not fail the call.  These vbuckets are returned
+// separately as timestamps (one per bucket), so that the caller can retry just the stragglers.
+//
+func (p *ProjectorClientEnvImpl) GetPartialNodeListForTimestamps(timestamps []*common.TsVbuuid) (
+	map[string][]*protobuf.TsVbuuid, []*common.TsVbuuid, error) {
+
+	return p.GetPartialNodeListForTimestampsWithContext(context.Background(), timestamps)
+}
 
-		vbmap, err := bucketRef.GetVBmap(nil)
+//
+// Get the set of nodes for the given timestamps, refer GetPartialNodeListForTimestamps.
+// The requests to the cluster are cancelled once ctx is done.
+//
+func (p *ProjectorClientEnvImpl) GetPartialNodeListForTimestampsWithContext(ctx context.Context,
+	timestamps []*common.TsVbuuid) (map[string][]*protobuf.TsVbuuid, []*common.TsVbuuid, error) {
+
+	logging.Debugf("ProjectorCLientEnvImpl::getPartialNodeListForTimestamps(): start")
+
+	nodes := make(map[string][]*protobuf.TsVbuuid)
+	var unlocated []*common.TsVbuuid = nil
+
+	for _, ts := range timestamps {
+
+		// Always use the latest vbmap.  This also refreshes the cached vbmap.
+		vbmap, err := p.refreshVBMap(ctx, ts.Bucket)
 		if err != nil {
-			return nil, err
+			return nil, nil, err
 		}
 
+		var straggler *common.TsVbuuid = nil
 		for i, seqno := range ts.Seqnos {
 			if seqno != 0 {
-				found := false
-				for kvaddr, vbnos := range vbmap {
-					for _, vbno := range vbnos {
-						if vbno == uint16(i) {
-							newTs := p.findTimestamp(nodes, kvaddr, ts.Bucket)
-							newTs.Append(uint16(i), ts.Seqnos[i], ts.Vbuuids[i],
-								ts.Snapshots[i][0], ts.Snapshots[i][1])
-							found = true
-							break
-						}
-					}
-
-					if found {
-						break
+				if kvaddr, err := vbmap.NodeForVbucket(uint16(i)); err == nil {
+					newTs := p.findTimestamp(nodes, kvaddr, ts.Bucket)
+					newTs.Append(uint16(i), ts.Seqnos[i], ts.Vbuuids[i],
+						ts.Snapshots[i][0], ts.Snapshots[i][1])
+				} else {
+					if straggler == nil {
+						straggler = common.NewTsVbuuid(ts.Bucket, len(ts.Seqnos))
+						unlocated = append(unlocated, straggler)
 					}
-				}
-
-				if !found {
-					return nil, NewError2(ERROR_STREAM_INCONSISTENT_VBMAP, STREAM)
+					straggler.Seqnos[i] = ts.Seqnos[i]
+					straggler.Vbuuids[i] = ts.Vbuuids[i]
+					straggler.Snapshots[i] = ts.Snapshots[i]
 				}
 			}
 		}
 	}
 
-	return nodes, nil
+	return nodes, unlocated, nil
 }
 
 func (p *ProjectorClientEnvImpl) findTimestamp(timestampMap map[string][]*protobuf.TsVbuuid,
@@ -1144,7 +3153,7 @@ func (p *ProjectorClientEnvImpl) findTimestamp(timestampMap map[string][]*protob
 		}
 	}
 
-	newTs := protobuf.NewTsVbuuid(DEFAULT_POOL_NAME, bucket, NUM_VB)
+	newTs := protobuf.NewTsVbuuid(p.poolName, bucket, NUM_VB)
 	timestamps = append(timestamps, newTs)
 	timestampMap[kvaddr] = timestamps
 	return newTs
@@ -1156,38 +3165,35 @@ func (p *ProjectorClientEnvImpl) findTimestamp(timestampMap map[string][]*protob
 func (p *ProjectorClientEnvImpl) FilterTimestampsForNode(timestamps []*protobuf.TsVbuuid,
 	node string) ([]*protobuf.TsVbuuid, error) {
 
+	return p.FilterTimestampsForNodeWithContext(context.Background(), timestamps, node)
+}
+
+//
+// Filter the timestamp based on vb list on a certain node.  The requests to the
+// cluster are cancelled once ctx is done.
+//
+func (p *ProjectorClientEnvImpl) FilterTimestampsForNodeWithContext(ctx context.Context,
+	timestamps []*protobuf.TsVbuuid, node string) ([]*protobuf.TsVbuuid, error) {
+
 	logging.Debugf("ProjectorClientEnvImpl.FilterTimestampsForNode(): start")
 
 	var newTimestamps []*protobuf.TsVbuuid = nil
 
 	for _, ts := range timestamps {
 
-		bucketRef, err := couchbase.GetBucket(COUCHBASE_INTERNAL_BUCKET_URL, DEFAULT_POOL_NAME, ts.GetBucket())
-		if err != nil {
-			return nil, err
-		}
-
-		if err := bucketRef.Refresh(); err != nil {
-			return nil, err
-		}
-
-		vbmap, err := bucketRef.GetVBmap(nil)
+		vbmap, err := p.getVBMap(ctx, ts.GetBucket())
 		if err != nil {
 			return nil, err
 		}
 
-		newTs := protobuf.NewTsVbuuid(DEFAULT_POOL_NAME, ts.GetBucket(), NUM_VB)
+		newTs := protobuf.NewTsVbuuid(p.poolName, ts.GetBucket(), NUM_VB)
 
-		for kvaddr, vbnos := range vbmap {
-			if kvaddr == node {
-				for _, vbno := range vbnos {
-					seqno, vbuuid, sStart, sEnd, err := ts.Get(vbno)
-					// If cannot get the seqno from this vbno (err != nil), then skip.
-					// Otherwise, add to the new timestamp.
-					if err == nil {
-						newTs.Append(uint16(vbno), seqno, vbuuid, sStart, sEnd)
-					}
-				}
+		for i, vbno := range ts.GetVbnos() {
+			// Skip the vbno if it is not owned by this node, or if its owner cannot
+			// be located in the vbmap.
+			if kvaddr, err := vbmap.NodeForVbucket(uint16(vbno)); err == nil && kvaddr == node {
+				newTs.Append(uint16(vbno), ts.Seqnos[i], ts.Vbuuids[i],
+					ts.Snapshots[i].GetStart(), ts.Snapshots[i].GetEnd())
 			}
 		}
 
@@ -1199,39 +3205,357 @@ func (p *ProjectorClientEnvImpl) FilterTimestampsForNode(timestamps []*protobuf.
 	return newTimestamps, nil
 }
 
+//
+// Get the vbmap for the bucket.  The vbmap is cached for vbmapTTL, so that
+// it is not fetched from the cluster for every node during stream fan-out.
+//
+func (p *ProjectorClientEnvImpl) getVBMap(ctx context.Context, bucket string) (vbOwnerLookup, error) {
+
+	p.mutex.Lock()
+	entry, ok := p.vbmapCache[bucket]
+	p.mutex.Unlock()
+
+	if ok && time.Since(entry.fetched) < p.vbmapTTL {
+		return entry.vbmap, nil
+	}
+
+	return p.refreshVBMap(ctx, bucket)
+}
+
+//
+// Fetch the latest vbmap for the bucket and replace the cached one.
+//
+func (p *ProjectorClientEnvImpl) refreshVBMap(ctx context.Context, bucket string) (vbOwnerLookup, error) {
+
+	vbmap, err := p.fetchVBMap(ctx, bucket)
+	if err != nil {
+		p.invalidateVBMap(bucket)
+		return nil, err
+	}
+
+	p.setVBMap(bucket, vbmap)
+	return vbmap, nil
+}
+
+func (p *ProjectorClientEnvImpl) setVBMap(bucket string, vbmap vbOwnerLookup) {
+
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	p.vbmapCache[bucket] = &vbmapCacheEntry{vbmap: vbmap, fetched: time.Now()}
+}
+
+func (p *ProjectorClientEnvImpl) invalidateVBMap(bucket string) {
+
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	delete(p.vbmapCache, bucket)
+}
+
+func (p *ProjectorClientEnvImpl) getVBMapFromCluster(ctx context.Context, bucket string) (vbOwnerLookup, error) {
+
+	bucketRef, err := p.getBucket(ctx, bucket)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := refreshWithTimeout(ctx, bucketRef, p.timeout); err != nil {
+		return nil, enrichError(err, "Refresh", bucket, "")
+	}
+
+	return bucketRef, nil
+}
+
+func (p *ProjectorClientEnvImpl) getBucket(ctx context.Context, bucket string) (*couchbase.Bucket, error) {
+
+	var bucketRef *couchbase.Bucket
+	err := callWithTimeout(ctx, func(ctx context.Context) (err error) {
+		bucketRef, err = couchbase.GetBucketWithContext(ctx, p.clusterURL, p.poolName, bucket)
+		return
+	}, p.timeout)
+
+	return bucketRef, enrichError(err, "GetBucket", bucket, "")
+}
+
 /////////////////////////////////////////////////////////////////////////
 // Private Function - Utilty
 /////////////////////////////////////////////////////////////////////////
 
 //
-// Convert StreamId into topic string
+// Get the bucket-independent services of every node in the pool
+//
+func getPoolServices(ctx context.Context, clusterURL, poolName string) (*couchbase.PoolServices, error) {
+
+	client, err := couchbase.ConnectWithContext(ctx, clusterURL)
+	if err != nil {
+		return nil, err
+	}
+
+	ps, err := client.GetPoolServicesWithContext(ctx, poolName)
+	if err != nil {
+		return nil, err
+	}
+
+	// For the current node, hostname can be empty.  Use the hostname
+	// used to connect to the cluster.
+	host, _, _ := net.SplitHostPort(client.BaseURL.Host)
+	for i := range ps.NodesExt {
+		if ps.NodesExt[i].Hostname == "" {
+			ps.NodesExt[i].Hostname = host
+		}
+	}
+
+	return &ps, nil
+}
+
+//
+// Check if the error is the reply of a projector that does not support the request,
+// either from the adminport (no path or handler for the request) or the projector.
+//
+func isUnsupportedRequestError(err error) bool {
+
+	errStr := err.Error()
+	if strings.Contains(errStr, common.ErrorInvalidRequest.Error()) {
+		return true
+	}
+	return strings.Contains(errStr, ap.ErrorRequest.Error()) &&
+		(strings.Contains(errStr, "path not found") || strings.Contains(errStr, "no handler for"))
+}
+
+//
+// Check if the worker error has one of the given recoverable codes.  An error
+// that is not an Error (e.g. a raw network error) is never recoverable, so it is
+// returned to the caller instead of being retried.
+//
+func isRecoverableError(err error, codes ...errCode) bool {
+
+	e, ok := AsStreamError(err)
+	if !ok {
+		return false
+	}
+
+	for _, code := range codes {
+		if e.code == code {
+			return true
+		}
+	}
+	return false
+}
+
+//
+// Add the operation, bucket and node to the error for debugging.  Empty
+// values are ignored.  The error code is not changed.
+//
+func enrichError(err error, op, bucket, node string) error {
+
+	e, ok := err.(Error)
+	if !ok {
+		return err
+	}
+
+	if op != "" {
+		e.op = op
+	}
+	if bucket != "" {
+		e.bucket = bucket
+	}
+	if node != "" {
+		e.node = node
+	}
+	return e
+}
+
+//
+// Refresh the bucket.  Return an error if the cluster does not respond within timeout,
+// or once ctx is done.
+//
+func refreshWithTimeout(ctx context.Context, b *couchbase.Bucket, timeout time.Duration) error {
+
+	return callWithTimeout(ctx, b.RefreshWithContext, timeout)
+}
+
+//
+// Call fn with a context that is done after timeout, or once parent is done,
+// which cancels the requests of fn to the cluster.  A timeout of 0 or less means
+// no timeout.
+//
+func callWithTimeout(parent context.Context, fn func(ctx context.Context) error, timeout time.Duration) error {
+
+	ctx, cancel := parent, context.CancelFunc(func() {})
+	if timeout > 0 {
+		ctx, cancel = context.WithTimeout(parent, timeout)
+	}
+	defer cancel()
+
+	err := fn(ctx)
+	if err != nil && parent.Err() == nil && ctx.Err() == context.DeadlineExceeded {
+		return NewError(ERROR_STREAM_REQUEST_ERROR, NORMAL, STREAM, err,
+			fmt.Sprintf("Cluster does not respond after %v", timeout))
+	}
+	return err
+}
+
+//
+// Check if the error from projector client is a network error that will not go away
+// by retrying, such as DNS failure or connection refused.  Timeout and temporary
+// errors are considered to be retriable.
+//
+func isPermanentNetError(err error) bool {
+
+	if uerr, ok := err.(*url.Error); ok {
+		err = uerr.Err
+	}
+
+	if operr, ok := err.(*net.OpError); ok {
+		if operr.Timeout() || operr.Temporary() {
+			return false
+		}
+		err = operr.Err
+	}
+
+	if dnserr, ok := err.(*net.DNSError); ok {
+		return !dnserr.Timeout() && !dnserr.Temporary()
+	}
+
+	if nerr, ok := err.(net.Error); ok && (nerr.Timeout() || nerr.Temporary()) {
+		return false
+	}
+
+	return strings.Contains(err.Error(), "connection refused")
+}
+
+//
+// Get the names of the buckets in the given pool of the cluster.  Return an error
+// if the cluster does not respond within timeout.
+//
+func getBucketNames(clusterURL, poolName string, timeout time.Duration) ([]string, error) {
+
+	var infos []couchbase.BucketInfo
+	err := callWithTimeout(context.Background(), func(ctx context.Context) error {
+		client, err := couchbase.ConnectWithContext(ctx, clusterURL)
+		if err != nil {
+			return err
+		}
+		infos, err = client.ListBucketsWithContext(ctx, poolName)
+		return err
+	}, timeout)
+	if err != nil {
+		return nil, err
+	}
+
+	var buckets []string = nil
+	for _, info := range infos {
+		buckets = append(buckets, info.Name)
+	}
+
+	return buckets, nil
+}
+
+// topic and port of the stream types registered by RegisterStreamTopic
+// and RegisterStreamPort
+type streamRegistration struct {
+	topic string
+	port  string
+}
+
+var streamRegistry = map[common.StreamId]*streamRegistration{}
+var streamRegistryMutex sync.RWMutex
+
+//
+// Format the stream as key/value pairs for logging, so that the log lines
+// of a stream can be grep'ed across multiple nodes.
+//
+func (p *ProjectorAdmin) streamLogFields(streamId common.StreamId) string {
+	topic, _ := p.topicForStreamId(streamId)
+	return fmt.Sprintf("streamId=%v topic=%v", streamId, topic)
+}
+
+//
+// Signal the worker to stop.  It does not block and can be called more than once,
+// e.g. from concurrent cleanup paths, or after the worker is done.
+//
+func (worker *adminWorker) kill() {
+	worker.killOnce.Do(func() { close(worker.killch) })
+}
+
+//
+// Format the worker as key/value pairs for logging.
+//
+func (worker *adminWorker) logFields() string {
+	return fmt.Sprintf("%v server=%v", worker.admin.streamLogFields(worker.streamId), worker.server)
+}
+
+//
+// Convert StreamId into topic string, prefixed by TopicPrefix.
 //
-func getTopicForStreamId(streamId common.StreamId) string {
+func (p *ProjectorAdmin) topicForStreamId(streamId common.StreamId) (string, error) {
 
 	var topic string
 
 	switch streamId {
 	case common.MAINT_STREAM:
-		if !TESTING {
-			topic = MAINT_TOPIC
-		} else {
-			topic = "testing " + MAINT_TOPIC
-		}
+		topic = MAINT_TOPIC
 	case common.INIT_STREAM:
-		if !TESTING {
-			topic = INIT_TOPIC
-		} else {
-			topic = "testing " + INIT_TOPIC
-		}
+		topic = INIT_TOPIC
+	default:
+		topic = lookupStreamRegistration(streamId).topic
+	}
+
+	if topic == "" {
+		return "", NewError4(ERROR_STREAM_INVALID_ARGUMENT, NORMAL, STREAM,
+			fmt.Sprintf("No topic registered for stream %v", streamId))
+	}
+
+	if TESTING {
+		topic = "testing " + topic
+	}
+
+	return p.TopicPrefix + topic, nil
+}
+
+//
+// Register the topic for a stream other than MAINT_STREAM and INIT_STREAM.
+//
+func RegisterStreamTopic(id common.StreamId, topic string) {
+	registerStream(id, func(reg *streamRegistration) { reg.topic = topic })
+}
+
+//
+// Register the port for a stream other than MAINT_STREAM and INIT_STREAM.
+//
+func RegisterStreamPort(id common.StreamId, port string) {
+	registerStream(id, func(reg *streamRegistration) { reg.port = port })
+}
+
+func registerStream(id common.StreamId, update func(reg *streamRegistration)) {
+
+	streamRegistryMutex.Lock()
+	defer streamRegistryMutex.Unlock()
+
+	reg, ok := streamRegistry[id]
+	if !ok {
+		reg = &streamRegistration{}
+		streamRegistry[id] = reg
 	}
+	update(reg)
+}
+
+func lookupStreamRegistration(id common.StreamId) streamRegistration {
 
-	return topic
+	streamRegistryMutex.RLock()
+	defer streamRegistryMutex.RUnlock()
+
+	if reg, ok := streamRegistry[id]; ok {
+		return *reg
+	}
+	return streamRegistration{}
 }
 
 //
 // Convert StreamId into port
 //
-func getPortForStreamId(streamId common.StreamId) string {
+func getPortForStreamId(streamId common.StreamId) (string, error) {
 
 	var port string
 
@@ -1240,7 +3564,14 @@ func getPortForStreamId(streamId common.StreamId) string {
 		port = COORD_MAINT_STREAM_PORT
 	case common.INIT_STREAM:
 		port = COORD_INIT_STREAM_PORT
+	default:
+		port = lookupStreamRegistration(streamId).port
+	}
+
+	if port == "" {
+		return "", NewError4(ERROR_STREAM_INVALID_ARGUMENT, NORMAL, STREAM,
+			fmt.Sprintf("No port registered for stream %v", streamId))
 	}
 
-	return port
+	return port, nil
 }
@@ -0,0 +1,3118 @@
+// Copyright (c) 2014 Couchbase, Inc.
+// Licensed under the Apache License, Version 2.0 (the "License"); you may not use this file
+// except in compliance with the License. You may obtain a copy of the License at
+//   http://www.apache.org/licenses/LICENSE-2.0
+// Unless required by applicable law or agreed to in writing, software distributed under the
+// License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND,
+// either express or implied. See the License for the specific language governing permissions
+// and limitations under the License.
+
+package manager
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	ap "github.com/couchbase/indexing/secondary/adminport"
+	"github.com/couchbase/indexing/secondary/common"
+	couchbase "github.com/couchbase/indexing/secondary/dcp"
+	projectorC "github.com/couchbase/indexing/secondary/projector/client"
+	protobuf "github.com/couchbase/indexing/secondary/protobuf/projector"
+	"math/rand"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"reflect"
+	"sort"
+	"strings"
+	"sync"
+	"syscall"
+	"testing"
+	"time"
+)
+
+//
+// Simulate the stream fan-out for a 10-node cluster with 3 buckets.  Without the
+// vbmap cache, every FilterTimestampsForNode call fetches the vbmap of every bucket.
+//
+func BenchmarkFilterTimestampsForNode(b *testing.B) {
+
+	const numNodes = 10
+	buckets := []string{"bucket1", "bucket2", "bucket3"}
+
+	nodes := make([]string, numNodes)
+	for i := range nodes {
+		nodes[i] = fmt.Sprintf("127.0.0.%d:11210", i+1)
+	}
+
+	fetches := 0
+	env := NewProjectorClientEnvImpl(COUCHBASE_INTERNAL_BUCKET_URL, DEFAULT_POOL_NAME, time.Minute).(*ProjectorClientEnvImpl)
+	env.fetchVBMap = func(ctx context.Context, bucket string) (vbOwnerLookup, error) {
+		fetches++
+		vbmap := make(map[string][]uint16)
+		for vb := 0; vb < NUM_VB; vb++ {
+			node := nodes[vb%numNodes]
+			vbmap[node] = append(vbmap[node], uint16(vb))
+		}
+		return newTestVBOwners(vbmap), nil
+	}
+
+	var timestamps []*protobuf.TsVbuuid = nil
+	for _, bucket := range buckets {
+		ts := protobuf.NewTsVbuuid(DEFAULT_POOL_NAME, bucket, NUM_VB)
+		for vb := 0; vb < NUM_VB; vb++ {
+			ts.Append(uint16(vb), uint64(vb+1), uint64(1234), uint64(0), uint64(0))
+		}
+		timestamps = append(timestamps, ts)
+	}
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		for _, node := range nodes {
+			if _, err := env.FilterTimestampsForNode(timestamps, node); err != nil {
+				b.Fatal(err)
+			}
+		}
+	}
+	b.StopTimer()
+
+	b.Logf("vbmap fetches=%v, without cache=%v", fetches, b.N*len(nodes)*len(buckets))
+}
+
+// testVBOwners implements vbOwnerLookup for a vbmap of kv address to vbnos.
+type testVBOwners map[uint16]string
+
+func newTestVBOwners(vbmap map[string][]uint16) testVBOwners {
+	owners := make(testVBOwners)
+	for kvaddr, vbnos := range vbmap {
+		for _, vbno := range vbnos {
+			owners[vbno] = kvaddr
+		}
+	}
+	return owners
+}
+
+func (o testVBOwners) NodeForVbucket(vbno uint16) (string, error) {
+	if kvaddr, ok := o[vbno]; ok {
+		return kvaddr, nil
+	}
+	return "", fmt.Errorf("no active owner for vbucket %d", vbno)
+}
+
+//
+// A cluster that never responds should cause a timeout error rather than blocking forever.
+//
+func TestGetNodeListForBucketsTimeout(t *testing.T) {
+
+	blockch := make(chan bool)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-blockch
+	}))
+	defer server.Close()
+	defer close(blockch)
+
+	env := NewProjectorClientEnvImpl(server.URL+"/", DEFAULT_POOL_NAME, 100*time.Millisecond)
+
+	donech := make(chan error, 1)
+	go func() {
+		_, err := env.GetNodeListForBuckets([]string{DEFAULT_BUCKET_NAME})
+		donech <- err
+	}()
+
+	select {
+	case err := <-donech:
+		if err == nil {
+			t.Fatal("Expect GetNodeListForBuckets to fail with timeout")
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("GetNodeListForBuckets is blocked on a slow cluster")
+	}
+}
+
+//
+// The bucket list for the cleanup of cached projector clients should not block
+// on a slow cluster.
+//
+func TestGetBucketNamesTimeout(t *testing.T) {
+
+	blockch := make(chan bool)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-blockch
+	}))
+	defer server.Close()
+	defer close(blockch)
+
+	donech := make(chan error, 1)
+	go func() {
+		_, err := getBucketNames(server.URL+"/", DEFAULT_POOL_NAME, 100*time.Millisecond)
+		donech <- err
+	}()
+
+	select {
+	case err := <-donech:
+		if err == nil {
+			t.Fatal("Expect getBucketNames to fail with timeout")
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("getBucketNames is blocked on a slow cluster")
+	}
+}
+
+//
+// The vbmap is fetched with the context of the request, so that a cancelled request
+// does not wait for a slow cluster.
+//
+func TestFilterTimestampsForNodeCancel(t *testing.T) {
+
+	blockch := make(chan bool)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-blockch
+	}))
+	defer server.Close()
+	defer close(blockch)
+
+	env := NewProjectorClientEnvImpl(server.URL+"/", DEFAULT_POOL_NAME, time.Minute).(*ProjectorClientEnvImpl)
+	ts := protobuf.NewTsVbuuid(DEFAULT_POOL_NAME, DEFAULT_BUCKET_NAME, NUM_VB)
+	ts.Append(uint16(0), uint64(1), uint64(1234), uint64(0), uint64(0))
+
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	donech := make(chan error, 1)
+	go func() {
+		_, err := env.FilterTimestampsForNodeWithContext(ctx, []*protobuf.TsVbuuid{ts}, "127.0.0.1:11210")
+		donech <- err
+	}()
+
+	select {
+	case err := <-donech:
+		if err == nil {
+			t.Fatal("Expect FilterTimestampsForNodeWithContext to fail once ctx is done")
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("FilterTimestampsForNodeWithContext is blocked on a slow cluster after ctx is done")
+	}
+}
+
+func TestCallWithTimeout(t *testing.T) {
+
+	// the request is cancelled upon timeout
+	err := callWithTimeout(context.Background(), func(ctx context.Context) error {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(5 * time.Second):
+			return nil
+		}
+	}, 10*time.Millisecond)
+	if e, ok := AsStreamError(err); !ok || e.code != ERROR_STREAM_REQUEST_ERROR {
+		t.Fatalf("Expect timeout error, got %v", err)
+	}
+
+	// no timeout
+	for _, timeout := range []time.Duration{0, -1} {
+		err := callWithTimeout(context.Background(), func(ctx context.Context) error {
+			if _, ok := ctx.Deadline(); ok {
+				return fmt.Errorf("unexpected deadline")
+			}
+			return nil
+		}, timeout)
+		if err != nil {
+			t.Fatalf("Expect no timeout for %v, got %v", timeout, err)
+		}
+	}
+
+	// the request is cancelled when the parent is done, without timeout error
+	parent, cancel := context.WithCancel(context.Background())
+	cancel()
+	err = callWithTimeout(parent, func(ctx context.Context) error {
+		<-ctx.Done()
+		return ctx.Err()
+	}, time.Minute)
+	if err != context.Canceled {
+		t.Fatalf("Expect the request to be cancelled, got %v", err)
+	}
+
+	// error of the request is returned as is
+	cause := errors.New("HTTP error 404")
+	if err := callWithTimeout(context.Background(), func(ctx context.Context) error { return cause }, time.Minute); err != cause {
+		t.Fatalf("Expect error of the request, got %v", err)
+	}
+}
+
+//
+// The vbmap cached by FilterTimestampsForNode is replaced when GetNodeListForBuckets
+// refreshes the bucket, e.g. when the request is retried upon ErrorNotMyVbucket.
+//
+func TestGetNodeListForBucketsRefreshVBMap(t *testing.T) {
+
+	var mutex sync.Mutex
+	owner := "127.0.0.1:12000"
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mutex.Lock()
+		defer mutex.Unlock()
+
+		switch r.URL.Path {
+		case "/pools":
+			w.Write([]byte(`{"pools": [{"name": "default", "uri": "/pools/default"}]}`))
+		case "/pools/default":
+			w.Write([]byte(`{"nodes": [], "buckets": {"uri": "/pools/default/buckets",
+				"terseBucketsBase": "/pools/default/b/"}}`))
+		case "/pools/default/buckets":
+			w.Write([]byte(`[{"name": "bucket1", "uri": "/pools/default/buckets/bucket1"}]`))
+		case "/pools/default/nodeServices":
+			w.Write([]byte(`{"nodesExt": [
+				{"hostname": "127.0.0.1", "services": {"kv": 12000, "projector": 10000}},
+				{"hostname": "127.0.0.1", "services": {"kv": 12002, "projector": 10001}}]}`))
+		default:
+			fmt.Fprintf(w, `{"name": "bucket1", "uri": "/pools/default/buckets/bucket1",
+				"vBucketServerMap": {"hashAlgorithm": "CRC", "serverList": [%q], "vBucketMap": [[0]]}}`, owner)
+		}
+	}))
+	defer server.Close()
+
+	env := NewProjectorClientEnvImpl(server.URL+"/", DEFAULT_POOL_NAME, time.Minute)
+
+	ts := protobuf.NewTsVbuuid(DEFAULT_POOL_NAME, "bucket1", NUM_VB)
+	ts.Append(0, 10, 1234, 0, 0)
+	if filtered, err := env.FilterTimestampsForNode([]*protobuf.TsVbuuid{ts}, "127.0.0.1:12000"); err != nil ||
+		len(filtered) != 1 || len(filtered[0].GetVbnos()) != 1 {
+		t.Fatalf("Expect vb 0 on the first node, got %v, err %v", filtered, err)
+	}
+
+	// vb 0 moves to the second node
+	mutex.Lock()
+	owner = "127.0.0.1:12002"
+	mutex.Unlock()
+
+	nodes, err := env.GetNodeListForBuckets([]string{"bucket1"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := nodes[owner]; !ok || len(nodes) != 1 {
+		t.Fatalf("Expect the second node for the bucket, got %v", nodes)
+	}
+	if filtered, err := env.FilterTimestampsForNode([]*protobuf.TsVbuuid{ts}, owner); err != nil ||
+		len(filtered) != 1 || len(filtered[0].GetVbnos()) != 1 {
+		t.Fatalf("Expect vb 0 on the second node with the refreshed vbmap, got %v, err %v", filtered, err)
+	}
+}
+
+func makeRecomputeTestTimestamps(numVb int) (*protobuf.TsVbuuid, []*protobuf.TsVbuuid) {
+
+	requestTs := protobuf.NewTsVbuuid(DEFAULT_POOL_NAME, DEFAULT_BUCKET_NAME, numVb)
+	rollbackTs := protobuf.NewTsVbuuid(DEFAULT_POOL_NAME, DEFAULT_BUCKET_NAME, numVb)
+	for vb := 0; vb < numVb; vb++ {
+		requestTs.Append(uint16(vb), uint64(vb+100), uint64(1234), uint64(0), uint64(0))
+		// rollback timestamp in reverse order to simulate an unsorted response
+		rollbackTs.Append(uint16(numVb-vb-1), uint64(vb), uint64(5678), uint64(vb), uint64(vb))
+	}
+	return requestTs, []*protobuf.TsVbuuid{rollbackTs}
+}
+
+//
+// Reference implementation with a linear scan for each vbno, to compare
+// against recomputeRequestTimestamp.
+//
+func recomputeRequestTimestampLinear(requestTs *protobuf.TsVbuuid,
+	rollbackTimestamps []*protobuf.TsVbuuid) *protobuf.TsVbuuid {
+
+	newTs := protobuf.NewTsVbuuid(requestTs.GetPool(), requestTs.GetBucket(), len(requestTs.GetVbnos()))
+	var rollbackTs *protobuf.TsVbuuid = nil
+	for _, ts := range rollbackTimestamps {
+		if ts.GetBucket() == requestTs.GetBucket() {
+			rollbackTs = ts
+			break
+		}
+	}
+
+	for i, vbno := range requestTs.GetVbnos() {
+		offset := -1
+		if rollbackTs != nil {
+			for j, ts_vbno := range rollbackTs.GetVbnos() {
+				if ts_vbno == vbno {
+					offset = j
+					break
+				}
+			}
+		}
+
+		if offset != -1 {
+			newTs.Append(uint16(vbno), rollbackTs.Seqnos[offset], rollbackTs.Vbuuids[offset],
+				rollbackTs.Snapshots[offset].GetStart(), rollbackTs.Snapshots[offset].GetEnd())
+		} else {
+			newTs.Append(uint16(vbno), requestTs.Seqnos[i], requestTs.Vbuuids[i],
+				requestTs.Snapshots[i].GetStart(), requestTs.Snapshots[i].GetEnd())
+		}
+	}
+
+	return newTs
+}
+
+func TestRecomputeRequestTimestamp(t *testing.T) {
+
+	requestTs, rollbackTimestamps := makeRecomputeTestTimestamps(1024)
+
+	// drop half of the rollback timestamp so that some vbuckets are copied from the request
+	rollbackTs := rollbackTimestamps[0]
+	rollbackTs.Vbnos = rollbackTs.Vbnos[:512]
+	rollbackTs.Seqnos = rollbackTs.Seqnos[:512]
+	rollbackTs.Vbuuids = rollbackTs.Vbuuids[:512]
+	rollbackTs.Snapshots = rollbackTs.Snapshots[:512]
+
+	expected := recomputeRequestTimestampLinear(requestTs, rollbackTimestamps)
+	actual := recomputeRequestTimestamp(requestTs, indexTimestampsByBucket(rollbackTimestamps))
+
+	if expected.String() != actual.String() {
+		t.Fatalf("recomputeRequestTimestamp does not match the reference implementation")
+	}
+}
+
+func TestRecomputeRequestTimestampClampSnapshot(t *testing.T) {
+
+	requestTs := protobuf.NewTsVbuuid(DEFAULT_POOL_NAME, DEFAULT_BUCKET_NAME, 3)
+	rollbackTs := protobuf.NewTsVbuuid(DEFAULT_POOL_NAME, DEFAULT_BUCKET_NAME, 3)
+	for vb := 0; vb < 3; vb++ {
+		requestTs.Append(uint16(vb), uint64(100), uint64(1234), uint64(100), uint64(100))
+	}
+	rollbackTs.Append(uint16(0), uint64(50), uint64(5678), uint64(40), uint64(60)) // in window
+	rollbackTs.Append(uint16(1), uint64(50), uint64(5678), uint64(60), uint64(80)) // below window
+	rollbackTs.Append(uint16(2), uint64(50), uint64(5678), uint64(20), uint64(40)) // above window
+
+	newTs := recomputeRequestTimestamp(requestTs, indexTimestampsByBucket([]*protobuf.TsVbuuid{rollbackTs}))
+
+	expected := [][2]uint64{{40, 60}, {50, 80}, {20, 50}}
+	for i, snapshot := range newTs.GetSnapshots() {
+		if newTs.Seqnos[i] != 50 {
+			t.Fatalf("Expect rollback seqno 50 for vb %d, got %d", i, newTs.Seqnos[i])
+		}
+		actual := [2]uint64{snapshot.GetStart(), snapshot.GetEnd()}
+		if actual != expected[i] {
+			t.Fatalf("Expect snapshot %v for vb %d, got %v", expected[i], i, actual)
+		}
+	}
+}
+
+func BenchmarkRecomputeRequestTimestamp(b *testing.B) {
+
+	requestTs, rollbackTimestamps := makeRecomputeTestTimestamps(1024)
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		recomputeRequestTimestamp(requestTs, indexTimestampsByBucket(rollbackTimestamps))
+	}
+}
+
+func BenchmarkRecomputeRequestTimestampLinear(b *testing.B) {
+
+	requestTs, rollbackTimestamps := makeRecomputeTestTimestamps(1024)
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		recomputeRequestTimestampLinear(requestTs, rollbackTimestamps)
+	}
+}
+
+//
+// The request and rollback timestamps are generated from the vbnos (one byte per vbno),
+// and the seed for seqnos and snapshots, so that the seqno can fall on either side of
+// the snapshot window.
+//
+func FuzzRecomputeRequestTimestamp(f *testing.F) {
+
+	f.Add("bucket1", "bucket1", []byte{0, 1, 2, 3}, []byte{}, int64(1))           // empty rollback
+	f.Add("bucket1", "bucket1", []byte{0, 1, 2, 3}, []byte{3, 2, 1, 0}, int64(2)) // full rollback
+	f.Add("bucket1", "bucket1", []byte{0, 1, 2, 3}, []byte{1, 3}, int64(3))       // partial rollback
+	f.Add("bucket1", "bucket2", []byte{0, 1, 2, 3}, []byte{0, 1}, int64(4))       // mismatched bucket
+	f.Add("", "", []byte{}, []byte{0, 0, 255}, int64(5))                          // empty request
+
+	f.Fuzz(func(t *testing.T, bucket, rollbackBucket string, vbnos, rollbackVbnos []byte, seed int64) {
+
+		rnd := rand.New(rand.NewSource(seed))
+		makeTs := func(bucket string, vbnos []byte) *protobuf.TsVbuuid {
+			ts := protobuf.NewTsVbuuid(DEFAULT_POOL_NAME, bucket, len(vbnos))
+			for _, vbno := range vbnos {
+				ts.Append(uint16(vbno), uint64(rnd.Intn(100)), rnd.Uint64(),
+					uint64(rnd.Intn(100)), uint64(rnd.Intn(100)))
+			}
+			return ts
+		}
+
+		requestTs := makeTs(bucket, vbnos)
+		var rollbackTimestamps []*protobuf.TsVbuuid = nil
+		if len(rollbackVbnos) != 0 {
+			rollbackTimestamps = append(rollbackTimestamps, makeTs(rollbackBucket, rollbackVbnos))
+		}
+
+		newTs := recomputeRequestTimestamp(requestTs, indexTimestampsByBucket(rollbackTimestamps))
+		expected := recomputeRequestTimestampLinear(requestTs, rollbackTimestamps)
+
+		if newTs.GetBucket() != bucket || len(newTs.GetVbnos()) != len(vbnos) ||
+			len(newTs.GetSeqnos()) != len(vbnos) || len(newTs.GetSnapshots()) != len(vbnos) {
+			t.Fatalf("Expect %v vbnos for bucket %q, got %v", len(vbnos), bucket, newTs)
+		}
+		if !reflect.DeepEqual(newTs.GetVbnos(), expected.GetVbnos()) ||
+			!reflect.DeepEqual(newTs.GetSeqnos(), expected.GetSeqnos()) ||
+			!reflect.DeepEqual(newTs.GetVbuuids(), expected.GetVbuuids()) {
+			t.Fatalf("recomputeRequestTimestamp does not match the reference implementation")
+		}
+	})
+}
+
+func TestIndexTimestampsByBucket(t *testing.T) {
+
+	ts1 := protobuf.NewTsVbuuid(DEFAULT_POOL_NAME, "bucket1", NUM_VB)
+	ts1.Append(uint16(0), uint64(10), uint64(1234), uint64(0), uint64(0))
+	ts2 := protobuf.NewTsVbuuid(DEFAULT_POOL_NAME, "bucket2", NUM_VB)
+	ts2.Append(uint16(1), uint64(20), uint64(1234), uint64(0), uint64(0))
+	ts3 := protobuf.NewTsVbuuid(DEFAULT_POOL_NAME, "bucket1", NUM_VB)
+	ts3.Append(uint16(2), uint64(30), uint64(1234), uint64(0), uint64(0))
+
+	result := indexTimestampsByBucket([]*protobuf.TsVbuuid{ts1, ts2, ts3})
+	if len(result) != 2 {
+		t.Fatalf("Expect 2 buckets, got %v", len(result))
+	}
+
+	vbnos := result["bucket1"].GetVbnos()
+	if len(vbnos) != 2 || vbnos[0] != 0 || vbnos[1] != 2 {
+		t.Fatalf("Expect merged vbnos [0 2] for bucket1, got %v", vbnos)
+	}
+	if result["bucket1"].GetSeqnos()[1] != 30 {
+		t.Fatalf("Expect seqno 30 for vb 2, got %v", result["bucket1"].GetSeqnos()[1])
+	}
+	if result["bucket2"] != ts2 {
+		t.Fatalf("Expect bucket2 timestamp to be unchanged")
+	}
+}
+
+func TestConsolidateActiveTimestamps(t *testing.T) {
+
+	// active timestamps of 3 nodes, bucket2 is active in a single node.
+	node1 := protobuf.NewTsVbuuid(DEFAULT_POOL_NAME, "bucket1", NUM_VB)
+	node1.Append(uint16(2), uint64(30), uint64(1234), uint64(0), uint64(30))
+	node2 := protobuf.NewTsVbuuid(DEFAULT_POOL_NAME, "bucket2", NUM_VB)
+	node2.Append(uint16(1), uint64(20), uint64(1234), uint64(0), uint64(20))
+	node3 := protobuf.NewTsVbuuid(DEFAULT_POOL_NAME, "bucket1", NUM_VB)
+	node3.Append(uint16(0), uint64(10), uint64(5678), uint64(5), uint64(10))
+	node3.Append(uint16(3), uint64(40), uint64(5678), uint64(0), uint64(40))
+
+	result := consolidateActiveTimestamps([]*protobuf.TsVbuuid{node1, node2, node3})
+	if len(result) != 2 || result[0].GetBucket() != "bucket1" || result[1].GetBucket() != "bucket2" {
+		t.Fatalf("Expect a single timestamp for each bucket, got %v", result)
+	}
+
+	ts := result[0]
+	if !reflect.DeepEqual(ts.GetVbnos(), []uint32{0, 2, 3}) ||
+		!reflect.DeepEqual(ts.GetSeqnos(), []uint64{10, 30, 40}) ||
+		!reflect.DeepEqual(ts.GetVbuuids(), []uint64{5678, 1234, 5678}) {
+		t.Fatalf("Unexpected consolidated timestamp %v", ts)
+	}
+	if s := ts.GetSnapshots()[0]; s.GetStart() != 5 || s.GetEnd() != 10 {
+		t.Fatalf("Expect snapshot {5, 10} for vb 0, got %v", s)
+	}
+	if !reflect.DeepEqual(result[1].GetVbnos(), []uint32{1}) {
+		t.Fatalf("Unexpected timestamp for bucket2 %v", result[1])
+	}
+
+	if result := consolidateActiveTimestamps(nil); len(result) != 0 {
+		t.Fatalf("Expect no timestamp, got %v", result)
+	}
+}
+
+func TestGetPartialNodeListForTimestamps(t *testing.T) {
+
+	env := NewProjectorClientEnvImpl(COUCHBASE_INTERNAL_BUCKET_URL, DEFAULT_POOL_NAME, time.Minute).(*ProjectorClientEnvImpl)
+	env.fetchVBMap = func(ctx context.Context, bucket string) (vbOwnerLookup, error) {
+		// vb 3 is missing from the vbmap, e.g. during rebalance
+		return newTestVBOwners(map[string][]uint16{"127.0.0.1:11210": []uint16{0, 1}, "127.0.0.2:11210": []uint16{2}}), nil
+	}
+
+	ts := common.NewTsVbuuid(DEFAULT_BUCKET_NAME, 4)
+	for vb := 0; vb < 4; vb++ {
+		ts.Seqnos[vb] = uint64(vb + 1)
+		ts.Vbuuids[vb] = uint64(1234)
+	}
+
+	nodes, unlocated, err := env.GetPartialNodeListForTimestamps([]*common.TsVbuuid{ts})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(nodes) != 2 || len(nodes["127.0.0.1:11210"][0].GetVbnos()) != 2 {
+		t.Fatalf("Expect vbuckets to be located on 2 nodes, got %v", nodes)
+	}
+	if len(unlocated) != 1 || unlocated[0].Seqnos[3] != 4 || unlocated[0].Seqnos[0] != 0 {
+		t.Fatalf("Expect only vb 3 to be unlocated, got %v", unlocated)
+	}
+
+	if _, err := env.GetNodeListForTimestamps([]*common.TsVbuuid{ts}); err == nil {
+		t.Fatal("Expect GetNodeListForTimestamps to fail with inconsistent vbmap")
+	}
+}
+
+func TestAsStreamError(t *testing.T) {
+
+	err := enrichError(NewError2(ERROR_STREAM_PROJECTOR_TIMEOUT, STREAM), "DelInstances", DEFAULT_BUCKET_NAME, "127.0.0.1")
+	if e, ok := AsStreamError(err); !ok || e.code != ERROR_STREAM_PROJECTOR_TIMEOUT {
+		t.Fatalf("Expect stream error with code %v, got %v", ERROR_STREAM_PROJECTOR_TIMEOUT, err)
+	}
+	if !errors.Is(err, NewError2(ERROR_STREAM_PROJECTOR_TIMEOUT, STREAM)) {
+		t.Fatalf("Expect errors.Is to match on error code")
+	}
+	if errors.Is(err, NewError2(ERROR_STREAM_WRONG_VBUCKET, STREAM)) {
+		t.Fatalf("Expect errors.Is to not match a different error code")
+	}
+
+	netErr := &net.OpError{Op: "dial", Net: "tcp", Err: errors.New("connection refused")}
+	if _, ok := AsStreamError(netErr); ok {
+		t.Fatalf("Expect network error to not be a stream error")
+	}
+}
+
+func TestIsRecoverableError(t *testing.T) {
+
+	if !isRecoverableError(NewError2(ERROR_STREAM_WRONG_VBUCKET, STREAM), ERROR_STREAM_WRONG_VBUCKET, ERROR_STREAM_PROJECTOR_TIMEOUT) {
+		t.Fatalf("Expect wrong vbucket error to be recoverable")
+	}
+	if isRecoverableError(NewError2(ERROR_STREAM_REQUEST_ERROR, STREAM), ERROR_STREAM_WRONG_VBUCKET, ERROR_STREAM_PROJECTOR_TIMEOUT) {
+		t.Fatalf("Expect request error to not be recoverable")
+	}
+
+	// a worker that returns a plain error must not panic the admin loop
+	if isRecoverableError(errors.New("connection reset by peer"), ERROR_STREAM_PROJECTOR_TIMEOUT) {
+		t.Fatalf("Expect non-Error to not be recoverable")
+	}
+	if isRecoverableError(nil, ERROR_STREAM_PROJECTOR_TIMEOUT) {
+		t.Fatalf("Expect nil error to not be recoverable")
+	}
+}
+
+func TestWaitForWorkersNonError(t *testing.T) {
+
+	admin := NewProjectorAdmin(&mockProjectorStreamClientFactory{}, &MockProjectorClientEnv{}, nil, "")
+
+	newWorker := func(server string) *adminWorker {
+		return &adminWorker{admin: admin, server: server, streamId: common.MAINT_STREAM, killch: make(chan bool, 1)}
+	}
+	workers := map[string]*adminWorker{"node1:9999": newWorker("node1:9999"), "node2:9999": newWorker("node2:9999")}
+	failed, pending := workers["node1:9999"], workers["node2:9999"]
+
+	// node1 fails with a plain error, node2 is still running.
+	failed.err = errors.New("connection reset by peer")
+	donech := make(chan *adminWorker, len(workers))
+	donech <- failed
+
+	_, retry, err := waitForWorkers(workers, donech, ERROR_STREAM_WRONG_VBUCKET, ERROR_STREAM_PROJECTOR_TIMEOUT)
+	if err != failed.err || retry {
+		t.Fatalf("Expect non-Error to be returned without retry, got retry=%v err=%v", retry, err)
+	}
+	select {
+	case <-pending.killch:
+	default:
+		t.Fatalf("Expect the other worker to be killed")
+	}
+}
+
+// implement ProjectorClientEnv with a fixed set of nodes for each bucket
+type bucketNodesTestEnv struct {
+	nodes map[string][]string
+}
+
+func (p *bucketNodesTestEnv) GetNodeListForBuckets(buckets []string) (map[string]string, error) {
+
+	nodes := make(map[string]string)
+	for _, bucket := range buckets {
+		for _, node := range p.nodes[bucket] {
+			nodes[node] = node
+		}
+	}
+	return nodes, nil
+}
+
+func (p *bucketNodesTestEnv) GetNodeListForTimestamps(timestamps []*common.TsVbuuid) (map[string][]*protobuf.TsVbuuid, error) {
+	return nil, nil
+}
+
+func (p *bucketNodesTestEnv) GetPartialNodeListForTimestamps(timestamps []*common.TsVbuuid) (map[string][]*protobuf.TsVbuuid, []*common.TsVbuuid, error) {
+	return nil, nil, nil
+}
+
+func (p *bucketNodesTestEnv) FilterTimestampsForNode(timestamps []*protobuf.TsVbuuid, node string) ([]*protobuf.TsVbuuid, error) {
+	return timestamps, nil
+}
+
+func TestGetNodeInstancesForBuckets(t *testing.T) {
+
+	env := &bucketNodesTestEnv{nodes: map[string][]string{
+		"bucket1": []string{"node1", "node2"},
+		"bucket2": []string{"node2"},
+	}}
+	admin := &ProjectorAdmin{env: env}
+
+	nodes, err := admin.getNodeInstancesForBuckets(map[string][]uint64{
+		"bucket1": []uint64{1, 2},
+		"bucket2": []uint64{3},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(nodes) != 2 {
+		t.Fatalf("Expect 2 nodes, got %v", nodes)
+	}
+	if !reflect.DeepEqual(nodes["node1"], []uint64{1, 2}) {
+		t.Fatalf("Expect node1 to delete instances of bucket1 only, got %v", nodes["node1"])
+	}
+	node2 := append([]uint64(nil), nodes["node2"]...)
+	sort.Slice(node2, func(i, j int) bool { return node2[i] < node2[j] })
+	if !reflect.DeepEqual(node2, []uint64{1, 2, 3}) {
+		t.Fatalf("Expect node2 to delete instances of both buckets, got %v", nodes["node2"])
+	}
+
+	// the same instances for every bucket, as in DeleteIndexListFromStream.
+	nodes, err = admin.getNodeInstancesForBuckets(map[string][]uint64{
+		"bucket1": []uint64{1, 2},
+		"bucket2": []uint64{1, 2},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, node := range []string{"node1", "node2"} {
+		if !reflect.DeepEqual(nodes[node], []uint64{1, 2}) {
+			t.Fatalf("Expect %v to delete each instance once, got %v", node, nodes[node])
+		}
+	}
+}
+
+func TestSortBucketsByPriority(t *testing.T) {
+
+	admin := &ProjectorAdmin{BucketPriority: map[string]int{"critical": 10, "batch": -1}}
+
+	sorted := admin.sortBucketsByPriority([]string{"batch", "bucket1", "critical", "bucket2"})
+	if !reflect.DeepEqual(sorted, []string{"critical", "bucket1", "bucket2", "batch"}) {
+		t.Fatalf("Unexpected order %v", sorted)
+	}
+
+	levels := admin.groupBucketsByPriority([]string{"batch", "bucket1", "critical", "bucket2"})
+	if len(levels) != 1 {
+		t.Fatalf("Expect a single group without TreatTopicExistAsSuccess, got %v", levels)
+	}
+	admin.TreatTopicExistAsSuccess = true
+	levels = admin.groupBucketsByPriority([]string{"batch", "bucket1", "critical", "bucket2"})
+	if !reflect.DeepEqual(levels, [][]string{{"critical"}, {"bucket1", "bucket2"}, {"batch"}}) {
+		t.Fatalf("Unexpected groups %v", levels)
+	}
+}
+
+func TestValidateActiveVbPriority(t *testing.T) {
+
+	// all vbuckets, except the first `missing` ones, are active.
+	makeTs := func(bucket string, missing int) *protobuf.TsVbuuid {
+		ts := protobuf.NewTsVbuuid(DEFAULT_POOL_NAME, bucket, NUM_VB)
+		for vb := missing; vb < NUM_VB; vb++ {
+			ts.Append(uint16(vb), uint64(vb+1), uint64(1234), uint64(0), uint64(0))
+		}
+		return ts
+	}
+
+	admin := &ProjectorAdmin{BucketPriority: map[string]int{"batch": -1}}
+	buckets := []string{"default", "batch"}
+	requestTs := []*common.TsVbuuid{common.NewTsVbuuid("batch", NUM_VB)}
+
+	// missing vbuckets of a bucket that is not of low priority are never tolerated.
+	budget := make(map[string]int)
+	active := []*protobuf.TsVbuuid{makeTs("default", 1), makeTs("batch", 0)}
+	if admin.validateActiveVb(buckets, active, requestTs, budget) {
+		t.Fatalf("Expect missing vbucket of default bucket to fail validation")
+	}
+
+	// missing vbuckets of a low priority bucket are tolerated until the budget is exhausted.
+	active = []*protobuf.TsVbuuid{makeTs("default", 0), makeTs("batch", LOW_PRIORITY_VB_BUDGET/2)}
+	if !admin.validateActiveVb(buckets, active, requestTs, budget) {
+		t.Fatalf("Expect missing vbuckets of low priority bucket to be tolerated")
+	}
+	if !admin.validateActiveVb(buckets, active, requestTs, budget) {
+		t.Fatalf("Expect missing vbuckets of low priority bucket to be tolerated")
+	}
+	if admin.validateActiveVb(buckets, active, requestTs, budget) {
+		t.Fatalf("Expect validation to fail when the budget is exhausted")
+	}
+	if budget["batch"] != 0 {
+		t.Fatalf("Expect budget to be reset after forcing a retry, got %v", budget["batch"])
+	}
+
+	// low priority bucket without any active timestamp is not tolerated.
+	active = []*protobuf.TsVbuuid{makeTs("default", 0)}
+	if admin.validateActiveVb(buckets, active, requestTs, budget) {
+		t.Fatalf("Expect low priority bucket without active timestamp to fail validation")
+	}
+
+	// low priority bucket without request timestamp is not tolerated.
+	active = []*protobuf.TsVbuuid{makeTs("default", 0), makeTs("batch", 1)}
+	if admin.validateActiveVb(buckets, active, nil, make(map[string]int)) {
+		t.Fatalf("Expect low priority bucket without request timestamp to fail validation")
+	}
+}
+
+func TestMergeAddIndexRequests(t *testing.T) {
+
+	instance := func(id uint64, name string) *protobuf.Instance {
+		defn := &protobuf.IndexDefn{Name: &name}
+		return &protobuf.Instance{IndexInstance: &protobuf.IndexInst{InstId: &id, Definition: defn}}
+	}
+	ts1 := common.NewTsVbuuid("bucket1", NUM_VB)
+	ts2 := common.NewTsVbuuid("bucket1", NUM_VB)
+
+	requests := []AddIndexRequest{
+		{Buckets: []string{"bucket1"}, Instances: []*protobuf.Instance{instance(1, "a"), instance(2, "b")},
+			RequestTimestamps: []*common.TsVbuuid{ts1}},
+		{Buckets: []string{"bucket2", "bucket1"}, Instances: []*protobuf.Instance{instance(1, "c")},
+			RequestTimestamps: []*common.TsVbuuid{ts2}},
+	}
+	buckets, instances, timestamps := mergeAddIndexRequests(requests)
+
+	if !reflect.DeepEqual(buckets, []string{"bucket1", "bucket2"}) {
+		t.Fatalf("Unexpected buckets %v", buckets)
+	}
+	if len(instances) != 2 || instances[0].GetUuid() != 1 || instances[1].GetUuid() != 2 {
+		t.Fatalf("Unexpected instances %v", instances)
+	}
+	if instances[0].GetIndexInstance().GetDefinition().GetName() != "c" {
+		t.Fatalf("Expect the last duplicate instance to be used, got %v", instances[0])
+	}
+	if len(timestamps) != 1 || timestamps[0] != ts1 {
+		t.Fatalf("Expect the first request timestamp of bucket1 to be used, got %v", timestamps)
+	}
+}
+
+func TestInstanceVersions(t *testing.T) {
+
+	instance := func(id uint64, version uint64) *protobuf.Instance {
+		return &protobuf.Instance{
+			IndexInstance: &protobuf.IndexInst{InstId: &id},
+			Version:       &version,
+		}
+	}
+	admin := &ProjectorAdmin{}
+
+	if result := admin.filterStaleInstances([]*protobuf.Instance{instance(1, 2), instance(2, 1)}); len(result) != 2 {
+		t.Fatalf("Expect no stale instance, got %v", result)
+	}
+	admin.recordInstanceVersions([]*protobuf.Instance{instance(1, 2), instance(2, 1)})
+	result := admin.filterStaleInstances([]*protobuf.Instance{instance(1, 1), instance(2, 3)})
+	if len(result) != 1 || result[0].GetUuid() != 2 {
+		t.Fatalf("Expect instance 1 to be stale, got %v", result)
+	}
+	admin.recordInstanceVersions(result)
+
+	versions := admin.getInstanceVersions(map[string][]uint64{"bucket1": {1, 2, 3}})
+	if !reflect.DeepEqual(versions, map[uint64]uint64{1: 2, 2: 3, 3: 0}) {
+		t.Fatalf("Unexpected versions %v", versions)
+	}
+
+	// instance 2 is re-added with a newer version while being deleted
+	admin.recordInstanceVersions([]*protobuf.Instance{instance(2, 4)})
+	if uuids := admin.filterReaddedInstances([]uint64{1, 2, 3}, versions); !reflect.DeepEqual(uuids, []uint64{1, 3}) {
+		t.Fatalf("Expect instance 2 to be skipped, got %v", uuids)
+	}
+
+	// the version of an instance that fails to be added is not remembered.
+	env, factory := newMockProjectorCluster("node1:9999")
+	factory.clients["node1:9999"].mutationTopicRequest = func(topic, endpointType string,
+		reqTimestamps []*protobuf.TsVbuuid, instances []*protobuf.Instance) (*protobuf.TopicResponse, error) {
+		return nil, projectorC.ErrorInconsistentFeed
+	}
+	admin = NewProjectorAdmin(factory, env, nil, "")
+	if err := admin.AddIndexToStream(common.MAINT_STREAM, []string{"bucket1"}, []*protobuf.Instance{instance(1, 5)}, nil); err == nil {
+		t.Fatalf("Expect AddIndexToStream to fail")
+	}
+	if result := admin.filterStaleInstances([]*protobuf.Instance{instance(1, 4)}); len(result) != 1 {
+		t.Fatalf("Expect version of failed instance not to be remembered, got %v", result)
+	}
+}
+
+func TestFindCompleteBuckets(t *testing.T) {
+
+	makeTs := func(bucket string, vbnos ...uint16) *protobuf.TsVbuuid {
+		ts := protobuf.NewTsVbuuid(DEFAULT_POOL_NAME, bucket, len(vbnos))
+		for _, vbno := range vbnos {
+			ts.Append(vbno, 0, 0, 0, 0)
+		}
+		return ts
+	}
+
+	buckets := []string{"bucket1", "bucket2", "bucket3"}
+	requestTs := []*protobuf.TsVbuuid{makeTs("bucket1", 0, 1), makeTs("bucket2", 2, 3)}
+	activeTs := filterTimestampsByBucket([]*protobuf.TsVbuuid{
+		makeTs("bucket1", 0), makeTs("bucket1", 1), makeTs("bucket2", 2), makeTs("bucket4", 4)}, buckets)
+	if len(activeTs) != 3 {
+		t.Fatalf("Expect timestamps of other buckets to be filtered, got %v", activeTs)
+	}
+
+	complete := findCompleteBuckets(buckets, requestTs, activeTs)
+	if !reflect.DeepEqual(complete, map[string]bool{"bucket1": true, "bucket3": true}) {
+		t.Fatalf("Unexpected complete buckets %v", complete)
+	}
+
+	completed := make(map[string]map[string]*protobuf.TsVbuuid)
+	recordCompleteBuckets(completed, &adminWorker{server: "node1", activeTimestamps: activeTs, completeBuckets: complete})
+	if len(completed["node1"]) != 2 || len(completed["node1"]["bucket1"].GetVbnos()) != 2 ||
+		completed["node1"]["bucket3"] != nil {
+		t.Fatalf("Unexpected completed buckets %v", completed)
+	}
+}
+
+func TestToleratedTimestamps(t *testing.T) {
+
+	requestTs := common.NewTsVbuuid("batch", NUM_VB)
+	for vb := 0; vb < 4; vb++ {
+		requestTs.Seqnos[vb] = uint64(10 * (vb + 1))
+		requestTs.Vbuuids[vb] = uint64(1234)
+		requestTs.Snapshots[vb] = [2]uint64{uint64(10 * (vb + 1)), uint64(10 * (vb + 1))}
+	}
+	active := protobuf.NewTsVbuuid(DEFAULT_POOL_NAME, "batch", 2)
+	active.Append(2, 30, 1234, 30, 30)
+	active.Append(3, 40, 1234, 40, 40)
+
+	tolerated := toleratedTimestamps("pool1", []string{"batch", "default"},
+		[]*protobuf.TsVbuuid{active}, []*common.TsVbuuid{requestTs})
+	if len(tolerated) != 1 || tolerated[0].GetBucket() != "batch" || tolerated[0].GetPool() != "pool1" {
+		t.Fatalf("Unexpected tolerated timestamps %v", tolerated)
+	}
+	if !reflect.DeepEqual(tolerated[0].GetVbnos(), []uint32{0, 1}) ||
+		!reflect.DeepEqual(tolerated[0].GetSeqnos(), []uint64{10, 20}) {
+		t.Fatalf("Expect the request timestamp of missing vbuckets, got %v", tolerated[0])
+	}
+
+	// the stream monitor restarts the tolerated vbuckets from the request timestamp.
+	monitor := NewStreamMonitor(nil, nil, "")
+	monitor.StartStream(common.MAINT_STREAM, "batch", active)
+	monitor.StartStream(common.MAINT_STREAM, "batch", tolerated[0])
+	if seqno, vbuuid := monitor.findRestartSeqno(common.MAINT_STREAM, "batch", 1); seqno != 20 || vbuuid != 1234 {
+		t.Fatalf("Expect restart from request timestamp, got seqno %v vbuuid %v", seqno, vbuuid)
+	}
+}
+
+func TestStreamState(t *testing.T) {
+
+	admin := &ProjectorAdmin{}
+	if admin.StreamState(common.MAINT_STREAM) != nil {
+		t.Fatalf("Expect no stream state without monitor")
+	}
+
+	start := protobuf.NewTsVbuuid(DEFAULT_POOL_NAME, "bucket1", 2)
+	start.Append(1, 10, 100, 10, 10)
+	start.Append(2, 20, 200, 20, 20)
+
+	monitor := NewStreamMonitor(nil, nil, "pool1")
+	monitor.StartStream(common.MAINT_STREAM, "bucket1", start)
+	monitor.Activate(common.MAINT_STREAM, "bucket1", 2)
+	admin.monitor = monitor
+
+	state := admin.StreamState(common.MAINT_STREAM)
+	ts, ok := state["bucket1"]
+	if !ok || len(state) != 1 || ts.GetPool() != "pool1" {
+		t.Fatalf("Unexpected stream state %v", state)
+	}
+	if !reflect.DeepEqual(ts.GetVbnos(), []uint32{2}) ||
+		!reflect.DeepEqual(ts.GetSeqnos(), []uint64{20}) ||
+		!reflect.DeepEqual(ts.GetVbuuids(), []uint64{200}) {
+		t.Fatalf("Unexpected timestamp %v", ts)
+	}
+	if len(admin.StreamState(common.INIT_STREAM)) != 0 {
+		t.Fatalf("Expect empty state for stream not started")
+	}
+}
+
+func TestWaitForActive(t *testing.T) {
+
+	env, factory := newMockProjectorCluster("node1:9999")
+	monitor := NewStreamMonitor(nil, nil, "")
+	admin := NewProjectorAdmin(factory, env, monitor, "")
+
+	ts := protobuf.NewTsVbuuid(DEFAULT_POOL_NAME, "bucket1", 4)
+	for vb := 0; vb < 4; vb++ {
+		ts.Append(uint16(vb), uint64(vb), uint64(1234), uint64(0), uint64(0))
+	}
+	timestamps := []*protobuf.TsVbuuid{ts}
+
+	// vb 3 never becomes active
+	for vb := 0; vb < 3; vb++ {
+		monitor.Activate(common.MAINT_STREAM, "bucket1", uint16(vb))
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 500*time.Millisecond)
+	inactive, err := admin.WaitForActive(ctx, common.MAINT_STREAM, timestamps)
+	cancel()
+	if err == nil {
+		t.Fatal("Expect WaitForActive to time out")
+	}
+	if !reflect.DeepEqual(inactive, map[string][]uint16{"bucket1": []uint16{3}}) {
+		t.Fatalf("Expect vb 3 to be inactive, got %v", inactive)
+	}
+
+	// activate vb 3 while waiting
+	go func() {
+		time.Sleep(200 * time.Millisecond)
+		monitor.Activate(common.MAINT_STREAM, "bucket1", uint16(3))
+	}()
+
+	ctx, cancel = context.WithTimeout(context.Background(), 5*time.Second)
+	inactive, err = admin.WaitForActive(ctx, common.MAINT_STREAM, timestamps)
+	cancel()
+	if err != nil || len(inactive) != 0 {
+		t.Fatalf("Expect all vbuckets to be active, got %v (error=%v)", inactive, err)
+	}
+}
+
+func TestStreamRegistry(t *testing.T) {
+
+	admin := &ProjectorAdmin{}
+	streamId := common.StreamId(100)
+	if _, err := admin.topicForStreamId(streamId); err == nil {
+		t.Fatalf("Expect error for topic of unregistered stream")
+	}
+	if _, err := getPortForStreamId(streamId); err == nil {
+		t.Fatalf("Expect error for port of unregistered stream")
+	}
+
+	if port, err := getPortForStreamId(common.MAINT_STREAM); err != nil || port != COORD_MAINT_STREAM_PORT {
+		t.Fatalf("Unexpected port %v for MAINT_STREAM, err %v", port, err)
+	}
+
+	RegisterStreamTopic(streamId, "CATCHUP_STREAM_TOPIC")
+	if _, err := getPortForStreamId(streamId); err == nil {
+		t.Fatalf("Expect error for port of stream with only topic registered")
+	}
+
+	RegisterStreamPort(streamId, "9110")
+	if port, err := getPortForStreamId(streamId); err != nil || port != "9110" {
+		t.Fatalf("Unexpected port %v, err %v", port, err)
+	}
+	if topic, err := admin.topicForStreamId(streamId); err != nil || !strings.HasSuffix(topic, "CATCHUP_STREAM_TOPIC") {
+		t.Fatalf("Unexpected topic %v, err %v", topic, err)
+	}
+}
+
+func TestWorkerErrorContext(t *testing.T) {
+
+	env, factory := newMockProjectorCluster("node1:9999")
+
+	ts := common.NewTsVbuuid("bucket1", NUM_VB)
+	ts.Seqnos[0], ts.Vbuuids[0] = 1, 1234
+
+	// the worker cannot find the topic of an unregistered stream
+	admin := NewProjectorAdmin(factory, env, nil, "")
+	err := admin.RestartStreamIfNecessary(common.StreamId(102), []*common.TsVbuuid{ts})
+	e, ok := AsStreamError(err)
+	if !ok || e.code != ERROR_STREAM_INVALID_ARGUMENT || e.op != "RestartVbuckets" || e.node != "node1:9999" {
+		t.Fatalf("Expect error with op and node of the worker, got %v", err)
+	}
+}
+
+func TestTopicPrefix(t *testing.T) {
+
+	admin := &ProjectorAdmin{}
+	topic, err := admin.topicForStreamId(common.MAINT_STREAM)
+	if err != nil || !strings.HasSuffix(topic, MAINT_TOPIC) || (TESTING && topic != "testing "+MAINT_TOPIC) {
+		t.Fatalf("Unexpected topic %v without prefix, err %v", topic, err)
+	}
+
+	admin.TopicPrefix = "node1:9100/"
+	prefixed, err := admin.topicForStreamId(common.MAINT_STREAM)
+	if err != nil || prefixed != "node1:9100/"+topic {
+		t.Fatalf("Unexpected topic %v with prefix, err %v", prefixed, err)
+	}
+
+	if _, err := admin.topicForStreamId(common.StreamId(101)); err == nil {
+		t.Fatalf("Expect error for topic of unregistered stream with prefix")
+	}
+}
+
+func TestProjectorRequestTimeout(t *testing.T) {
+
+	if timeout := projectorRequestTimeout(5*time.Minute, 10); timeout != 30*time.Second {
+		t.Fatalf("Expect timeout to be a share of the budget, got %v", timeout)
+	}
+	if timeout := projectorRequestTimeout(time.Minute, 10); timeout != MIN_PROJECTOR_REQUEST_TIMEOUT {
+		t.Fatalf("Expect timeout to be floored, got %v", timeout)
+	}
+
+	// projector accepts the request but never responds.
+	donech := make(chan bool)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-donech
+	}))
+	defer server.Close()
+	defer close(donech)
+
+	config := common.SystemConfig.SectionConfig("manager.projectorclient.", true)
+	config.SetValue("requestTimeout", 100)
+	client := projectorC.NewClient(server.Listener.Addr().String(), NUM_VB, config)
+
+	errch := make(chan error, 1)
+	go func() {
+		_, err := client.MutationTopicRequest("testing "+MAINT_TOPIC, "dataport", nil, nil)
+		errch <- err
+	}()
+
+	select {
+	case err := <-errch:
+		if err == nil {
+			t.Fatalf("Expect error from hung projector")
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("Expect request to hung projector to be abandoned")
+	}
+}
+
+func TestAdminWorkerKill(t *testing.T) {
+
+	worker := &adminWorker{killch: make(chan bool, 1)}
+
+	donech := make(chan bool)
+	go func() {
+		worker.kill()
+		worker.kill()
+		close(donech)
+	}()
+
+	select {
+	case <-donech:
+	case <-time.After(time.Second):
+		t.Fatalf("Expect kill not to block")
+	}
+
+	for i := 0; i < 2; i++ {
+		select {
+		case <-worker.killch:
+		default:
+			t.Fatalf("Expect worker to observe the kill signal")
+		}
+	}
+}
+
+func TestNodeToProjectorMap(t *testing.T) {
+
+	factory := &ProjectorStreamClientFactoryImpl{
+		clientCache:        make(map[string]*projectorClientEntry),
+		nodeAddrs:          make(map[string]string),
+		NodeToProjectorMap: map[string]string{"node1:11210": "127.0.0.1:19999"},
+	}
+
+	client := factory.GetClientForNode("node1:11210")
+	if client == nil {
+		t.Fatalf("Expect client for node in override map")
+	}
+	if addr := factory.nodeAddrs["node1:11210"]; addr != "127.0.0.1:19999" {
+		t.Fatalf("Expect projector address from override map, got %v", addr)
+	}
+	if _, ok := factory.clientCache["127.0.0.1:19999"]; !ok {
+		t.Fatalf("Expect client to be cached by projector address")
+	}
+}
+
+func TestGetClientForNodePoolServicesCache(t *testing.T) {
+
+	fetches := 0
+	ps := &couchbase.PoolServices{NodesExt: []couchbase.NodeServices{
+		{Hostname: "127.0.0.1", Services: map[string]int{"kv": 12000, "projector": 10000}},
+		{Hostname: "127.0.0.1", Services: map[string]int{"kv": 12002, "projector": 10001}},
+	}}
+	factory := &ProjectorStreamClientFactoryImpl{
+		clientCache: make(map[string]*projectorClientEntry),
+		nodeAddrs:   make(map[string]string),
+		fetchPoolServices: func() (*couchbase.PoolServices, error) {
+			fetches++
+			return ps, nil
+		},
+	}
+
+	factory.GetClientForNode("127.0.0.1:12000")
+	factory.GetClientForNode("127.0.0.1:12002")
+	if fetches != 1 {
+		t.Fatalf("Expect pool services to be cached, got %v fetches", fetches)
+	}
+	if addr := factory.nodeAddrs["127.0.0.1:12002"]; addr != "127.0.0.1:10001" {
+		t.Fatalf("Unexpected projector address %v", addr)
+	}
+
+	// a node missing from the cached pool services refreshes them
+	factory.GetClientForNode("127.0.0.1:12004")
+	if fetches != 2 {
+		t.Fatalf("Expect pool services to be refreshed for an unknown node, got %v fetches", fetches)
+	}
+
+	// the cached pool services expire
+	factory.poolServicesFetched = time.Now().Add(-POOL_SERVICES_CACHE_TTL)
+	if _, err := factory.getProjectorAddrForNode("127.0.0.1:12000"); err != nil || fetches != 3 {
+		t.Fatalf("Expect expired pool services to be fetched, got %v fetches, err %v", fetches, err)
+	}
+}
+
+func TestGetClientForNodeFallbackExpiry(t *testing.T) {
+
+	fetchErr := errors.New("connection reset")
+	ps := &couchbase.PoolServices{NodesExt: []couchbase.NodeServices{
+		{Hostname: "127.0.0.1", Services: map[string]int{"kv": 12000, "projector": 10000}},
+	}}
+	factory := &ProjectorStreamClientFactoryImpl{
+		clientCache: make(map[string]*projectorClientEntry),
+		nodeAddrs:   make(map[string]string),
+		fetchPoolServices: func() (*couchbase.PoolServices, error) {
+			if fetchErr != nil {
+				return nil, fetchErr
+			}
+			return ps, nil
+		},
+	}
+	defer factory.Close()
+
+	// a transient failure falls back to the default projector port
+	factory.GetClientForNode("127.0.0.1:12000")
+	if addr := factory.nodeAddrs["127.0.0.1:12000"]; addr != net.JoinHostPort("127.0.0.1", PROJECTOR_PORT) {
+		t.Fatalf("Expect default projector address, got %v", addr)
+	}
+
+	// the fallback is used until it expires
+	fetchErr = nil
+	factory.GetClientForNode("127.0.0.1:12000")
+	if addr := factory.nodeAddrs["127.0.0.1:12000"]; addr != net.JoinHostPort("127.0.0.1", PROJECTOR_PORT) {
+		t.Fatalf("Expect default projector address before expiry, got %v", addr)
+	}
+
+	// once expired, the projector is looked up again and the fallback client is evicted
+	factory.fallbackExpiry["127.0.0.1:12000"] = time.Now().Add(-time.Second)
+	factory.GetClientForNode("127.0.0.1:12000")
+	if addr := factory.nodeAddrs["127.0.0.1:12000"]; addr != "127.0.0.1:10000" {
+		t.Fatalf("Expect projector address from the cluster, got %v", addr)
+	}
+	if _, ok := factory.fallbackExpiry["127.0.0.1:12000"]; ok {
+		t.Fatalf("Expect fallback to be cleared")
+	}
+	if len(factory.clientCache) != 1 {
+		t.Fatalf("Expect fallback client to be evicted, got %v", factory.clientCache)
+	}
+}
+
+func TestEvictNodeSharedProjector(t *testing.T) {
+
+	factory := &ProjectorStreamClientFactoryImpl{
+		clientCache:        make(map[string]*projectorClientEntry),
+		nodeAddrs:          make(map[string]string),
+		NodeToProjectorMap: map[string]string{"node1:11210": "127.0.0.1:19999", "node2:11210": "127.0.0.1:19999"},
+	}
+
+	client := factory.GetClientForNode("node1:11210")
+	if factory.GetClientForNode("node2:11210") != client {
+		t.Fatalf("Expect nodes at the same projector address to share the client")
+	}
+
+	factory.EvictNode("node1:11210")
+	if _, ok := factory.clientCache["127.0.0.1:19999"]; !ok {
+		t.Fatalf("Expect client still used by node2 not to be evicted")
+	}
+	if factory.GetClientForNode("node2:11210") != client {
+		t.Fatalf("Expect node2 to keep the shared client")
+	}
+
+	factory.EvictNode("node2:11210")
+	if len(factory.clientCache) != 0 || len(factory.nodeAddrs) != 0 {
+		t.Fatalf("Expect client to be evicted with its last node, got %v %v", factory.clientCache, factory.nodeAddrs)
+	}
+}
+
+func TestGetClientForNodeConcurrentCheck(t *testing.T) {
+
+	for i := 0; i < 20; i++ {
+		factory := &ProjectorStreamClientFactoryImpl{
+			clientCache:        make(map[string]*projectorClientEntry),
+			nodeAddrs:          make(map[string]string),
+			NodeToProjectorMap: map[string]string{"node1:11210": "127.0.0.1:1"},
+		}
+
+		var wg sync.WaitGroup
+		for j := 0; j < 4; j++ {
+			wg.Add(2)
+			go func() {
+				defer wg.Done()
+				factory.GetClientForNode("node1:11210")
+			}()
+			go func() {
+				defer wg.Done()
+				factory.checkClients()
+			}()
+		}
+		wg.Wait()
+	}
+}
+
+func TestCheckClientsUnsupportedRequest(t *testing.T) {
+
+	// an older projector without the probe request
+	older := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "path not found", http.StatusNotFound)
+	}))
+	defer older.Close()
+
+	down := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	down.Close()
+
+	factory := &ProjectorStreamClientFactoryImpl{
+		clientCache: make(map[string]*projectorClientEntry),
+		nodeAddrs:   make(map[string]string),
+		NodeToProjectorMap: map[string]string{
+			"node1:11210": older.Listener.Addr().String(),
+			"node2:11210": down.Listener.Addr().String(),
+		},
+	}
+	factory.GetClientForNode("node1:11210")
+	factory.GetClientForNode("node2:11210")
+
+	factory.checkClients()
+	if _, ok := factory.nodeAddrs["node1:11210"]; !ok {
+		t.Fatalf("Expect client of projector without the probe request to be kept")
+	}
+	if _, ok := factory.nodeAddrs["node2:11210"]; ok {
+		t.Fatalf("Expect client of unreachable projector to be evicted")
+	}
+}
+
+func TestProjectorStreamClientFactoryClusterURL(t *testing.T) {
+
+	env := NewProjectorClientEnvImpl("http://cluster1:8091/", "pool1", time.Minute)
+	factory := newProjectorStreamClientFactoryImpl(env, "pool1", time.Hour).(*ProjectorStreamClientFactoryImpl)
+	defer factory.Close()
+	if factory.clusterURL != "http://cluster1:8091/" {
+		t.Fatalf("Expect factory to use the cluster of the env, got %v", factory.clusterURL)
+	}
+
+	mockEnv, _ := newMockProjectorCluster("node1:9999")
+	mockFactory := newProjectorStreamClientFactoryImpl(mockEnv, "", time.Hour).(*ProjectorStreamClientFactoryImpl)
+	defer mockFactory.Close()
+	if mockFactory.clusterURL != COUCHBASE_INTERNAL_BUCKET_URL {
+		t.Fatalf("Expect factory to default to the local cluster, got %v", mockFactory.clusterURL)
+	}
+}
+
+func TestProjectorStreamClientFactoryHealthCheckDisabled(t *testing.T) {
+
+	saved := common.SystemConfig
+	common.SystemConfig = saved.Clone()
+	defer func() { common.SystemConfig = saved }()
+	if err := common.SystemConfig.SetValue("manager.projectorclient.healthCheckInterval", 0); err != nil {
+		t.Fatal(err)
+	}
+
+	// a zero interval disables the health check instead of panicking in the background
+	env, _ := newMockProjectorCluster("node1:9999")
+	factory := newProjectorStreamClientFactoryImpl(env, "", time.Hour).(*ProjectorStreamClientFactoryImpl)
+	time.Sleep(10 * time.Millisecond)
+	factory.Close()
+}
+
+func TestProjectorStreamClientFactoryCleanupDisabled(t *testing.T) {
+
+	// a zero interval disables the cleanup instead of panicking in the background
+	env, _ := newMockProjectorCluster("node1:9999")
+	factory := newProjectorStreamClientFactoryImpl(env, "", 0).(*ProjectorStreamClientFactoryImpl)
+	time.Sleep(10 * time.Millisecond)
+	factory.Close()
+}
+
+func TestProjectorAdminClose(t *testing.T) {
+
+	env, _ := newMockProjectorCluster("node1:9999")
+	factory := newProjectorStreamClientFactoryImpl(env, "", time.Hour).(*ProjectorStreamClientFactoryImpl)
+	factory.NodeToProjectorMap = map[string]string{"node1:9999": "127.0.0.1:19999"}
+	factory.GetClientForNode("node1:9999")
+
+	admin := NewProjectorAdmin(factory, env, nil, "")
+	admin.Close()
+	admin.Close()
+
+	select {
+	case <-factory.stopch:
+	default:
+		t.Fatalf("Expect background goroutines of the factory to be stopped")
+	}
+	if len(factory.clientCache) != 0 {
+		t.Fatalf("Expect cached clients to be closed")
+	}
+}
+
+func TestGetClientForNodeProxy(t *testing.T) {
+
+	var mutex sync.Mutex
+	var hosts []string
+	proxy := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mutex.Lock()
+		hosts = append(hosts, r.URL.Host)
+		mutex.Unlock()
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	defer proxy.Close()
+
+	proxyURL, err := url.Parse(proxy.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	factory := &ProjectorStreamClientFactoryImpl{
+		clientCache: make(map[string]*projectorClientEntry),
+		nodeAddrs:   make(map[string]string),
+		ProxyURL:    proxyURL,
+	}
+
+	expected := net.JoinHostPort("node1", PROJECTOR_PORT)
+	for _, server := range []string{"node1:11210", "node1"} {
+		if client := factory.GetClientForNode(server); client == nil {
+			t.Fatalf("Expect client for node %v", server)
+		}
+		if addr := factory.nodeAddrs[server]; addr != expected {
+			t.Fatalf("Expect projector address %v for node %v, got %v", expected, server, addr)
+		}
+	}
+	if len(factory.clientCache) != 1 {
+		t.Fatalf("Expect a single client for the projector, got %v", len(factory.clientCache))
+	}
+
+	// the request is routed via the proxy, which fails it.
+	if err := factory.GetClientForNode("node1:11210").Ping(); err == nil {
+		t.Fatalf("Expect error from proxy")
+	}
+
+	mutex.Lock()
+	defer mutex.Unlock()
+	if !reflect.DeepEqual(hosts, []string{expected}) {
+		t.Fatalf("Expect request to projector via proxy, got %v", hosts)
+	}
+}
+
+// MockProjectorStreamClient implements ProjectorStreamClient.  The response of each
+// call is injected via the function fields.  If a function field is not set, the call
+// succeeds, and the active timestamps of a topic request are the request timestamps.
+type MockProjectorStreamClient struct {
+	mutationTopicRequest    func(topic, endpointType string, reqTimestamps []*protobuf.TsVbuuid, instances []*protobuf.Instance) (*protobuf.TopicResponse, error)
+	addInstances            func(topic string, instances []*protobuf.Instance) (*protobuf.TimestampResponse, error)
+	delInstances            func(topic string, uuids []uint64, version uint64) error
+	repairEndpoints         func(topic string, endpoints []string) error
+	initialRestartTimestamp func(pooln, bucketn string) (*protobuf.TsVbuuid, error)
+	restartVbuckets         func(topic string, restartTimestamps []*protobuf.TsVbuuid) (*protobuf.TopicResponse, error)
+	getActiveTopics         func() ([]string, error)
+	getFailoverLogs         func(pooln, bucketn string, vbnos []uint32) (*protobuf.FailoverLogResponse, error)
+	ping                    func() error
+
+	// If set, MutationTopicRequest fails with ErrorTopicExist on a topic that
+	// has been created, like projector does.
+	topicExist bool
+
+	mutex  sync.Mutex
+	calls  map[string]int
+	topics map[string]bool
+}
+
+func (c *MockProjectorStreamClient) MutationTopicRequest(topic, endpointType string, reqTimestamps []*protobuf.TsVbuuid,
+	instances []*protobuf.Instance) (*protobuf.TopicResponse, error) {
+
+	c.called("MutationTopicRequest")
+	if c.topicExist && !c.createTopic(topic) {
+		return nil, projectorC.ErrorTopicExist
+	}
+	if c.mutationTopicRequest != nil {
+		return c.mutationTopicRequest(topic, endpointType, reqTimestamps, instances)
+	}
+	return &protobuf.TopicResponse{ActiveTimestamps: reqTimestamps}, nil
+}
+
+func (c *MockProjectorStreamClient) AddInstances(topic string, instances []*protobuf.Instance) (*protobuf.TimestampResponse, error) {
+
+	c.called("AddInstances")
+	if c.addInstances != nil {
+		return c.addInstances(topic, instances)
+	}
+	return &protobuf.TimestampResponse{Topic: &topic}, nil
+}
+
+func (c *MockProjectorStreamClient) DelInstances(topic string, uuids []uint64, version uint64) error {
+
+	c.called("DelInstances")
+	if c.delInstances != nil {
+		return c.delInstances(topic, uuids, version)
+	}
+	return nil
+}
+
+func (c *MockProjectorStreamClient) RepairEndpoints(topic string, endpoints []string) error {
+
+	c.called("RepairEndpoints")
+	if c.repairEndpoints != nil {
+		return c.repairEndpoints(topic, endpoints)
+	}
+	return nil
+}
+
+func (c *MockProjectorStreamClient) InitialRestartTimestamp(pooln, bucketn string) (*protobuf.TsVbuuid, error) {
+
+	c.called("InitialRestartTimestamp")
+	if c.initialRestartTimestamp != nil {
+		return c.initialRestartTimestamp(pooln, bucketn)
+	}
+	ts := protobuf.NewTsVbuuid(pooln, bucketn, NUM_VB)
+	for vb := 0; vb < NUM_VB; vb++ {
+		ts.Append(uint16(vb), uint64(0), uint64(1234), uint64(0), uint64(0))
+	}
+	return ts, nil
+}
+
+func (c *MockProjectorStreamClient) RestartVbuckets(topic string, restartTimestamps []*protobuf.TsVbuuid) (*protobuf.TopicResponse, error) {
+
+	c.called("RestartVbuckets")
+	if c.restartVbuckets != nil {
+		return c.restartVbuckets(topic, restartTimestamps)
+	}
+	return &protobuf.TopicResponse{ActiveTimestamps: restartTimestamps}, nil
+}
+
+func (c *MockProjectorStreamClient) GetActiveTopics() ([]string, error) {
+
+	c.called("GetActiveTopics")
+	if c.getActiveTopics != nil {
+		return c.getActiveTopics()
+	}
+	return nil, nil
+}
+
+func (c *MockProjectorStreamClient) GetFailoverLogs(pooln, bucketn string, vbnos []uint32) (*protobuf.FailoverLogResponse, error) {
+
+	c.called("GetFailoverLogs")
+	if c.getFailoverLogs != nil {
+		return c.getFailoverLogs(pooln, bucketn, vbnos)
+	}
+	return &protobuf.FailoverLogResponse{}, nil
+}
+
+func (c *MockProjectorStreamClient) Ping() error {
+
+	c.called("Ping")
+	if c.ping != nil {
+		return c.ping()
+	}
+	return nil
+}
+
+func (c *MockProjectorStreamClient) called(op string) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	if c.calls == nil {
+		c.calls = make(map[string]int)
+	}
+	c.calls[op]++
+}
+
+// return false if the topic has been created
+func (c *MockProjectorStreamClient) createTopic(topic string) bool {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	if c.topics == nil {
+		c.topics = make(map[string]bool)
+	}
+	if c.topics[topic] {
+		return false
+	}
+	c.topics[topic] = true
+	return true
+}
+
+func (c *MockProjectorStreamClient) count(op string) int {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	return c.calls[op]
+}
+
+// implement ProjectorStreamClientFactory with a fixed client for each node
+type mockProjectorStreamClientFactory struct {
+	clients map[string]*MockProjectorStreamClient
+}
+
+func (p *mockProjectorStreamClientFactory) GetClientForNode(server string) ProjectorStreamClient {
+	if client, ok := p.clients[server]; ok {
+		return client
+	}
+	return nil
+}
+
+func (p *mockProjectorStreamClientFactory) CloseClientForNode(server string) {
+}
+
+// MockProjectorClientEnv implements ProjectorClientEnv.  The result of each call is
+// injected via the function fields.  If a function field is not set, the call locates
+// the vbuckets with vbmap.
+type MockProjectorClientEnv struct {
+	getNodeListForBuckets           func(buckets []string) (map[string]string, error)
+	getNodeListForTimestamps        func(timestamps []*common.TsVbuuid) (map[string][]*protobuf.TsVbuuid, error)
+	getPartialNodeListForTimestamps func(timestamps []*common.TsVbuuid) (map[string][]*protobuf.TsVbuuid, []*common.TsVbuuid, error)
+	filterTimestampsForNode         func(timestamps []*protobuf.TsVbuuid, node string) ([]*protobuf.TsVbuuid, error)
+
+	mutex sync.Mutex
+	vbmap map[string][]uint16 // node -> vbnos, same for every bucket
+}
+
+func (p *MockProjectorClientEnv) getVBMap() map[string][]uint16 {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	return p.vbmap
+}
+
+// replace the vbmap, e.g. to simulate rebalance while a request is in progress.
+func (p *MockProjectorClientEnv) setVBMap(vbmap map[string][]uint16) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	p.vbmap = vbmap
+}
+
+func (p *MockProjectorClientEnv) GetNodeListForBuckets(buckets []string) (map[string]string, error) {
+
+	if p.getNodeListForBuckets != nil {
+		return p.getNodeListForBuckets(buckets)
+	}
+
+	nodes := make(map[string]string)
+	for node := range p.getVBMap() {
+		nodes[node] = node
+	}
+	return nodes, nil
+}
+
+func (p *MockProjectorClientEnv) GetNodeListForTimestamps(timestamps []*common.TsVbuuid) (map[string][]*protobuf.TsVbuuid, error) {
+
+	if p.getNodeListForTimestamps != nil {
+		return p.getNodeListForTimestamps(timestamps)
+	}
+
+	nodes, unlocated, err := p.GetPartialNodeListForTimestamps(timestamps)
+	if err != nil {
+		return nil, err
+	}
+	if len(unlocated) != 0 {
+		return nil, enrichError(NewError2(ERROR_STREAM_INCONSISTENT_VBMAP, STREAM), "GetNodeListForTimestamps", unlocated[0].Bucket, "")
+	}
+	return nodes, nil
+}
+
+func (p *MockProjectorClientEnv) GetPartialNodeListForTimestamps(timestamps []*common.TsVbuuid) (
+	map[string][]*protobuf.TsVbuuid, []*common.TsVbuuid, error) {
+
+	if p.getPartialNodeListForTimestamps != nil {
+		return p.getPartialNodeListForTimestamps(timestamps)
+	}
+	nodes, unlocated := locateTestTimestamps(p.getVBMap(), timestamps)
+	return nodes, unlocated, nil
+}
+
+func (p *MockProjectorClientEnv) FilterTimestampsForNode(timestamps []*protobuf.TsVbuuid, node string) ([]*protobuf.TsVbuuid, error) {
+
+	if p.filterTimestampsForNode != nil {
+		return p.filterTimestampsForNode(timestamps, node)
+	}
+
+	vbnos := p.getVBMap()[node]
+	owned := make(map[uint32]bool)
+	for _, vbno := range vbnos {
+		owned[uint32(vbno)] = true
+	}
+
+	var result []*protobuf.TsVbuuid = nil
+	for _, ts := range timestamps {
+		newTs := protobuf.NewTsVbuuid(ts.GetPool(), ts.GetBucket(), len(vbnos))
+		for i, vbno := range ts.GetVbnos() {
+			if owned[vbno] {
+				newTs.Append(uint16(vbno), ts.Seqnos[i], ts.Vbuuids[i],
+					ts.Snapshots[i].GetStart(), ts.Snapshots[i].GetEnd())
+			}
+		}
+		result = append(result, newTs)
+	}
+	return result, nil
+}
+
+// Locate the vbuckets of the timestamps with vbmap, like ProjectorClientEnvImpl.
+func locateTestTimestamps(vbmap map[string][]uint16, timestamps []*common.TsVbuuid) (
+	map[string][]*protobuf.TsVbuuid, []*common.TsVbuuid) {
+
+	owners := make(map[uint16]string)
+	for node, vbnos := range vbmap {
+		for _, vbno := range vbnos {
+			owners[vbno] = node
+		}
+	}
+
+	nodes := make(map[string][]*protobuf.TsVbuuid)
+	var unlocated []*common.TsVbuuid = nil
+
+	for _, ts := range timestamps {
+		located := make(map[string]*protobuf.TsVbuuid)
+		var straggler *common.TsVbuuid = nil
+
+		for i, seqno := range ts.Seqnos {
+			if seqno == 0 {
+				continue
+			}
+
+			node, ok := owners[uint16(i)]
+			if !ok {
+				if straggler == nil {
+					straggler = common.NewTsVbuuid(ts.Bucket, len(ts.Seqnos))
+					unlocated = append(unlocated, straggler)
+				}
+				straggler.Seqnos[i] = ts.Seqnos[i]
+				straggler.Vbuuids[i] = ts.Vbuuids[i]
+				straggler.Snapshots[i] = ts.Snapshots[i]
+				continue
+			}
+
+			if located[node] == nil {
+				located[node] = protobuf.NewTsVbuuid(DEFAULT_POOL_NAME, ts.Bucket, NUM_VB)
+				nodes[node] = append(nodes[node], located[node])
+			}
+			located[node].Append(uint16(i), ts.Seqnos[i], ts.Vbuuids[i], ts.Snapshots[i][0], ts.Snapshots[i][1])
+		}
+	}
+
+	return nodes, unlocated
+}
+
+// Create a mock cluster of the given nodes, with the vbuckets assigned round-robin.
+func newMockProjectorCluster(servers ...string) (*MockProjectorClientEnv, *mockProjectorStreamClientFactory) {
+
+	env := &MockProjectorClientEnv{vbmap: make(map[string][]uint16)}
+	factory := &mockProjectorStreamClientFactory{clients: make(map[string]*MockProjectorStreamClient)}
+
+	for vb := 0; vb < NUM_VB; vb++ {
+		server := servers[vb%len(servers)]
+		env.vbmap[server] = append(env.vbmap[server], uint16(vb))
+	}
+	for _, server := range servers {
+		factory.clients[server] = &MockProjectorStreamClient{}
+	}
+	return env, factory
+}
+
+func makeTestInstance(id uint64, name string) *protobuf.Instance {
+	defn := &protobuf.IndexDefn{Name: &name}
+	return &protobuf.Instance{IndexInstance: &protobuf.IndexInst{InstId: &id, Definition: defn}}
+}
+
+func TestAddIndexToStream(t *testing.T) {
+
+	servers := []string{"node1:9999", "node2:9999", "node3:9999"}
+	env, factory := newMockProjectorCluster(servers...)
+
+	var mutex sync.Mutex
+	requested := make(map[uint32]int)
+	for _, client := range factory.clients {
+		client.mutationTopicRequest = func(topic, endpointType string, reqTimestamps []*protobuf.TsVbuuid,
+			instances []*protobuf.Instance) (*protobuf.TopicResponse, error) {
+
+			mutex.Lock()
+			defer mutex.Unlock()
+			for _, ts := range reqTimestamps {
+				for _, vbno := range ts.GetVbnos() {
+					requested[vbno]++
+				}
+			}
+			return &protobuf.TopicResponse{ActiveTimestamps: reqTimestamps}, nil
+		}
+	}
+
+	admin := NewProjectorAdmin(factory, env, nil, "")
+	instances := []*protobuf.Instance{makeTestInstance(1, "idx1")}
+	if err := admin.AddIndexToStream(common.MAINT_STREAM, []string{"bucket1"}, instances, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, server := range servers {
+		client := factory.clients[server]
+		if client.count("InitialRestartTimestamp") != 1 || client.count("MutationTopicRequest") != 1 {
+			t.Fatalf("Expect a single request to %v, got %v", server, client.calls)
+		}
+	}
+	if len(requested) != NUM_VB {
+		t.Fatalf("Expect all %v vbuckets to be requested, got %v", NUM_VB, len(requested))
+	}
+	for vbno, count := range requested {
+		if count != 1 {
+			t.Fatalf("Expect vb %v to be requested from a single node, got %v", vbno, count)
+		}
+	}
+	if len(admin.filterActiveInstances(common.MAINT_STREAM, instances)) != 0 {
+		t.Fatalf("Expect instance to be active after it is added")
+	}
+}
+
+// recordTopics makes the clients of the factory report the topics that have been
+// requested as active topics, like projector does.
+func recordTopics(factory *mockProjectorStreamClientFactory) {
+	for _, client := range factory.clients {
+		client := client
+		client.mutationTopicRequest = func(topic, endpointType string, reqTimestamps []*protobuf.TsVbuuid,
+			instances []*protobuf.Instance) (*protobuf.TopicResponse, error) {
+			client.createTopic(topic)
+			return &protobuf.TopicResponse{ActiveTimestamps: reqTimestamps}, nil
+		}
+		client.getActiveTopics = func() ([]string, error) {
+			client.mutex.Lock()
+			defer client.mutex.Unlock()
+			var topics []string
+			for topic := range client.topics {
+				topics = append(topics, topic)
+			}
+			return topics, nil
+		}
+	}
+}
+
+func TestAddIndexToStreamIdempotent(t *testing.T) {
+
+	env, factory := newMockProjectorCluster("node1:9999")
+	recordTopics(factory)
+	client := factory.clients["node1:9999"]
+
+	admin := NewProjectorAdmin(factory, env, nil, "")
+	buckets := []string{"bucket1"}
+	instances := []*protobuf.Instance{makeTestInstance(1, "idx1"), makeTestInstance(2, "idx2")}
+
+	if err := admin.AddIndexToStream(common.MAINT_STREAM, buckets, instances, nil); err != nil {
+		t.Fatal(err)
+	}
+	if client.count("MutationTopicRequest") != 1 {
+		t.Fatalf("Expect 1 MutationTopicRequest after first AddIndexToStream, got %v", client.calls)
+	}
+
+	// Adding the same instances again should not send any request to projector.
+	if err := admin.AddIndexToStream(common.MAINT_STREAM, buckets, instances, nil); err != nil {
+		t.Fatal(err)
+	}
+	if client.count("MutationTopicRequest") != 1 {
+		t.Fatalf("Expect no new MutationTopicRequest for active instances, got %v", client.calls)
+	}
+
+	// Adding a new instance should only send the delta to projector.
+	instances = append(instances, makeTestInstance(3, "idx3"))
+	if err := admin.AddIndexToStream(common.MAINT_STREAM, buckets, instances, nil); err != nil {
+		t.Fatal(err)
+	}
+	if client.count("MutationTopicRequest") != 2 {
+		t.Fatalf("Expect 2 MutationTopicRequest after adding new instance, got %v", client.calls)
+	}
+
+	// If the topics cannot be listed, the instances are sent again and added
+	// to the existing topic.
+	client.topicExist = true
+	for i, err := range []error{errors.New("connection reset"), common.ErrorInvalidRequest} {
+		client.getActiveTopics = func() ([]string, error) { return nil, err }
+		if err := admin.AddIndexToStream(common.MAINT_STREAM, buckets, instances, nil); err != nil {
+			t.Fatal(err)
+		}
+		if count := client.count("AddInstances"); count != i+1 {
+			t.Fatalf("Expect %v AddInstances when the topic cannot be listed, got %v", i+1, client.calls)
+		}
+		if len(admin.filterActiveInstances(common.MAINT_STREAM, instances)) != 0 {
+			t.Fatalf("Expect instances to stay active when the topic cannot be listed")
+		}
+	}
+}
+
+func TestBatchAddIndexesToStream(t *testing.T) {
+
+	env, factory := newMockProjectorCluster("node1:9999")
+	recordTopics(factory)
+	client := factory.clients["node1:9999"]
+	admin := NewProjectorAdmin(factory, env, nil, "")
+
+	// Concurrent requests within the batching window, with a duplicate instance,
+	// should be sent to projector in a single MutationTopicRequest.
+	var wg sync.WaitGroup
+	for id := uint64(1); id < 6; id++ {
+		wg.Add(1)
+		go func(id uint64) {
+			defer wg.Done()
+			request := AddIndexRequest{
+				Buckets:   []string{"bucket1"},
+				Instances: []*protobuf.Instance{makeTestInstance(id, "idx"), makeTestInstance(1, "idx")},
+			}
+			if err := admin.BatchAddIndexesToStream(context.Background(), common.INIT_STREAM,
+				[]AddIndexRequest{request}); err != nil {
+				t.Error(err)
+			}
+		}(id)
+	}
+	wg.Wait()
+
+	if client.count("MutationTopicRequest") != 1 {
+		t.Fatalf("Expect 1 MutationTopicRequest for the batch, got %v", client.calls)
+	}
+}
+
+func TestAddIndexToStreamPriority(t *testing.T) {
+
+	env, factory := newMockProjectorCluster("node1:9999")
+	client := factory.clients["node1:9999"]
+	client.topicExist = true
+
+	// record the buckets of each request in order.
+	var mutex sync.Mutex
+	var started []string
+	record := func(timestamps []*protobuf.TsVbuuid) {
+		mutex.Lock()
+		defer mutex.Unlock()
+		for _, ts := range timestamps {
+			started = append(started, ts.GetBucket())
+		}
+	}
+	client.mutationTopicRequest = func(topic, endpointType string, reqTimestamps []*protobuf.TsVbuuid,
+		instances []*protobuf.Instance) (*protobuf.TopicResponse, error) {
+		record(reqTimestamps)
+		return &protobuf.TopicResponse{ActiveTimestamps: reqTimestamps}, nil
+	}
+	client.restartVbuckets = func(topic string, restartTimestamps []*protobuf.TsVbuuid) (*protobuf.TopicResponse, error) {
+		record(restartTimestamps)
+		return &protobuf.TopicResponse{ActiveTimestamps: restartTimestamps}, nil
+	}
+
+	admin := NewProjectorAdmin(factory, env, nil, "")
+	admin.BucketPriority = map[string]int{"critical": 10, "batch": -1}
+
+	instance := func(id uint64, bucket string) *protobuf.Instance {
+		inst := makeTestInstance(id, "idx")
+		inst.GetIndexInstance().GetDefinition().Bucket = &bucket
+		return inst
+	}
+	instances := []*protobuf.Instance{instance(1, "batch"), instance(2, "default"), instance(3, "critical")}
+	if err := admin.AddIndexToStream(common.MAINT_STREAM, []string{"batch", "default", "critical"}, instances, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	if !reflect.DeepEqual(started, []string{"critical", "default", "batch"}) {
+		t.Fatalf("Expect buckets to be started in priority order, got %v", started)
+	}
+	if len(admin.filterActiveInstances(common.MAINT_STREAM, instances)) != 0 {
+		t.Fatalf("Expect instances of all buckets to be active")
+	}
+}
+
+func TestShouldRetryAddInstancesRollback(t *testing.T) {
+
+	worker := &adminWorker{admin: &ProjectorAdmin{}, server: "node1:9999", streamId: common.MAINT_STREAM}
+
+	requestTs := protobuf.NewTsVbuuid(DEFAULT_POOL_NAME, "bucket1", 2)
+	requestTs.Append(1, 10, 100, 10, 10)
+	requestTs.Append(2, 20, 200, 20, 20)
+
+	rollbackTs := protobuf.NewTsVbuuid(DEFAULT_POOL_NAME, "bucket1", 1)
+	rollbackTs.Append(2, 5, 201, 5, 5)
+	response := &protobuf.TopicResponse{RollbackTimestamps: []*protobuf.TsVbuuid{rollbackTs}}
+
+	// retry from the rollback timestamp, for the vbuckets that have to rollback.
+	newTs, err := worker.shouldRetryAddInstances([]*protobuf.TsVbuuid{requestTs}, response, projectorC.ErrorStreamRequest)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(newTs) != 1 ||
+		!reflect.DeepEqual(newTs[0].GetVbnos(), []uint32{1, 2}) ||
+		!reflect.DeepEqual(newTs[0].GetSeqnos(), []uint64{10, 5}) ||
+		!reflect.DeepEqual(newTs[0].GetVbuuids(), []uint64{100, 201}) {
+		t.Fatalf("Unexpected retry timestamp %v", newTs)
+	}
+
+	// vbuckets that are not owned by the node have to be retried by another worker.
+	_, err = worker.shouldRetryAddInstances([]*protobuf.TsVbuuid{requestTs}, response, projectorC.ErrorNotMyVbucket)
+	if !isRecoverableError(err, ERROR_STREAM_WRONG_VBUCKET) {
+		t.Fatalf("Expect wrong vbucket error, got %v", err)
+	}
+}
+
+func TestValidateActiveVbDuplicate(t *testing.T) {
+
+	// node1 and node2 both claim vb 0 to be active.
+	ts1 := protobuf.NewTsVbuuid(DEFAULT_POOL_NAME, "bucket1", NUM_VB)
+	for vb := 0; vb < NUM_VB/2; vb++ {
+		ts1.Append(uint16(vb), uint64(vb+1), uint64(1234), uint64(0), uint64(0))
+	}
+	ts2 := protobuf.NewTsVbuuid(DEFAULT_POOL_NAME, "bucket1", NUM_VB)
+	ts2.Append(0, 1, 1234, 0, 0)
+	for vb := NUM_VB / 2; vb < NUM_VB; vb++ {
+		ts2.Append(uint16(vb), uint64(vb+1), uint64(1234), uint64(0), uint64(0))
+	}
+
+	admin := &ProjectorAdmin{}
+	budget := make(map[string]int)
+	if admin.validateActiveVb([]string{"bucket1"}, []*protobuf.TsVbuuid{ts1, ts2}, nil, budget) {
+		t.Fatalf("Expect duplicate active vbucket to fail validation")
+	}
+
+	ts2 = protobuf.NewTsVbuuid(DEFAULT_POOL_NAME, "bucket1", NUM_VB)
+	for vb := NUM_VB / 2; vb < NUM_VB; vb++ {
+		ts2.Append(uint16(vb), uint64(vb+1), uint64(1234), uint64(0), uint64(0))
+	}
+	if !admin.validateActiveVb([]string{"bucket1"}, []*protobuf.TsVbuuid{ts1, ts2}, nil, budget) {
+		t.Fatalf("Expect vbuckets active on a single node to pass validation")
+	}
+}
+
+func TestAddIndexToStreamWrongVbucket(t *testing.T) {
+
+	env, factory := newMockProjectorCluster("node1:9999", "node2:9999")
+
+	// all the vbuckets of node2 move to node1, after node1 has completed.
+	factory.clients["node2:9999"].mutationTopicRequest = func(topic, endpointType string,
+		reqTimestamps []*protobuf.TsVbuuid, instances []*protobuf.Instance) (*protobuf.TopicResponse, error) {
+
+		time.Sleep(50 * time.Millisecond)
+		vbmap := make(map[string][]uint16)
+		for vb := 0; vb < NUM_VB; vb++ {
+			vbmap["node1:9999"] = append(vbmap["node1:9999"], uint16(vb))
+		}
+		env.setVBMap(vbmap)
+		return nil, projectorC.ErrorNotMyVbucket
+	}
+	attempts := 0
+	env.getNodeListForBuckets = func(buckets []string) (map[string]string, error) {
+		attempts++
+		nodes := make(map[string]string)
+		for node := range env.getVBMap() {
+			nodes[node] = node
+		}
+		return nodes, nil
+	}
+
+	admin := NewProjectorAdmin(factory, env, nil, "")
+	instances := []*protobuf.Instance{makeTestInstance(1, "idx1")}
+	if err := admin.AddIndexToStream(common.MAINT_STREAM, []string{"bucket1"}, instances, nil); err != nil {
+		t.Fatal(err)
+	}
+	if count := factory.clients["node1:9999"].count("MutationTopicRequest"); count != 2 {
+		t.Fatalf("Expect the moved vbuckets to be requested from node1, got %v requests", count)
+	}
+	if attempts != 2 {
+		t.Fatalf("Expect the moved vbuckets to be requested in the next attempt, got %v attempts", attempts)
+	}
+}
+
+func TestAddIndexToStreamInconsistentFeed(t *testing.T) {
+
+	env, factory := newMockProjectorCluster("node1:9999", "node2:9999", "node3:9999")
+	factory.clients["node2:9999"].mutationTopicRequest = func(topic, endpointType string, reqTimestamps []*protobuf.TsVbuuid,
+		instances []*protobuf.Instance) (*protobuf.TopicResponse, error) {
+
+		return nil, projectorC.ErrorInconsistentFeed
+	}
+
+	admin := NewProjectorAdmin(factory, env, nil, "")
+	instances := []*protobuf.Instance{makeTestInstance(1, "idx1")}
+	err := admin.AddIndexToStream(common.MAINT_STREAM, []string{"bucket1"}, instances, nil)
+	if !isRecoverableError(err, ERROR_STREAM_REQUEST_ERROR) ||
+		!strings.Contains(err.Error(), projectorC.ErrorInconsistentFeed.Error()) {
+		t.Fatalf("Expect inconsistent feed to fail the request, got %v", err)
+	}
+	if count := factory.clients["node2:9999"].count("MutationTopicRequest"); count != 1 {
+		t.Fatalf("Expect inconsistent feed not to be retried, got %v requests", count)
+	}
+	if len(admin.filterActiveInstances(common.MAINT_STREAM, instances)) != 1 {
+		t.Fatalf("Expect instance not to be active after failure")
+	}
+}
+
+func TestAddIndexToStreamTopicExist(t *testing.T) {
+
+	topicExist := func(topic, endpointType string, reqTimestamps []*protobuf.TsVbuuid,
+		instances []*protobuf.Instance) (*protobuf.TopicResponse, error) {
+
+		return nil, projectorC.ErrorTopicExist
+	}
+	instances := []*protobuf.Instance{makeTestInstance(1, "idx1")}
+
+	// topic exist is not recoverable without TreatTopicExistAsSuccess
+	env, factory := newMockProjectorCluster("node1:9999", "node2:9999", "node3:9999")
+	factory.clients["node2:9999"].mutationTopicRequest = topicExist
+	admin := NewProjectorAdmin(factory, env, nil, "")
+	admin.TreatTopicExistAsSuccess = false
+	err := admin.AddIndexToStream(common.MAINT_STREAM, []string{"bucket1"}, instances, nil)
+	if !isRecoverableError(err, ERROR_STREAM_REQUEST_ERROR) {
+		t.Fatalf("Expect topic exist to fail the request, got %v", err)
+	}
+	if count := factory.clients["node2:9999"].count("RestartVbuckets"); count != 0 {
+		t.Fatalf("Expect no restart request, got %v", count)
+	}
+
+	// by default, the instances are added to the live topic, with the active
+	// timestamps of the topic
+	env, factory = newMockProjectorCluster("node1:9999", "node2:9999", "node3:9999")
+	client := factory.clients["node2:9999"]
+	client.mutationTopicRequest = topicExist
+	var added []*protobuf.Instance
+	client.addInstances = func(topic string, instances []*protobuf.Instance) (*protobuf.TimestampResponse, error) {
+		added = instances
+		ts := protobuf.NewTsVbuuid(DEFAULT_POOL_NAME, "bucket1", NUM_VB)
+		for _, vb := range env.getVBMap()["node2:9999"] {
+			ts.Append(vb, 1, 1234, 0, 0)
+		}
+		return &protobuf.TimestampResponse{Topic: &topic, CurrentTimestamps: []*protobuf.TsVbuuid{ts}}, nil
+	}
+	admin = NewProjectorAdmin(factory, env, nil, "")
+	if err := admin.AddIndexToStream(common.MAINT_STREAM, []string{"bucket1"}, instances, nil); err != nil {
+		t.Fatalf("Expect topic exist to be treated as success, got %v", err)
+	}
+	if count := client.count("AddInstances"); count != 1 || !reflect.DeepEqual(added, instances) {
+		t.Fatalf("Expect the instances to be added to the topic, got %v requests with %v", count, added)
+	}
+	if count := client.count("RestartVbuckets"); count != 0 {
+		t.Fatalf("Expect no restart request when the topic has all the vbuckets active, got %v", count)
+	}
+	if len(admin.filterActiveInstances(common.MAINT_STREAM, instances)) != 0 {
+		t.Fatalf("Expect instance to be active")
+	}
+
+	// the vbuckets that are not active on the topic are restarted
+	env, factory = newMockProjectorCluster("node1:9999", "node2:9999", "node3:9999")
+	client = factory.clients["node2:9999"]
+	client.mutationTopicRequest = topicExist
+	admin = NewProjectorAdmin(factory, env, nil, "")
+	if err := admin.AddIndexToStream(common.MAINT_STREAM, []string{"bucket1"}, instances, nil); err != nil {
+		t.Fatalf("Expect topic exist to be treated as success, got %v", err)
+	}
+	if client.count("AddInstances") != 1 || client.count("RestartVbuckets") != 1 {
+		t.Fatalf("Expect instances to be added and inactive vbuckets restarted, got %v add and %v restart requests",
+			client.count("AddInstances"), client.count("RestartVbuckets"))
+	}
+
+	// the topic is deleted after ErrorTopicExist, so the request is retried
+	env, factory = newMockProjectorCluster("node1:9999", "node2:9999", "node3:9999")
+	client = factory.clients["node2:9999"]
+	client.mutationTopicRequest = func(topic, endpointType string, reqTimestamps []*protobuf.TsVbuuid,
+		instances []*protobuf.Instance) (*protobuf.TopicResponse, error) {
+
+		if client.count("MutationTopicRequest") == 1 {
+			return nil, projectorC.ErrorTopicExist
+		}
+		return &protobuf.TopicResponse{ActiveTimestamps: reqTimestamps}, nil
+	}
+	client.addInstances = func(topic string, instances []*protobuf.Instance) (*protobuf.TimestampResponse, error) {
+		return nil, projectorC.ErrorTopicMissing
+	}
+	admin = NewProjectorAdmin(factory, env, nil, "")
+	if err := admin.AddIndexToStream(common.MAINT_STREAM, []string{"bucket1"}, instances, nil); err != nil {
+		t.Fatalf("Expect the request to be retried when the topic is missing, got %v", err)
+	}
+	if count := client.count("MutationTopicRequest"); count != 2 {
+		t.Fatalf("Expect topic request to be retried, got %v", count)
+	}
+}
+
+func TestAddIndexToStreamConcurrent(t *testing.T) {
+
+	env, factory := newMockProjectorCluster("node1:9999", "node2:9999", "node3:9999")
+	admin := NewProjectorAdmin(factory, env, nil, "")
+
+	// the request that comes after the topic is created gets ErrorTopicExist, and
+	// fails if it overlaps with the request that creates the topic.
+	for _, client := range factory.clients {
+		var mutex sync.Mutex
+		active := 0
+		request := func() error {
+			mutex.Lock()
+			active++
+			overlap := active > 1
+			mutex.Unlock()
+			time.Sleep(10 * time.Millisecond)
+			mutex.Lock()
+			active--
+			mutex.Unlock()
+			if overlap {
+				return projectorC.ErrorInconsistentFeed
+			}
+			return nil
+		}
+		client.topicExist = true
+		client.mutationTopicRequest = func(topic, endpointType string,
+			reqTimestamps []*protobuf.TsVbuuid, instances []*protobuf.Instance) (*protobuf.TopicResponse, error) {
+			if err := request(); err != nil {
+				return nil, err
+			}
+			return &protobuf.TopicResponse{ActiveTimestamps: reqTimestamps}, nil
+		}
+		client.addInstances = func(topic string, instances []*protobuf.Instance) (*protobuf.TimestampResponse, error) {
+			if err := request(); err != nil {
+				return nil, err
+			}
+			return &protobuf.TimestampResponse{Topic: &topic}, nil
+		}
+	}
+
+	// requests for different buckets, while the stream monitor is set.
+	buckets := []string{"bucket1", "bucket2"}
+	instances := []*protobuf.Instance{makeTestInstance(1, "idx1"), makeTestInstance(2, "idx2")}
+	errs := make([]error, len(buckets))
+	var wg sync.WaitGroup
+	for i, bucket := range buckets {
+		wg.Add(1)
+		go func(i int, bucket string) {
+			defer wg.Done()
+			errs[i] = admin.AddIndexToStream(common.MAINT_STREAM, []string{bucket}, instances[i:i+1], nil)
+		}(i, bucket)
+	}
+	admin.Initialize(NewStreamMonitor(nil, nil, ""))
+	wg.Wait()
+
+	for i, err := range errs {
+		if err != nil {
+			t.Fatalf("Expect %v to be added to stream, got %v", buckets[i], err)
+		}
+	}
+	if delta := admin.filterActiveInstances(common.MAINT_STREAM, instances); len(delta) != 0 {
+		t.Fatalf("Expect both instances to be active, got %v inactive", len(delta))
+	}
+	if admin.StreamState(common.MAINT_STREAM) == nil {
+		t.Fatalf("Expect stream monitor to be initialized")
+	}
+	for server, client := range factory.clients {
+		if count := client.count("AddInstances"); count != 1 {
+			t.Fatalf("Expect the instances to be added to the live topic of %v, got %v", server, count)
+		}
+	}
+}
+
+func TestAddIndexToStreamContext(t *testing.T) {
+
+	env, factory := newMockProjectorCluster("node1:9999", "node2:9999")
+	admin := NewProjectorAdmin(factory, env, nil, "")
+	instances := []*protobuf.Instance{makeTestInstance(1, "idx1")}
+
+	// the request is retried until ctx is done.
+	factory.clients["node2:9999"].mutationTopicRequest = func(topic, endpointType string,
+		reqTimestamps []*protobuf.TsVbuuid, instances []*protobuf.Instance) (*protobuf.TopicResponse, error) {
+		return nil, projectorC.ErrorNotMyVbucket
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	err := admin.AddIndexToStreamWithContext(ctx, common.MAINT_STREAM, []string{"bucket1"}, instances, nil)
+	if err != context.DeadlineExceeded {
+		t.Fatalf("Expect the retry to stop when ctx is done, got %v", err)
+	}
+
+	// a blocked worker does not block the caller once ctx is done.
+	unblock := make(chan bool)
+	defer close(unblock)
+	factory.clients["node2:9999"].mutationTopicRequest = func(topic, endpointType string,
+		reqTimestamps []*protobuf.TsVbuuid, instances []*protobuf.Instance) (*protobuf.TopicResponse, error) {
+		<-unblock
+		return nil, projectorC.ErrorNotMyVbucket
+	}
+	ctx, cancel = context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	errch := make(chan error, 1)
+	go func() {
+		errch <- admin.AddIndexToStreamWithContext(ctx, common.MAINT_STREAM, []string{"bucket1"}, instances, nil)
+	}()
+	select {
+	case err := <-errch:
+		if err != context.DeadlineExceeded {
+			t.Fatalf("Expect ctx error, got %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("AddIndexToStreamWithContext is blocked by a worker after ctx is done")
+	}
+}
+
+func TestBatchAddIndexesToStreamCancel(t *testing.T) {
+
+	env, factory := newMockProjectorCluster("node1:9999")
+	admin := NewProjectorAdmin(factory, env, nil, "")
+	factory.clients["node1:9999"].mutationTopicRequest = func(topic, endpointType string,
+		reqTimestamps []*protobuf.TsVbuuid, instances []*protobuf.Instance) (*protobuf.TopicResponse, error) {
+		return nil, projectorC.ErrorNotMyVbucket
+	}
+
+	// the batch is cancelled once the only request has given up.
+	ctx, cancel := context.WithTimeout(context.Background(), ADD_INDEX_BATCH_WINDOW*2)
+	defer cancel()
+	request := AddIndexRequest{Buckets: []string{"bucket1"}, Instances: []*protobuf.Instance{makeTestInstance(1, "idx1")}}
+	if err := admin.BatchAddIndexesToStream(ctx, common.MAINT_STREAM, []AddIndexRequest{request}); err != context.DeadlineExceeded {
+		t.Fatalf("Expect ctx error, got %v", err)
+	}
+
+	time.Sleep(50 * time.Millisecond)
+	count := factory.clients["node1:9999"].count("MutationTopicRequest")
+	time.Sleep(200 * time.Millisecond)
+	if factory.clients["node1:9999"].count("MutationTopicRequest") != count {
+		t.Fatalf("Expect the batch to stop retrying after it is cancelled")
+	}
+}
+
+func TestBatchAddIndexesToStreamJoinAfterCancel(t *testing.T) {
+
+	env, factory := newMockProjectorCluster("node1:9999")
+	recordTopics(factory)
+	client := factory.clients["node1:9999"]
+	admin := NewProjectorAdmin(factory, env, nil, "")
+
+	// the only request of the batch gives up within the batching window.
+	ctx, cancel := context.WithTimeout(context.Background(), ADD_INDEX_BATCH_WINDOW/4)
+	defer cancel()
+	request := AddIndexRequest{Buckets: []string{"bucket1"}, Instances: []*protobuf.Instance{makeTestInstance(1, "idx1")}}
+	if err := admin.BatchAddIndexesToStream(ctx, common.MAINT_STREAM, []AddIndexRequest{request}); err != context.DeadlineExceeded {
+		t.Fatalf("Expect ctx error, got %v", err)
+	}
+
+	// a request arriving within the same window should not join the cancelled batch.
+	request = AddIndexRequest{Buckets: []string{"bucket1"}, Instances: []*protobuf.Instance{makeTestInstance(2, "idx2")}}
+	if err := admin.BatchAddIndexesToStream(context.Background(), common.MAINT_STREAM, []AddIndexRequest{request}); err != nil {
+		t.Fatal(err)
+	}
+	if client.count("MutationTopicRequest") != 1 {
+		t.Fatalf("Expect 1 MutationTopicRequest for the new batch, got %v", client.calls)
+	}
+}
+
+func TestAddIndexToStreamPoolName(t *testing.T) {
+
+	for poolName, expected := range map[string]string{"": DEFAULT_POOL_NAME, "pool1": "pool1"} {
+		env, factory := newMockProjectorCluster("node1:9999", "node2:9999", "node3:9999")
+
+		var mutex sync.Mutex
+		pools := make(map[string]bool)
+		for _, client := range factory.clients {
+			client.initialRestartTimestamp = func(pooln, bucketn string) (*protobuf.TsVbuuid, error) {
+				mutex.Lock()
+				pools[pooln] = true
+				mutex.Unlock()
+				ts := protobuf.NewTsVbuuid(pooln, bucketn, NUM_VB)
+				for vb := 0; vb < NUM_VB; vb++ {
+					ts.Append(uint16(vb), uint64(0), uint64(1234), uint64(0), uint64(0))
+				}
+				return ts, nil
+			}
+		}
+
+		admin := NewProjectorAdmin(factory, env, nil, poolName)
+		instances := []*protobuf.Instance{makeTestInstance(1, "idx1")}
+		if err := admin.AddIndexToStream(common.MAINT_STREAM, []string{"bucket1"}, instances, nil); err != nil {
+			t.Fatalf("Expect instance to be added to stream in pool %v, got %v", expected, err)
+		}
+		if len(pools) != 1 || !pools[expected] {
+			t.Fatalf("Expect restart timestamp from pool %v, got %v", expected, pools)
+		}
+	}
+}
+
+func TestActivatingVbCount(t *testing.T) {
+
+	// a bucket without request timestamp activates all vbuckets
+	if count := activatingVbCount([]string{"bucket1"}, nil); count != NUM_VB {
+		t.Fatalf("Expect %v vbuckets, got %v", NUM_VB, count)
+	}
+
+	// a restart timestamp activates only the vbuckets being restarted
+	ts := common.NewTsVbuuid("bucket2", NUM_VB)
+	ts.Seqnos[0], ts.Vbuuids[0] = 10, 1234
+	ts.Vbuuids[3] = 5678
+	ts.Seqnos[7], ts.Vbuuids[7] = 20, 9012
+	count := activatingVbCount([]string{"bucket1", "bucket2"}, []*common.TsVbuuid{ts})
+	if count != NUM_VB+3 {
+		t.Fatalf("Expect %v vbuckets, got %v", NUM_VB+3, count)
+	}
+
+	// the partial timestamp weighs less than a full bucket
+	c := NewStreamAdmissionController(2)
+	full, err := c.Acquire(context.Background(), activatingVbCount([]string{"bucket1"}, nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+	partial, err := c.Acquire(context.Background(), activatingVbCount([]string{"bucket2"}, []*common.TsVbuuid{ts}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if partial != 3 || partial >= full {
+		t.Fatalf("Expect partial timestamp to weigh 3 tokens, less than %v, got %v", full, partial)
+	}
+	c.Release(full)
+	c.Release(partial)
+}
+
+func TestAddIndexToStreamPreflightPing(t *testing.T) {
+
+	servers := []string{"node1:9999", "node2:9999", "node3:9999"}
+	instances := []*protobuf.Instance{makeTestInstance(1, "idx1")}
+
+	// all projectors are up
+	env, factory := newMockProjectorCluster(servers...)
+	admin := NewProjectorAdmin(factory, env, nil, "")
+	admin.PreflightPing = true
+	if err := admin.AddIndexToStream(common.MAINT_STREAM, []string{"bucket1"}, instances, nil); err != nil {
+		t.Fatalf("Expect instance to be added to stream, got %v", err)
+	}
+	for _, server := range servers {
+		if count := factory.clients[server].count("Ping"); count != 1 {
+			t.Fatalf("Expect node %v to be pinged once, got %v", server, count)
+		}
+	}
+
+	// a projector is down
+	env, factory = newMockProjectorCluster(servers...)
+	factory.clients["node2:9999"].ping = func() error {
+		return errors.New("dial tcp node2:9999: connection refused")
+	}
+	admin = NewProjectorAdmin(factory, env, nil, "")
+	admin.PreflightPing = true
+	err := admin.AddIndexToStream(common.MAINT_STREAM, []string{"bucket1"}, instances, nil)
+	if e, ok := AsStreamError(err); !ok || e.code != ERROR_STREAM_PROJECTOR_UNREACHABLE || e.node != "node2:9999" {
+		t.Fatalf("Expect projector on node2 to be unreachable, got %v", err)
+	}
+	for _, server := range servers {
+		if count := factory.clients[server].count("MutationTopicRequest"); count != 0 {
+			t.Fatalf("Expect no request to node %v, got %v", server, count)
+		}
+	}
+
+	// an older projector does not support the ping
+	env, factory = newMockProjectorCluster(servers...)
+	factory.clients["node2:9999"].ping = func() error {
+		return fmt.Errorf("%v, path not found", ap.ErrorRequest)
+	}
+	admin = NewProjectorAdmin(factory, env, nil, "")
+	admin.PreflightPing = true
+	if err := admin.AddIndexToStream(common.MAINT_STREAM, []string{"bucket1"}, instances, nil); err != nil {
+		t.Fatalf("Expect older projector to be reachable, got %v", err)
+	}
+	if count := factory.clients["node2:9999"].count("MutationTopicRequest"); count != 1 {
+		t.Fatalf("Expect request to older projector, got %v", count)
+	}
+
+	// a projector does not respond
+	saved := PROJECTOR_PING_TIMEOUT
+	PROJECTOR_PING_TIMEOUT = 10 * time.Millisecond
+	defer func() { PROJECTOR_PING_TIMEOUT = saved }()
+
+	donech := make(chan bool)
+	defer close(donech)
+	env, factory = newMockProjectorCluster(servers...)
+	factory.clients["node3:9999"].ping = func() error {
+		<-donech
+		return nil
+	}
+	admin = NewProjectorAdmin(factory, env, nil, "")
+	admin.PreflightPing = true
+	err = admin.AddIndexToStream(common.MAINT_STREAM, []string{"bucket1"}, instances, nil)
+	if e, ok := AsStreamError(err); !ok || e.code != ERROR_STREAM_PROJECTOR_UNREACHABLE || e.node != "node3:9999" {
+		t.Fatalf("Expect projector on node3 to time out, got %v", err)
+	}
+
+	// no ping unless enabled
+	env, factory = newMockProjectorCluster(servers...)
+	admin = NewProjectorAdmin(factory, env, nil, "")
+	if err := admin.AddIndexToStream(common.MAINT_STREAM, []string{"bucket1"}, instances, nil); err != nil {
+		t.Fatalf("Expect instance to be added to stream, got %v", err)
+	}
+	if count := factory.clients["node1:9999"].count("Ping"); count != 0 {
+		t.Fatalf("Expect no ping, got %v", count)
+	}
+}
+
+func TestDeleteIndexFromStreamTopicMissing(t *testing.T) {
+
+	servers := []string{"node1:9999", "node2:9999", "node3:9999"}
+	env, factory := newMockProjectorCluster(servers...)
+	factory.clients["node2:9999"].delInstances = func(topic string, uuids []uint64, version uint64) error {
+		return projectorC.ErrorTopicMissing
+	}
+
+	admin := NewProjectorAdmin(factory, env, nil, "")
+	instances := []*protobuf.Instance{makeTestInstance(1, "idx1")}
+	if err := admin.AddIndexToStream(common.MAINT_STREAM, []string{"bucket1"}, instances, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := admin.DeleteIndexFromStream(common.MAINT_STREAM, map[string][]uint64{"bucket1": []uint64{1}}); err != nil {
+		t.Fatalf("Expect missing topic to be treated as success, got %v", err)
+	}
+	for _, server := range servers {
+		if count := factory.clients[server].count("DelInstances"); count != 1 {
+			t.Fatalf("Expect a single delete request to %v, got %v", server, count)
+		}
+	}
+	if len(admin.filterActiveInstances(common.MAINT_STREAM, instances)) != 1 {
+		t.Fatalf("Expect instance not to be active after it is deleted")
+	}
+}
+
+func TestStreamAdminNoClient(t *testing.T) {
+
+	// the factory returns nil client for node2.
+	env, factory := newMockProjectorCluster("node1:9999", "node2:9999")
+	delete(factory.clients, "node2:9999")
+	admin := NewProjectorAdmin(factory, env, nil, "")
+
+	ts := common.NewTsVbuuid("bucket1", NUM_VB)
+	for vb := 0; vb < NUM_VB; vb++ {
+		ts.Seqnos[vb] = uint64(vb + 1)
+		ts.Vbuuids[vb] = uint64(1234)
+	}
+
+	requests := map[string]func() error{
+		"MutationTopicRequest": func() error {
+			instances := []*protobuf.Instance{makeTestInstance(1, "idx1")}
+			return admin.AddIndexToStream(common.MAINT_STREAM, []string{"bucket1"}, instances, nil)
+		},
+		"DelInstances": func() error {
+			return admin.DeleteIndexFromStream(common.MAINT_STREAM, map[string][]uint64{"bucket1": []uint64{1}})
+		},
+		"RepairEndpoints": func() error {
+			return admin.RepairEndpointForStream(common.MAINT_STREAM, map[string][]uint16{"bucket1": []uint16{0}}, "127.0.0.1:9999")
+		},
+		"RestartVbuckets": func() error {
+			return admin.RestartStreamIfNecessary(common.MAINT_STREAM, []*common.TsVbuuid{ts})
+		},
+	}
+	for op, request := range requests {
+		err := request()
+		if e, ok := AsStreamError(err); !ok || e.code != ERROR_STREAM_PROJECTOR_UNREACHABLE || e.op != op || e.node != "node2:9999" {
+			t.Fatalf("Expect %v to fail for the node without client, got %v", op, err)
+		}
+	}
+}
+
+// net.Error that is temporary
+type netErrorTimeout struct {
+}
+
+func (e *netErrorTimeout) Error() string   { return "i/o timeout" }
+func (e *netErrorTimeout) Timeout() bool   { return true }
+func (e *netErrorTimeout) Temporary() bool { return true }
+
+//
+// A permanent network error (DNS failure, connection refused) fails the request
+// without retry, while a temporary one is retried.
+//
+func TestDeleteAndRepairNetError(t *testing.T) {
+
+	dnsErr := &url.Error{
+		Op:  "Post",
+		URL: "http://unknown:9999/adminport/delInstancesRequest",
+		Err: &net.OpError{Op: "dial", Net: "tcp", Err: &net.DNSError{Err: "no such host", Name: "unknown"}},
+	}
+	refusedErr := &url.Error{
+		Op:  "Post",
+		URL: "http://127.0.0.1:9999/adminport/delInstancesRequest",
+		Err: &net.OpError{Op: "dial", Net: "tcp", Err: os.NewSyscallError("connect", syscall.ECONNREFUSED)},
+	}
+	timeoutErr := &url.Error{
+		Op:  "Post",
+		URL: "http://127.0.0.1:9999/adminport/delInstancesRequest",
+		Err: new(netErrorTimeout),
+	}
+
+	// return the errors in order, then nil
+	run := func(errs []error, op string) (int, error) {
+		env, factory := newMockProjectorCluster("node1:9999")
+		client := factory.clients["node1:9999"]
+		var mutex sync.Mutex
+		calls := 0
+		next := func() error {
+			mutex.Lock()
+			defer mutex.Unlock()
+			calls++
+			if calls <= len(errs) {
+				return errs[calls-1]
+			}
+			return nil
+		}
+		client.delInstances = func(topic string, uuids []uint64, version uint64) error { return next() }
+		client.repairEndpoints = func(topic string, endpoints []string) error { return next() }
+
+		admin := NewProjectorAdmin(factory, env, nil, "")
+		var err error
+		if op == "DelInstances" {
+			err = admin.DeleteIndexFromStream(common.MAINT_STREAM, map[string][]uint64{"bucket1": []uint64{600}})
+		} else {
+			err = admin.RepairEndpointForStream(common.MAINT_STREAM, map[string][]uint16{"bucket1": []uint16{0}}, "127.0.0.1:9999")
+		}
+		return client.count(op), err
+	}
+
+	for _, op := range []string{"DelInstances", "RepairEndpoints"} {
+		for _, permanent := range []error{dnsErr, refusedErr} {
+			if calls, err := run([]error{permanent}, op); err == nil || calls != 1 {
+				t.Fatalf("Expect %v to fail without retry for %v, got %v calls (error=%v)", op, permanent, calls, err)
+			}
+		}
+		if calls, err := run([]error{timeoutErr, timeoutErr}, op); err != nil || calls != 3 {
+			t.Fatalf("Expect %v to be retried on timeout, got %v calls (error=%v)", op, calls, err)
+		}
+	}
+}
+
+func TestAddIndexToStream_Failover(t *testing.T) {
+
+	nodeA, nodeB := "node1:9999", "node2:9999"
+	env, factory := newMockProjectorCluster(nodeA, nodeB)
+
+	// node A owns vb 0-511 and node B owns vb 512-1023 before rebalance.
+	vbmap := make(map[string][]uint16)
+	for vb := 0; vb < NUM_VB; vb++ {
+		if vb < NUM_VB/2 {
+			vbmap[nodeA] = append(vbmap[nodeA], uint16(vb))
+		}
+		vbmap[nodeB] = append(vbmap[nodeB], uint16(vb))
+	}
+	env.setVBMap(map[string][]uint16{nodeA: vbmap[nodeA], nodeB: vbmap[nodeB][NUM_VB/2:]})
+
+	// the vbmap is updated, once the request is sent with the vbmap before rebalance.
+	calls := 0
+	env.getNodeListForBuckets = func(buckets []string) (map[string]string, error) {
+		calls++
+		if calls == 2 {
+			env.setVBMap(map[string][]uint16{nodeB: vbmap[nodeB]})
+		}
+		nodes := make(map[string]string)
+		for node := range env.getVBMap() {
+			nodes[node] = node
+		}
+		return nodes, nil
+	}
+
+	// vbuckets of node A have moved to node B.  Node A responds after node B, so
+	// that node B is not contacted by a worker of the failed attempt.
+	respondedB := make(chan bool)
+	factory.clients[nodeA].mutationTopicRequest = func(topic, endpointType string, reqTimestamps []*protobuf.TsVbuuid,
+		instances []*protobuf.Instance) (*protobuf.TopicResponse, error) {
+
+		<-respondedB
+		return nil, projectorC.ErrorNotMyVbucket
+	}
+
+	// latest active timestamps returned by node B.
+	var once sync.Once
+	var active []*protobuf.TsVbuuid
+	factory.clients[nodeB].mutationTopicRequest = func(topic, endpointType string, reqTimestamps []*protobuf.TsVbuuid,
+		instances []*protobuf.Instance) (*protobuf.TopicResponse, error) {
+
+		active = reqTimestamps
+		once.Do(func() { close(respondedB) })
+		return &protobuf.TopicResponse{ActiveTimestamps: reqTimestamps}, nil
+	}
+
+	admin := NewProjectorAdmin(factory, env, nil, "")
+	instances := []*protobuf.Instance{makeTestInstance(1, "idx1")}
+	if err := admin.AddIndexToStream(common.MAINT_STREAM, []string{"bucket1"}, instances, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	if calls < 2 {
+		t.Fatalf("Expect the node list to be refreshed after failover, got %v calls", calls)
+	}
+	if count := factory.clients[nodeA].count("MutationTopicRequest"); count != 1 {
+		t.Fatalf("Expect node A not to be contacted after failover, got %v requests", count)
+	}
+
+	counts := make(map[uint32]int)
+	for _, ts := range active {
+		for _, vbno := range ts.GetVbnos() {
+			counts[vbno]++
+		}
+	}
+	for vb := 0; vb < NUM_VB; vb++ {
+		if counts[uint32(vb)] != 1 {
+			t.Fatalf("Expect a single active timestamp for vb %v, got %v", vb, counts[uint32(vb)])
+		}
+	}
+}
+
+func TestRestartStreamIfNecessaryInconsistentVbmap(t *testing.T) {
+
+	env, factory := newMockProjectorCluster("node1:9999", "node2:9999")
+
+	ts := common.NewTsVbuuid("bucket1", NUM_VB)
+	for vb := 0; vb < 4; vb++ {
+		ts.Seqnos[vb] = uint64(vb + 1)
+		ts.Vbuuids[vb] = uint64(1234)
+	}
+
+	// vb 3 is missing from the vbmap on the first attempt, e.g. during rebalance.
+	var requests [][]*common.TsVbuuid
+	env.getPartialNodeListForTimestamps = func(timestamps []*common.TsVbuuid) (
+		map[string][]*protobuf.TsVbuuid, []*common.TsVbuuid, error) {
+
+		requests = append(requests, timestamps)
+		vbmap := env.vbmap
+		if len(requests) == 1 {
+			vbmap = map[string][]uint16{"node1:9999": []uint16{0, 2}, "node2:9999": []uint16{1}}
+		}
+		nodes, unlocated := locateTestTimestamps(vbmap, timestamps)
+		return nodes, unlocated, nil
+	}
+
+	admin := NewProjectorAdmin(factory, env, nil, "")
+	if err := admin.RestartStreamIfNecessary(common.MAINT_STREAM, []*common.TsVbuuid{ts}); err != nil {
+		t.Fatal(err)
+	}
+	if len(requests) != 2 {
+		t.Fatalf("Expect unlocated vbucket to be retried, got %v attempts", len(requests))
+	}
+	if retry := requests[1][0]; retry.Seqnos[3] != 4 || retry.Seqnos[0] != 0 {
+		t.Fatalf("Expect only vb 3 to be retried, got %v", retry)
+	}
+	if count := factory.clients["node2:9999"].count("RestartVbuckets"); count != 2 {
+		t.Fatalf("Expect node2 to restart vbuckets in both attempts, got %v", count)
+	}
+
+	// vbmap that cannot be refreshed is returned to the caller.
+	env.getPartialNodeListForTimestamps = func(timestamps []*common.TsVbuuid) (
+		map[string][]*protobuf.TsVbuuid, []*common.TsVbuuid, error) {
+
+		return nil, nil, enrichError(NewError2(ERROR_STREAM_INCONSISTENT_VBMAP, STREAM), "GetNodeListForTimestamps", "bucket1", "")
+	}
+	err := admin.RestartStreamIfNecessary(common.MAINT_STREAM, []*common.TsVbuuid{ts})
+	if e, ok := AsStreamError(err); !ok || e.code != ERROR_STREAM_INCONSISTENT_VBMAP {
+		t.Fatalf("Expect inconsistent vbmap error, got %v", err)
+	}
+}
+
+func TestRestartStreamIfNecessaryFlappingVbmap(t *testing.T) {
+
+	env, factory := newMockProjectorCluster("node1:9999", "node2:9999")
+
+	ts := common.NewTsVbuuid("bucket1", NUM_VB)
+	ts.Seqnos[0], ts.Vbuuids[0] = 1, 1234
+
+	// vb 0 flaps between the nodes on every attempt, and the node that it is
+	// sent to no longer owns it.
+	attempts := 0
+	env.getPartialNodeListForTimestamps = func(timestamps []*common.TsVbuuid) (
+		map[string][]*protobuf.TsVbuuid, []*common.TsVbuuid, error) {
+
+		attempts++
+		vbmap := map[string][]uint16{"node1:9999": []uint16{0}}
+		if attempts%2 == 0 {
+			vbmap = map[string][]uint16{"node2:9999": []uint16{0}}
+		}
+		nodes, unlocated := locateTestTimestamps(vbmap, timestamps)
+		return nodes, unlocated, nil
+	}
+	notMyVbucket := func(topic string, restartTimestamps []*protobuf.TsVbuuid) (*protobuf.TopicResponse, error) {
+		return nil, projectorC.ErrorNotMyVbucket
+	}
+	factory.clients["node1:9999"].restartVbuckets = notMyVbucket
+	factory.clients["node2:9999"].restartVbuckets = notMyVbucket
+
+	admin := NewProjectorAdmin(factory, env, nil, "")
+	err := admin.RestartStreamIfNecessary(common.MAINT_STREAM, []*common.TsVbuuid{ts})
+	if e, ok := AsStreamError(err); !ok || e.code != ERROR_STREAM_INCONSISTENT_VBMAP {
+		t.Fatalf("Expect flapping vbmap to fail the request, got %v", err)
+	}
+	if attempts != MAX_VBMAP_CHANGE_RETRIES+2 {
+		t.Fatalf("Expect %v attempts, got %v", MAX_VBMAP_CHANGE_RETRIES+2, attempts)
+	}
+}
+
+func TestRestartStreamIfNecessaryUnlocatedBackoff(t *testing.T) {
+
+	savedInterval, savedMax := UNLOCATED_VB_RETRY_INTERVAL, MAX_UNLOCATED_VB_RETRY_INTERVAL
+	UNLOCATED_VB_RETRY_INTERVAL = 20 * time.Millisecond
+	MAX_UNLOCATED_VB_RETRY_INTERVAL = 30 * time.Millisecond
+	defer func() {
+		UNLOCATED_VB_RETRY_INTERVAL, MAX_UNLOCATED_VB_RETRY_INTERVAL = savedInterval, savedMax
+	}()
+
+	env, factory := newMockProjectorCluster("node1:9999", "node2:9999")
+
+	ts := common.NewTsVbuuid("bucket1", NUM_VB)
+	ts.Seqnos[0], ts.Vbuuids[0] = 1, 1234
+
+	// vb 0 has no owner for the first 3 attempts.
+	var attempts []time.Time
+	env.getPartialNodeListForTimestamps = func(timestamps []*common.TsVbuuid) (
+		map[string][]*protobuf.TsVbuuid, []*common.TsVbuuid, error) {
+
+		attempts = append(attempts, time.Now())
+		vbmap := env.vbmap
+		if len(attempts) <= 3 {
+			vbmap = map[string][]uint16{}
+		}
+		nodes, unlocated := locateTestTimestamps(vbmap, timestamps)
+		return nodes, unlocated, nil
+	}
+
+	admin := NewProjectorAdmin(factory, env, nil, "")
+	if err := admin.RestartStreamIfNecessary(common.MAINT_STREAM, []*common.TsVbuuid{ts}); err != nil {
+		t.Fatal(err)
+	}
+	if len(attempts) != 4 {
+		t.Fatalf("Expect 4 attempts, got %v", len(attempts))
+	}
+	for i, expected := range []time.Duration{20, 30, 30} {
+		if gap := attempts[i+1].Sub(attempts[i]); gap < expected*time.Millisecond {
+			t.Fatalf("Expect retry %v to back off for %vms, got %v", i+1, expected, gap)
+		}
+	}
+}
+
+func TestRestartStreamIfNecessaryUnlocatedExhausted(t *testing.T) {
+
+	savedInterval, savedMax, savedRetries := UNLOCATED_VB_RETRY_INTERVAL, MAX_UNLOCATED_VB_RETRY_INTERVAL, MAX_UNLOCATED_VB_RETRIES
+	UNLOCATED_VB_RETRY_INTERVAL = time.Millisecond
+	MAX_UNLOCATED_VB_RETRY_INTERVAL = time.Millisecond
+	MAX_UNLOCATED_VB_RETRIES = 3
+	defer func() {
+		UNLOCATED_VB_RETRY_INTERVAL, MAX_UNLOCATED_VB_RETRY_INTERVAL, MAX_UNLOCATED_VB_RETRIES =
+			savedInterval, savedMax, savedRetries
+	}()
+
+	env, factory := newMockProjectorCluster("node1:9999", "node2:9999")
+
+	ts := common.NewTsVbuuid("bucket1", NUM_VB)
+	ts.Seqnos[0], ts.Vbuuids[0] = 1, 1234
+	ts.Seqnos[5], ts.Vbuuids[5] = 1, 5678
+
+	// vb 5 never has an owner (e.g. bucket deleted).
+	attempts := 0
+	env.getPartialNodeListForTimestamps = func(timestamps []*common.TsVbuuid) (
+		map[string][]*protobuf.TsVbuuid, []*common.TsVbuuid, error) {
+
+		attempts++
+		vbmap := make(map[string][]uint16)
+		for node, vbnos := range env.vbmap {
+			for _, vbno := range vbnos {
+				if vbno != 5 {
+					vbmap[node] = append(vbmap[node], vbno)
+				}
+			}
+		}
+		nodes, unlocated := locateTestTimestamps(vbmap, timestamps)
+		return nodes, unlocated, nil
+	}
+
+	admin := NewProjectorAdmin(factory, env, nil, "")
+	err := admin.RestartStreamIfNecessary(common.MAINT_STREAM, []*common.TsVbuuid{ts})
+	e, ok := AsStreamError(err)
+	if !ok || e.code != ERROR_STREAM_INCONSISTENT_VBMAP {
+		t.Fatalf("Expect unlocated vbucket to fail the request, got %v", err)
+	}
+	if !strings.Contains(e.Error(), "bucket1:[5]") {
+		t.Fatalf("Expect error to name the unlocated vbucket, got %v", e)
+	}
+	if attempts != MAX_UNLOCATED_VB_RETRIES+1 {
+		t.Fatalf("Expect %v attempts, got %v", MAX_UNLOCATED_VB_RETRIES+1, attempts)
+	}
+}
+
+//
+// Fan-out of AddIndexToStream to 64 projector nodes, each of which owns a contiguous
+// range of vbuckets.
+//
+func BenchmarkAddIndexToStream(b *testing.B) {
+
+	const numNodes = 64
+
+	env := &MockProjectorClientEnv{vbmap: make(map[string][]uint16)}
+	factory := &mockProjectorStreamClientFactory{clients: make(map[string]*MockProjectorStreamClient)}
+	for vb := 0; vb < NUM_VB; vb++ {
+		server := fmt.Sprintf("127.0.0.%d:9999", vb*numNodes/NUM_VB+1)
+		env.vbmap[server] = append(env.vbmap[server], uint16(vb))
+	}
+	for server := range env.vbmap {
+		factory.clients[server] = &MockProjectorStreamClient{}
+	}
+
+	for _, numInstances := range []int{1, 10, 100} {
+		instances := make([]*protobuf.Instance, 0, numInstances)
+		for i := 0; i < numInstances; i++ {
+			instances = append(instances, makeTestInstance(uint64(i+1), fmt.Sprintf("idx%d", i+1)))
+		}
+
+		b.Run(fmt.Sprintf("instances=%d", numInstances), func(b *testing.B) {
+			b.ReportAllocs()
+			for i := 0; i < b.N; i++ {
+				// a new admin for each iteration, so that the instances are not active yet.
+				admin := NewProjectorAdmin(factory, env, nil, "")
+				if err := admin.AddIndexToStream(common.MAINT_STREAM, []string{"bucket1"}, instances, nil); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
+
+// ChaosConfig controls the faults injected by ChaosProjectorStreamClient.
+type ChaosConfig struct {
+	ErrorRate  float64       // probability of a call to fail, from 0 to 1
+	MinLatency time.Duration // latency added to every call
+	MaxLatency time.Duration
+	// errors injected, as returned by projector (e.g. "feed.notMyVbucket").
+	// If empty, projectorC.ErrorResponseTimeout is injected.
+	ErrorTypes []string
+}
+
+// ChaosProjectorStreamClient wraps MockProjectorStreamClient, and injects faults
+// to simulate network partition.  A call that fails is either dropped before it
+// reaches the projector, or its response is dropped after the projector has
+// handled it.
+type ChaosProjectorStreamClient struct {
+	client *MockProjectorStreamClient
+	config ChaosConfig
+
+	mutex sync.Mutex
+	rnd   *rand.Rand
+}
+
+func NewChaosProjectorStreamClient(client *MockProjectorStreamClient, config ChaosConfig,
+	seed int64) *ChaosProjectorStreamClient {
+
+	return &ChaosProjectorStreamClient{
+		client: client,
+		config: config,
+		rnd:    rand.New(rand.NewSource(seed))}
+}
+
+//
+// Delay the call by a random latency, and decide whether to fail the call.  The
+// call is sent to the wrapped client only if send is true.  If err is not nil,
+// the caller shall return err instead of the response of the wrapped client.
+//
+func (c *ChaosProjectorStreamClient) chaos() (send bool, err error) {
+
+	c.mutex.Lock()
+	latency := c.config.MinLatency
+	if c.config.MaxLatency > c.config.MinLatency {
+		latency += time.Duration(c.rnd.Int63n(int64(c.config.MaxLatency - c.config.MinLatency)))
+	}
+	send = true
+	if c.rnd.Float64() < c.config.ErrorRate {
+		err = projectorC.ErrorResponseTimeout
+		if len(c.config.ErrorTypes) != 0 {
+			err = errors.New(c.config.ErrorTypes[c.rnd.Intn(len(c.config.ErrorTypes))])
+		}
+		send = c.rnd.Intn(2) == 0
+	}
+	c.mutex.Unlock()
+
+	time.Sleep(latency)
+	return send, err
+}
+
+func (c *ChaosProjectorStreamClient) MutationTopicRequest(topic, endpointType string, reqTimestamps []*protobuf.TsVbuuid,
+	instances []*protobuf.Instance) (*protobuf.TopicResponse, error) {
+
+	send, err := c.chaos()
+	if send {
+		response, rerr := c.client.MutationTopicRequest(topic, endpointType, reqTimestamps, instances)
+		if err == nil {
+			return response, rerr
+		}
+	}
+	return nil, err
+}
+
+func (c *ChaosProjectorStreamClient) AddInstances(topic string, instances []*protobuf.Instance) (*protobuf.TimestampResponse, error) {
+
+	send, err := c.chaos()
+	if send {
+		response, rerr := c.client.AddInstances(topic, instances)
+		if err == nil {
+			return response, rerr
+		}
+	}
+	return nil, err
+}
+
+func (c *ChaosProjectorStreamClient) DelInstances(topic string, uuids []uint64, version uint64) error {
+
+	send, err := c.chaos()
+	if send {
+		rerr := c.client.DelInstances(topic, uuids, version)
+		if err == nil {
+			return rerr
+		}
+	}
+	return err
+}
+
+func (c *ChaosProjectorStreamClient) RepairEndpoints(topic string, endpoints []string) error {
+
+	send, err := c.chaos()
+	if send {
+		rerr := c.client.RepairEndpoints(topic, endpoints)
+		if err == nil {
+			return rerr
+		}
+	}
+	return err
+}
+
+func (c *ChaosProjectorStreamClient) InitialRestartTimestamp(pooln, bucketn string) (*protobuf.TsVbuuid, error) {
+
+	send, err := c.chaos()
+	if send {
+		ts, rerr := c.client.InitialRestartTimestamp(pooln, bucketn)
+		if err == nil {
+			return ts, rerr
+		}
+	}
+	return nil, err
+}
+
+func (c *ChaosProjectorStreamClient) RestartVbuckets(topic string, restartTimestamps []*protobuf.TsVbuuid) (*protobuf.TopicResponse, error) {
+
+	send, err := c.chaos()
+	if send {
+		response, rerr := c.client.RestartVbuckets(topic, restartTimestamps)
+		if err == nil {
+			return response, rerr
+		}
+	}
+	return nil, err
+}
+
+func (c *ChaosProjectorStreamClient) GetActiveTopics() ([]string, error) {
+
+	send, err := c.chaos()
+	if send {
+		topics, rerr := c.client.GetActiveTopics()
+		if err == nil {
+			return topics, rerr
+		}
+	}
+	return nil, err
+}
+
+func (c *ChaosProjectorStreamClient) GetFailoverLogs(pooln, bucketn string, vbnos []uint32) (*protobuf.FailoverLogResponse, error) {
+
+	send, err := c.chaos()
+	if send {
+		response, rerr := c.client.GetFailoverLogs(pooln, bucketn, vbnos)
+		if err == nil {
+			return response, rerr
+		}
+	}
+	return nil, err
+}
+
+func (c *ChaosProjectorStreamClient) Ping() error {
+
+	send, err := c.chaos()
+	if send {
+		rerr := c.client.Ping()
+		if err == nil {
+			return rerr
+		}
+	}
+	return err
+}
+
+// implement ProjectorStreamClientFactory with a chaos client for each node
+type chaosProjectorStreamClientFactory struct {
+	clients map[string]*ChaosProjectorStreamClient
+}
+
+func (p *chaosProjectorStreamClientFactory) GetClientForNode(server string) ProjectorStreamClient {
+	if client, ok := p.clients[server]; ok {
+		return client
+	}
+	return nil
+}
+
+func (p *chaosProjectorStreamClientFactory) CloseClientForNode(server string) {
+}
+
+// Create a mock cluster of the given nodes, where every projector injects faults.
+func newChaosProjectorCluster(config ChaosConfig, seed int64,
+	servers ...string) (*MockProjectorClientEnv, *chaosProjectorStreamClientFactory) {
+
+	env, mockFactory := newMockProjectorCluster(servers...)
+	factory := &chaosProjectorStreamClientFactory{clients: make(map[string]*ChaosProjectorStreamClient)}
+	for i, server := range servers {
+		factory.clients[server] = NewChaosProjectorStreamClient(mockFactory.clients[server], config, seed+int64(i))
+	}
+	return env, factory
+}
+
+// request timestamp of all the vbuckets, so that the restart timestamp is not
+// fetched from projector.
+func makeChaosRequestTimestamps(bucket string) []*common.TsVbuuid {
+	ts := common.NewTsVbuuid(bucket, NUM_VB)
+	for vb := 0; vb < NUM_VB; vb++ {
+		ts.Seqnos[vb] = uint64(vb + 1)
+		ts.Vbuuids[vb] = uint64(1234)
+	}
+	return []*common.TsVbuuid{ts}
+}
+
+func TestChaosRecoverableErrors(t *testing.T) {
+
+	config := ChaosConfig{
+		ErrorRate:  0.3,
+		MinLatency: time.Millisecond,
+		MaxLatency: 5 * time.Millisecond,
+		ErrorTypes: []string{
+			projectorC.ErrorStreamRequest.Error(),
+			projectorC.ErrorResponseTimeout.Error(),
+			projectorC.ErrorFeeder.Error(),
+			projectorC.ErrorNotMyVbucket.Error(),
+			"connection reset by peer",
+		},
+	}
+
+	for seed := int64(1); seed <= 5; seed++ {
+		env, factory := newChaosProjectorCluster(config, seed*10, "node1:9999", "node2:9999", "node3:9999")
+		admin := NewProjectorAdmin(factory, env, nil, "")
+		instances := []*protobuf.Instance{makeTestInstance(1, "idx1")}
+
+		err := admin.AddIndexToStream(common.MAINT_STREAM, []string{"bucket1"}, instances,
+			makeChaosRequestTimestamps("bucket1"))
+		if err != nil {
+			t.Fatalf("Expect AddIndexToStream to converge for seed %v, got %v", seed, err)
+		}
+
+		err = admin.DeleteIndexFromStream(common.MAINT_STREAM, map[string][]uint64{"bucket1": []uint64{1}})
+		if err != nil {
+			t.Fatalf("Expect DeleteIndexFromStream to converge for seed %v, got %v", seed, err)
+		}
+	}
+}
+
+func TestChaosNonRecoverableErrors(t *testing.T) {
+
+	config := ChaosConfig{
+		ErrorRate:  1,
+		MinLatency: time.Millisecond,
+		MaxLatency: 5 * time.Millisecond,
+		ErrorTypes: []string{
+			projectorC.ErrorStreamRequest.Error(),
+			projectorC.ErrorInconsistentFeed.Error(),
+		},
+	}
+
+	for seed := int64(1); seed <= 5; seed++ {
+		env, factory := newChaosProjectorCluster(config, seed*10, "node1:9999", "node2:9999", "node3:9999")
+		admin := NewProjectorAdmin(factory, env, nil, "")
+		instances := []*protobuf.Instance{makeTestInstance(1, "idx1")}
+
+		errch := make(chan error, 1)
+		go func() {
+			errch <- admin.AddIndexToStream(common.MAINT_STREAM, []string{"bucket1"}, instances,
+				makeChaosRequestTimestamps("bucket1"))
+		}()
+
+		select {
+		case err := <-errch:
+			if !isRecoverableError(err, ERROR_STREAM_REQUEST_ERROR) {
+				t.Fatalf("Expect inconsistent feed to fail the request for seed %v, got %v", seed, err)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("Expect AddIndexToStream to return promptly for seed %v", seed)
+		}
+	}
+}
@@ -0,0 +1,162 @@
+// Copyright (c) 2014 Couchbase, Inc.
+// Licensed under the Apache License, Version 2.0 (the "License"); you may not use this file
+// except in compliance with the License. You may obtain a copy of the License at
+//   http://www.apache.org/licenses/LICENSE-2.0
+// Unless required by applicable law or agreed to in writing, software distributed under the
+// License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND,
+// either express or implied. See the License for the specific language governing permissions
+// and limitations under the License.
+
+package manager
+
+import (
+	"container/list"
+	"context"
+	"sync"
+)
+
+/////////////////////////////////////////////////////////////////////////
+// Type Definition
+/////////////////////////////////////////////////////////////////////////
+
+//
+// StreamAdmissionController limits the number of concurrent stream setups
+// against the projectors.  Each setup acquires tokens weighted by the number
+// of vbuckets being activated, where a setup of NUM_VB vbuckets counts as one
+// stream setup.  Callers block in FIFO order while the controller is saturated.
+//
+type StreamAdmissionController struct {
+	// Maximum concurrent stream setups.  Zero or negative means unlimited.
+	MaxConcurrentStreamSetups int
+
+	inuse   int
+	waiters *list.List
+	mutex   sync.Mutex
+}
+
+type admissionWaiter struct {
+	weight int
+	ready  chan bool
+}
+
+/////////////////////////////////////////////////////////////////////////
+// Public Function
+/////////////////////////////////////////////////////////////////////////
+
+func NewStreamAdmissionController(maxConcurrentStreamSetups int) *StreamAdmissionController {
+	return &StreamAdmissionController{
+		MaxConcurrentStreamSetups: maxConcurrentStreamSetups,
+		waiters:                   list.New(),
+	}
+}
+
+//
+// Acquire tokens for activating `numVb` vbuckets, blocking until the tokens
+// are available or the context is done.  It returns the number of tokens
+// acquired, which must be given back to Release().
+//
+func (c *StreamAdmissionController) Acquire(ctx context.Context, numVb int) (int, error) {
+
+	c.mutex.Lock()
+
+	if c.waiters == nil {
+		c.waiters = list.New()
+	}
+
+	weight := c.weight(numVb)
+	if weight == 0 || (c.waiters.Len() == 0 && c.inuse+weight <= c.capacity()) {
+		c.inuse += weight
+		c.mutex.Unlock()
+		return weight, nil
+	}
+
+	waiter := &admissionWaiter{weight: weight, ready: make(chan bool)}
+	elem := c.waiters.PushBack(waiter)
+	c.mutex.Unlock()
+
+	select {
+	case <-waiter.ready:
+		return weight, nil
+
+	case <-ctx.Done():
+		c.mutex.Lock()
+		defer c.mutex.Unlock()
+
+		select {
+		case <-waiter.ready:
+			// tokens are granted while cancelling, give them back.
+			c.inuse -= weight
+		default:
+			c.waiters.Remove(elem)
+		}
+		c.notifyWaiters()
+		return 0, ctx.Err()
+	}
+}
+
+//
+// Release tokens returned by Acquire().
+//
+func (c *StreamAdmissionController) Release(weight int) {
+
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	c.inuse -= weight
+	c.notifyWaiters()
+}
+
+//
+// Number of callers waiting for admission.
+//
+func (c *StreamAdmissionController) WaitingCount() int {
+
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	if c.waiters == nil {
+		return 0
+	}
+	return c.waiters.Len()
+}
+
+/////////////////////////////////////////////////////////////////////////
+// Private Function
+/////////////////////////////////////////////////////////////////////////
+
+func (c *StreamAdmissionController) capacity() int {
+	return c.MaxConcurrentStreamSetups * NUM_VB
+}
+
+//
+// Tokens for activating `numVb` vbuckets.  A single setup larger than the
+// capacity is admitted on its own.
+//
+func (c *StreamAdmissionController) weight(numVb int) int {
+
+	if c.MaxConcurrentStreamSetups <= 0 || numVb <= 0 {
+		return 0
+	}
+	if numVb > c.capacity() {
+		return c.capacity()
+	}
+	return numVb
+}
+
+//
+// Admit waiters in FIFO order while there are enough tokens.  Caller must
+// hold the mutex.
+//
+func (c *StreamAdmissionController) notifyWaiters() {
+
+	for c.waiters.Len() != 0 {
+		elem := c.waiters.Front()
+		waiter := elem.Value.(*admissionWaiter)
+		if c.inuse+waiter.weight > c.capacity() {
+			return
+		}
+		c.inuse += waiter.weight
+		c.waiters.Remove(elem)
+		close(waiter.ready)
+	}
+}
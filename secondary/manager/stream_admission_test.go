@@ -0,0 +1,71 @@
+// Copyright (c) 2014 Couchbase, Inc.
+// Licensed under the Apache License, Version 2.0 (the "License"); you may not use this file
+// except in compliance with the License. You may obtain a copy of the License at
+//   http://www.apache.org/licenses/LICENSE-2.0
+// Unless required by applicable law or agreed to in writing, software distributed under the
+// License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND,
+// either express or implied. See the License for the specific language governing permissions
+// and limitations under the License.
+
+package manager
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func TestStreamAdmissionController(t *testing.T) {
+
+	c := NewStreamAdmissionController(2)
+
+	// a setup larger than the capacity is admitted on its own
+	tokens, err := c.Acquire(context.Background(), 3*NUM_VB)
+	if err != nil || tokens != 2*NUM_VB {
+		t.Fatalf("Unexpected tokens %v, err %v", tokens, err)
+	}
+
+	admitted := make(chan int, 2)
+	for i := 0; i < 2; i++ {
+		go func() {
+			tokens, err := c.Acquire(context.Background(), NUM_VB)
+			if err != nil {
+				t.Errorf("Unexpected error %v", err)
+			}
+			admitted <- tokens
+		}()
+	}
+	waitForWaitingCount(t, c, 2)
+
+	// a cancelled waiter gives up its place in the queue
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	if _, err := c.Acquire(ctx, NUM_VB); err != context.DeadlineExceeded {
+		t.Fatalf("Expect deadline exceeded, got %v", err)
+	}
+	waitForWaitingCount(t, c, 2)
+
+	c.Release(tokens)
+	for i := 0; i < 2; i++ {
+		c.Release(<-admitted)
+	}
+	if c.WaitingCount() != 0 || c.inuse != 0 {
+		t.Fatalf("Expect no waiter and no token in use, got %v, %v", c.WaitingCount(), c.inuse)
+	}
+
+	// no admission control
+	c = NewStreamAdmissionController(0)
+	if tokens, err := c.Acquire(context.Background(), NUM_VB); err != nil || tokens != 0 {
+		t.Fatalf("Unexpected tokens %v, err %v", tokens, err)
+	}
+}
+
+func waitForWaitingCount(t *testing.T, c *StreamAdmissionController, count int) {
+	for i := 0; i < 100; i++ {
+		if c.WaitingCount() == count {
+			return
+		}
+		time.Sleep(time.Millisecond)
+	}
+	t.Fatalf("Expect %v waiters, got %v", count, c.WaitingCount())
+}
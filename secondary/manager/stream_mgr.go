@@ -53,7 +53,7 @@ type MutationHandler interface {
 //
 type StreamAdmin interface {
 	AddIndexToStream(streamId common.StreamId, bucket []string, instances []*protobuf.Instance, requestTs []*common.TsVbuuid) error
-	DeleteIndexFromStream(streamId common.StreamId, bucket []string, instances []uint64) error
+	DeleteIndexFromStream(streamId common.StreamId, bucketInstances map[string][]uint64) error
 	RepairEndpointForStream(streamId common.StreamId, bucketVbnosMap map[string][]uint16, endpoint string) error
 	RestartStreamIfNecessary(streamId common.StreamId, timestamps []*common.TsVbuuid) error
 	Initialize(monitor *StreamMonitor)
@@ -171,7 +171,10 @@ func (s *StreamManager) StartStream(streamId common.StreamId) error {
 	}
 
 	// Create a new stream.  This will prepare the reciever to be ready for receving mutation.
-	port := getPortForStreamId(streamId)
+	port, err := getPortForStreamId(streamId)
+	if err != nil {
+		return err
+	}
 	stream, err := newStream(streamId, port, s.handler)
 	if err != nil {
 		return err
@@ -239,7 +242,10 @@ func (s *StreamManager) AddIndexForBuckets(streamId common.StreamId, buckets []s
 		s.indexMgr.getTimer().start(streamId, bucket)
 
 		// Genereate the index instance protobuf messages based on distribution topology
-		port := getPortForStreamId(streamId)
+		port, err := getPortForStreamId(streamId)
+		if err != nil {
+			return err
+		}
 		addr, err := s.getAddrForPort(port)
 		if err != nil {
 			return err
@@ -283,12 +289,16 @@ func (s *StreamManager) DeleteIndexForBuckets(streamId common.StreamId, buckets
 	}
 
 	// Genereate the index instance protobuf messages based on distribution topology
-	instances, err := GetAllDeletedIndexInstancesId(s.indexMgr, buckets)
-	if err != nil {
-		return err
+	bucketInstances := make(map[string][]uint64)
+	for _, bucket := range buckets {
+		instances, err := GetAllDeletedIndexInstancesId(s.indexMgr, []string{bucket})
+		if err != nil {
+			return err
+		}
+		bucketInstances[bucket] = instances
 	}
 
-	if err := s.admin.DeleteIndexFromStream(streamId, buckets, instances); err != nil {
+	if err := s.admin.DeleteIndexFromStream(streamId, bucketInstances); err != nil {
 		return err
 	}
 
@@ -376,7 +386,7 @@ func (s *StreamManager) removeIndexInstances(streamId common.StreamId, bucket st
 	}
 
 	// Remove those index instances from the stream
-	if err := s.admin.DeleteIndexFromStream(streamId, []string{bucket}, instances); err != nil {
+	if err := s.admin.DeleteIndexFromStream(streamId, map[string][]uint64{bucket: instances}); err != nil {
 		return err
 	}
 
@@ -709,7 +719,10 @@ func (s *StreamManager) handleAddInstances(
 	}
 
 	if len(changes) > 0 {
-		port := getPortForStreamId(streamId)
+		port, err := getPortForStreamId(streamId)
+		if err != nil {
+			return err
+		}
 		addr, err := s.getAddrForPort(port)
 		if err != nil {
 			return err
@@ -26,6 +26,7 @@ type StreamMonitor struct {
 	timer           *Timer
 	activeMap       map[common.StreamId]map[string][]bool
 	startTimestamps map[common.StreamId]map[string]*common.TsVbuuid
+	poolName        string
 	mutex           sync.Mutex
 	killch          chan (bool)
 }
@@ -34,12 +35,20 @@ type StreamMonitor struct {
 // StreamMonitor - Public Function
 /////////////////////////////////////////////////////////////////////////
 
-func NewStreamMonitor(manager *IndexManager, timer *Timer) *StreamMonitor {
+//
+// Create a StreamMonitor for the buckets of the given pool.  An empty pool name
+// defaults to DEFAULT_POOL_NAME.
+//
+func NewStreamMonitor(manager *IndexManager, timer *Timer, poolName string) *StreamMonitor {
+	if poolName == "" {
+		poolName = DEFAULT_POOL_NAME
+	}
 	return &StreamMonitor{
 		manager:         manager,
 		timer:           timer,
 		activeMap:       make(map[common.StreamId]map[string][]bool),
 		startTimestamps: make(map[common.StreamId]map[string]*common.TsVbuuid),
+		poolName:        poolName,
 		killch:          make(chan bool, 1)}
 }
 
@@ -134,6 +143,37 @@ func (m *StreamMonitor) Deactivate(streamId common.StreamId, bucket string, vb u
 	activeArr[vb] = false
 }
 
+func (m *StreamMonitor) IsActive(streamId common.StreamId, bucket string, vb uint16) bool {
+
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	return m.isActive(streamId, bucket, vb)
+}
+
+//
+// Get the latest known timestamp of the active vbuckets for each bucket of the stream.
+// The seqno is the latest from the timer, or the start timestamp if timer has none.
+//
+func (m *StreamMonitor) ActiveTimestamps(streamId common.StreamId) map[string]*protobuf.TsVbuuid {
+
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	result := make(map[string]*protobuf.TsVbuuid)
+	for bucket, startTs := range m.startTimestamps[streamId] {
+		ts := protobuf.NewTsVbuuid(m.poolName, bucket, len(startTs.Seqnos))
+		for vb := range startTs.Seqnos {
+			if m.isActive(streamId, bucket, uint16(vb)) {
+				seqno, vbuuid := m.findRestartSeqno(streamId, bucket, uint16(vb))
+				ts.Append(uint16(vb), seqno, vbuuid, seqno, seqno)
+			}
+		}
+		result[bucket] = ts
+	}
+	return result
+}
+
 /////////////////////////////////////////////////////////////////////////
 // StreamMonitor - Private Function
 /////////////////////////////////////////////////////////////////////////
@@ -221,7 +261,10 @@ func (m *StreamMonitor) repair() {
 func (m *StreamMonitor) findRestartSeqno(streamId common.StreamId, bucket string, vb uint16) (uint64, uint64) {
 
 	// First check if the timer has a timestamp.
-	currentTs := m.timer.getLatest(streamId, bucket)
+	var currentTs *common.TsVbuuid
+	if m.timer != nil {
+		currentTs = m.timer.getLatest(streamId, bucket)
+	}
 	if currentTs != nil {
 		if currentTs.Seqnos[vb] != 0 {
 			return currentTs.Seqnos[vb], currentTs.Vbuuids[vb]
@@ -40,7 +40,7 @@ func TestEventMgr(t *testing.T) {
 	logging.Infof("Start Index Manager")
 	factory := new(util.TestDefaultClientFactory)
 	env := new(util.TestDefaultClientEnv)
-	admin := manager.NewProjectorAdmin(factory, env, nil)
+	admin := manager.NewProjectorAdmin(factory, env, nil, "")
 	//mgr, err := manager.NewIndexManagerInternal(requestAddr, leaderAddr, config, admin)
 	mgr, err := manager.NewIndexManagerInternal("localhost:9886", "localhost:"+manager.COORD_MAINT_STREAM_PORT, admin, cfg)
 	if err != nil {
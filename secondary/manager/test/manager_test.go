@@ -34,7 +34,7 @@ func TestIndexManager(t *testing.T) {
 	var msgAddr = "localhost:9884"
 	factory := new(util.TestDefaultClientFactory)
 	env := new(util.TestDefaultClientEnv)
-	admin := manager.NewProjectorAdmin(factory, env, nil)
+	admin := manager.NewProjectorAdmin(factory, env, nil, "")
 	mgr, err := manager.NewIndexManagerInternal(msgAddr, "localhost:"+manager.COORD_MAINT_STREAM_PORT, admin, cfg)
 	if err != nil {
 		t.Fatal(err)
@@ -46,7 +46,7 @@ func TestMetadataProvider(t *testing.T) {
 	var httpAddr = "localhost:9885"
 	factory := new(util.TestDefaultClientFactory)
 	env := new(util.TestDefaultClientEnv)
-	admin := manager.NewProjectorAdmin(factory, env, nil)
+	admin := manager.NewProjectorAdmin(factory, env, nil, "")
 	addrPrv := util.NewFakeAddressProvider(msgAddr, httpAddr)
 	mgr, err := manager.NewIndexManagerInternal(addrPrv, admin, cfg)
 	if err != nil {
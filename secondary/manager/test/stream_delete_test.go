@@ -92,7 +92,7 @@ func runDeleteTest() {
 	factory := new(deleteTestProjectorClientFactory)
 	factory.donech = donech
 	env := new(deleteTestProjectorClientEnv)
-	admin := manager.NewProjectorAdmin(factory, env, nil)
+	admin := manager.NewProjectorAdmin(factory, env, nil, "")
 	//mgr, err := manager.NewIndexManagerInternal(requestAddr, leaderAddr, config, admin)
 	mgr, err := manager.NewIndexManagerInternal("localhost:9886", "localhost:"+manager.COORD_MAINT_STREAM_PORT, admin, cfg)
 	if err != nil {
@@ -469,7 +469,12 @@ func (c *deleteTestProjectorClient) MutationTopicRequest(topic, endpointType str
 	return response, nil
 }
 
-func (c *deleteTestProjectorClient) DelInstances(topic string, uuids []uint64) error {
+func (c *deleteTestProjectorClient) AddInstances(topic string,
+	instances []*protobuf.Instance) (*protobuf.TimestampResponse, error) {
+	return &protobuf.TimestampResponse{Topic: &topic}, nil
+}
+
+func (c *deleteTestProjectorClient) DelInstances(topic string, uuids []uint64, version uint64) error {
 
 	logging.Infof("deleteTestProjectorClient.DelInstances() for server %v", c.server)
 
@@ -499,6 +504,18 @@ func (c *deleteTestProjectorClient) RestartVbuckets(topic string,
 	return nil, nil
 }
 
+func (c *deleteTestProjectorClient) GetActiveTopics() ([]string, error) {
+	return nil, nil
+}
+
+func (c *deleteTestProjectorClient) GetFailoverLogs(pooln, bucketn string, vbnos []uint32) (*protobuf.FailoverLogResponse, error) {
+	return nil, nil
+}
+
+func (c *deleteTestProjectorClient) Ping() error {
+	return nil
+}
+
 ////////////////////////////////////////////////////////////////////////////////////////////////////
 // testProjectorClientFactory
 ////////////////////////////////////////////////////////////////////////////////////////////////////
@@ -511,6 +528,9 @@ func (p *deleteTestProjectorClientFactory) GetClientForNode(server string) manag
 	return client
 }
 
+func (p *deleteTestProjectorClientFactory) CloseClientForNode(server string) {
+}
+
 ////////////////////////////////////////////////////////////////////////////////////////////////////
 // testProjectorClientFactory
 ////////////////////////////////////////////////////////////////////////////////////////////////////
@@ -528,6 +548,11 @@ func (p *deleteTestProjectorClientEnv) GetNodeListForTimestamps(timestamps []*co
 	return nil, nil
 }
 
+func (p *deleteTestProjectorClientEnv) GetPartialNodeListForTimestamps(timestamps []*common.TsVbuuid) (map[string][]*protobuf.TsVbuuid, []*common.TsVbuuid, error) {
+	nodes, err := p.GetNodeListForTimestamps(timestamps)
+	return nodes, nil, err
+}
+
 func (p *deleteTestProjectorClientEnv) FilterTimestampsForNode(timestamps []*protobuf.TsVbuuid, node string) ([]*protobuf.TsVbuuid, error) {
 	return timestamps, nil
 }
@@ -83,7 +83,7 @@ func runStreamEndTest() {
 	factory := new(streamEndTestProjectorClientFactory)
 	factory.donech = donech
 	env := new(streamEndTestProjectorClientEnv)
-	admin := manager.NewProjectorAdmin(factory, env, nil)
+	admin := manager.NewProjectorAdmin(factory, env, nil, "")
 	//mgr, err := manager.NewIndexManagerInternal(requestAddr, leaderAddr, config, admin)
 	mgr, err := manager.NewIndexManagerInternal("localhost:9886", "localhost:"+manager.COORD_MAINT_STREAM_PORT, admin, cfg)
 	if err != nil {
@@ -294,7 +294,12 @@ func (c *streamEndTestProjectorClient) MutationTopicRequest(topic, endpointType
 	return response, nil
 }
 
-func (c *streamEndTestProjectorClient) DelInstances(topic string, uuids []uint64) error {
+func (c *streamEndTestProjectorClient) AddInstances(topic string,
+	instances []*protobuf.Instance) (*protobuf.TimestampResponse, error) {
+	return &protobuf.TimestampResponse{Topic: &topic}, nil
+}
+
+func (c *streamEndTestProjectorClient) DelInstances(topic string, uuids []uint64, version uint64) error {
 	return nil
 }
 
@@ -327,6 +332,18 @@ func (c *streamEndTestProjectorClient) RestartVbuckets(topic string,
 	return response, nil
 }
 
+func (c *streamEndTestProjectorClient) GetActiveTopics() ([]string, error) {
+	return nil, nil
+}
+
+func (c *streamEndTestProjectorClient) GetFailoverLogs(pooln, bucketn string, vbnos []uint32) (*protobuf.FailoverLogResponse, error) {
+	return nil, nil
+}
+
+func (c *streamEndTestProjectorClient) Ping() error {
+	return nil
+}
+
 ////////////////////////////////////////////////////////////////////////////////////////////////////
 // testProjectorClientFactory
 ////////////////////////////////////////////////////////////////////////////////////////////////////
@@ -338,6 +355,9 @@ func (p *streamEndTestProjectorClientFactory) GetClientForNode(server string) ma
 	return c
 }
 
+func (p *streamEndTestProjectorClientFactory) CloseClientForNode(server string) {
+}
+
 ////////////////////////////////////////////////////////////////////////////////////////////////////
 // testProjectorClientFactory
 ////////////////////////////////////////////////////////////////////////////////////////////////////
@@ -366,6 +386,11 @@ func (p *streamEndTestProjectorClientEnv) GetNodeListForTimestamps(timestamps []
 	return nodes, nil
 }
 
+func (p *streamEndTestProjectorClientEnv) GetPartialNodeListForTimestamps(timestamps []*common.TsVbuuid) (map[string][]*protobuf.TsVbuuid, []*common.TsVbuuid, error) {
+	nodes, err := p.GetNodeListForTimestamps(timestamps)
+	return nodes, nil, err
+}
+
 func (p *streamEndTestProjectorClientEnv) FilterTimestampsForNode(timestamps []*protobuf.TsVbuuid, node string) ([]*protobuf.TsVbuuid, error) {
 	return timestamps, nil
 }
@@ -96,7 +96,7 @@ func runMonitorTest() {
 	factory := new(monitorTestProjectorClientFactory)
 	factory.donech = donech
 	env := new(monitorTestProjectorClientEnv)
-	admin := manager.NewProjectorAdmin(factory, env, nil)
+	admin := manager.NewProjectorAdmin(factory, env, nil, "")
 	//mgr, err := manager.NewIndexManagerInternal(requestAddr, leaderAddr, config, admin)
 	mgr, err := manager.NewIndexManagerInternal("localhost:9886", "localhost:"+manager.COORD_MAINT_STREAM_PORT, admin, cfg)
 	if err != nil {
@@ -282,7 +282,12 @@ func (c *monitorTestProjectorClient) MutationTopicRequest(topic, endpointType st
 	}
 }
 
-func (c *monitorTestProjectorClient) DelInstances(topic string, uuids []uint64) error {
+func (c *monitorTestProjectorClient) AddInstances(topic string,
+	instances []*protobuf.Instance) (*protobuf.TimestampResponse, error) {
+	return &protobuf.TimestampResponse{Topic: &topic}, nil
+}
+
+func (c *monitorTestProjectorClient) DelInstances(topic string, uuids []uint64, version uint64) error {
 	return nil
 }
 
@@ -316,6 +321,18 @@ func (c *monitorTestProjectorClient) RestartVbuckets(topic string,
 	return response, nil
 }
 
+func (c *monitorTestProjectorClient) GetActiveTopics() ([]string, error) {
+	return nil, nil
+}
+
+func (c *monitorTestProjectorClient) GetFailoverLogs(pooln, bucketn string, vbnos []uint32) (*protobuf.FailoverLogResponse, error) {
+	return nil, nil
+}
+
+func (c *monitorTestProjectorClient) Ping() error {
+	return nil
+}
+
 ////////////////////////////////////////////////////////////////////////////////////////////////////
 // testProjectorClientFactory
 ////////////////////////////////////////////////////////////////////////////////////////////////////
@@ -327,6 +344,9 @@ func (p *monitorTestProjectorClientFactory) GetClientForNode(server string) mana
 	return c
 }
 
+func (p *monitorTestProjectorClientFactory) CloseClientForNode(server string) {
+}
+
 ////////////////////////////////////////////////////////////////////////////////////////////////////
 // testProjectorClientFactory
 ////////////////////////////////////////////////////////////////////////////////////////////////////
@@ -355,6 +375,11 @@ func (p *monitorTestProjectorClientEnv) GetNodeListForTimestamps(timestamps []*c
 	return nodes, nil
 }
 
+func (p *monitorTestProjectorClientEnv) GetPartialNodeListForTimestamps(timestamps []*common.TsVbuuid) (map[string][]*protobuf.TsVbuuid, []*common.TsVbuuid, error) {
+	nodes, err := p.GetNodeListForTimestamps(timestamps)
+	return nodes, nil, err
+}
+
 func (p *monitorTestProjectorClientEnv) FilterTimestampsForNode(timestamps []*protobuf.TsVbuuid, node string) ([]*protobuf.TsVbuuid, error) {
 	return timestamps, nil
 }
@@ -91,7 +91,7 @@ func runSyncTest() {
 	factory := new(syncTestProjectorClientFactory)
 	factory.donech = donech
 	env := new(syncTestProjectorClientEnv)
-	admin := manager.NewProjectorAdmin(factory, env, nil)
+	admin := manager.NewProjectorAdmin(factory, env, nil, "")
 	//mgr, err := manager.NewIndexManagerInternal(requestAddr, leaderAddr, config, admin)
 	mgr, err := manager.NewIndexManagerInternal("localhost:9886", "localhost:"+manager.COORD_MAINT_STREAM_PORT, admin, cfg)
 	if err != nil {
@@ -272,7 +272,12 @@ func (c *syncTestProjectorClient) MutationTopicRequest(topic, endpointType strin
 	return response, nil
 }
 
-func (c *syncTestProjectorClient) DelInstances(topic string, uuids []uint64) error {
+func (c *syncTestProjectorClient) AddInstances(topic string,
+	instances []*protobuf.Instance) (*protobuf.TimestampResponse, error) {
+	return &protobuf.TimestampResponse{Topic: &topic}, nil
+}
+
+func (c *syncTestProjectorClient) DelInstances(topic string, uuids []uint64, version uint64) error {
 	return nil
 }
 
@@ -294,6 +299,18 @@ func (c *syncTestProjectorClient) RestartVbuckets(topic string,
 	return nil, nil
 }
 
+func (c *syncTestProjectorClient) GetActiveTopics() ([]string, error) {
+	return nil, nil
+}
+
+func (c *syncTestProjectorClient) GetFailoverLogs(pooln, bucketn string, vbnos []uint32) (*protobuf.FailoverLogResponse, error) {
+	return nil, nil
+}
+
+func (c *syncTestProjectorClient) Ping() error {
+	return nil
+}
+
 ////////////////////////////////////////////////////////////////////////////////////////////////////
 // testProjectorClientFactory
 ////////////////////////////////////////////////////////////////////////////////////////////////////
@@ -305,6 +322,9 @@ func (p *syncTestProjectorClientFactory) GetClientForNode(server string) manager
 	return c
 }
 
+func (p *syncTestProjectorClientFactory) CloseClientForNode(server string) {
+}
+
 ////////////////////////////////////////////////////////////////////////////////////////////////////
 // syncTestProjectorClientFactory
 ////////////////////////////////////////////////////////////////////////////////////////////////////
@@ -323,6 +343,11 @@ func (p *syncTestProjectorClientEnv) GetNodeListForTimestamps(timestamps []*comm
 	return nil, nil
 }
 
+func (p *syncTestProjectorClientEnv) GetPartialNodeListForTimestamps(timestamps []*common.TsVbuuid) (map[string][]*protobuf.TsVbuuid, []*common.TsVbuuid, error) {
+	nodes, err := p.GetNodeListForTimestamps(timestamps)
+	return nodes, nil, err
+}
+
 func (p *syncTestProjectorClientEnv) FilterTimestampsForNode(timestamps []*protobuf.TsVbuuid, node string) ([]*protobuf.TsVbuuid, error) {
 	return timestamps, nil
 }
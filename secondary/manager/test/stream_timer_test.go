@@ -82,7 +82,7 @@ func runTimerTest() {
 	factory := new(timerTestProjectorClientFactory)
 	factory.donech = donech
 	env := new(timerTestProjectorClientEnv)
-	admin := manager.NewProjectorAdmin(factory, env, nil)
+	admin := manager.NewProjectorAdmin(factory, env, nil, "")
 	//mgr, err := manager.NewIndexManagerInternal(requestAddr, leaderAddr, config, admin)
 	mgr, err := manager.NewIndexManagerInternal("localhost:9886", "localhost:"+manager.COORD_MAINT_STREAM_PORT, admin, cfg)
 	if err != nil {
@@ -288,7 +288,12 @@ func (c *timerTestProjectorClient) MutationTopicRequest(topic, endpointType stri
 	return response, nil
 }
 
-func (c *timerTestProjectorClient) DelInstances(topic string, uuids []uint64) error {
+func (c *timerTestProjectorClient) AddInstances(topic string,
+	instances []*protobuf.Instance) (*protobuf.TimestampResponse, error) {
+	return &protobuf.TimestampResponse{Topic: &topic}, nil
+}
+
+func (c *timerTestProjectorClient) DelInstances(topic string, uuids []uint64, version uint64) error {
 	return nil
 }
 
@@ -310,6 +315,18 @@ func (c *timerTestProjectorClient) RestartVbuckets(topic string,
 	return nil, nil
 }
 
+func (c *timerTestProjectorClient) GetActiveTopics() ([]string, error) {
+	return nil, nil
+}
+
+func (c *timerTestProjectorClient) GetFailoverLogs(pooln, bucketn string, vbnos []uint32) (*protobuf.FailoverLogResponse, error) {
+	return nil, nil
+}
+
+func (c *timerTestProjectorClient) Ping() error {
+	return nil
+}
+
 ////////////////////////////////////////////////////////////////////////////////////////////////////
 // testProjectorClientFactory
 ////////////////////////////////////////////////////////////////////////////////////////////////////
@@ -321,6 +338,9 @@ func (p *timerTestProjectorClientFactory) GetClientForNode(server string) manage
 	return c
 }
 
+func (p *timerTestProjectorClientFactory) CloseClientForNode(server string) {
+}
+
 ////////////////////////////////////////////////////////////////////////////////////////////////////
 // testProjectorClientFactory
 ////////////////////////////////////////////////////////////////////////////////////////////////////
@@ -339,6 +359,11 @@ func (p *timerTestProjectorClientEnv) GetNodeListForTimestamps(timestamps []*com
 	return nil, nil
 }
 
+func (p *timerTestProjectorClientEnv) GetPartialNodeListForTimestamps(timestamps []*common.TsVbuuid) (map[string][]*protobuf.TsVbuuid, []*common.TsVbuuid, error) {
+	nodes, err := p.GetNodeListForTimestamps(timestamps)
+	return nodes, nil, err
+}
+
 func (p *timerTestProjectorClientEnv) FilterTimestampsForNode(timestamps []*protobuf.TsVbuuid, node string) ([]*protobuf.TsVbuuid, error) {
 	return timestamps, nil
 }
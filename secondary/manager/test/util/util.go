@@ -37,6 +37,9 @@ func (p *TestDefaultClientFactory) GetClientForNode(server string) manager.Proje
 	return nil
 }
 
+func (p *TestDefaultClientFactory) CloseClientForNode(server string) {
+}
+
 ////////////////////////////////////////////////////////////////////////////////////////////////////
 // testDefaultClientEnv
 ////////////////////////////////////////////////////////////////////////////////////////////////////
@@ -66,6 +69,11 @@ func (p *TestDefaultClientEnv) GetNodeListForTimestamps(timestamps []*common.TsV
 	return nodes, nil
 }
 
+func (p *TestDefaultClientEnv) GetPartialNodeListForTimestamps(timestamps []*common.TsVbuuid) (map[string][]*protobuf.TsVbuuid, []*common.TsVbuuid, error) {
+	nodes, err := p.GetNodeListForTimestamps(timestamps)
+	return nodes, nil, err
+}
+
 func (p *TestDefaultClientEnv) FilterTimestampsForNode(timestamps []*protobuf.TsVbuuid, node string) ([]*protobuf.TsVbuuid, error) {
 	return timestamps, nil
 }
@@ -42,6 +42,7 @@ type Timer struct {
 	tickers    map[common.StreamId]tickerBucketMap
 	stopchs    map[common.StreamId]stopchBucketMap
 	outch      chan *timestampSerializable
+	poolName   string
 
 	mutex sync.Mutex
 	ready bool
@@ -63,8 +64,13 @@ type timestampListSerializable struct {
 
 //
 // Create a timer that keeps track of the timestamp history across streams and buckets
+// of the given pool.  An empty pool name defaults to DEFAULT_POOL_NAME.
 //
-func newTimer(repo *MetadataRepo) *Timer {
+func newTimer(repo *MetadataRepo, poolName string) *Timer {
+
+	if poolName == "" {
+		poolName = DEFAULT_POOL_NAME
+	}
 
 	timestamps := make(map[common.StreamId]timestampHistoryBucketMap)
 	tickers := make(map[common.StreamId]tickerBucketMap)
@@ -72,10 +78,11 @@ func newTimer(repo *MetadataRepo) *Timer {
 	outch := make(chan *timestampSerializable, TIMESTAMP_CHANNEL_SIZE)
 
 	timer := &Timer{timestamps: timestamps,
-		tickers: tickers,
-		stopchs: stopchs,
-		outch:   outch,
-		ready:   false}
+		tickers:  tickers,
+		stopchs:  stopchs,
+		outch:    outch,
+		poolName: poolName,
+		ready:    false}
 
 	savedTimestamps, err := repo.GetStabilityTimestamps()
 	if err == nil {
@@ -346,7 +353,7 @@ func (t *Timer) run(streamId common.StreamId, bucket string, ticker *time.Ticker
 				if ok && len(t.outch) < TIMESTAMP_CHANNEL_SIZE {
 					// Make sure that this call is not blocking.  It is OK to drop
 					// the timestamp is the channel receiver is slow.
-					wrapper, err := createTimestampSerializable(ts, streamId)
+					wrapper, err := createTimestampSerializable(t.poolName, ts, streamId)
 					if err != nil {
 						logging.Debugf("timer.run(): Unable to create wrapper for timestamp.  Skip timestamp.")
 					} else {
@@ -519,9 +526,9 @@ func (t *timestampHistory) isReady() bool {
 // Private Function : TimestampSerializable
 /////////////////////////////////////////////////////////////////////////
 
-func createTimestampSerializable(ts *common.TsVbuuid, streamId common.StreamId) (*timestampSerializable, error) {
+func createTimestampSerializable(pool string, ts *common.TsVbuuid, streamId common.StreamId) (*timestampSerializable, error) {
 
-	data, err := marshallTimestamp(ts)
+	data, err := marshallTimestamp(pool, ts)
 	if err != nil {
 		return nil, err
 	}
@@ -549,9 +556,9 @@ func unmarshallTimestampSerializable(data []byte) (*timestampSerializable, error
 	return wrapper, nil
 }
 
-func marshallTimestamp(input *common.TsVbuuid) (string, error) {
+func marshallTimestamp(pool string, input *common.TsVbuuid) (string, error) {
 
-	ts := protobuf.NewTsVbuuid(DEFAULT_POOL_NAME, input.Bucket, NUM_VB)
+	ts := protobuf.NewTsVbuuid(pool, input.Bucket, NUM_VB)
 	ts = ts.FromTsVbuuid(input)
 	buf, err := proto.Marshal(ts)
 	if err != nil {
@@ -66,6 +66,7 @@ import "fmt"
 import "time"
 import "strings"
 import "errors"
+import "net/url"
 
 import "github.com/couchbase/indexing/secondary/logging"
 import ap "github.com/couchbase/indexing/secondary/adminport"
@@ -141,13 +142,26 @@ type Client struct {
 // - `retryInterval` is specified in milliseconds.
 //   if retryInterval is ZERO, API will not perform retry.
 // - if `maxRetries` is ZERO, will perform indefinite retry.
+// - `requestTimeout`, if present and greater than ZERO, is specified in
+//   milliseconds and bounds each request to projector.
 func NewClient(adminport string, maxvbs int, config c.Config) *Client {
+	return NewClientWithProxy(adminport, maxvbs, config, nil)
+}
+
+// NewClientWithProxy is same as NewClient, except that requests to
+// projector are sent via `proxyURL`.
+func NewClientWithProxy(
+	adminport string, maxvbs int, config c.Config, proxyURL *url.URL) *Client {
+
 	retryInterval := config["retryInterval"].Int()
 	maxRetries := config["maxRetries"].Int()
 	expBackoff := config["exponentialBackoff"].Int()
 
 	urlPrefix := config["urlPrefix"].String()
-	ap := ap.NewHTTPClient(adminport, urlPrefix)
+	ap := ap.NewHTTPClientWithProxy(adminport, urlPrefix, proxyURL)
+	if cv, ok := config["requestTimeout"]; ok && cv.Int() > 0 {
+		ap.WithTimeout(time.Duration(cv.Int()) * time.Millisecond)
+	}
 	client := &Client{
 		adminport:     adminport,
 		ap:            ap,
@@ -553,8 +567,14 @@ func (client *Client) AddInstances(
 // Possible errors returned,
 // - http errors for transport related failures.
 // - ErrorTopicMissing if feed is not started.
-func (client *Client) DelInstances(topic string, uuids []uint64) error {
+//
+// Instances added with a version newer than `version` are not deleted,
+// if `version` is ZERO instances are deleted unconditionally.
+func (client *Client) DelInstances(topic string, uuids []uint64, version uint64) error {
 	req := protobuf.NewDelInstancesRequest(topic, uuids)
+	if version > 0 {
+		req.Version = proto.Uint64(version)
+	}
 	res := &protobuf.Error{}
 	err := client.withRetry(
 		func() error {
@@ -620,6 +640,49 @@ func (client *Client) ShutdownTopic(topic string) error {
 	return nil
 }
 
+// Close will release the connections to projector's adminport. The
+// client should not be used after Close.
+func (client *Client) Close() {
+	if closer, ok := client.ap.(ap.Closer); ok {
+		closer.Close()
+	}
+}
+
+// GetActiveTopics will return the list of topics that are active
+// on projector.
+//
+// - return http errors for transport related failures.
+func (client *Client) GetActiveTopics() ([]string, error) {
+	req := protobuf.NewListTopicsRequest()
+	res := &protobuf.ListTopicsResponse{}
+	err := client.withRetry(
+		func() error {
+			err := client.ap.Request(req, res)
+			if err != nil {
+				return err
+			} else if protoerr := res.GetErr(); protoerr != nil {
+				return fmt.Errorf(protoerr.GetError())
+			}
+			return err // nil
+		})
+	if err != nil {
+		return nil, err
+	}
+	return res.GetTopics(), nil
+}
+
+// Ping checks that projector's adminport is reachable. Unlike other APIs
+// it does not retry, so that a projector that is down is detected quickly.
+//
+// - return http errors for transport related failures.
+func (client *Client) Ping() error {
+	req := protobuf.NewListTopicsRequest()
+	res := &protobuf.ListTopicsResponse{}
+	// an older projector replies with an error for ListTopicsRequest, which
+	// is returned as is.  Callers shall treat it as projector being up.
+	return client.ap.Request(req, res)
+}
+
 // InitialRestartTimestamp will compose the initial set of timestamp
 // for a subset of vbuckets in `bucket`.
 // - return http errors for transport related failures.
@@ -55,6 +55,7 @@ type Feed struct {
 	// downstream
 	kvdata    map[string]*KVData            // bucket -> kvdata
 	engines   map[string]map[uint64]*Engine // bucket -> uuid -> engine
+	versions  map[uint64]uint64             // uuid -> instance version
 	endpoints map[string]c.RouterEndpoint
 	// genServer channel
 	reqch  chan []interface{}
@@ -100,6 +101,7 @@ func NewFeed(
 		// downstream
 		kvdata:    make(map[string]*KVData),
 		engines:   make(map[string]map[uint64]*Engine),
+		versions:  make(map[uint64]uint64),
 		endpoints: make(map[string]c.RouterEndpoint),
 		// genServer channel
 		reqch:  make(chan []interface{}, chsize),
@@ -1052,8 +1054,9 @@ func (feed *Feed) delInstances(
 		uuids := make([]uint64, 0)
 		m := make(map[uint64]*Engine)
 		for uuid, engine := range engines {
-			if c.HasUint64(uuid, instanceIds) {
+			if c.HasUint64(uuid, instanceIds) && !feed.isNewerInstance(uuid, req) {
 				uuids = append(uuids, uuid)
+				delete(feed.versions, uuid)
 			} else {
 				m[uuid] = engine
 			}
@@ -1076,6 +1079,21 @@ func (feed *Feed) delInstances(
 	return err
 }
 
+// instance `uuid` was added with a version newer than the version of
+// delete request.
+func (feed *Feed) isNewerInstance(
+	uuid uint64, req *protobuf.DelInstancesRequest) bool {
+
+	if req.Version == nil {
+		return false
+	} else if version := feed.versions[uuid]; version > req.GetVersion() {
+		fmsg := "%v delInstances() skip instance %v, version %v > %v\n"
+		logging.Infof(fmsg, feed.logPrefix, uuid, version, req.GetVersion())
+		return true
+	}
+	return false
+}
+
 // endpoints are independent.
 func (feed *Feed) repairEndpoints(
 	req *protobuf.RepairEndpointsRequest, opaque uint16) (err error) {
@@ -1427,6 +1445,14 @@ func (feed *Feed) processSubscribers(opaque uint16, req Subscriber) error {
 	if err = feed.startEndpoints(opaque, routers); err != nil {
 		return err
 	}
+	// update instance versions.
+	if r, ok := req.(interface {
+		GetInstances() []*protobuf.Instance
+	}); ok {
+		for _, instance := range r.GetInstances() {
+			feed.versions[instance.GetUuid()] = instance.GetVersion()
+		}
+	}
 	// update feed engines.
 	for uuid, evaluator := range evaluators {
 		bucketn := evaluator.Bucket()
@@ -577,6 +577,15 @@ func (p *Projector) doShutdownTopic(
 	return protobuf.NewError(err)
 }
 
+// - return list of active topics.
+func (p *Projector) doListTopics(
+	request *protobuf.ListTopicsRequest,
+	opaque uint16) ap.MessageMarshaller {
+
+	logging.Infof("%v ##%x doListTopics()\n", p.logPrefix, opaque)
+	return protobuf.NewListTopicsResponse(p.listTopics())
+}
+
 func (p *Projector) doStatistics() interface{} {
 	logging.Infof("%v doStatistics()\n", p.logPrefix)
 	defer logging.Infof("%v doStatistics() returns ...\n", p.logPrefix)
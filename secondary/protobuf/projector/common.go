@@ -184,6 +184,21 @@ func (ts *TsVbuuid) Contains(vbno uint16) bool {
 	return false
 }
 
+// CoversVbuckets returns the vbuckets, from `vbnos`, that do not have an
+// entry in the timestamp, nil if all of them are covered.
+func (ts *TsVbuuid) CoversVbuckets(vbnos []uint16) (missing []uint16) {
+	cache := make(map[uint32]bool)
+	for _, vbno := range ts.GetVbnos() {
+		cache[vbno] = true
+	}
+	for _, vbno := range vbnos {
+		if _, ok := cache[uint32(vbno)]; !ok {
+			missing = append(missing, vbno)
+		}
+	}
+	return missing
+}
+
 // FromTsVbuuid converts timestamp from common.TsVbuuid to protobuf
 // format.
 func (ts *TsVbuuid) FromTsVbuuid(nativeTs *c.TsVbuuid) *TsVbuuid {
@@ -198,6 +213,21 @@ func (ts *TsVbuuid) FromTsVbuuid(nativeTs *c.TsVbuuid) *TsVbuuid {
 	return ts
 }
 
+// NewTsVbuuidFromNative converts a full common.TsVbuuid to protobuf
+// format, unlike FromTsVbuuid() vbuckets with invalid vbuuid are not
+// skipped.  The reverse is ToTsVbuuid().
+func NewTsVbuuidFromNative(pool string, nativeTs *c.TsVbuuid) *TsVbuuid {
+	ts := NewTsVbuuid(pool, nativeTs.Bucket, len(nativeTs.Seqnos))
+	for vbno, seqno := range nativeTs.Seqnos {
+		s := nativeTs.Snapshots[vbno]
+		ts.Vbnos = append(ts.Vbnos, uint32(vbno))
+		ts.Seqnos = append(ts.Seqnos, seqno)
+		ts.Vbuuids = append(ts.Vbuuids, nativeTs.Vbuuids[vbno])
+		ts.Snapshots = append(ts.Snapshots, NewSnapshot(s[0], s[1]))
+	}
+	return ts
+}
+
 // ToTsVbuuid converts timestamp from protobuf format to common.TsVbuuid,
 // later requires the full set of timestamp.
 func (ts *TsVbuuid) ToTsVbuuid(maxVbuckets int) *c.TsVbuuid {
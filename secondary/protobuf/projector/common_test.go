@@ -0,0 +1,69 @@
+package protobuf
+
+import (
+	c "github.com/couchbase/indexing/secondary/common"
+	"reflect"
+	"testing"
+)
+
+func TestCoversVbuckets(t *testing.T) {
+	vbnos := []uint16{0, 1, 2, 3}
+
+	ts := NewTsVbuuid("default", "bucket1", 4)
+	for _, vbno := range vbnos {
+		ts.Append(vbno, uint64(vbno+1), 1234, 0, 0)
+	}
+	if missing := ts.CoversVbuckets(vbnos); missing != nil {
+		t.Fatalf("expected full coverage, missing %v", missing)
+	}
+
+	ts = NewTsVbuuid("default", "bucket1", 4)
+	ts.Append(3, 10, 1234, 0, 0)
+	ts.Append(1, 10, 1234, 0, 0)
+	if missing := ts.CoversVbuckets(vbnos); !reflect.DeepEqual(missing, []uint16{0, 2}) {
+		t.Fatalf("expected vbuckets 0 and 2 to be missing, got %v", missing)
+	}
+
+	ts = NewTsVbuuid("default", "bucket1", 4)
+	if missing := ts.CoversVbuckets(vbnos); !reflect.DeepEqual(missing, vbnos) {
+		t.Fatalf("expected all vbuckets to be missing, got %v", missing)
+	}
+	var nilTs *TsVbuuid
+	if missing := nilTs.CoversVbuckets(vbnos); !reflect.DeepEqual(missing, vbnos) {
+		t.Fatalf("expected all vbuckets to be missing for nil timestamp, got %v", missing)
+	}
+	if missing := ts.CoversVbuckets(nil); missing != nil {
+		t.Fatalf("expected no vbucket to be missing, got %v", missing)
+	}
+}
+
+func TestNewTsVbuuidFromNative(t *testing.T) {
+	nativeTs := c.NewTsVbuuid("bucket1", 8)
+	for vbno := 0; vbno < 8; vbno += 2 {
+		nativeTs.Seqnos[vbno] = uint64(vbno + 10)
+		nativeTs.Vbuuids[vbno] = uint64(vbno + 1234)
+		nativeTs.Snapshots[vbno] = [2]uint64{uint64(vbno), uint64(vbno + 20)}
+	}
+
+	ts := NewTsVbuuidFromNative("default", nativeTs)
+	if ts.GetPool() != "default" || ts.GetBucket() != "bucket1" {
+		t.Fatalf("unexpected pool %v bucket %v", ts.GetPool(), ts.GetBucket())
+	}
+	// vbuckets with invalid vbuuid are part of the full timestamp.
+	if len(ts.GetVbnos()) != 8 {
+		t.Fatalf("expected 8 vbuckets, got %v", ts.GetVbnos())
+	}
+	for i, vbno := range ts.GetVbnos() {
+		if vbno != uint32(i) {
+			t.Fatalf("expected vbuckets in order, got %v", ts.GetVbnos())
+		}
+	}
+
+	back := ts.ToTsVbuuid(8)
+	if back.Bucket != "bucket1" ||
+		!reflect.DeepEqual(back.Seqnos, nativeTs.Seqnos) ||
+		!reflect.DeepEqual(back.Vbuuids, nativeTs.Vbuuids) ||
+		!reflect.DeepEqual(back.Snapshots, nativeTs.Snapshots) {
+		t.Fatalf("expected %v after round-trip, got %v", nativeTs, back)
+	}
+}
@@ -151,7 +151,7 @@ func (ie *IndexEvaluator) StreamBeginData(
 	bucket := ie.Bucket()
 	kv := c.NewKeyVersions(seqno, nil, 1)
 	kv.AddStreamBegin()
-	return &c.DataportKeyVersions{bucket, vbno, vbuuid, kv}
+	return &c.DataportKeyVersions{bucket, 0, vbno, vbuuid, kv}
 }
 
 // SyncData implement Evaluator{} interface.
@@ -161,7 +161,7 @@ func (ie *IndexEvaluator) SyncData(
 	bucket := ie.Bucket()
 	kv := c.NewKeyVersions(seqno, nil, 1)
 	kv.AddSync()
-	return &c.DataportKeyVersions{bucket, vbno, vbuuid, kv}
+	return &c.DataportKeyVersions{bucket, 0, vbno, vbuuid, kv}
 }
 
 // SnapshotData implement Evaluator{} interface.
@@ -171,7 +171,7 @@ func (ie *IndexEvaluator) SnapshotData(
 	bucket := ie.Bucket()
 	kv := c.NewKeyVersions(seqno, nil, 1)
 	kv.AddSnapshot(m.SnapshotType, m.SnapstartSeq, m.SnapendSeq)
-	return &c.DataportKeyVersions{bucket, vbno, vbuuid, kv}
+	return &c.DataportKeyVersions{bucket, 0, vbno, vbuuid, kv}
 }
 
 // StreamEndData implement Evaluator{} interface.
@@ -181,7 +181,7 @@ func (ie *IndexEvaluator) StreamEndData(
 	bucket := ie.Bucket()
 	kv := c.NewKeyVersions(seqno, nil, 1)
 	kv.AddStreamEnd()
-	return &c.DataportKeyVersions{bucket, vbno, vbuuid, kv}
+	return &c.DataportKeyVersions{bucket, 0, vbno, vbuuid, kv}
 }
 
 // TransformRoute implement Evaluator{} interface.
@@ -241,7 +241,7 @@ func (ie *IndexEvaluator) TransformRoute(
 			if !ok {
 				kv := c.NewKeyVersions(seqno, m.Key, 4)
 				kv.AddUpsert(uuid, nkey, okey)
-				dkv = &c.DataportKeyVersions{bucket, vbno, vbuuid, kv}
+				dkv = &c.DataportKeyVersions{bucket, 0, vbno, vbuuid, kv}
 			} else {
 				dkv.Kv.AddUpsert(uuid, nkey, okey)
 			}
@@ -256,7 +256,7 @@ func (ie *IndexEvaluator) TransformRoute(
 			if !ok {
 				kv := c.NewKeyVersions(seqno, m.Key, 4)
 				kv.AddUpsertDeletion(uuid, okey)
-				dkv = &c.DataportKeyVersions{bucket, vbno, vbuuid, kv}
+				dkv = &c.DataportKeyVersions{bucket, 0, vbno, vbuuid, kv}
 			} else {
 				dkv.Kv.AddUpsertDeletion(uuid, okey)
 			}
@@ -271,7 +271,7 @@ func (ie *IndexEvaluator) TransformRoute(
 			if !ok {
 				kv := c.NewKeyVersions(seqno, m.Key, 4)
 				kv.AddDeletion(uuid, okey)
-				dkv = &c.DataportKeyVersions{bucket, vbno, vbuuid, kv}
+				dkv = &c.DataportKeyVersions{bucket, 0, vbno, vbuuid, kv}
 			} else {
 				dkv.Kv.AddDeletion(uuid, okey)
 			}
@@ -778,6 +778,71 @@ func (req *ShutdownTopicRequest) Decode(data []byte) (err error) {
 	return proto.Unmarshal(data, req)
 }
 
+// *************************
+// ListTopicsRequest
+// *************************
+
+// NewListTopicsRequest creates a ListTopicsRequest.
+func NewListTopicsRequest() *ListTopicsRequest {
+	return &ListTopicsRequest{}
+}
+
+// Name implement MessageMarshaller{} interface
+func (req *ListTopicsRequest) Name() string {
+	return "listTopicsRequest"
+}
+
+// ContentType implement MessageMarshaller{} interface
+func (req *ListTopicsRequest) ContentType() string {
+	return "application/protobuf"
+}
+
+// Encode implement MessageMarshaller{} interface
+func (req *ListTopicsRequest) Encode() (data []byte, err error) {
+	return proto.Marshal(req)
+}
+
+// Decode implement MessageMarshaller{} interface
+func (req *ListTopicsRequest) Decode(data []byte) (err error) {
+	return proto.Unmarshal(data, req)
+}
+
+// *************************
+// ListTopicsResponse
+// *************************
+
+// NewListTopicsResponse creates a ListTopicsResponse for
+// list of active topics.
+func NewListTopicsResponse(topics []string) *ListTopicsResponse {
+	return &ListTopicsResponse{Topics: topics}
+}
+
+// Name implement MessageMarshaller{} interface
+func (resp *ListTopicsResponse) Name() string {
+	return "listTopicsResponse"
+}
+
+// ContentType implement MessageMarshaller{} interface
+func (resp *ListTopicsResponse) ContentType() string {
+	return "application/protobuf"
+}
+
+// Encode implement MessageMarshaller{} interface
+func (resp *ListTopicsResponse) Encode() (data []byte, err error) {
+	return proto.Marshal(resp)
+}
+
+// Decode implement MessageMarshaller{} interface
+func (resp *ListTopicsResponse) Decode(data []byte) (err error) {
+	return proto.Unmarshal(data, resp)
+}
+
+// SetErr update error value in response's.
+func (resp *ListTopicsResponse) SetErr(err error) *ListTopicsResponse {
+	resp.Err = NewError(err)
+	return resp
+}
+
 //-- local functions
 
 // TODO: add other types of engines
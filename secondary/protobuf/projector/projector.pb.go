@@ -408,9 +408,12 @@ func (m *AddInstancesRequest) GetInstances() []*Instance {
 // DelInstancesRequest to add index-instances to a topic.
 // Respond back with TopicResponse
 type DelInstancesRequest struct {
-	Topic            *string  `protobuf:"bytes,1,req,name=topic" json:"topic,omitempty"`
-	InstanceIds      []uint64 `protobuf:"varint,2,rep,name=instanceIds" json:"instanceIds,omitempty"`
-	XXX_unrecognized []byte   `json:"-"`
+	Topic       *string  `protobuf:"bytes,1,req,name=topic" json:"topic,omitempty"`
+	InstanceIds []uint64 `protobuf:"varint,2,rep,name=instanceIds" json:"instanceIds,omitempty"`
+	// instances added with a newer version are not deleted, if not
+	// specified instances are deleted unconditionally.
+	Version          *uint64 `protobuf:"varint,3,opt,name=version" json:"version,omitempty"`
+	XXX_unrecognized []byte  `json:"-"`
 }
 
 func (m *DelInstancesRequest) Reset()         { *m = DelInstancesRequest{} }
@@ -431,6 +434,13 @@ func (m *DelInstancesRequest) GetInstanceIds() []uint64 {
 	return nil
 }
 
+func (m *DelInstancesRequest) GetVersion() uint64 {
+	if m != nil && m.Version != nil {
+		return *m.Version
+	}
+	return 0
+}
+
 // Requested by indexer / coordinator to inform router to re-connect with
 // downstream endpoint. Error message will be sent as response.
 type RepairEndpointsRequest struct {
@@ -475,9 +485,45 @@ func (m *ShutdownTopicRequest) GetTopic() string {
 	return ""
 }
 
+// Requested by coordinator / indexer to learn the list of topics
+// that are currently active on projector.
+// Respond back with ListTopicsResponse
+type ListTopicsRequest struct {
+	XXX_unrecognized []byte `json:"-"`
+}
+
+func (m *ListTopicsRequest) Reset()         { *m = ListTopicsRequest{} }
+func (m *ListTopicsRequest) String() string { return proto.CompactTextString(m) }
+func (*ListTopicsRequest) ProtoMessage()    {}
+
+type ListTopicsResponse struct {
+	Topics           []string `protobuf:"bytes,1,rep,name=topics" json:"topics,omitempty"`
+	Err              *Error   `protobuf:"bytes,2,opt,name=err" json:"err,omitempty"`
+	XXX_unrecognized []byte   `json:"-"`
+}
+
+func (m *ListTopicsResponse) Reset()         { *m = ListTopicsResponse{} }
+func (m *ListTopicsResponse) String() string { return proto.CompactTextString(m) }
+func (*ListTopicsResponse) ProtoMessage()    {}
+
+func (m *ListTopicsResponse) GetTopics() []string {
+	if m != nil {
+		return m.Topics
+	}
+	return nil
+}
+
+func (m *ListTopicsResponse) GetErr() *Error {
+	if m != nil {
+		return m.Err
+	}
+	return nil
+}
+
 // Generic instance, can be an index instance, xdcr, search etc ...
 type Instance struct {
 	IndexInstance    *IndexInst `protobuf:"bytes,1,opt,name=indexInstance" json:"indexInstance,omitempty"`
+	Version          *uint64    `protobuf:"varint,2,opt,name=version" json:"version,omitempty"`
 	XXX_unrecognized []byte     `json:"-"`
 }
 
@@ -492,6 +538,13 @@ func (m *Instance) GetIndexInstance() *IndexInst {
 	return nil
 }
 
+func (m *Instance) GetVersion() uint64 {
+	if m != nil && m.Version != nil {
+		return *m.Version
+	}
+	return 0
+}
+
 // List of instances
 type Instances struct {
 	Instances        []*Instance `protobuf:"bytes,1,rep,name=instances" json:"instances,omitempty"`